@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"sync"
 	"syscall"
 	"time"
@@ -23,6 +24,7 @@ import (
 	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
 	traces "github.com/paulojmdias/lokxy/pkg/o11y/tracing"
 	"github.com/paulojmdias/lokxy/pkg/proxy"
+	"github.com/paulojmdias/lokxy/pkg/ruler"
 )
 
 // Build information, populated at build-time
@@ -80,6 +82,7 @@ type reloader struct {
 	proxy   *proxy.Proxy
 	logger  kitlog.Logger
 	logging config.LoggerConfig // last-seen logging config; changing it requires a restart
+	ruler   config.RulerConfig  // last-seen ruler config; changing it requires a restart
 }
 
 func (r *reloader) Reload(ctx context.Context) error {
@@ -100,11 +103,42 @@ func (r *reloader) Reload(ctx context.Context) error {
 		level.Warn(r.logger).Log("msg", "Logging configuration changed on reload; logging changes require a restart to take effect")
 		r.logging = newCfg.Logging
 	}
+	if !reflect.DeepEqual(newCfg.Ruler, r.ruler) {
+		level.Warn(r.logger).Log("msg", "Ruler configuration changed on reload; ruler changes require a restart to take effect")
+		r.ruler = newCfg.Ruler
+	}
 	metrics.RecordConfigReload(ctx, true)
 	level.Info(r.logger).Log("msg", "Configuration reloaded", "path", r.path)
 	return nil
 }
 
+// newRuler builds the federated ruler. Recording rule results go to remote
+// write when configured and are exposed on the metrics server otherwise.
+func newRuler(logger kitlog.Logger, rulerCfg config.RulerConfig, p *proxy.Proxy) (*ruler.Ruler, error) {
+	var notifier ruler.Notifier
+	if rulerCfg.Alertmanager.URL != "" {
+		n, err := ruler.NewHTTPNotifier(rulerCfg.Alertmanager)
+		if err != nil {
+			return nil, err
+		}
+		notifier = n
+	}
+
+	var appender ruler.Appender
+	if rulerCfg.RemoteWrite.URL != "" {
+		appender = ruler.NewRemoteWriteAppender(rulerCfg.RemoteWrite)
+	} else {
+		collector := ruler.NewCollectorAppender()
+		if err := metrics.RegisterCollector(collector); err != nil {
+			return nil, fmt.Errorf("failed to register recording rule collector: %w", err)
+		}
+		appender = collector
+	}
+
+	querier := ruler.NewHandlerQuerier(http.HandlerFunc(p.Handler()))
+	return ruler.New(kitlog.With(logger, "component", "ruler"), rulerCfg, querier, notifier, appender)
+}
+
 func run(ctx context.Context, logger kitlog.Logger, cfg *config.Config, opts runOptions) error {
 	// Startup log
 	level.Info(logger).Log("msg", "Starting lokxy", "version", Version, "revision", Revision)
@@ -147,19 +181,39 @@ func run(ctx context.Context, logger kitlog.Logger, cfg *config.Config, opts run
 	// e.g. an unreadable TLS certificate file.
 	p, err := proxy.New(logger, cfg)
 	if err != nil {
-		shutdownErr := meterProvider.Shutdown(ctx)
-		if shutdownErr != nil {
+		if shutdownErr := tracerProvider.Shutdown(ctx); shutdownErr != nil {
+			err = fmt.Errorf("%w (tracer shutdown error: %v)", err, shutdownErr)
+		}
+		if shutdownErr := meterProvider.Shutdown(ctx); shutdownErr != nil {
 			err = fmt.Errorf("%w (meter shutdown error: %v)", err, shutdownErr)
 		}
 		return fmt.Errorf("failed to build proxy: %w", err)
 	}
 	metrics.RecordConfigReload(ctx, true)
 
+	// Build the federated ruler when rule files are configured. It evaluates
+	// rules through the proxy handler, so it sees every server group. It is
+	// started with the servers below.
+	var r *ruler.Ruler
+	if cfg.Ruler.Enabled() {
+		r, err = newRuler(logger, cfg.Ruler, p)
+		if err != nil {
+			if shutdownErr := tracerProvider.Shutdown(ctx); shutdownErr != nil {
+				err = fmt.Errorf("%w (tracer shutdown error: %v)", err, shutdownErr)
+			}
+			if shutdownErr := meterProvider.Shutdown(ctx); shutdownErr != nil {
+				err = fmt.Errorf("%w (meter shutdown error: %v)", err, shutdownErr)
+			}
+			return fmt.Errorf("failed to start ruler: %w", err)
+		}
+	}
+
 	rl := &reloader{
 		path:    opts.configPath,
 		proxy:   p,
 		logger:  logger,
 		logging: cfg.Logging,
+		ruler:   cfg.Ruler,
 	}
 
 	eg, ctx := errgroup.WithContext(ctx)
@@ -201,6 +255,18 @@ func run(ctx context.Context, logger kitlog.Logger, cfg *config.Config, opts run
 		})
 	}
 
+	// Probe the server groups that have a health check configured.
+	eg.Go(func() error {
+		return p.RunHealthChecks(ctx)
+	})
+
+	// Run the federated ruler.
+	if r != nil {
+		eg.Go(func() error {
+			return r.Run(ctx)
+		})
+	}
+
 	// Set up Lokxy proxy server
 	reload := func() error { return rl.Reload(ctx) }
 	proxyServer := &http.Server{Handler: traces.HTTPTracesHandler(logger)(proxy.NewServeMux(logger, p, reload, opts.enableLifecycle))}
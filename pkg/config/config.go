@@ -2,7 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -28,7 +31,10 @@ type TransportConfig struct {
 type HTTPClientConfig struct {
 	DialTimeout time.Duration   `yaml:"dial_timeout"`
 	Transport   TransportConfig `yaml:"transport"`
-	TLSConfig   struct {
+	// ProxyURL is the HTTP proxy that queries and tails of the server group
+	// go through. Empty means they connect directly.
+	ProxyURL  string `yaml:"proxy_url"`
+	TLSConfig struct {
 		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
 		CAFile             string `yaml:"ca_file"`
 		CertFile           string `yaml:"cert_file"`
@@ -36,6 +42,281 @@ type HTTPClientConfig struct {
 	} `yaml:"tls_config"`
 }
 
+// RetryConfig controls how requests to a server group are retried. Only
+// idempotent requests are retried: GET, and POST to Loki's read-only query
+// endpoints.
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts, including the first. Zero or
+	// one disables retries.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// StatusCodes are the upstream response statuses that are retried, in
+	// addition to connection errors. Empty means 429, 502, 503 and 504.
+	StatusCodes []int `yaml:"status_codes"`
+
+	// MinBackoff is the delay before the first retry, doubled on every
+	// further one up to MaxBackoff, with random jitter. Zero means 100ms
+	// and 2s.
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// Enabled reports whether requests are retried.
+func (r RetryConfig) Enabled() bool {
+	return r.MaxAttempts > 1
+}
+
+// RetryBudgetConfig bounds the retries made for one client request.
+type RetryBudgetConfig struct {
+	// MaxRetries is the most retries made for one client request across
+	// all server groups. Zero means unlimited.
+	MaxRetries int `yaml:"max_retries"`
+}
+
+// LoadSheddingConfig bounds the requests lokxy serves at once. Requests
+// over a limit are answered with 503 and a Retry-After header.
+type LoadSheddingConfig struct {
+	// MaxInflightRequests limits the requests served at once, tails
+	// excepted. Zero means unlimited.
+	MaxInflightRequests int `yaml:"max_inflight_requests"`
+
+	// MaxInflightTails limits the tails open at once. Zero means unlimited.
+	MaxInflightTails int `yaml:"max_inflight_tails"`
+
+	// RetryAfter is sent to shed clients as the Retry-After header. Zero
+	// means 1s.
+	RetryAfter time.Duration `yaml:"retry_after"`
+
+	// Adaptive lowers the request limit while upstreams are slow.
+	Adaptive AdaptiveConcurrencyConfig `yaml:"adaptive"`
+}
+
+// AdaptiveConcurrencyConfig controls the adaptive concurrency limit: it
+// shrinks while requests take longer than the target latency to be
+// answered by the server groups, and grows back while they do not.
+type AdaptiveConcurrencyConfig struct {
+	// TargetLatency is the upstream latency above which the limit is
+	// lowered. Zero disables the adaptive limit.
+	TargetLatency time.Duration `yaml:"target_latency"`
+
+	// MinLimit is the lowest the limit goes. Zero means 10.
+	MinLimit int `yaml:"min_limit"`
+
+	// MaxLimit is the highest the limit goes, and where it starts. Zero
+	// means max_inflight_requests, or 1000 when that is not set.
+	MaxLimit int `yaml:"max_limit"`
+}
+
+// Enabled reports whether the adaptive concurrency limit is used.
+func (a AdaptiveConcurrencyConfig) Enabled() bool {
+	return a.TargetLatency > 0
+}
+
+func (l LoadSheddingConfig) validate() error {
+	if l.MaxInflightRequests < 0 || l.MaxInflightTails < 0 || l.RetryAfter < 0 {
+		return fmt.Errorf("max_inflight_requests, max_inflight_tails and retry_after must not be negative")
+	}
+	a := l.Adaptive
+	if a.TargetLatency < 0 || a.MinLimit < 0 || a.MaxLimit < 0 {
+		return fmt.Errorf("adaptive: settings must not be negative")
+	}
+	if a.MinLimit > 0 && a.MaxLimit > 0 && a.MinLimit > a.MaxLimit {
+		return fmt.Errorf("adaptive: min_limit must not exceed max_limit")
+	}
+	return nil
+}
+
+// Query scheduler strategies for QuerySchedulerConfig.Strategy.
+const (
+	SchedulerRoundRobin = "round_robin"
+	SchedulerWeighted   = "weighted"
+)
+
+// QuerySchedulerConfig controls the scheduler that queues fanout requests
+// per tenant and dispatches them fairly between tenants.
+type QuerySchedulerConfig struct {
+	// MaxConcurrentQueries is the number of requests fanned out at once,
+	// across all tenants. Zero means unlimited.
+	MaxConcurrentQueries int `yaml:"max_concurrent_queries"`
+
+	// MaxInflightPerTenant is the number of requests of one tenant fanned
+	// out at once. Zero means unlimited.
+	MaxInflightPerTenant int `yaml:"max_inflight_per_tenant"`
+
+	// MaxQueueLength is the number of requests of one tenant waiting to be
+	// fanned out. Zero means 100.
+	MaxQueueLength int `yaml:"max_queue_length"`
+
+	// QueueTimeout is how long a request waits in its tenant's queue. Zero
+	// means until the client gives up.
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+
+	// Strategy picks the next tenant to dispatch a request of:
+	// "round_robin" (default) or "weighted".
+	Strategy string `yaml:"strategy"`
+
+	// TenantWeights is the number of requests dispatched for a tenant in
+	// its turn with the weighted strategy. Unlisted tenants weigh 1.
+	TenantWeights map[string]int `yaml:"tenant_weights"`
+
+	// MaxTenants is the number of tenants with requests in the scheduler
+	// that are scheduled under their own name. Requests of further tenants
+	// share one queue until some of those are done. Tenants listed in
+	// TenantWeights always have their own. Zero means 1000.
+	MaxTenants int `yaml:"max_tenants"`
+}
+
+// Enabled reports whether requests go through the query scheduler.
+func (q QuerySchedulerConfig) Enabled() bool {
+	return q.MaxConcurrentQueries > 0 || q.MaxInflightPerTenant > 0
+}
+
+func (q QuerySchedulerConfig) validate() error {
+	if q.MaxConcurrentQueries < 0 || q.MaxInflightPerTenant < 0 || q.MaxQueueLength < 0 || q.QueueTimeout < 0 || q.MaxTenants < 0 {
+		return fmt.Errorf("settings must not be negative")
+	}
+	switch q.Strategy {
+	case "", SchedulerRoundRobin, SchedulerWeighted:
+	default:
+		return fmt.Errorf("strategy must be %q or %q", SchedulerRoundRobin, SchedulerWeighted)
+	}
+	for tenant, weight := range q.TenantWeights {
+		if weight <= 0 {
+			return fmt.Errorf("tenant_weights: weight of %q must be positive", tenant)
+		}
+	}
+	return nil
+}
+
+// HedgeConfig controls hedged requests to a server group: when a response
+// takes longer than the hedge delay, a duplicate request is sent and the
+// first response is used. Only idempotent requests are hedged.
+type HedgeConfig struct {
+	// Delay is how long to wait for a response before hedging. With
+	// Percentile set it is the delay used until enough latencies have been
+	// observed, and the lower bound of the delay afterwards.
+	Delay time.Duration `yaml:"delay"`
+
+	// Percentile, between 0 and 100, hedges requests that take longer than
+	// this percentile of the server group's recent response times, e.g. 95.
+	Percentile float64 `yaml:"percentile"`
+
+	// MaxPerSecond is the hedges sent to the server group per second at
+	// most. Zero means 10.
+	MaxPerSecond float64 `yaml:"max_per_second"`
+}
+
+// Enabled reports whether requests are hedged.
+func (h HedgeConfig) Enabled() bool {
+	return h.Delay > 0 || h.Percentile > 0
+}
+
+// LoadBalancingConfig controls how requests are spread over the endpoints
+// of a server group with several URLs.
+type LoadBalancingConfig struct {
+	// Strategy is round_robin (the default) or least_loaded, which picks
+	// the endpoint with the fewest requests in flight.
+	Strategy string `yaml:"strategy"`
+
+	// EjectAfter is the number of consecutive failures after which an
+	// endpoint is taken out of rotation. Zero means 3.
+	EjectAfter int `yaml:"eject_after"`
+
+	// EjectDuration is how long an ejected endpoint stays out of rotation.
+	// Zero means 30s.
+	EjectDuration time.Duration `yaml:"eject_duration"`
+}
+
+// Load balancing strategies for LoadBalancingConfig.Strategy.
+const (
+	LoadBalancingRoundRobin  = "round_robin"
+	LoadBalancingLeastLoaded = "least_loaded"
+)
+
+// HealthCheckConfig configures the background probe of a server group.
+type HealthCheckConfig struct {
+	// Interval is the time between probes. Zero disables health checking.
+	Interval time.Duration `yaml:"interval"`
+
+	// Timeout bounds each probe. Zero means the interval, at most 5s.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Path is the endpoint probed. Empty means /ready.
+	Path string `yaml:"path"`
+
+	// Query, when set, probes with this LogQL instant query as a canary
+	// instead of requesting Path.
+	Query string `yaml:"query"`
+
+	// FailureThreshold is the number of consecutive failed probes after
+	// which the server group is considered down. Zero means 1.
+	FailureThreshold int `yaml:"failure_threshold"`
+
+	// ExcludeWhenDown skips the server group in the fanout while it is
+	// down, so queries do not wait for its timeout. The group must be
+	// optional, with ignore_error or downgrade_error.
+	ExcludeWhenDown bool `yaml:"exclude_when_down"`
+}
+
+// Enabled reports whether the server group is probed.
+func (h HealthCheckConfig) Enabled() bool {
+	return h.Interval > 0
+}
+
+// CircuitBreakerConfig configures the circuit breaker of a server group.
+// Once open, requests to the group fail at once instead of waiting for it,
+// until trial requests find it has recovered.
+type CircuitBreakerConfig struct {
+	// ConsecutiveFailures is the number of consecutive failed requests that
+	// open the breaker. Zero disables the breaker.
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+
+	// OpenDuration is how long the breaker stays open before trial requests
+	// are let through. Zero means 30s.
+	OpenDuration time.Duration `yaml:"open_duration"`
+
+	// HalfOpenRequests is the number of trial requests let through once
+	// the open duration has passed; the breaker closes when they all
+	// succeed. Zero means 1.
+	HalfOpenRequests int `yaml:"half_open_requests"`
+}
+
+// Enabled reports whether the server group has a circuit breaker.
+func (c CircuitBreakerConfig) Enabled() bool {
+	return c.ConsecutiveFailures > 0
+}
+
+// LimitsConfig bounds the load lokxy puts on a server group.
+type LimitsConfig struct {
+	// MaxConcurrentRequests is the number of requests sent to the server
+	// group at a time. Zero means unlimited.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests"`
+
+	// MaxQueuedRequests is the number of requests that wait for a free slot
+	// once MaxConcurrentRequests are in flight. Zero means as many as
+	// MaxConcurrentRequests.
+	MaxQueuedRequests int `yaml:"max_queued_requests"`
+
+	// QueueTimeout is how long a request waits for a free slot before it
+	// is rejected. Zero means 1s.
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+
+	// RequestsPerSecond is the rate of requests sent to the server group.
+	// Zero means unlimited.
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+
+	// Burst is the number of requests sent at once above the rate. Zero
+	// means RequestsPerSecond rounded up.
+	Burst int `yaml:"burst"`
+}
+
+func (l LimitsConfig) validate() error {
+	if l.MaxConcurrentRequests < 0 || l.MaxQueuedRequests < 0 || l.QueueTimeout < 0 || l.RequestsPerSecond < 0 || l.Burst < 0 {
+		return fmt.Errorf("settings must not be negative")
+	}
+	return nil
+}
+
 // ServerGroup represents a single Loki instance configuration
 type ServerGroup struct {
 	Name             string            `yaml:"name"`
@@ -44,6 +325,14 @@ type ServerGroup struct {
 	Headers          map[string]string `yaml:"headers"`
 	HTTPClientConfig HTTPClientConfig  `yaml:"http_client_config"` // Add HTTP config
 
+	// URLs lists the endpoints of a server group served by several
+	// query-frontends, instead of URL. Requests are balanced over them and
+	// fail over between them.
+	URLs []string `yaml:"urls"`
+
+	// LoadBalancing configures how requests are spread over URLs.
+	LoadBalancing LoadBalancingConfig `yaml:"load_balancing"`
+
 	// IgnoreError makes this server group's response optional: if it fails but
 	// other groups succeed, the overall query still succeeds with partial
 	// results and no warning is surfaced.
@@ -54,18 +343,218 @@ type ServerGroup struct {
 	// of failing the query. IgnoreError and DowngradeError are mutually
 	// exclusive; setting both on the same server group is a configuration error.
 	DowngradeError bool `yaml:"downgrade_error"`
+
+	// TailMode is how live tails reach this server group: websocket (the
+	// default) or poll, for groups behind gateways that block WebSocket
+	// upgrades. Polling emulates the tail with repeated query_range
+	// requests.
+	TailMode string `yaml:"tail_mode"`
+
+	// TailPollInterval is the delay between query_range requests in poll
+	// mode. Zero means 1s.
+	TailPollInterval time.Duration `yaml:"tail_poll_interval"`
+
+	// Retry configures retries of failed idempotent requests.
+	Retry RetryConfig `yaml:"retry"`
+
+	// Hedge configures hedged requests to cut the latency of slow
+	// responses.
+	Hedge HedgeConfig `yaml:"hedge"`
+
+	// HealthCheck configures the background probe of the server group.
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+
+	// CircuitBreaker configures failing fast while the server group keeps
+	// failing.
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+
+	// Limits bounds the concurrency and rate of requests sent to the
+	// server group.
+	Limits LimitsConfig `yaml:"limits"`
+
+	// FailoverGroup names the failover group the server group belongs to.
+	// Instead of all being queried at once, the groups of a failover group
+	// are queried by ascending Priority: the groups of a priority only when
+	// every group of the priority before failed.
+	FailoverGroup string `yaml:"failover_group"`
+	Priority      int    `yaml:"priority"`
+}
+
+// Endpoints returns the base URLs of the server group: URLs, or URL when a
+// single one is configured.
+func (sg ServerGroup) Endpoints() []string {
+	if len(sg.URLs) > 0 {
+		return sg.URLs
+	}
+	return []string{sg.URL}
 }
 
+// Tail modes for ServerGroup.TailMode.
+const (
+	TailModeWebSocket = "websocket"
+	TailModePoll      = "poll"
+)
+
 // LoggerConfig contains the logger configuration details.
 type LoggerConfig struct {
 	Level  string `yaml:"level"`
 	Format string `yaml:"format"`
 }
 
+// AlertmanagerConfig holds the endpoint alerts from the federated ruler are
+// sent to. URL is the base URL of an Alertmanager (alerts are POSTed to
+// /api/v2/alerts) or the full URL of any compatible webhook.
+type AlertmanagerConfig struct {
+	URL     string            `yaml:"url"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// RemoteWriteConfig holds the Prometheus remote write endpoint recording rule
+// results are pushed to.
+type RemoteWriteConfig struct {
+	URL     string            `yaml:"url"`
+	Timeout time.Duration     `yaml:"timeout"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// RulerConfig configures the federated ruler, which evaluates Loki-format
+// recording and alerting rules through lokxy's own fanout so they see the
+// data of every server group. The ruler is disabled when no rule files are
+// configured.
+type RulerConfig struct {
+	RuleFiles          []string           `yaml:"rule_files"`
+	EvaluationInterval time.Duration      `yaml:"evaluation_interval"`
+	ExternalLabels     map[string]string  `yaml:"external_labels"`
+	Alertmanager       AlertmanagerConfig `yaml:"alertmanager"`
+
+	// RemoteWrite sends recording rule results to a Prometheus remote write
+	// endpoint. When unset they are exposed on the metrics server instead.
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+}
+
+// Enabled reports whether any rule files are configured.
+func (r RulerConfig) Enabled() bool {
+	return len(r.RuleFiles) > 0
+}
+
+// ResponseCompressionConfig controls how responses sent to clients are
+// compressed. Compression is negotiated from the client's Accept-Encoding
+// header (gzip, zstd or snappy). It is off unless enabled, so clients keep
+// receiving uncompressed responses by default.
+type ResponseCompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// MinSize is the smallest response, in bytes, worth compressing. Zero
+	// means the default of 1024 bytes.
+	MinSize int `yaml:"min_size"`
+
+	// Level is the compression level from 1 (fastest) to 9 (smallest). Zero
+	// means each encoding's default level; snappy has no levels.
+	Level int `yaml:"level"`
+}
+
+// TailReconnectConfig controls how a live tail reconnects to a server group
+// whose WebSocket connection closed or failed. Reconnects resume from the
+// timestamp of the last entry received from that group.
+type TailReconnectConfig struct {
+	// MaxAttempts is the number of consecutive failed reconnects after which
+	// the server group is given up on. Zero means the default of 5; a
+	// negative value disables reconnection.
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// MinBackoff and MaxBackoff bound the exponential delay between
+	// attempts. They default to 250ms and 10s.
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// Slow consumer policies for TailConfig.SlowConsumerPolicy.
+const (
+	// TailDropOldest drops the oldest buffered entries to make room, and
+	// reports them to the client in dropped_entries.
+	TailDropOldest = "drop_oldest"
+
+	// TailDisconnect closes the client's connection.
+	TailDisconnect = "disconnect"
+)
+
+// TailAuthConfig holds the credentials clients authenticate tails with. Both
+// maps are keyed by client name, which identifies the client for the
+// per-client concurrency limit.
+type TailAuthConfig struct {
+	// BearerTokens maps client names to bearer tokens.
+	BearerTokens map[string]string `yaml:"bearer_tokens"`
+
+	// BasicAuth maps user names to passwords.
+	BasicAuth map[string]string `yaml:"basic_auth"`
+}
+
+// Enabled reports whether tails must authenticate.
+func (a TailAuthConfig) Enabled() bool {
+	return len(a.BearerTokens) > 0 || len(a.BasicAuth) > 0
+}
+
+// TailConfig configures the /loki/api/v1/tail fan-in.
+type TailConfig struct {
+	Reconnect TailReconnectConfig `yaml:"reconnect"`
+
+	// BufferSize is the number of entries buffered per tail while the client
+	// is slower than the server groups. Zero means the default of 1000.
+	BufferSize int `yaml:"buffer_size"`
+
+	// SlowConsumerPolicy is applied when the buffer is full: drop_oldest
+	// (the default) or disconnect.
+	SlowConsumerPolicy string `yaml:"slow_consumer_policy"`
+
+	// WriteTimeout bounds each write to the client. Zero means 10s.
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	// PingInterval is how often the client is pinged. A client that answers
+	// nothing for two intervals is disconnected. Zero means 30s.
+	PingInterval time.Duration `yaml:"ping_interval"`
+
+	// ReorderWindow is how long entries are held back so that entries of
+	// all server groups are sent in timestamp order. Zero, the default,
+	// forwards entries as they arrive.
+	ReorderWindow time.Duration `yaml:"reorder_window"`
+
+	// AllowedOrigins lists the origins browsers may open tails from, or "*"
+	// for any. When empty every origin is allowed. Requests without an
+	// Origin header, which non-browser clients send, are always allowed.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+
+	// Auth requires clients to authenticate before a tail starts.
+	Auth TailAuthConfig `yaml:"auth"`
+
+	// MaxConcurrentPerClient limits the tails of a single client open at
+	// once. Clients are told apart by their authenticated name, or their IP
+	// address when Auth is not configured. Zero means unlimited. The tails
+	// open at once overall are limited by LoadShedding.MaxInflightTails.
+	MaxConcurrentPerClient int `yaml:"max_concurrent_per_client"`
+
+	// MaxDuration ends tails that have been open this long. Zero means
+	// unlimited.
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
 // Config represents the overall proxy configuration
 type Config struct {
-	ServerGroups []ServerGroup `yaml:"server_groups"`
-	Logging      LoggerConfig  `yaml:"logging"`
+	ServerGroups        []ServerGroup             `yaml:"server_groups"`
+	Logging             LoggerConfig              `yaml:"logging"`
+	Ruler               RulerConfig               `yaml:"ruler"`
+	ResponseCompression ResponseCompressionConfig `yaml:"response_compression"`
+	Tail                TailConfig                `yaml:"tail"`
+	RetryBudget         RetryBudgetConfig         `yaml:"retry_budget"`
+	LoadShedding        LoadSheddingConfig        `yaml:"load_shedding"`
+	QueryScheduler      QuerySchedulerConfig      `yaml:"query_scheduler"`
+
+	// SoftDeadline is how long a request waits for its optional server
+	// groups (ignore_error or downgrade_error) before the ones still
+	// pending are cancelled and the results that arrived are returned.
+	// Clients may set their own with the X-Lokxy-Soft-Deadline header.
+	// Zero means optional groups are waited for like required ones.
+	SoftDeadline time.Duration `yaml:"soft_deadline"`
 }
 
 // LoadConfig loads and parses the YAML configuration file
@@ -99,14 +588,188 @@ func (c *Config) Validate() error {
 		if sg.Name == "" {
 			return fmt.Errorf("server_groups[%d]: name is required", i)
 		}
-		if sg.URL == "" {
+		if sg.URL == "" && len(sg.URLs) == 0 {
 			return fmt.Errorf("server_groups[%d]: url is required", i)
 		}
+		if sg.URL != "" && len(sg.URLs) > 0 {
+			return fmt.Errorf("server_groups[%d]: url and urls are mutually exclusive", i)
+		}
+		if slices.Contains(sg.URLs, "") {
+			return fmt.Errorf("server_groups[%d]: urls must not be empty", i)
+		}
+		if err := sg.LoadBalancing.validate(); err != nil {
+			return fmt.Errorf("server_groups[%d]: load_balancing: %w", i, err)
+		}
 		if sg.IgnoreError && sg.DowngradeError {
 			return fmt.Errorf("server_groups[%d]: ignore_error and downgrade_error are mutually exclusive", i)
 		}
+		switch sg.TailMode {
+		case "", TailModeWebSocket, TailModePoll:
+		default:
+			return fmt.Errorf("server_groups[%d]: tail_mode must be %q or %q", i, TailModeWebSocket, TailModePoll)
+		}
+		if sg.TailPollInterval < 0 {
+			return fmt.Errorf("server_groups[%d]: tail_poll_interval must not be negative", i)
+		}
+		if sg.HTTPClientConfig.ProxyURL != "" {
+			if u, err := url.Parse(sg.HTTPClientConfig.ProxyURL); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("server_groups[%d]: http_client_config: proxy_url must be an absolute URL", i)
+			}
+		}
+		if err := sg.Retry.validate(); err != nil {
+			return fmt.Errorf("server_groups[%d]: retry: %w", i, err)
+		}
+		if err := sg.Hedge.validate(); err != nil {
+			return fmt.Errorf("server_groups[%d]: hedge: %w", i, err)
+		}
+		if err := sg.HealthCheck.validate(); err != nil {
+			return fmt.Errorf("server_groups[%d]: health_check: %w", i, err)
+		}
+		if sg.CircuitBreaker.ConsecutiveFailures < 0 || sg.CircuitBreaker.OpenDuration < 0 || sg.CircuitBreaker.HalfOpenRequests < 0 {
+			return fmt.Errorf("server_groups[%d]: circuit_breaker: settings must not be negative", i)
+		}
+		if err := sg.Limits.validate(); err != nil {
+			return fmt.Errorf("server_groups[%d]: limits: %w", i, err)
+		}
+		if sg.Priority < 0 {
+			return fmt.Errorf("server_groups[%d]: priority must not be negative", i)
+		}
+		if sg.Priority > 0 && sg.FailoverGroup == "" {
+			return fmt.Errorf("server_groups[%d]: priority requires failover_group", i)
+		}
+		if sg.HealthCheck.ExcludeWhenDown && !sg.IgnoreError && !sg.DowngradeError && sg.FailoverGroup == "" {
+			return fmt.Errorf("server_groups[%d]: health_check: exclude_when_down requires ignore_error, downgrade_error or failover_group", i)
+		}
+	}
+
+	if c.RetryBudget.MaxRetries < 0 {
+		return fmt.Errorf("retry_budget: max_retries must not be negative")
+	}
+
+	if err := c.LoadShedding.validate(); err != nil {
+		return fmt.Errorf("load_shedding: %w", err)
+	}
+
+	if err := c.QueryScheduler.validate(); err != nil {
+		return fmt.Errorf("query_scheduler: %w", err)
+	}
+
+	if c.SoftDeadline < 0 {
+		return fmt.Errorf("soft_deadline must not be negative")
+	}
+
+	if c.Ruler.EvaluationInterval < 0 {
+		return fmt.Errorf("ruler: evaluation_interval must not be negative")
+	}
+
+	if c.ResponseCompression.MinSize < 0 {
+		return fmt.Errorf("response_compression: min_size must not be negative")
+	}
+	if c.ResponseCompression.Level < 0 || c.ResponseCompression.Level > 9 {
+		return fmt.Errorf("response_compression: level must be between 1 and 9")
+	}
+
+	if c.Tail.BufferSize < 0 {
+		return fmt.Errorf("tail: buffer_size must not be negative")
+	}
+	switch c.Tail.SlowConsumerPolicy {
+	case "", TailDropOldest, TailDisconnect:
+	default:
+		return fmt.Errorf("tail: slow_consumer_policy must be %q or %q", TailDropOldest, TailDisconnect)
+	}
+	if c.Tail.WriteTimeout < 0 || c.Tail.PingInterval < 0 {
+		return fmt.Errorf("tail: write_timeout and ping_interval must not be negative")
+	}
+	if c.Tail.ReorderWindow < 0 {
+		return fmt.Errorf("tail: reorder_window must not be negative")
+	}
+	if c.Tail.MaxConcurrentPerClient < 0 || c.Tail.MaxDuration < 0 {
+		return fmt.Errorf("tail: max_concurrent_per_client and max_duration must not be negative")
+	}
+	for name, token := range c.Tail.Auth.BearerTokens {
+		if token == "" {
+			return fmt.Errorf("tail: auth: bearer token of %q must not be empty", name)
+		}
+	}
+	for user, password := range c.Tail.Auth.BasicAuth {
+		if password == "" {
+			return fmt.Errorf("tail: auth: password of %q must not be empty", user)
+		}
+	}
+
+	reconnect := c.Tail.Reconnect
+	if reconnect.MinBackoff < 0 || reconnect.MaxBackoff < 0 {
+		return fmt.Errorf("tail: reconnect backoff must not be negative")
+	}
+	if reconnect.MinBackoff > 0 && reconnect.MaxBackoff > 0 && reconnect.MinBackoff > reconnect.MaxBackoff {
+		return fmt.Errorf("tail: reconnect min_backoff must not exceed max_backoff")
+	}
+
+	return nil
+}
+
+func (r RetryConfig) validate() error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("max_attempts must not be negative")
+	}
+	for _, code := range r.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
 	}
+	if r.MinBackoff < 0 || r.MaxBackoff < 0 {
+		return fmt.Errorf("backoff must not be negative")
+	}
+	if r.MinBackoff > 0 && r.MaxBackoff > 0 && r.MinBackoff > r.MaxBackoff {
+		return fmt.Errorf("min_backoff must not exceed max_backoff")
+	}
+	return nil
+}
 
+func (l LoadBalancingConfig) validate() error {
+	switch l.Strategy {
+	case "", LoadBalancingRoundRobin, LoadBalancingLeastLoaded:
+	default:
+		return fmt.Errorf("strategy must be %q or %q", LoadBalancingRoundRobin, LoadBalancingLeastLoaded)
+	}
+	if l.EjectAfter < 0 {
+		return fmt.Errorf("eject_after must not be negative")
+	}
+	if l.EjectDuration < 0 {
+		return fmt.Errorf("eject_duration must not be negative")
+	}
+	return nil
+}
+
+func (h HealthCheckConfig) validate() error {
+	if h.Interval < 0 || h.Timeout < 0 {
+		return fmt.Errorf("interval and timeout must not be negative")
+	}
+	if h.Path != "" && h.Query != "" {
+		return fmt.Errorf("path and query are mutually exclusive")
+	}
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if h.FailureThreshold < 0 {
+		return fmt.Errorf("failure_threshold must not be negative")
+	}
+	if h.ExcludeWhenDown && !h.Enabled() {
+		return fmt.Errorf("exclude_when_down requires an interval")
+	}
+	return nil
+}
+
+func (h HedgeConfig) validate() error {
+	if h.Delay < 0 {
+		return fmt.Errorf("delay must not be negative")
+	}
+	if h.Percentile < 0 || h.Percentile >= 100 {
+		return fmt.Errorf("percentile must be between 0 and 100")
+	}
+	if h.MaxPerSecond < 0 {
+		return fmt.Errorf("max_per_second must not be negative")
+	}
 	return nil
 }
 
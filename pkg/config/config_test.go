@@ -47,6 +47,7 @@ func TestLoadConfig(t *testing.T) {
 				require.Equal(t, "loki1", cfg.ServerGroups[0].Name)
 				require.Equal(t, "http://localhost:3100", cfg.ServerGroups[0].URL)
 				require.Equal(t, 0, cfg.ServerGroups[0].Timeout) // Default not set in config
+				require.False(t, cfg.Ruler.Enabled())
 			},
 		},
 		{
@@ -127,6 +128,188 @@ func TestLoadConfig(t *testing.T) {
 				require.True(t, cfg.ServerGroups[2].DowngradeError)
 			},
 		},
+		{
+			name:       "ruler config",
+			configFile: "testdata/ruler_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				require.True(t, cfg.Ruler.Enabled())
+				require.Equal(t, []string{"/etc/lokxy/rules/*.yaml"}, cfg.Ruler.RuleFiles)
+				require.Equal(t, 30*time.Second, cfg.Ruler.EvaluationInterval)
+				require.Equal(t, "lokxy", cfg.Ruler.ExternalLabels["source"])
+				require.Equal(t, "http://alertmanager:9093", cfg.Ruler.Alertmanager.URL)
+				require.Equal(t, 5*time.Second, cfg.Ruler.Alertmanager.Timeout)
+				require.Equal(t, "http://prometheus:9090/api/v1/write", cfg.Ruler.RemoteWrite.URL)
+				require.Equal(t, "ruler", cfg.Ruler.RemoteWrite.Headers["X-Scope-OrgID"])
+			},
+		},
+		{
+			name:       "response compression config",
+			configFile: "testdata/response_compression_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				require.True(t, cfg.ResponseCompression.Enabled)
+				require.Equal(t, 4096, cfg.ResponseCompression.MinSize)
+				require.Equal(t, 6, cfg.ResponseCompression.Level)
+			},
+		},
+		{
+			name:       "tail config",
+			configFile: "testdata/tail_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				require.Equal(t, 10, cfg.Tail.Reconnect.MaxAttempts)
+				require.Equal(t, 500*time.Millisecond, cfg.Tail.Reconnect.MinBackoff)
+				require.Equal(t, 30*time.Second, cfg.Tail.Reconnect.MaxBackoff)
+				require.Equal(t, 500, cfg.Tail.BufferSize)
+				require.Equal(t, TailDisconnect, cfg.Tail.SlowConsumerPolicy)
+				require.Equal(t, 5*time.Second, cfg.Tail.WriteTimeout)
+				require.Equal(t, 15*time.Second, cfg.Tail.PingInterval)
+				require.Equal(t, 250*time.Millisecond, cfg.Tail.ReorderWindow)
+				require.Equal(t, []string{"https://grafana.example.com"}, cfg.Tail.AllowedOrigins)
+				require.Equal(t, map[string]string{"grafana": "grafana-token"}, cfg.Tail.Auth.BearerTokens)
+				require.Equal(t, map[string]string{"alice": "secret"}, cfg.Tail.Auth.BasicAuth)
+				require.True(t, cfg.Tail.Auth.Enabled())
+				require.Equal(t, 5, cfg.Tail.MaxConcurrentPerClient)
+				require.Equal(t, time.Hour, cfg.Tail.MaxDuration)
+				require.Empty(t, cfg.ServerGroups[0].TailMode)
+				require.Equal(t, TailModePoll, cfg.ServerGroups[1].TailMode)
+				require.Equal(t, 2*time.Second, cfg.ServerGroups[1].TailPollInterval)
+			},
+		},
+		{
+			name:       "retry config",
+			configFile: "testdata/retry_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				retry := cfg.ServerGroups[0].Retry
+				require.True(t, retry.Enabled())
+				require.Equal(t, 3, retry.MaxAttempts)
+				require.Equal(t, []int{502, 503}, retry.StatusCodes)
+				require.Equal(t, 50*time.Millisecond, retry.MinBackoff)
+				require.Equal(t, time.Second, retry.MaxBackoff)
+				require.False(t, cfg.ServerGroups[1].Retry.Enabled())
+				require.Equal(t, 4, cfg.RetryBudget.MaxRetries)
+			},
+		},
+		{
+			name:       "hedge config",
+			configFile: "testdata/hedge_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				hedge := cfg.ServerGroups[0].Hedge
+				require.True(t, hedge.Enabled())
+				require.Equal(t, 200*time.Millisecond, hedge.Delay)
+				require.InDelta(t, 95, hedge.Percentile, 0)
+				require.InDelta(t, 5, hedge.MaxPerSecond, 0)
+				require.False(t, cfg.ServerGroups[1].Hedge.Enabled())
+			},
+		},
+		{
+			name:       "multiple endpoints",
+			configFile: "testdata/endpoints_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				sg := cfg.ServerGroups[0]
+				require.Equal(t, []string{"http://qf1.example.com", "http://qf2.example.com"}, sg.Endpoints())
+				require.Equal(t, LoadBalancingLeastLoaded, sg.LoadBalancing.Strategy)
+				require.Equal(t, 2, sg.LoadBalancing.EjectAfter)
+				require.Equal(t, time.Minute, sg.LoadBalancing.EjectDuration)
+				require.Equal(t, []string{"http://loki2.example.com"}, cfg.ServerGroups[1].Endpoints())
+			},
+		},
+		{
+			name:       "health check config",
+			configFile: "testdata/health_check_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				hc := cfg.ServerGroups[0].HealthCheck
+				require.True(t, hc.Enabled())
+				require.Equal(t, 10*time.Second, hc.Interval)
+				require.Equal(t, 2*time.Second, hc.Timeout)
+				require.Equal(t, `count_over_time({job="canary"}[1m])`, hc.Query)
+				require.Equal(t, 3, hc.FailureThreshold)
+				require.True(t, hc.ExcludeWhenDown)
+				require.False(t, cfg.ServerGroups[1].HealthCheck.Enabled())
+			},
+		},
+		{
+			name:       "circuit breaker config",
+			configFile: "testdata/circuit_breaker_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				cb := cfg.ServerGroups[0].CircuitBreaker
+				require.True(t, cb.Enabled())
+				require.Equal(t, 5, cb.ConsecutiveFailures)
+				require.Equal(t, 10*time.Second, cb.OpenDuration)
+				require.Equal(t, 2, cb.HalfOpenRequests)
+				require.False(t, cfg.ServerGroups[1].CircuitBreaker.Enabled())
+			},
+		},
+		{
+			name:       "limits config",
+			configFile: "testdata/limits_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				require.Equal(t, LimitsConfig{
+					MaxConcurrentRequests: 20,
+					MaxQueuedRequests:     40,
+					QueueTimeout:          500 * time.Millisecond,
+					RequestsPerSecond:     12.5,
+					Burst:                 25,
+				}, cfg.ServerGroups[0].Limits)
+				require.Zero(t, cfg.ServerGroups[1].Limits)
+			},
+		},
+		{
+			name:       "load shedding config",
+			configFile: "testdata/load_shedding_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				ls := cfg.LoadShedding
+				require.Equal(t, 200, ls.MaxInflightRequests)
+				require.Equal(t, 50, ls.MaxInflightTails)
+				require.Equal(t, 5*time.Second, ls.RetryAfter)
+				require.True(t, ls.Adaptive.Enabled())
+				require.Equal(t, AdaptiveConcurrencyConfig{TargetLatency: 2 * time.Second, MinLimit: 20, MaxLimit: 150}, ls.Adaptive)
+			},
+		},
+		{
+			name:       "query scheduler config",
+			configFile: "testdata/query_scheduler_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				qs := cfg.QueryScheduler
+				require.True(t, qs.Enabled())
+				require.Equal(t, 64, qs.MaxConcurrentQueries)
+				require.Equal(t, 8, qs.MaxInflightPerTenant)
+				require.Equal(t, 50, qs.MaxQueueLength)
+				require.Equal(t, 30*time.Second, qs.QueueTimeout)
+				require.Equal(t, SchedulerWeighted, qs.Strategy)
+				require.Equal(t, map[string]int{"platform": 3, "team-a": 2}, qs.TenantWeights)
+				require.Equal(t, 500, qs.MaxTenants)
+			},
+		},
+		{
+			name:       "failover config",
+			configFile: "testdata/failover_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				require.Equal(t, "logs", cfg.ServerGroups[0].FailoverGroup)
+				require.Equal(t, 0, cfg.ServerGroups[0].Priority)
+				require.Equal(t, "logs", cfg.ServerGroups[1].FailoverGroup)
+				require.Equal(t, 1, cfg.ServerGroups[1].Priority)
+				require.Empty(t, cfg.ServerGroups[2].FailoverGroup)
+			},
+		},
+		{
+			name:       "soft deadline config",
+			configFile: "testdata/soft_deadline_config.yaml",
+			wantErr:    false,
+			validateFunc: func(t *testing.T, cfg *Config) {
+				require.Equal(t, 5*time.Second, cfg.SoftDeadline)
+			},
+		},
 		{
 			name:       "invalid empty config",
 			configFile: "testdata/invalid_empty.yaml",
@@ -217,3 +400,246 @@ func TestValidate_MutuallyExclusiveErrorHandling(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "mutually exclusive")
 }
+
+func TestValidate_ResponseCompression(t *testing.T) {
+	cfg := &Config{
+		ServerGroups:        []ServerGroup{{Name: "loki1", URL: "http://localhost:3100"}},
+		ResponseCompression: ResponseCompressionConfig{Level: 10},
+	}
+	require.ErrorContains(t, cfg.Validate(), "level")
+
+	cfg.ResponseCompression = ResponseCompressionConfig{MinSize: -1}
+	require.ErrorContains(t, cfg.Validate(), "min_size")
+}
+
+func TestValidate_ProxyURL(t *testing.T) {
+	sg := ServerGroup{Name: "loki1", URL: "http://localhost:3100"}
+	sg.HTTPClientConfig.ProxyURL = "proxy.example:3128"
+	cfg := &Config{ServerGroups: []ServerGroup{sg}}
+	require.ErrorContains(t, cfg.Validate(), "proxy_url")
+
+	cfg.ServerGroups[0].HTTPClientConfig.ProxyURL = "http://proxy.example:3128"
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_TailReconnect(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100"}},
+		Tail:         TailConfig{Reconnect: TailReconnectConfig{MinBackoff: -time.Second}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "negative")
+
+	cfg.Tail.Reconnect = TailReconnectConfig{MinBackoff: 5 * time.Second, MaxBackoff: time.Second}
+	require.ErrorContains(t, cfg.Validate(), "min_backoff")
+
+	cfg.Tail.Reconnect = TailReconnectConfig{MaxAttempts: -1, MinBackoff: time.Second}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_TailBackpressure(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100"}},
+		Tail:         TailConfig{SlowConsumerPolicy: "block"},
+	}
+	require.ErrorContains(t, cfg.Validate(), "slow_consumer_policy")
+
+	cfg.Tail = TailConfig{BufferSize: -1}
+	require.ErrorContains(t, cfg.Validate(), "buffer_size")
+
+	cfg.Tail = TailConfig{WriteTimeout: -time.Second}
+	require.ErrorContains(t, cfg.Validate(), "write_timeout")
+
+	cfg.Tail = TailConfig{ReorderWindow: -time.Millisecond}
+	require.ErrorContains(t, cfg.Validate(), "reorder_window")
+
+	cfg.Tail = TailConfig{SlowConsumerPolicy: TailDropOldest, BufferSize: 10}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_TailAccess(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100"}},
+		Tail:         TailConfig{MaxConcurrentPerClient: -1},
+	}
+	require.ErrorContains(t, cfg.Validate(), "max_concurrent_per_client")
+
+	cfg.Tail = TailConfig{Auth: TailAuthConfig{BearerTokens: map[string]string{"grafana": ""}}}
+	require.ErrorContains(t, cfg.Validate(), `bearer token of "grafana"`)
+
+	cfg.Tail = TailConfig{Auth: TailAuthConfig{BasicAuth: map[string]string{"alice": ""}}}
+	require.ErrorContains(t, cfg.Validate(), `password of "alice"`)
+
+	cfg.Tail = TailConfig{MaxConcurrentPerClient: 10, MaxDuration: time.Hour}
+	require.NoError(t, cfg.Validate())
+	require.False(t, cfg.Tail.Auth.Enabled())
+}
+
+func TestValidate_Retry(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100", Retry: RetryConfig{MaxAttempts: -1}}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "max_attempts")
+
+	cfg.ServerGroups[0].Retry = RetryConfig{MaxAttempts: 3, StatusCodes: []int{700}}
+	require.ErrorContains(t, cfg.Validate(), "invalid status code 700")
+
+	cfg.ServerGroups[0].Retry = RetryConfig{MaxAttempts: 3, MinBackoff: time.Second, MaxBackoff: time.Millisecond}
+	require.ErrorContains(t, cfg.Validate(), "min_backoff")
+
+	cfg.ServerGroups[0].Retry = RetryConfig{MaxAttempts: 3}
+	cfg.RetryBudget.MaxRetries = -1
+	require.ErrorContains(t, cfg.Validate(), "retry_budget")
+
+	cfg.RetryBudget.MaxRetries = 2
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_Hedge(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100", Hedge: HedgeConfig{Delay: -time.Second}}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "delay")
+
+	cfg.ServerGroups[0].Hedge = HedgeConfig{Percentile: 100}
+	require.ErrorContains(t, cfg.Validate(), "percentile")
+
+	cfg.ServerGroups[0].Hedge = HedgeConfig{Percentile: 99, MaxPerSecond: -1}
+	require.ErrorContains(t, cfg.Validate(), "max_per_second")
+
+	cfg.ServerGroups[0].Hedge = HedgeConfig{Percentile: 99.9, MaxPerSecond: 0.5}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_Endpoints(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100", URLs: []string{"http://localhost:3101"}}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "mutually exclusive")
+
+	cfg.ServerGroups[0] = ServerGroup{Name: "loki1", URLs: []string{"http://localhost:3100", ""}}
+	require.ErrorContains(t, cfg.Validate(), "urls must not be empty")
+
+	cfg.ServerGroups[0] = ServerGroup{Name: "loki1", URLs: []string{"http://localhost:3100"}, LoadBalancing: LoadBalancingConfig{Strategy: "random"}}
+	require.ErrorContains(t, cfg.Validate(), "strategy")
+
+	cfg.ServerGroups[0].LoadBalancing = LoadBalancingConfig{EjectAfter: -1}
+	require.ErrorContains(t, cfg.Validate(), "eject_after")
+
+	cfg.ServerGroups[0].LoadBalancing = LoadBalancingConfig{Strategy: LoadBalancingRoundRobin, EjectAfter: 1}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_HealthCheck(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100", HealthCheck: HealthCheckConfig{Interval: -time.Second}}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "interval")
+
+	cfg.ServerGroups[0].HealthCheck = HealthCheckConfig{Interval: time.Second, Path: "/ready", Query: "vector(1)"}
+	require.ErrorContains(t, cfg.Validate(), "mutually exclusive")
+
+	cfg.ServerGroups[0].HealthCheck = HealthCheckConfig{Interval: time.Second, Path: "ready"}
+	require.ErrorContains(t, cfg.Validate(), "path must start with /")
+
+	cfg.ServerGroups[0].HealthCheck = HealthCheckConfig{ExcludeWhenDown: true}
+	require.ErrorContains(t, cfg.Validate(), "requires an interval")
+
+	cfg.ServerGroups[0].HealthCheck = HealthCheckConfig{Interval: time.Second, ExcludeWhenDown: true}
+	require.ErrorContains(t, cfg.Validate(), "requires ignore_error, downgrade_error or failover_group")
+
+	cfg.ServerGroups[0].FailoverGroup = "primary"
+	require.NoError(t, cfg.Validate())
+
+	cfg.ServerGroups[0].FailoverGroup = ""
+	cfg.ServerGroups[0].IgnoreError = true
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_CircuitBreaker(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100", CircuitBreaker: CircuitBreakerConfig{ConsecutiveFailures: 3, OpenDuration: -time.Second}}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "circuit_breaker")
+
+	cfg.ServerGroups[0].CircuitBreaker = CircuitBreakerConfig{ConsecutiveFailures: 3, HalfOpenRequests: 2}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_Limits(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100", Limits: LimitsConfig{RequestsPerSecond: -1}}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "limits")
+
+	cfg.ServerGroups[0].Limits = LimitsConfig{MaxConcurrentRequests: 4, RequestsPerSecond: 0.5}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_LoadShedding(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100"}},
+		LoadShedding: LoadSheddingConfig{MaxInflightRequests: -1},
+	}
+	require.ErrorContains(t, cfg.Validate(), "load_shedding")
+
+	cfg.LoadShedding = LoadSheddingConfig{Adaptive: AdaptiveConcurrencyConfig{TargetLatency: time.Second, MinLimit: 50, MaxLimit: 10}}
+	require.ErrorContains(t, cfg.Validate(), "min_limit")
+
+	cfg.LoadShedding = LoadSheddingConfig{MaxInflightRequests: 100, Adaptive: AdaptiveConcurrencyConfig{TargetLatency: time.Second}}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_QueryScheduler(t *testing.T) {
+	cfg := &Config{
+		ServerGroups:   []ServerGroup{{Name: "loki1", URL: "http://localhost:3100"}},
+		QueryScheduler: QuerySchedulerConfig{MaxConcurrentQueries: 10, Strategy: "fifo"},
+	}
+	require.ErrorContains(t, cfg.Validate(), "strategy")
+
+	cfg.QueryScheduler = QuerySchedulerConfig{MaxConcurrentQueries: 10, Strategy: SchedulerWeighted, TenantWeights: map[string]int{"a": 0}}
+	require.ErrorContains(t, cfg.Validate(), "tenant_weights")
+
+	cfg.QueryScheduler = QuerySchedulerConfig{MaxQueueLength: -1}
+	require.ErrorContains(t, cfg.Validate(), "query_scheduler")
+
+	cfg.QueryScheduler = QuerySchedulerConfig{MaxInflightPerTenant: 2}
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_Failover(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100", Priority: 1}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "priority requires failover_group")
+
+	cfg.ServerGroups[0].Priority = -1
+	cfg.ServerGroups[0].FailoverGroup = "logs"
+	require.ErrorContains(t, cfg.Validate(), "priority must not be negative")
+
+	cfg.ServerGroups[0].Priority = 1
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_SoftDeadline(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100"}},
+		SoftDeadline: -time.Second,
+	}
+	require.ErrorContains(t, cfg.Validate(), "soft_deadline")
+
+	cfg.SoftDeadline = time.Second
+	require.NoError(t, cfg.Validate())
+}
+
+func TestValidate_TailMode(t *testing.T) {
+	cfg := &Config{
+		ServerGroups: []ServerGroup{{Name: "loki1", URL: "http://localhost:3100", TailMode: "sse"}},
+	}
+	require.ErrorContains(t, cfg.Validate(), "tail_mode")
+
+	cfg.ServerGroups[0] = ServerGroup{Name: "loki1", URL: "http://localhost:3100", TailMode: TailModePoll, TailPollInterval: -time.Second}
+	require.ErrorContains(t, cfg.Validate(), "tail_poll_interval")
+
+	cfg.ServerGroups[0].TailPollInterval = time.Second
+	require.NoError(t, cfg.Validate())
+}
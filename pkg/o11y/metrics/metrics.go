@@ -6,9 +6,10 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/prometheus"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
 	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/metric/noop"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
@@ -34,6 +35,110 @@ var (
 	// downgrade_error. The "outcome" attribute distinguishes the two.
 	RequestDegraded metric.Int64Counter = noop.Int64Counter{}
 
+	// UpstreamRetries counts upstream requests sent again after a connection
+	// error or a retryable status.
+	UpstreamRetries metric.Int64Counter = noop.Int64Counter{}
+
+	// UpstreamHedges counts duplicate requests sent to server groups that
+	// were slow to respond.
+	UpstreamHedges metric.Int64Counter = noop.Int64Counter{}
+
+	// UpstreamHedgeWins counts hedged requests whose response came back
+	// before the original's.
+	UpstreamHedgeWins metric.Int64Counter = noop.Int64Counter{}
+
+	// ResponseCompressionSavedBytes counts the bytes saved by compressing
+	// responses sent to clients, per route and content encoding.
+	ResponseCompressionSavedBytes metric.Int64Counter = noop.Int64Counter{}
+
+	// TailReconnects counts tail WebSocket connections re-established to a
+	// server group after it closed or failed.
+	TailReconnects metric.Int64Counter = noop.Int64Counter{}
+
+	// TailDroppedEntries counts tail entries dropped because a client read
+	// them slower than the server groups produced them.
+	TailDroppedEntries metric.Int64Counter = noop.Int64Counter{}
+
+	// TailLateEntries counts tail entries that arrived after newer entries
+	// had already been sent, despite the reorder window.
+	TailLateEntries metric.Int64Counter = noop.Int64Counter{}
+
+	// TailReorderForcedFlushes counts the times a tail's reorder buffer was
+	// full and its oldest entries were released before the reorder window.
+	TailReorderForcedFlushes metric.Int64Counter = noop.Int64Counter{}
+
+	// TailActive tracks the tails currently connected to each server group.
+	TailActive metric.Int64UpDownCounter = noop.Int64UpDownCounter{}
+
+	// TailRejected counts tails refused before they started. The "reason"
+	// attribute is origin, auth or limit.
+	TailRejected metric.Int64Counter = noop.Int64Counter{}
+
+	// RulerEvaluations counts rule group evaluations performed by the
+	// federated ruler.
+	RulerEvaluations metric.Int64Counter = noop.Int64Counter{}
+
+	// RulerEvaluationFailures counts failed rule evaluations. The "reason"
+	// attribute tells query, limit, remote write and notification failures
+	// apart.
+	RulerEvaluationFailures metric.Int64Counter = noop.Int64Counter{}
+
+	// RulerEvaluationDuration records how long a rule group evaluation took,
+	// in seconds.
+	RulerEvaluationDuration metric.Float64Histogram = noop.Float64Histogram{}
+
+	// ServerGroupUp reports whether the health check of a server group
+	// found it up (1) or down (0).
+	ServerGroupUp metric.Int64Gauge = noop.Int64Gauge{}
+
+	// ServerGroupProbeDuration holds how long the last health check of a
+	// server group took, in seconds.
+	ServerGroupProbeDuration metric.Float64Gauge = noop.Float64Gauge{}
+
+	// CircuitBreakerState holds the state of a server group's circuit
+	// breaker: 0 closed, 1 half-open, 2 open.
+	CircuitBreakerState metric.Int64Gauge = noop.Int64Gauge{}
+
+	// CircuitBreakerRejected counts requests failed at once because the
+	// server group's circuit breaker was open.
+	CircuitBreakerRejected metric.Int64Counter = noop.Int64Counter{}
+
+	// ServerGroupQueueWait records how long requests waited for a free slot
+	// of a server group with a concurrency limit, in seconds.
+	ServerGroupQueueWait metric.Float64Histogram = noop.Float64Histogram{}
+
+	// ServerGroupLimited counts requests rejected by a server group's
+	// limits. The "reason" attribute is concurrency or rate.
+	ServerGroupLimited metric.Int64Counter = noop.Int64Counter{}
+
+	// InflightRequests tracks the requests being served. The "kind"
+	// attribute is request or tail.
+	InflightRequests metric.Int64UpDownCounter = noop.Int64UpDownCounter{}
+
+	// RequestsShed counts requests answered with 503 because lokxy was
+	// overloaded. The "reason" attribute is limit or adaptive.
+	RequestsShed metric.Int64Counter = noop.Int64Counter{}
+
+	// AdaptiveConcurrencyLimit holds the current adaptive concurrency limit
+	// of incoming requests.
+	AdaptiveConcurrencyLimit metric.Int64Gauge = noop.Int64Gauge{}
+
+	// SchedulerQueueLength tracks the requests waiting in each tenant's
+	// queue of the query scheduler.
+	SchedulerQueueLength metric.Int64UpDownCounter = noop.Int64UpDownCounter{}
+
+	// SchedulerInflight tracks the requests of each tenant dispatched by the
+	// query scheduler and not yet done.
+	SchedulerInflight metric.Int64UpDownCounter = noop.Int64UpDownCounter{}
+
+	// SchedulerQueueWait records how long requests waited in their tenant's
+	// queue, in seconds.
+	SchedulerQueueWait metric.Float64Histogram = noop.Float64Histogram{}
+
+	// SchedulerRejected counts requests the query scheduler rejected. The
+	// "reason" attribute is queue_full or timeout.
+	SchedulerRejected metric.Int64Counter = noop.Int64Counter{}
+
 	// ConfigReloadSuccessful reports whether the last configuration load or
 	// reload attempt succeeded (1) or failed (0).
 	ConfigReloadSuccessful metric.Int64Gauge = noop.Int64Gauge{}
@@ -68,7 +173,7 @@ func RecordConfigReload(ctx context.Context, success bool) {
 // This function should be called during application startup before any
 // metrics are recorded.
 func Initialize(ctx context.Context) (*sdkmetric.MeterProvider, error) {
-	promExporter, err := prometheus.New()
+	promExporter, err := otelprom.New()
 	if err != nil {
 		return nil, err
 	}
@@ -135,6 +240,193 @@ func createMetrics() error {
 		return fmt.Errorf("failed to create RequestDegraded metric: %w", err)
 	}
 
+	UpstreamRetries, err = meter.Int64Counter("lokxy_upstream_retries_total",
+		metric.WithDescription("Total number of retried upstream requests"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create UpstreamRetries metric: %w", err)
+	}
+
+	UpstreamHedges, err = meter.Int64Counter("lokxy_upstream_hedges_total",
+		metric.WithDescription("Total number of hedged upstream requests sent"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create UpstreamHedges metric: %w", err)
+	}
+
+	UpstreamHedgeWins, err = meter.Int64Counter("lokxy_upstream_hedge_wins_total",
+		metric.WithDescription("Total number of hedged upstream requests that responded before the original"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create UpstreamHedgeWins metric: %w", err)
+	}
+
+	ResponseCompressionSavedBytes, err = meter.Int64Counter("lokxy_response_compression_saved_bytes_total",
+		metric.WithDescription("Total number of bytes saved by compressing responses sent to clients"),
+		metric.WithUnit("By"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create ResponseCompressionSavedBytes metric: %w", err)
+	}
+
+	TailReconnects, err = meter.Int64Counter("lokxy_tail_reconnects_total",
+		metric.WithDescription("Total number of tail connections re-established to a server group"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create TailReconnects metric: %w", err)
+	}
+
+	TailDroppedEntries, err = meter.Int64Counter("lokxy_tail_dropped_entries_total",
+		metric.WithDescription("Total number of tail entries dropped because the client was too slow"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create TailDroppedEntries metric: %w", err)
+	}
+
+	TailLateEntries, err = meter.Int64Counter("lokxy_tail_late_entries_total",
+		metric.WithDescription("Total number of tail entries sent out of timestamp order because they arrived after the reorder window"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create TailLateEntries metric: %w", err)
+	}
+
+	TailReorderForcedFlushes, err = meter.Int64Counter("lokxy_tail_reorder_forced_flushes_total",
+		metric.WithDescription("Total number of times a full tail reorder buffer released its oldest entries before the reorder window"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create TailReorderForcedFlushes metric: %w", err)
+	}
+
+	TailActive, err = meter.Int64UpDownCounter("lokxy_tail_active",
+		metric.WithDescription("Number of tails currently connected to each server group"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create TailActive metric: %w", err)
+	}
+
+	TailRejected, err = meter.Int64Counter("lokxy_tail_rejected_total",
+		metric.WithDescription("Total number of tails refused by the tail access controls"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create TailRejected metric: %w", err)
+	}
+
+	RulerEvaluations, err = meter.Int64Counter("lokxy_ruler_evaluations_total",
+		metric.WithDescription("Total number of rule group evaluations performed by the federated ruler"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create RulerEvaluations metric: %w", err)
+	}
+
+	RulerEvaluationFailures, err = meter.Int64Counter("lokxy_ruler_evaluation_failures_total",
+		metric.WithDescription("Total number of failed rule evaluations in the federated ruler"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create RulerEvaluationFailures metric: %w", err)
+	}
+
+	RulerEvaluationDuration, err = meter.Float64Histogram("lokxy_ruler_evaluation_duration_seconds",
+		metric.WithDescription("Duration of rule group evaluations in seconds"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create RulerEvaluationDuration metric: %w", err)
+	}
+
+	ServerGroupUp, err = meter.Int64Gauge("lokxy_server_group_up",
+		metric.WithDescription("Whether the last health checks of the server group succeeded"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create ServerGroupUp metric: %w", err)
+	}
+
+	ServerGroupProbeDuration, err = meter.Float64Gauge("lokxy_server_group_probe_duration_seconds",
+		metric.WithDescription("Duration of the last health check of the server group"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create ServerGroupProbeDuration metric: %w", err)
+	}
+
+	CircuitBreakerState, err = meter.Int64Gauge("lokxy_circuit_breaker_state",
+		metric.WithDescription("State of the server group's circuit breaker: 0 closed, 1 half-open, 2 open"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create CircuitBreakerState metric: %w", err)
+	}
+
+	CircuitBreakerRejected, err = meter.Int64Counter("lokxy_circuit_breaker_rejected_total",
+		metric.WithDescription("Total number of requests failed at once by an open circuit breaker"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create CircuitBreakerRejected metric: %w", err)
+	}
+
+	ServerGroupQueueWait, err = meter.Float64Histogram("lokxy_server_group_queue_wait_seconds",
+		metric.WithDescription("Time requests waited for a free slot of the server group's concurrency limit in seconds"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create ServerGroupQueueWait metric: %w", err)
+	}
+
+	ServerGroupLimited, err = meter.Int64Counter("lokxy_server_group_limited_total",
+		metric.WithDescription("Total number of requests rejected by the server group's concurrency or rate limit"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create ServerGroupLimited metric: %w", err)
+	}
+
+	InflightRequests, err = meter.Int64UpDownCounter("lokxy_inflight_requests",
+		metric.WithDescription("Number of requests and tails being served"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create InflightRequests metric: %w", err)
+	}
+
+	RequestsShed, err = meter.Int64Counter("lokxy_requests_shed_total",
+		metric.WithDescription("Total number of requests rejected with 503 because lokxy was overloaded"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create RequestsShed metric: %w", err)
+	}
+
+	AdaptiveConcurrencyLimit, err = meter.Int64Gauge("lokxy_adaptive_concurrency_limit",
+		metric.WithDescription("Current adaptive limit of requests served at once"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create AdaptiveConcurrencyLimit metric: %w", err)
+	}
+
+	SchedulerQueueLength, err = meter.Int64UpDownCounter("lokxy_query_scheduler_queue_length",
+		metric.WithDescription("Number of requests waiting in the tenant's queue of the query scheduler"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create SchedulerQueueLength metric: %w", err)
+	}
+
+	SchedulerInflight, err = meter.Int64UpDownCounter("lokxy_query_scheduler_inflight_requests",
+		metric.WithDescription("Number of requests of the tenant dispatched by the query scheduler"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create SchedulerInflight metric: %w", err)
+	}
+
+	SchedulerQueueWait, err = meter.Float64Histogram("lokxy_query_scheduler_queue_wait_seconds",
+		metric.WithDescription("Time requests waited in the tenant's queue of the query scheduler in seconds"),
+		metric.WithUnit("s"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create SchedulerQueueWait metric: %w", err)
+	}
+
+	SchedulerRejected, err = meter.Int64Counter("lokxy_query_scheduler_rejected_total",
+		metric.WithDescription("Total number of requests rejected by the query scheduler"),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create SchedulerRejected metric: %w", err)
+	}
+
 	ConfigReloadSuccessful, err = meter.Int64Gauge("lokxy_config_last_reload_successful",
 		metric.WithDescription("Whether the last configuration reload attempt was successful"),
 	)
@@ -160,6 +452,20 @@ func Reinitialize() error {
 	return createMetrics()
 }
 
+// collectors holds the series produced outside of OpenTelemetry. They are
+// kept apart from lokxy's own metrics so that a bad series, such as two
+// recording rules producing the same one, is dropped on its own instead of
+// failing the whole scrape.
+var collectors = prometheus.NewRegistry()
+
+// RegisterCollector registers c with the metrics server, so series produced
+// outside of OpenTelemetry (such as recording rule results) are exposed next
+// to lokxy's own metrics. Series that clash with lokxy's own metrics or with
+// each other are left out of the scrape.
+func RegisterCollector(c prometheus.Collector) error {
+	return collectors.Register(c)
+}
+
 // NewServeMux returns an [http.ServeMux] preconfigured with a Prometheus
 // metrics handler.
 //
@@ -167,6 +473,9 @@ func Reinitialize() error {
 // or to integrate metrics into an existing HTTP server.
 func NewServeMux() *http.ServeMux {
 	metricsMux := http.NewServeMux()
-	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsMux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, collectors}, promhttp.HandlerOpts{
+			ErrorHandling: promhttp.ContinueOnError,
+		})))
 	return metricsMux
 }
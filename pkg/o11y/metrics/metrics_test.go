@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 )
 
@@ -68,3 +69,30 @@ func TestInitMetrics(t *testing.T) {
 	// Look for the metric with its full format including OpenTelemetry labels
 	require.Contains(t, metricsData, `lokxy_request_count_total{otel_scope_name="lokxy",otel_scope_schema_url="",otel_scope_version=""} 5`)
 }
+
+// clashingCollector is an unchecked collector that sends one good series, a
+// duplicate of it and a series named like a Go runtime metric.
+type clashingCollector struct{}
+
+func (clashingCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (clashingCollector) Collect(ch chan<- prometheus.Metric) {
+	desc := prometheus.NewDesc("rule_result", "Recording rule.", nil, nil)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 2)
+	ch <- prometheus.MustNewConstMetric(prometheus.NewDesc("go_goroutines", "Recording rule.", nil, nil), prometheus.GaugeValue, 3)
+}
+
+func TestNewServeMux_ClashingCollectorSeries(t *testing.T) {
+	require.NoError(t, RegisterCollector(clashingCollector{}))
+
+	rr := httptest.NewRecorder()
+	NewServeMux().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	// The clashing series are left out instead of failing the scrape.
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), "go_goroutines")
+	require.Contains(t, rr.Body.String(), "rule_result 1")
+	require.NotContains(t, rr.Body.String(), "rule_result 2")
+	require.NotContains(t, rr.Body.String(), "go_goroutines 3")
+}
@@ -140,3 +140,10 @@ func (rw *responseWriter) WriteHeader(statusCode int) {
 func (rw *responseWriter) Write(data []byte) (int, error) {
 	return rw.ResponseWriter.Write(data)
 }
+
+// Unwrap lets [http.ResponseController] reach the underlying writer, so
+// streamed responses can be flushed and WebSocket upgrades can hijack the
+// connection.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// Defaults for cfg.CircuitBreakerConfig.
+const (
+	defaultBreakerOpenDuration = 30 * time.Second
+	defaultBreakerHalfOpen     = 1
+)
+
+// errCircuitOpen fails requests to a server group whose breaker is open.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// breakerState is the state of a circuit breaker. The values are the ones
+// exported on the lokxy_circuit_breaker_state metric.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// breakerResult is how a request let through a breaker counts.
+type breakerResult int
+
+const (
+	// breakerIgnored is a request that did not complete, e.g. because the
+	// client went away; it tells nothing about the server group.
+	breakerIgnored breakerResult = iota
+	breakerSuccess
+	breakerFailure
+)
+
+// circuitBreaker stops sending requests to a server group after
+// consecutive failures. Once open for the open duration it turns half-open
+// and lets a few trial requests through: the breaker closes when they all
+// succeed and opens again on the first failure.
+type circuitBreaker struct {
+	group        string
+	config       cfg.CircuitBreakerConfig
+	threshold    int
+	openDuration time.Duration
+	halfOpenMax  int
+	logger       log.Logger
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	// trials and successes count the trial requests let through, and
+	// those that succeeded, while half-open.
+	trials    int
+	successes int
+}
+
+// newCircuitBreaker returns the circuit breaker of a server group, or nil
+// when it has none.
+func newCircuitBreaker(instance cfg.ServerGroup, logger log.Logger) *circuitBreaker {
+	c := instance.CircuitBreaker
+	if !c.Enabled() {
+		return nil
+	}
+	b := &circuitBreaker{
+		group:        instance.Name,
+		config:       c,
+		threshold:    c.ConsecutiveFailures,
+		openDuration: c.OpenDuration,
+		halfOpenMax:  c.HalfOpenRequests,
+		logger:       logger,
+	}
+	if b.openDuration == 0 {
+		b.openDuration = defaultBreakerOpenDuration
+	}
+	if b.halfOpenMax == 0 {
+		b.halfOpenMax = defaultBreakerHalfOpen
+	}
+	b.record(context.Background())
+	return b
+}
+
+// allow reports whether a request may be sent to the server group, and the
+// state it is sent in. The request's result must be reported to done.
+func (b *circuitBreaker) allow(ctx context.Context) (breakerState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.openDuration {
+		b.transition(ctx, breakerHalfOpen)
+	}
+	switch b.state {
+	case breakerOpen:
+		return b.state, false
+	case breakerHalfOpen:
+		if b.trials >= b.halfOpenMax {
+			return b.state, false
+		}
+		b.trials++
+	}
+	return b.state, true
+}
+
+// done records the result of a request let through in state from.
+func (b *circuitBreaker) done(ctx context.Context, from breakerState, result breakerResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if from == breakerHalfOpen && b.state == breakerHalfOpen {
+		switch result {
+		case breakerIgnored:
+			// Give the trial to another request.
+			b.trials--
+		case breakerFailure:
+			b.open(ctx)
+		case breakerSuccess:
+			if b.successes++; b.successes >= b.halfOpenMax {
+				b.transition(ctx, breakerClosed)
+			}
+		}
+		return
+	}
+	if b.state != breakerClosed {
+		// A request sent before the breaker opened.
+		return
+	}
+
+	switch result {
+	case breakerFailure:
+		if b.failures++; b.failures >= b.threshold {
+			b.open(ctx)
+		}
+	case breakerSuccess:
+		b.failures = 0
+	}
+}
+
+// currentState returns the breaker's state.
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) open(ctx context.Context) {
+	b.openedAt = time.Now()
+	b.transition(ctx, breakerOpen)
+}
+
+// transition moves the breaker to state. b.mu must be held.
+func (b *circuitBreaker) transition(ctx context.Context, state breakerState) {
+	level.Warn(b.logger).Log("msg", "Circuit breaker changed state", "instance", b.group, "from", b.state, "to", state)
+	b.state = state
+	b.failures = 0
+	b.trials = 0
+	b.successes = 0
+	b.record(ctx)
+}
+
+func (b *circuitBreaker) record(ctx context.Context) {
+	metrics.CircuitBreakerState.Record(context.WithoutCancel(ctx), int64(b.state),
+		metric.WithAttributes(attribute.String("server_group", b.group)))
+}
+
+// circuitBreakers keeps the circuit breakers of the server groups. Like
+// healthChecker it is keyed by group name and outlives configuration
+// reloads, so a reload neither closes an open breaker nor forgets the
+// failures counted so far. A group's breaker starts afresh only when its
+// breaker configuration changes.
+type circuitBreakers struct {
+	mu     sync.Mutex
+	groups map[string]*circuitBreaker
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{groups: map[string]*circuitBreaker{}}
+}
+
+// breaker returns the circuit breaker of the server group, or nil when it
+// has none.
+func (s *circuitBreakers) breaker(instance cfg.ServerGroup, logger log.Logger) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.groups[instance.Name]; ok && b.config == instance.CircuitBreaker {
+		return b
+	}
+	b := newCircuitBreaker(instance, logger)
+	if b == nil {
+		delete(s.groups, instance.Name)
+		return nil
+	}
+	s.groups[instance.Name] = b
+	return b
+}
+
+// prune forgets the breakers of server groups that are no longer
+// configured.
+func (s *circuitBreakers) prune(config *cfg.Config) {
+	configured := map[string]bool{}
+	for _, sg := range config.ServerGroups {
+		configured[sg.Name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.groups {
+		if !configured[name] {
+			delete(s.groups, name)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// breakerStates returns the lokxy_circuit_breaker_state value of each group.
+func breakerStates(t *testing.T, reader *sdkmetric.ManualReader) map[string]int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	states := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "lokxy_circuit_breaker_state" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+				group, _ := dp.Attributes.Value("server_group")
+				states[group.AsString()] = dp.Value
+			}
+		}
+	}
+	return states
+}
+
+func TestCircuitBreaker_Transitions(t *testing.T) {
+	sg := cfg.ServerGroup{
+		Name:           "loki1",
+		URL:            "http://loki1:3100",
+		CircuitBreaker: cfg.CircuitBreakerConfig{ConsecutiveFailures: 2, OpenDuration: 50 * time.Millisecond, HalfOpenRequests: 2},
+	}
+	b := newCircuitBreaker(sg, log.NewNopLogger())
+	ctx := t.Context()
+
+	// A success resets the count of consecutive failures.
+	for _, result := range []breakerResult{breakerFailure, breakerSuccess, breakerFailure, breakerIgnored} {
+		state, ok := b.allow(ctx)
+		require.True(t, ok)
+		b.done(ctx, state, result)
+	}
+	require.Equal(t, breakerClosed, b.currentState())
+
+	state, _ := b.allow(ctx)
+	b.done(ctx, state, breakerFailure)
+	require.Equal(t, breakerOpen, b.currentState())
+	_, ok := b.allow(ctx)
+	require.False(t, ok)
+
+	// Half-open lets the configured number of trials through; a failed
+	// trial opens the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	s1, ok := b.allow(ctx)
+	require.True(t, ok)
+	require.Equal(t, breakerHalfOpen, s1)
+	s2, ok := b.allow(ctx)
+	require.True(t, ok)
+	_, ok = b.allow(ctx)
+	require.False(t, ok)
+	b.done(ctx, s1, breakerSuccess)
+	b.done(ctx, s2, breakerFailure)
+	require.Equal(t, breakerOpen, b.currentState())
+
+	// An ignored trial is handed to the next request, and the breaker
+	// closes once enough trials succeed.
+	time.Sleep(60 * time.Millisecond)
+	s1, _ = b.allow(ctx)
+	s2, _ = b.allow(ctx)
+	b.done(ctx, s1, breakerIgnored)
+	s3, ok := b.allow(ctx)
+	require.True(t, ok)
+	b.done(ctx, s2, breakerSuccess)
+	b.done(ctx, s3, breakerSuccess)
+	require.Equal(t, breakerClosed, b.currentState())
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	require.Nil(t, newCircuitBreaker(cfg.ServerGroup{Name: "loki1", URL: "http://loki1:3100"}, log.NewNopLogger()))
+}
+
+func TestProxy_CircuitBreaker(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	otel.SetMeterProvider(mp)
+	require.NoError(t, metrics.Reinitialize())
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+
+	var healthyCalls, failingCalls atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+	healthy := mkCountingServer(t, http.StatusOK, &healthyCalls)
+	flaky := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/": func(w http.ResponseWriter, _ *http.Request) {
+			failingCalls.Add(1)
+			if failing.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status": "success", "data":["b"]}`))
+		},
+	})
+	defer flaky.Close()
+
+	config := mkConfig(healthy.URL, flaky.URL)
+	config.ServerGroups[1].IgnoreError = true
+	config.ServerGroups[1].CircuitBreaker = cfg.CircuitBreakerConfig{ConsecutiveFailures: 2, OpenDuration: 50 * time.Millisecond}
+	mux := mustMux(t, log.NewNopLogger(), config)
+
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+		return rr
+	}
+
+	for range 5 {
+		rr := get()
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.JSONEq(t, `{"status":"success","data":["a"]}`, rr.Body.String())
+	}
+	// The group is not contacted once the breaker is open.
+	require.Equal(t, int32(2), failingCalls.Load())
+	require.Equal(t, int64(breakerOpen), breakerStates(t, reader)["sg2"])
+
+	// After the open duration a trial request goes through and closes it.
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	rr := get()
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"status":"success","data":["a","b"]}`, rr.Body.String())
+	require.Equal(t, int32(3), failingCalls.Load())
+	require.Equal(t, int64(breakerClosed), breakerStates(t, reader)["sg2"])
+}
+
+func TestProxy_CircuitBreaker_Downgrade(t *testing.T) {
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, streamResultBody)
+		},
+	})
+	defer s1.Close()
+	var calls atomic.Int32
+	s2 := mkCountingServer(t, http.StatusBadGateway, &calls)
+
+	config := mkConfig(s1.URL, s2.URL)
+	config.ServerGroups[1].DowngradeError = true
+	config.ServerGroups[1].CircuitBreaker = cfg.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenDuration: time.Minute}
+	mux := mustMux(t, log.NewNopLogger(), config)
+
+	for range 3 {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query={app=\"a\"}", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "downgraded")
+	}
+	require.Equal(t, int32(1), calls.Load())
+
+	// The open breaker's error is the warning once it rejects requests.
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query={app=\"a\"}", nil))
+	require.Contains(t, rr.Body.String(), errCircuitOpen.Error())
+}
+
+func TestProxy_CircuitBreakerSurvivesReload(t *testing.T) {
+	mkBreakerConfig := func(openDuration time.Duration) *cfg.Config {
+		config := mkConfig("http://loki1:3100")
+		config.ServerGroups[0].CircuitBreaker = cfg.CircuitBreakerConfig{ConsecutiveFailures: 1, OpenDuration: openDuration}
+		return config
+	}
+	p, err := New(log.NewNopLogger(), mkBreakerConfig(time.Minute))
+	require.NoError(t, err)
+
+	b := p.state.Load().upstreams["sg1"].breaker
+	state, _ := b.allow(t.Context())
+	b.done(t.Context(), state, breakerFailure)
+	require.Equal(t, breakerOpen, b.currentState())
+
+	// An unchanged breaker configuration keeps the breaker open.
+	require.NoError(t, p.ApplyConfig(mkBreakerConfig(time.Minute)))
+	require.Same(t, b, p.state.Load().upstreams["sg1"].breaker)
+
+	// A changed one starts a closed breaker.
+	require.NoError(t, p.ApplyConfig(mkBreakerConfig(time.Hour)))
+	require.Equal(t, breakerClosed, p.state.Load().upstreams["sg1"].breaker.currentState())
+}
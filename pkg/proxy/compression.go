@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// Content encodings lokxy understands, both from upstreams and towards
+// clients. snappy uses the framing format, since HTTP bodies are streams.
+const (
+	encodingGzip   = "gzip"
+	encodingZstd   = "zstd"
+	encodingSnappy = "snappy"
+)
+
+// upstreamAcceptEncoding is advertised to every upstream. Setting it
+// explicitly disables the transport's transparent gzip handling, so
+// decodeResponseBody must handle every encoding listed here.
+const upstreamAcceptEncoding = "gzip, zstd, snappy"
+
+// defaultCompressionMinSize is used when response_compression.min_size is
+// not set. Smaller responses are not worth the compression overhead.
+const defaultCompressionMinSize = 1024
+
+// supportedEncodings lists the encodings offered to clients, in order of
+// preference when the client accepts several with the same weight.
+var supportedEncodings = []string{encodingZstd, encodingGzip, encodingSnappy}
+
+// decodedBody closes the decoder and the original body together.
+type decodedBody struct {
+	io.Reader
+	closeDecoder func()
+	body         io.Closer
+}
+
+func (d *decodedBody) Close() error {
+	if d.closeDecoder != nil {
+		d.closeDecoder()
+	}
+	return d.body.Close()
+}
+
+// decodeResponseBody replaces a compressed response body with a decoding
+// reader and drops the headers describing the encoded body, so handlers and
+// forwarded responses only ever see the decoded payload. Unknown encodings
+// and responses without a body, such as to HEAD, are left untouched; an
+// empty body is passed on as it is, since there is nothing to decode.
+func decodeResponseBody(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if !slices.Contains(supportedEncodings, encoding) {
+		return nil
+	}
+	if (resp.Request != nil && resp.Request.Method == http.MethodHead) ||
+		resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+
+	encoded := bufio.NewReader(resp.Body)
+	if _, err := encoded.Peek(1); err == io.EOF {
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = 0
+		return nil
+	}
+
+	var body *decodedBody
+	switch encoding {
+	case encodingGzip:
+		gzReader, err := gzip.NewReader(encoded)
+		if err != nil {
+			return err
+		}
+		body = &decodedBody{Reader: gzReader, body: resp.Body}
+	case encodingZstd:
+		zstdReader, err := zstd.NewReader(encoded, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		body = &decodedBody{Reader: zstdReader, closeDecoder: zstdReader.Close, body: resp.Body}
+	case encodingSnappy:
+		body = &decodedBody{Reader: snappy.NewReader(encoded), body: resp.Body}
+	}
+
+	resp.Body = body
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// negotiateEncoding picks the response encoding from an Accept-Encoding
+// header: the supported encoding with the highest weight, preferring zstd,
+// then gzip, then snappy on ties. It returns "" when none is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	weights := make(map[string]float64, len(supportedEncodings))
+	wildcard := -1.0
+	for part := range strings.SplitSeq(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildcard = q
+			continue
+		}
+		weights[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supportedEncodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// encoder is the common interface of the gzip, zstd and snappy writers.
+// All of them can be reset onto a new destination and reused.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+type encoderKey struct {
+	encoding string
+	level    int
+}
+
+// encoderPools holds a *sync.Pool of encoders per encoding and level, since
+// zstd encoders in particular are expensive to create.
+var encoderPools sync.Map
+
+func newEncoder(encoding string, level int, w io.Writer) (encoder, error) {
+	switch encoding {
+	case encodingGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case encodingZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case encodingSnappy:
+		return snappy.NewBufferedWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+func getEncoder(encoding string, level int, w io.Writer) (encoder, error) {
+	key := encoderKey{encoding: encoding, level: level}
+	if pool, ok := encoderPools.Load(key); ok {
+		if enc, ok := pool.(*sync.Pool).Get().(encoder); ok {
+			enc.Reset(w)
+			return enc, nil
+		}
+	}
+	return newEncoder(encoding, level, w)
+}
+
+func putEncoder(encoding string, level int, enc encoder) {
+	key := encoderKey{encoding: encoding, level: level}
+	pool, _ := encoderPools.LoadOrStore(key, &sync.Pool{})
+	pool.(*sync.Pool).Put(enc)
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// compressResponseWriter compresses a response with the negotiated encoding
+// once it has grown past the minimum size. Until then the status and body are
+// held back, so small responses are sent unchanged. Close must be called
+// once the handler returns.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	encoding string
+	level    int
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+
+	enc        encoder
+	compressed *countingWriter
+	written    int64
+	err        error
+}
+
+func newCompressResponseWriter(w http.ResponseWriter, r *http.Request, encoding string, config cfg.ResponseCompressionConfig) *compressResponseWriter {
+	minSize := config.MinSize
+	if minSize == 0 {
+		minSize = defaultCompressionMinSize
+	}
+	return &compressResponseWriter{
+		ResponseWriter: w,
+		r:              r,
+		encoding:       encoding,
+		level:          config.Level,
+		minSize:        minSize,
+	}
+}
+
+func (c *compressResponseWriter) WriteHeader(status int) {
+	if c.started || c.status != 0 {
+		return
+	}
+	c.status = status
+}
+
+func (c *compressResponseWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.started {
+		c.buf = append(c.buf, p...)
+		if len(c.buf) >= c.minSize {
+			c.start(true)
+		}
+		return len(p), c.err
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.enc == nil {
+		return c.ResponseWriter.Write(p)
+	}
+	n, err := c.enc.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// start sends the held back status and body, compressed when compress is
+// true and the response is eligible.
+func (c *compressResponseWriter) start(compress bool) {
+	c.started = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+
+	h := c.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if compress && c.compressible() {
+		compressed := &countingWriter{w: c.ResponseWriter}
+		if enc, err := getEncoder(c.encoding, c.level, compressed); err == nil {
+			c.enc = enc
+			c.compressed = compressed
+			h.Set("Content-Encoding", c.encoding)
+			h.Del("Content-Length")
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+	if len(c.buf) == 0 {
+		return
+	}
+	if c.enc != nil {
+		n, err := c.enc.Write(c.buf)
+		c.written += int64(n)
+		c.err = err
+	} else {
+		_, c.err = c.ResponseWriter.Write(c.buf)
+	}
+	c.buf = nil
+}
+
+// compressible reports whether the response may be re-encoded: it must have
+// a body and must not already carry a content encoding.
+func (c *compressResponseWriter) compressible() bool {
+	if c.r.Method == http.MethodHead || c.status == http.StatusNoContent || c.status == http.StatusNotModified {
+		return false
+	}
+	return c.Header().Get("Content-Encoding") == ""
+}
+
+// Flush sends everything written so far, committing to the current
+// encoding decision.
+func (c *compressResponseWriter) Flush() {
+	if !c.started {
+		c.start(len(c.buf) >= c.minSize)
+	}
+	if c.enc != nil {
+		_ = c.enc.Flush()
+	}
+	_ = http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Unwrap lets [http.ResponseController] reach the underlying writer.
+func (c *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// Close finishes the response and records the bytes saved.
+func (c *compressResponseWriter) Close() error {
+	if !c.started {
+		if c.status == 0 && len(c.buf) == 0 {
+			// The handler wrote nothing, not even a status.
+			return nil
+		}
+		c.start(false)
+	}
+	if c.enc == nil {
+		return c.err
+	}
+
+	err := c.enc.Close()
+	putEncoder(c.encoding, c.level, c.enc)
+	c.enc = nil
+
+	if saved := c.written - c.compressed.n; saved > 0 {
+		metrics.ResponseCompressionSavedBytes.Add(c.r.Context(), saved, metric.WithAttributes(
+			attribute.String("path", c.r.Pattern),
+			attribute.String("encoding", c.encoding),
+		))
+	}
+	return err
+}
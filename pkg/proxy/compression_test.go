@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+func encodeBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc, err := newEncoder(encoding, 0, &buf)
+	require.NoError(t, err)
+	_, err = enc.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, enc.Close())
+	return buf.Bytes()
+}
+
+func decodeBody(t *testing.T, encoding string, body []byte) []byte {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case encodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		r = zr
+	case encodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		defer zr.Close()
+		r = zr
+	case encodingSnappy:
+		r = snappy.NewReader(bytes.NewReader(body))
+	default:
+		r = bytes.NewReader(body)
+	}
+	out, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return out
+}
+
+// largeLabelsBody returns a labels response well above the default minimum
+// compression size.
+func largeLabelsBody(n int) string {
+	labels := make([]string, n)
+	for i := range labels {
+		labels[i] = fmt.Sprintf("%q", fmt.Sprintf("label_%04d", i))
+	}
+	return `{"status":"success","data":[` + strings.Join(labels, ",") + `]}`
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip, deflate, br", "gzip"},
+		{"gzip, zstd", "zstd"},
+		{"gzip;q=1.0, zstd;q=0.5", "gzip"},
+		{"snappy", "snappy"},
+		{"zstd;q=0, gzip;q=0", ""},
+		{"*", "zstd"},
+		{"*;q=0.5, gzip;q=0.8", "gzip"},
+		{"GZIP", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			require.Equal(t, tt.want, negotiateEncoding(tt.acceptEncoding))
+		})
+	}
+}
+
+func TestRoundTrip_DecodesUpstreamEncodings(t *testing.T) {
+	plain := []byte(`{"status":"success","data":["a","b"]}`)
+	for _, encoding := range []string{encodingGzip, encodingZstd, encodingSnappy} {
+		t.Run(encoding, func(t *testing.T) {
+			inner := roundTripFunc(func(_ *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header: http.Header{
+						"Content-Encoding": []string{encoding},
+						"Content-Length":   []string{"123"},
+					},
+					Body: io.NopCloser(bytes.NewReader(encodeBody(t, encoding, plain))),
+				}, nil
+			})
+
+			rt := &CustomRoundTripper{rt: inner, logger: log.NewNopLogger()}
+			resp, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "/test", nil))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, plain, body)
+			require.Empty(t, resp.Header.Get("Content-Encoding"))
+			require.Empty(t, resp.Header.Get("Content-Length"))
+			require.True(t, resp.Uncompressed)
+		})
+	}
+}
+
+func TestRoundTrip_EncodedResponseWithoutBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{"empty body", http.MethodGet, http.StatusBadGateway},
+		{"no content", http.MethodGet, http.StatusNoContent},
+		{"not modified", http.MethodGet, http.StatusNotModified},
+		{"head", http.MethodHead, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: tt.status,
+					Header:     http.Header{"Content-Encoding": []string{encodingGzip}},
+					Body:       http.NoBody,
+					Request:    req,
+				}, nil
+			})
+
+			rt := &CustomRoundTripper{rt: inner, logger: log.NewNopLogger()}
+			resp, err := rt.RoundTrip(httptest.NewRequest(tt.method, "/test", nil))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.status, resp.StatusCode)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Empty(t, body)
+		})
+	}
+}
+
+func TestProxy_AdvertisesEncodingsUpstream(t *testing.T) {
+	var gotAcceptEncoding string
+	srv := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, r *http.Request) {
+			gotAcceptEncoding = r.Header.Get("Accept-Encoding")
+			body := encodeBody(t, encodingZstd, []byte(`{"status":"success","data":["a"]}`))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Encoding", encodingZstd)
+			w.Write(body)
+		},
+	})
+	defer srv.Close()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	mustMux(t, log.NewNopLogger(), mkConfig(srv.URL)).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, upstreamAcceptEncoding, gotAcceptEncoding)
+	require.JSONEq(t, `{"status":"success","data":["a"]}`, rr.Body.String())
+}
+
+func TestProxy_ResponseCompression(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	otel.SetMeterProvider(mp)
+	require.NoError(t, metrics.Reinitialize())
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+
+	body := largeLabelsBody(500)
+	srv := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, body)
+		},
+	})
+	defer srv.Close()
+
+	config := mkConfig(srv.URL)
+	config.ResponseCompression.Enabled = true
+	mux := mustMux(t, log.NewNopLogger(), config)
+
+	for _, encoding := range []string{encodingGzip, encodingZstd, encodingSnappy} {
+		t.Run(encoding, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			mux.ServeHTTP(rr, req)
+
+			require.Equal(t, http.StatusOK, rr.Code)
+			require.Equal(t, encoding, rr.Header().Get("Content-Encoding"))
+			require.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+			require.Less(t, rr.Body.Len(), len(body))
+
+			var got struct {
+				Data []string `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(decodeBody(t, encoding, rr.Body.Bytes()), &got))
+			require.Len(t, got.Data, 500)
+		})
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	saved := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "lokxy_response_compression_saved_bytes_total" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				path, _ := dp.Attributes.Value(attribute.Key("path"))
+				require.Equal(t, "/loki/api/v1/labels", path.AsString())
+				encoding, _ := dp.Attributes.Value(attribute.Key("encoding"))
+				saved[encoding.AsString()] = dp.Value
+			}
+		}
+	}
+	require.Len(t, saved, 3)
+	for encoding, n := range saved {
+		require.Positive(t, n, encoding)
+	}
+}
+
+func TestProxy_ResponseCompression_BelowMinSizeOrDisabled(t *testing.T) {
+	srv := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, largeLabelsBody(100))
+		},
+	})
+	defer srv.Close()
+
+	tests := []struct {
+		name        string
+		compression cfg.ResponseCompressionConfig
+		want        string
+	}{
+		{"default min size", cfg.ResponseCompressionConfig{Enabled: true}, encodingGzip},
+		{"larger min size", cfg.ResponseCompressionConfig{Enabled: true, MinSize: 64 * 1024}, ""},
+		{"disabled by default", cfg.ResponseCompressionConfig{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := mkConfig(srv.URL)
+			config.ResponseCompression = tt.compression
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, req)
+
+			require.Equal(t, http.StatusOK, rr.Code)
+			require.Equal(t, tt.want, rr.Header().Get("Content-Encoding"))
+			var got struct {
+				Data []string `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal(decodeBody(t, tt.want, rr.Body.Bytes()), &got))
+			require.Len(t, got.Data, 100)
+		})
+	}
+}
+
+func TestCompressResponseWriter_KeepsStatusAndExistingEncoding(t *testing.T) {
+	// Error statuses are preserved when the body is compressed.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	cw := newCompressResponseWriter(rr, req, encodingGzip, cfg.ResponseCompressionConfig{MinSize: 1})
+	cw.WriteHeader(http.StatusBadGateway)
+	io.WriteString(cw, "no healthy upstreams")
+	require.NoError(t, cw.Close())
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	require.Equal(t, "no healthy upstreams", string(decodeBody(t, encodingGzip, rr.Body.Bytes())))
+
+	// A body that is already encoded is passed through untouched.
+	rr = httptest.NewRecorder()
+	cw = newCompressResponseWriter(rr, req, encodingGzip, cfg.ResponseCompressionConfig{MinSize: 1})
+	cw.Header().Set("Content-Encoding", "br")
+	io.WriteString(cw, "opaque")
+	require.NoError(t, cw.Close())
+	require.Equal(t, "br", rr.Header().Get("Content-Encoding"))
+	require.Equal(t, "opaque", rr.Body.String())
+}
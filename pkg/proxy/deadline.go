@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// softDeadlineHeader lets a client set the soft deadline of its request,
+// overriding soft_deadline.
+const softDeadlineHeader = "X-Lokxy-Soft-Deadline"
+
+// errSoftDeadline fails optional server groups still pending when the
+// request's soft deadline passes.
+var errSoftDeadline = errors.New("soft deadline exceeded")
+
+// softDeadline returns how long the request waits for its optional server
+// groups: the X-Lokxy-Soft-Deadline header, a duration such as 2s or a
+// number of seconds, else the configured one. Zero means no soft deadline.
+func softDeadline(r *http.Request, configured time.Duration) (time.Duration, error) {
+	value := r.Header.Get(softDeadlineHeader)
+	if value == "" {
+		return configured, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, perr := strconv.ParseFloat(value, 64)
+		if perr != nil || math.IsNaN(seconds) {
+			return 0, fmt.Errorf("invalid %s header %q: %w", softDeadlineHeader, value, err)
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid %s header %q: must not be negative", softDeadlineHeader, value)
+	}
+	return d, nil
+}
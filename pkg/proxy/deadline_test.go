@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSoftDeadline(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{header: "", want: 5 * time.Second},
+		{header: "2s", want: 2 * time.Second},
+		{header: "2.5", want: 2500 * time.Millisecond},
+		{header: "0", want: 0},
+		{header: "-1s", wantErr: true},
+		{header: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range", nil)
+		if tt.header != "" {
+			r.Header.Set(softDeadlineHeader, tt.header)
+		}
+		got, err := softDeadline(r, 5*time.Second)
+		if tt.wantErr {
+			require.Error(t, err, tt.header)
+			continue
+		}
+		require.NoError(t, err, tt.header)
+		require.Equal(t, tt.want, got, tt.header)
+	}
+}
+
+// mkSlowQueryRangeServer returns an upstream answering query_range requests
+// once the client gives up or unblock is closed.
+func mkSlowQueryRangeServer(t *testing.T, unblock <-chan struct{}) *httptest.Server {
+	t.Helper()
+	s := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-unblock:
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, streamResultBody)
+		},
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestProxy_SoftDeadline(t *testing.T) {
+	const target = "/loki/api/v1/query_range?query={app=\"a\"}"
+
+	t.Run("slow optional group is left out", func(t *testing.T) {
+		var calls atomic.Int32
+		fast := mkQueryRangeServer(t, http.StatusOK, &calls)
+		slow := mkSlowQueryRangeServer(t, nil)
+
+		config := mkConfig(fast.URL, slow.URL)
+		config.ServerGroups[1].IgnoreError = true
+		config.SoftDeadline = 50 * time.Millisecond
+
+		rr := httptest.NewRecorder()
+		mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "hello")
+		require.Contains(t, rr.Body.String(), "server groups sg2 did not answer within the soft deadline of 50ms")
+	})
+
+	t.Run("client sets the deadline", func(t *testing.T) {
+		var calls atomic.Int32
+		fast := mkQueryRangeServer(t, http.StatusOK, &calls)
+		slow := mkSlowQueryRangeServer(t, nil)
+
+		config := mkConfig(fast.URL, slow.URL)
+		config.ServerGroups[1].DowngradeError = true
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(softDeadlineHeader, "0.05")
+		mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "server groups sg2 did not answer within the soft deadline of 50ms")
+		require.NotContains(t, rr.Body.String(), "downgraded to warning")
+	})
+
+	t.Run("required group is waited for", func(t *testing.T) {
+		unblock := make(chan struct{})
+		slow := mkSlowQueryRangeServer(t, unblock)
+		var calls atomic.Int32
+		optional := mkQueryRangeServer(t, http.StatusOK, &calls)
+
+		config := mkConfig(slow.URL, optional.URL)
+		config.ServerGroups[1].IgnoreError = true
+		config.SoftDeadline = 10 * time.Millisecond
+
+		time.AfterFunc(100*time.Millisecond, func() { close(unblock) })
+		rr := httptest.NewRecorder()
+		mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "hello")
+		require.NotContains(t, rr.Body.String(), "soft deadline")
+	})
+
+	t.Run("invalid header", func(t *testing.T) {
+		var calls atomic.Int32
+		s := mkQueryRangeServer(t, http.StatusOK, &calls)
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set(softDeadlineHeader, "soon")
+		mustMux(t, log.NewNopLogger(), mkConfig(s.URL)).ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		require.Zero(t, calls.Load())
+	})
+}
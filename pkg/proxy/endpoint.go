@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"cmp"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gorilla/websocket"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// Defaults for cfg.LoadBalancingConfig.
+const (
+	defaultEjectAfter    = 3
+	defaultEjectDuration = 30 * time.Second
+)
+
+// endpoint is one base URL of a server group, with its own connection pool.
+type endpoint struct {
+	url    string
+	client *http.Client
+	dialer *websocket.Dialer
+	*endpointState
+}
+
+// endpointState is the load and ejection state of an endpoint. It is kept
+// apart from the endpoint's clients so that it survives reloads.
+type endpointState struct {
+	// inflight counts the requests whose response body is still open.
+	inflight atomic.Int64
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+}
+
+// endpointPool balances the requests of a server group over its endpoints
+// and takes endpoints that keep failing out of rotation for a while.
+type endpointPool struct {
+	group         string
+	endpoints     []*endpoint
+	leastLoaded   bool
+	ejectAfter    int
+	ejectDuration time.Duration
+	logger        log.Logger
+
+	// next rotates the round-robin order.
+	next atomic.Uint64
+}
+
+func newEndpointPool(instance cfg.ServerGroup, logger log.Logger) (*endpointPool, error) {
+	lb := instance.LoadBalancing
+	p := &endpointPool{
+		group:         instance.Name,
+		leastLoaded:   lb.Strategy == cfg.LoadBalancingLeastLoaded,
+		ejectAfter:    lb.EjectAfter,
+		ejectDuration: lb.EjectDuration,
+		logger:        logger,
+	}
+	if p.ejectAfter == 0 {
+		p.ejectAfter = defaultEjectAfter
+	}
+	if p.ejectDuration == 0 {
+		p.ejectDuration = defaultEjectDuration
+	}
+
+	for _, url := range instance.Endpoints() {
+		transport, err := createTransport(instance)
+		if err != nil {
+			return nil, err
+		}
+		p.endpoints = append(p.endpoints, &endpoint{
+			url: url,
+			client: &http.Client{
+				Timeout:   time.Duration(instance.Timeout) * time.Second,
+				Transport: &CustomRoundTripper{rt: transport, logger: logger},
+			},
+			dialer:        createWebSocketDialer(instance, transport),
+			endpointState: &endpointState{},
+		})
+	}
+	return p, nil
+}
+
+// order returns the endpoints to try for a request, in order of preference:
+// those in rotation, round-robin or least loaded first, then the ejected
+// ones, soonest back first, as a last resort.
+func (p *endpointPool) order() []*endpoint {
+	if len(p.endpoints) == 1 {
+		return p.endpoints
+	}
+
+	now := time.Now()
+	start := int(p.next.Add(1) % uint64(len(p.endpoints)))
+	var healthy, ejected []*endpoint
+	until := map[*endpoint]time.Time{}
+	for i := range p.endpoints {
+		e := p.endpoints[(start+i)%len(p.endpoints)]
+		e.mu.Lock()
+		ejectedUntil := e.ejectedUntil
+		e.mu.Unlock()
+		if now.Before(ejectedUntil) {
+			until[e] = ejectedUntil
+			ejected = append(ejected, e)
+		} else {
+			healthy = append(healthy, e)
+		}
+	}
+
+	if p.leastLoaded {
+		// Stable, so endpoints equally loaded keep the round-robin order.
+		slices.SortStableFunc(healthy, func(a, b *endpoint) int {
+			return cmp.Compare(a.inflight.Load(), b.inflight.Load())
+		})
+	}
+	slices.SortStableFunc(ejected, func(a, b *endpoint) int {
+		return until[a].Compare(until[b])
+	})
+	return append(healthy, ejected...)
+}
+
+// report records the outcome of a request to e, ejecting it after too many
+// consecutive failures.
+func (p *endpointPool) report(e *endpoint, failed bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !failed {
+		e.failures = 0
+		return
+	}
+	e.failures++
+	if len(p.endpoints) > 1 && e.failures >= p.ejectAfter && !time.Now().Before(e.ejectedUntil) {
+		e.ejectedUntil = time.Now().Add(p.ejectDuration)
+		level.Warn(p.logger).Log("msg", "Ejecting server group endpoint", "instance", p.group, "endpoint", e.url, "failures", e.failures, "duration", p.ejectDuration)
+	}
+}
+
+// endpointStates keeps the state of the endpoints of the server groups,
+// keyed by group name and endpoint URL. Like healthChecker it outlives
+// configuration reloads, so a reload neither puts an ejected endpoint back
+// into rotation nor forgets the requests still in flight on it.
+type endpointStates struct {
+	mu     sync.Mutex
+	groups map[string]map[string]*endpointState
+}
+
+func newEndpointStates() *endpointStates {
+	return &endpointStates{groups: map[string]map[string]*endpointState{}}
+}
+
+// restore hands the endpoints of pool the state they had before the reload,
+// and keeps the state of those that are new.
+func (s *endpointStates) restore(pool *endpointPool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.groups[pool.group]
+	states := make(map[string]*endpointState, len(pool.endpoints))
+	for _, e := range pool.endpoints {
+		if state, ok := old[e.url]; ok {
+			e.endpointState = state
+		}
+		states[e.url] = e.endpointState
+	}
+	s.groups[pool.group] = states
+}
+
+// prune forgets the endpoints of server groups that are no longer
+// configured.
+func (s *endpointStates) prune(config *cfg.Config) {
+	configured := map[string]bool{}
+	for _, sg := range config.ServerGroups {
+		configured[sg.Name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.groups {
+		if !configured[name] {
+			delete(s.groups, name)
+		}
+	}
+}
+
+// isEndpointFailure reports whether a response status tells the endpoint
+// itself is unavailable, rather than the request being at fault.
+func isEndpointFailure(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// closeHook calls onClose once the response body it wraps is closed.
+type closeHook struct {
+	io.ReadCloser
+	once    sync.Once
+	onClose func()
+}
+
+func (b *closeHook) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.onClose)
+	return err
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// mkCountingServer returns an upstream answering labels requests with
+// status, counting them.
+func mkCountingServer(t *testing.T, status int, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	s := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/": func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["a"]}`)
+		},
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+// mkEndpointsConfig returns a config with one server group spread over urls.
+func mkEndpointsConfig(lb cfg.LoadBalancingConfig, urls ...string) *cfg.Config {
+	config := mkConfig("")
+	config.ServerGroups[0].URL = ""
+	config.ServerGroups[0].URLs = urls
+	config.ServerGroups[0].LoadBalancing = lb
+	return config
+}
+
+func TestProxy_Endpoints_RoundRobin(t *testing.T) {
+	var calls1, calls2 atomic.Int32
+	s1 := mkCountingServer(t, http.StatusOK, &calls1)
+	s2 := mkCountingServer(t, http.StatusOK, &calls2)
+
+	mux := mustMux(t, log.NewNopLogger(), mkEndpointsConfig(cfg.LoadBalancingConfig{}, s1.URL, s2.URL))
+	for range 10 {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	require.Equal(t, int32(5), calls1.Load())
+	require.Equal(t, int32(5), calls2.Load())
+}
+
+func TestProxy_Endpoints_FailoverAndEjection(t *testing.T) {
+	var failing, healthy atomic.Int32
+	s1 := mkCountingServer(t, http.StatusServiceUnavailable, &failing)
+	s2 := mkCountingServer(t, http.StatusOK, &healthy)
+
+	lb := cfg.LoadBalancingConfig{EjectAfter: 2, EjectDuration: time.Minute}
+	mux := mustMux(t, log.NewNopLogger(), mkEndpointsConfig(lb, s1.URL, s2.URL))
+	for range 10 {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	// Every request succeeds through the healthy endpoint; the failing one
+	// is not tried again once ejected.
+	require.Equal(t, int32(10), healthy.Load())
+	require.Equal(t, int32(2), failing.Load())
+}
+
+func TestProxy_Endpoints_UnreachableEndpoint(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkCountingServer(t, http.StatusOK, &calls)
+
+	mux := mustMux(t, log.NewNopLogger(), mkEndpointsConfig(cfg.LoadBalancingConfig{}, "http://127.0.0.1:1", s1.URL))
+	for range 4 {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	require.Equal(t, int32(4), calls.Load())
+}
+
+func TestProxy_Endpoints_NoFailoverForNonIdempotentRequests(t *testing.T) {
+	var calls1, calls2 atomic.Int32
+	s1 := mkCountingServer(t, http.StatusBadGateway, &calls1)
+	s2 := mkCountingServer(t, http.StatusBadGateway, &calls2)
+
+	mux := mustMux(t, log.NewNopLogger(), mkEndpointsConfig(cfg.LoadBalancingConfig{}, s1.URL, s2.URL))
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader("{}")))
+
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	require.Equal(t, int32(1), calls1.Load()+calls2.Load())
+}
+
+func TestEndpointPool_LeastLoaded(t *testing.T) {
+	sg := cfg.ServerGroup{
+		Name:          "loki1",
+		URLs:          []string{"http://qf1:3100", "http://qf2:3100", "http://qf3:3100"},
+		LoadBalancing: cfg.LoadBalancingConfig{Strategy: cfg.LoadBalancingLeastLoaded},
+	}
+	p, err := newEndpointPool(sg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	p.endpoints[0].inflight.Store(3)
+	p.endpoints[1].inflight.Store(1)
+	p.endpoints[2].inflight.Store(2)
+	for range 3 {
+		order := p.order()
+		require.Equal(t, "http://qf2:3100", order[0].url)
+		require.Equal(t, "http://qf3:3100", order[1].url)
+		require.Equal(t, "http://qf1:3100", order[2].url)
+	}
+}
+
+func TestEndpointPool_EjectedEndpointsLast(t *testing.T) {
+	sg := cfg.ServerGroup{
+		Name:          "loki1",
+		URLs:          []string{"http://qf1:3100", "http://qf2:3100"},
+		LoadBalancing: cfg.LoadBalancingConfig{EjectAfter: 1, EjectDuration: 50 * time.Millisecond},
+	}
+	p, err := newEndpointPool(sg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	p.report(p.endpoints[0], true)
+	for range 4 {
+		order := p.order()
+		require.Len(t, order, 2)
+		require.Equal(t, "http://qf2:3100", order[0].url)
+	}
+
+	// Back in rotation once the ejection has expired.
+	time.Sleep(60 * time.Millisecond)
+	first := map[string]bool{}
+	for range 4 {
+		first[p.order()[0].url] = true
+	}
+	require.Len(t, first, 2)
+}
+
+func TestProxy_EndpointStateSurvivesReload(t *testing.T) {
+	mkPoolConfig := func(urls ...string) *cfg.Config {
+		return &cfg.Config{ServerGroups: []cfg.ServerGroup{{
+			Name:          "sg1",
+			URLs:          urls,
+			LoadBalancing: cfg.LoadBalancingConfig{EjectAfter: 1, EjectDuration: time.Minute},
+		}}}
+	}
+	p, err := New(log.NewNopLogger(), mkPoolConfig("http://qf1:3100", "http://qf2:3100"))
+	require.NoError(t, err)
+
+	pool := p.state.Load().upstreams["sg1"].endpoints
+	pool.report(pool.endpoints[0], true)
+	pool.endpoints[1].inflight.Store(2)
+
+	// The ejected endpoint stays ejected and the load of a kept endpoint is
+	// carried over; a new endpoint starts afresh.
+	require.NoError(t, p.ApplyConfig(mkPoolConfig("http://qf1:3100", "http://qf2:3100", "http://qf3:3100")))
+	pool = p.state.Load().upstreams["sg1"].endpoints
+	require.Equal(t, int64(2), pool.endpoints[1].inflight.Load())
+	require.Equal(t, int64(0), pool.endpoints[2].inflight.Load())
+	for range 3 {
+		require.Equal(t, "http://qf1:3100", pool.order()[2].url)
+	}
+}
+
+func TestUpstream_DialWebSocketFailsOver(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer backend.Close()
+
+	u, err := newUpstream(cfg.ServerGroup{Name: "loki1", URLs: []string{"http://127.0.0.1:1", backend.URL}}, log.NewNopLogger())
+	require.NoError(t, err)
+
+	for range 2 {
+		conn, resp, err := u.dialWebSocket(t.Context(), "/loki/api/v1/tail", http.Header{})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		conn.Close()
+	}
+}
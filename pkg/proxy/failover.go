@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/proxy/proxyresponse"
+)
+
+// groupOutcome is the response of a server group, or the error it failed
+// with.
+type groupOutcome struct {
+	instance cfg.ServerGroup
+	resp     *proxyresponse.BackendResponse
+	berr     *proxyresponse.BackendError
+}
+
+// fanoutPlan splits the server groups into the units a request fans out
+// to, in configuration order. The groups of a failover group form one unit
+// of tiers, by ascending priority; every other group is a unit of its own
+// with a single tier.
+func fanoutPlan(groups []cfg.ServerGroup) [][][]cfg.ServerGroup {
+	var plan [][][]cfg.ServerGroup
+	failover := map[string]int{}
+	for _, sg := range groups {
+		if sg.FailoverGroup == "" {
+			plan = append(plan, [][]cfg.ServerGroup{{sg}})
+			continue
+		}
+		i, ok := failover[sg.FailoverGroup]
+		if !ok {
+			i = len(plan)
+			failover[sg.FailoverGroup] = i
+			plan = append(plan, nil)
+		}
+		tiers := plan[i]
+		t, found := slices.BinarySearchFunc(tiers, sg.Priority, func(tier []cfg.ServerGroup, priority int) int {
+			return cmp.Compare(tier[0].Priority, priority)
+		})
+		if found {
+			tiers[t] = append(tiers[t], sg)
+		} else {
+			tiers = slices.Insert(tiers, t, []cfg.ServerGroup{sg})
+		}
+		plan[i] = tiers
+	}
+	return plan
+}
+
+// queryTier queries the server groups of a tier at once and returns their
+// outcomes.
+func queryTier(ctx context.Context, tier []cfg.ServerGroup, query func(context.Context, cfg.ServerGroup) (*proxyresponse.BackendResponse, *proxyresponse.BackendError)) []groupOutcome {
+	outcomes := make([]groupOutcome, len(tier))
+	var wg sync.WaitGroup
+	for i, instance := range tier {
+		wg.Go(func() {
+			resp, berr := query(ctx, instance)
+			outcomes[i] = groupOutcome{instance: instance, resp: resp, berr: berr}
+		})
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// shouldFailOver reports whether the next tier is to be queried: when no
+// group of the tier answered and they did not fail because of the request
+// itself, which the next tier would reject as well.
+func shouldFailOver(outcomes []groupOutcome) bool {
+	if answered(outcomes) {
+		return false
+	}
+	for _, o := range outcomes {
+		if status := o.berr.StatusCode; status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+			return false
+		}
+	}
+	return true
+}
+
+// answered reports whether any server group of a tier answered.
+func answered(outcomes []groupOutcome) bool {
+	return slices.ContainsFunc(outcomes, func(o groupOutcome) bool { return o.resp != nil })
+}
+
+// tierNames returns the names of the server groups of a tier.
+func tierNames(tier []cfg.ServerGroup) string {
+	names := make([]string, len(tier))
+	for i, sg := range tier {
+		names[i] = sg.Name
+	}
+	return strings.Join(names, ", ")
+}
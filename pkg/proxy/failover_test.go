@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+func TestFanoutPlan(t *testing.T) {
+	plan := fanoutPlan([]cfg.ServerGroup{
+		{Name: "dr", FailoverGroup: "logs", Priority: 2},
+		{Name: "audit"},
+		{Name: "primary-a", FailoverGroup: "logs"},
+		{Name: "secondary", FailoverGroup: "logs", Priority: 1},
+		{Name: "primary-b", FailoverGroup: "logs"},
+	})
+
+	var names [][]string
+	for _, tiers := range plan {
+		var unit []string
+		for _, tier := range tiers {
+			unit = append(unit, tierNames(tier))
+		}
+		names = append(names, unit)
+	}
+	require.Equal(t, [][]string{
+		{"primary-a, primary-b", "secondary", "dr"},
+		{"audit"},
+	}, names)
+}
+
+// mkQueryRangeServer returns an upstream answering query_range requests
+// with status, counting them.
+func mkQueryRangeServer(t *testing.T, status int, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+	s := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				io.WriteString(w, "failed")
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, streamResultBody)
+		},
+	})
+	t.Cleanup(s.Close)
+	return s
+}
+
+// mkFailoverConfig returns a config with a primary and a DR server group
+// in one failover group.
+func mkFailoverConfig(primary, dr string) *cfg.Config {
+	config := mkConfig(primary, dr)
+	config.ServerGroups[0].FailoverGroup = "logs"
+	config.ServerGroups[1].FailoverGroup = "logs"
+	config.ServerGroups[1].Priority = 1
+	return config
+}
+
+func TestProxy_Failover(t *testing.T) {
+	const target = "/loki/api/v1/query_range?query={app=\"a\"}"
+
+	t.Run("primary answers", func(t *testing.T) {
+		var primaryCalls, drCalls atomic.Int32
+		primary := mkQueryRangeServer(t, http.StatusOK, &primaryCalls)
+		dr := mkQueryRangeServer(t, http.StatusOK, &drCalls)
+
+		rr := httptest.NewRecorder()
+		mustMux(t, log.NewNopLogger(), mkFailoverConfig(primary.URL, dr.URL)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.NotContains(t, rr.Body.String(), "warnings")
+		require.Equal(t, int32(1), primaryCalls.Load())
+		require.Zero(t, drCalls.Load())
+	})
+
+	t.Run("primary fails over", func(t *testing.T) {
+		var primaryCalls, drCalls atomic.Int32
+		primary := mkQueryRangeServer(t, http.StatusServiceUnavailable, &primaryCalls)
+		dr := mkQueryRangeServer(t, http.StatusOK, &drCalls)
+
+		rr := httptest.NewRecorder()
+		mustMux(t, log.NewNopLogger(), mkFailoverConfig(primary.URL, dr.URL)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "hello")
+		require.Contains(t, rr.Body.String(), `failover group \"logs\" served by priority 1 (sg2)`)
+		require.Equal(t, int32(1), drCalls.Load())
+	})
+
+	t.Run("client error does not fail over", func(t *testing.T) {
+		var primaryCalls, drCalls atomic.Int32
+		primary := mkQueryRangeServer(t, http.StatusBadRequest, &primaryCalls)
+		dr := mkQueryRangeServer(t, http.StatusOK, &drCalls)
+
+		rr := httptest.NewRecorder()
+		mustMux(t, log.NewNopLogger(), mkFailoverConfig(primary.URL, dr.URL)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		require.Equal(t, "sg1", rr.Header().Get("Failed-Backend"))
+		require.Zero(t, drCalls.Load())
+	})
+
+	t.Run("every tier fails", func(t *testing.T) {
+		// The primary's rate limiting is reported along with the DR
+		// tier's failure, and takes precedence over it.
+		var primaryCalls, drCalls atomic.Int32
+		primary := mkQueryRangeServer(t, http.StatusTooManyRequests, &primaryCalls)
+		dr := mkQueryRangeServer(t, http.StatusServiceUnavailable, &drCalls)
+
+		rr := httptest.NewRecorder()
+		mustMux(t, log.NewNopLogger(), mkFailoverConfig(primary.URL, dr.URL)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		require.Equal(t, http.StatusTooManyRequests, rr.Code)
+		require.Equal(t, "sg1,sg2", rr.Header().Get("Failed-Backend"))
+		require.NotContains(t, rr.Body.String(), "served by priority")
+		require.Equal(t, int32(1), drCalls.Load())
+	})
+}
@@ -18,11 +18,12 @@ import (
 const grafanaHealthCheckQuery = "vector(1)+vector(1)"
 
 // IsGrafanaHealthCheck reports whether r looks like the Grafana datasource
-// health check request.  Detection is based on the query parameter; Grafana
+// health check request.  Detection is based on the query parameter, read from
+// either the query string or a form-encoded body (see [RequestParams]); Grafana
 // does not send any health-check-specific header (the internal refID
 // "__healthcheck__" stays inside the plugin SDK).
 func IsGrafanaHealthCheck(r *http.Request) bool {
-	return r.URL.Query().Get("query") == grafanaHealthCheckQuery
+	return RequestParams(r).Get("query") == grafanaHealthCheckQuery
 }
 
 // WriteGrafanaHealthCheckResponse writes a static Loki-compatible vector
@@ -32,7 +33,7 @@ func IsGrafanaHealthCheck(r *http.Request) bool {
 //   - metric: {} (empty)
 //   - value: [<time>, "2"]
 //
-// The time parameter is taken from the request query string.  Grafana sends
+// The time parameter is taken from the request parameters.  Grafana sends
 // time values in nanoseconds (see pkg/tsdb/loki/api.go: strconv.FormatInt(
 // query.End.UnixNano(), 10)).  For the health check the sentinel value is
 // 4000000000 (i.e. time.Unix(4,0).UnixNano()).  We convert nanoseconds to
@@ -41,7 +42,7 @@ func IsGrafanaHealthCheck(r *http.Request) bool {
 func WriteGrafanaHealthCheckResponse(w http.ResponseWriter, r *http.Request, logger log.Logger) {
 	// Default: current time in seconds (Prometheus convention).
 	timestamp := float64(time.Now().Unix())
-	if t := r.URL.Query().Get("time"); t != "" {
+	if t := RequestParams(r).Get("time"); t != "" {
 		if parsed, err := strconv.ParseInt(t, 10, 64); err == nil {
 			// Grafana always sends nanoseconds; convert to seconds.
 			timestamp = float64(parsed) / 1e9
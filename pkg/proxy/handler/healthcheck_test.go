@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -58,6 +59,31 @@ func TestIsGrafanaHealthCheck(t *testing.T) {
 	}
 }
 
+func TestIsGrafanaHealthCheck_FormBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/query",
+		strings.NewReader("query=vector%281%29%2Bvector%281%29&time=4000000000"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	require.False(t, IsGrafanaHealthCheck(req), "body is only visible once parsed")
+
+	params, err := ParseParams(req)
+	require.NoError(t, err)
+	req = WithParams(req, params)
+	require.True(t, IsGrafanaHealthCheck(req))
+
+	rec := httptest.NewRecorder()
+	WriteGrafanaHealthCheckResponse(rec, req, log.NewNopLogger())
+	var resp struct {
+		Data struct {
+			Result []struct {
+				Value []any `json:"value"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Data.Result, 1)
+	require.Equal(t, []any{4.0, "2"}, resp.Data.Result[0].Value)
+}
+
 func TestWriteGrafanaHealthCheckResponse(t *testing.T) {
 	logger := log.NewNopLogger()
 
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// Params holds the parameters of a client request, merged from the URL query
+// string and a form-encoded POST body. Loki accepts query_range, series and
+// labels both ways, and Grafana switches to POST for long queries, so routing
+// and handlers read parameters from here rather than from r.URL.Query().
+type Params struct {
+	url.Values
+
+	// Form is true when some of the parameters came from the request body.
+	Form bool
+
+	// Err is set when the query string or body is malformed; Values then
+	// holds the parameters that could be parsed. Requests forwarded as they
+	// are do not need their parameters, so only the routes that do fail on
+	// it, through requireParams.
+	Err error
+}
+
+type paramsKey struct{}
+
+// ParseParams parses r's parameters. A form-encoded POST body is read and
+// then restored, so it can still be forwarded upstream unchanged. As with
+// [http.Request.ParseForm], body values take precedence over query string
+// values with the same name. Malformed parameters are recorded in Err; the
+// returned error is only set when the body cannot be read.
+func ParseParams(r *http.Request) (*Params, error) {
+	query, queryErr := url.ParseQuery(r.URL.RawQuery)
+	if !isFormRequest(r) {
+		return &Params{Values: query, Err: queryErr}, nil
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	values, bodyErr := url.ParseQuery(string(body))
+	for name, vs := range query {
+		values[name] = append(values[name], vs...)
+	}
+	return &Params{Values: values, Form: len(body) > 0, Err: errors.Join(queryErr, bodyErr)}, nil
+}
+
+// requireParams answers 400 when r's parameters are malformed, for the
+// routes that read them. It reports whether the request may go on.
+func requireParams(w http.ResponseWriter, r *http.Request) bool {
+	if err := RequestParams(r).Err; err != nil {
+		http.Error(w, "invalid request parameters: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// WithParams returns a shallow copy of r carrying p, for [RequestParams].
+func WithParams(r *http.Request, p *Params) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), paramsKey{}, p))
+}
+
+// RequestParams returns the parameters attached to r by [WithParams]. When
+// there are none, only the URL query string is parsed; the body is left
+// alone.
+func RequestParams(r *http.Request) *Params {
+	if p, ok := r.Context().Value(paramsKey{}).(*Params); ok {
+		return p
+	}
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	return &Params{Values: query, Err: err}
+}
+
+func isFormRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost || r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
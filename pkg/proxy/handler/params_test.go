@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseParams(t *testing.T) {
+	t.Run("query string only", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query=%7Bapp%3D%22a%22%7D&limit=10", nil)
+		p, err := ParseParams(r)
+		require.NoError(t, err)
+		require.Equal(t, `{app="a"}`, p.Get("query"))
+		require.Equal(t, "10", p.Get("limit"))
+		require.False(t, p.Form)
+	})
+
+	t.Run("form body merged with query string", func(t *testing.T) {
+		body := "query=%7Bapp%3D%22a%22%7D&limit=100"
+		r := httptest.NewRequest(http.MethodPost, "/loki/api/v1/query_range?limit=10&direction=forward", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+		p, err := ParseParams(r)
+		require.NoError(t, err)
+		require.True(t, p.Form)
+		require.Equal(t, `{app="a"}`, p.Get("query"))
+		require.Equal(t, "forward", p.Get("direction"))
+		// Body values take precedence, as with http.Request.ParseForm.
+		require.Equal(t, []string{"100", "10"}, p.Values["limit"])
+
+		// The body is still available to be forwarded upstream.
+		forwarded, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, body, string(forwarded))
+	})
+
+	t.Run("non-form body is left alone", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push?query=x", strings.NewReader("query=y"))
+		r.Header.Set("Content-Type", "application/json")
+		p, err := ParseParams(r)
+		require.NoError(t, err)
+		require.False(t, p.Form)
+		require.Equal(t, "x", p.Get("query"))
+	})
+
+	t.Run("invalid form body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/loki/api/v1/query", strings.NewReader("query=%zz&limit=10"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		p, err := ParseParams(r)
+		require.NoError(t, err)
+		require.Error(t, p.Err)
+		require.Equal(t, "10", p.Get("limit"))
+	})
+
+	t.Run("invalid query string", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query?query=%zz", nil)
+		p, err := ParseParams(r)
+		require.NoError(t, err)
+		require.Error(t, p.Err)
+
+		rr := httptest.NewRecorder()
+		require.False(t, requireParams(rr, WithParams(r, p)))
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
+
+func TestRequestParams(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/loki/api/v1/query?time=1", strings.NewReader("query=up"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	// Without WithParams only the query string is visible.
+	require.Empty(t, RequestParams(r).Get("query"))
+	require.Equal(t, "1", RequestParams(r).Get("time"))
+
+	p, err := ParseParams(r)
+	require.NoError(t, err)
+	r = WithParams(r, p)
+	require.Same(t, p, RequestParams(r))
+	require.Equal(t, "up", RequestParams(r).Get("query"))
+}
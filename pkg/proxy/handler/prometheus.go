@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/loki/v3/pkg/loghttp"
+	"github.com/prometheus/common/model"
+
+	"github.com/paulojmdias/lokxy/pkg/proxy/proxyresponse"
+)
+
+// Prometheus API error types, see
+// https://prometheus.io/docs/prometheus/latest/querying/api/#format-overview
+const (
+	prometheusErrorBadData     = "bad_data"
+	prometheusErrorExecution   = "execution"
+	prometheusErrorInternal    = "internal"
+	prometheusErrorNotFound    = "not_found"
+	prometheusErrorTimeout     = "timeout"
+	prometheusErrorUnavailable = "unavailable"
+)
+
+// PrometheusErrorType returns the Prometheus API error type of a response
+// status.
+func PrometheusErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return prometheusErrorBadData
+	case http.StatusNotFound:
+		return prometheusErrorNotFound
+	case http.StatusUnprocessableEntity:
+		return prometheusErrorExecution
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return prometheusErrorUnavailable
+	case http.StatusGatewayTimeout:
+		return prometheusErrorTimeout
+	default:
+		return prometheusErrorInternal
+	}
+}
+
+// HandlePrometheusQueries merges query and query_range responses like
+// HandleLokiQueries, but encodes the result in the Prometheus HTTP API
+// format so PromQL-only clients can consume LogQL metric queries. Log
+// (stream) queries have no Prometheus representation and are rejected, as
+// are scalar results that differ between server groups.
+func HandlePrometheusQueries(_ context.Context, w http.ResponseWriter, results <-chan *proxyresponse.BackendResponse, warnings []string, logger log.Logger) {
+	merged := mergeQueryResponses(results, warnings, logger)
+
+	var result any
+	switch merged.resultType {
+	case loghttp.ResultTypeMatrix:
+		matrix := make(model.Matrix, 0, len(merged.matrix))
+		for i := range merged.matrix {
+			matrix = append(matrix, &merged.matrix[i])
+		}
+		result = matrix
+	case loghttp.ResultTypeVector:
+		vector := make(model.Vector, 0, len(merged.vector))
+		for i := range merged.vector {
+			vector = append(vector, &merged.vector[i])
+		}
+		result = vector
+	case loghttp.ResultTypeScalar:
+		if merged.scalarConflict {
+			WritePrometheusError(w, http.StatusBadGateway, prometheusErrorInternal,
+				"server groups returned different scalar results", logger)
+			return
+		}
+		if merged.scalar == nil {
+			WritePrometheusError(w, http.StatusBadGateway, prometheusErrorInternal, "no valid upstream responses", logger)
+			return
+		}
+		result = model.Scalar(*merged.scalar)
+	case loghttp.ResultTypeStream:
+		WritePrometheusError(w, http.StatusBadRequest, prometheusErrorBadData,
+			"only LogQL metric queries are supported by the Prometheus-compatible API", logger)
+		return
+	case "":
+		// No backend returned a decodable body.
+		WritePrometheusError(w, http.StatusBadGateway, prometheusErrorInternal, "no valid upstream responses", logger)
+		return
+	default:
+		WritePrometheusError(w, http.StatusBadRequest, prometheusErrorBadData,
+			fmt.Sprintf("unsupported result type %q", merged.resultType), logger)
+		return
+	}
+
+	finalResponse := map[string]any{
+		"status": statusSuccess,
+		"data": map[string]any{
+			"resultType": merged.resultType,
+			"result":     result,
+		},
+	}
+	if len(merged.warnings) > 0 {
+		finalResponse["warnings"] = merged.warnings
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(finalResponse); err != nil {
+		level.Error(logger).Log("msg", "Failed to encode Prometheus query response", "err", err)
+	}
+}
+
+// WritePrometheusError writes an error in the Prometheus HTTP API format.
+func WritePrometheusError(w http.ResponseWriter, status int, errorType, msg string, logger log.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"status":    "error",
+		"errorType": errorType,
+		"error":     msg,
+	}); err != nil {
+		level.Error(logger).Log("msg", "Failed to encode Prometheus error response", "err", err)
+	}
+}
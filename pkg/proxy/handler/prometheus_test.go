@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase"
+	"github.com/stretchr/testify/require"
+
+	"github.com/paulojmdias/lokxy/pkg/proxy/proxyresponse"
+)
+
+func prometheusResults(bodies ...string) <-chan *proxyresponse.BackendResponse {
+	results := make(chan *proxyresponse.BackendResponse, len(bodies))
+	for _, body := range bodies {
+		rec := httptest.NewRecorder()
+		rec.WriteString(body)
+		results <- wrapResponse(rec.Result())
+	}
+	close(results)
+	return results
+}
+
+func TestHandlePrometheusQueries_Matrix(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := prometheusResults(
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"app":"a"},"values":[[1700000000.5,"1"],[1700000060.5,"2"]]}],"stats":{}}}`,
+		`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"app":"a"},"values":[[1700000000.5,"3"]]}],"stats":{}}}`,
+	)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusQueries(t.Context(), w, results, nil, logger)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{
+		"status":"success",
+		"data":{
+			"resultType":"matrix",
+			"result":[{"metric":{"app":"a"},"values":[[1700000000.5,"4"],[1700000060.5,"2"]]}]
+		}
+	}`, w.Body.String())
+}
+
+func TestHandlePrometheusQueries_VectorWithWarnings(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := prometheusResults(
+		`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"app":"a"},"value":[1700000000,"5"]}],"stats":{}}}`,
+	)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusQueries(t.Context(), w, results, []string{"server group \"sg2\" error downgraded to warning"}, logger)
+
+	var got struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Value  []any             `json:"value"`
+			} `json:"result"`
+			Stats any `json:"stats"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Equal(t, "success", got.Status)
+	require.Equal(t, "vector", got.Data.ResultType)
+	require.Len(t, got.Data.Result, 1)
+	require.Equal(t, []any{1700000000.0, "5"}, got.Data.Result[0].Value)
+	require.Nil(t, got.Data.Stats, "Prometheus responses carry no Loki stats")
+	require.Len(t, got.Warnings, 1)
+}
+
+func TestHandlePrometheusQueries_StreamsRejected(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := prometheusResults(
+		`{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"a"},"values":[["1700000000000000000","line"]]}]}}`,
+	)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusQueries(t.Context(), w, results, nil, logger)
+
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	var got map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Equal(t, "error", got["status"])
+	require.Equal(t, "bad_data", got["errorType"])
+	require.Contains(t, got["error"], "metric queries")
+}
+
+func TestHandlePrometheusQueries_NoValidResponses(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	w := httptest.NewRecorder()
+	HandlePrometheusQueries(t.Context(), w, prometheusResults(`not json`), nil, logger)
+
+	require.Equal(t, http.StatusBadGateway, w.Code)
+	require.Contains(t, w.Body.String(), `"errorType":"internal"`)
+}
+
+func TestHandlePrometheusQueries_Scalar(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := prometheusResults(
+		`{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"],"stats":{}}}`,
+		`{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"],"stats":{}}}`,
+	)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusQueries(t.Context(), w, results, nil, logger)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{
+		"status":"success",
+		"data":{"resultType":"scalar","result":[1700000000,"1"]}
+	}`, w.Body.String())
+}
+
+func TestHandlePrometheusQueries_ScalarConflict(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := prometheusResults(
+		`{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"],"stats":{}}}`,
+		`{"status":"success","data":{"resultType":"scalar","result":[1700000000,"2"],"stats":{}}}`,
+	)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusQueries(t.Context(), w, results, nil, logger)
+
+	require.Equal(t, http.StatusBadGateway, w.Code)
+	require.Contains(t, w.Body.String(), "different scalar results")
+}
+
+func TestHandlePrometheusQueries_ProtobufScalar(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 1)
+	results <- protobufResponse(promQueryResponseBody(t, queryrangebase.PrometheusResponse{
+		Status: "success",
+		Data: queryrangebase.PrometheusData{
+			ResultType: "scalar",
+			Result: []queryrangebase.SampleStream{{
+				Samples: []logproto.LegacySample{{Value: 1, TimestampMs: 1700000000000}},
+			}},
+		},
+	}))
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusQueries(t.Context(), w, results, nil, logger)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{
+		"status":"success",
+		"data":{"resultType":"scalar","result":[1700000000,"1"]}
+	}`, w.Body.String())
+}
@@ -0,0 +1,451 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/loki/v3/pkg/loghttp"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/logqlmodel/stats"
+	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase"
+	"github.com/grafana/loki/v3/pkg/util/marshal"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// ProtobufContentType is the media type Loki uses to negotiate protobuf
+// encoded query and query_range responses. Loki only answers in protobuf when
+// the Accept header is exactly this value and falls back to JSON otherwise.
+const ProtobufContentType = "application/vnd.google.protobuf"
+
+// Field numbers of Loki's queryrange.QueryResponse and of the two payloads it
+// carries for query and query_range (see pkg/querier/queryrange/queryrange.proto
+// in the Loki source). The wrapper messages are encoded by hand because Loki's
+// queryrange package cannot be imported without its storage backends; the
+// nested messages reuse the generated codecs.
+const (
+	queryResponseStatus  protowire.Number = 1
+	queryResponseProm    protowire.Number = 5
+	queryResponseStreams protowire.Number = 6
+
+	rpcStatusCode    protowire.Number = 1
+	rpcStatusMessage protowire.Number = 2
+
+	lokiResponseStatus     protowire.Number = 1
+	lokiResponseData       protowire.Number = 2
+	lokiResponseErrorType  protowire.Number = 3
+	lokiResponseError      protowire.Number = 4
+	lokiResponseStatistics protowire.Number = 8
+	lokiResponseWarnings   protowire.Number = 10
+
+	lokiDataResultType protowire.Number = 1
+	lokiDataResult     protowire.Number = 2
+
+	lokiPromResponseResponse   protowire.Number = 1
+	lokiPromResponseStatistics protowire.Number = 2
+)
+
+// AcceptsProtobuf reports whether the client asked for a protobuf encoded
+// query response. Protobuf is chosen when the Accept header lists it and no
+// JSON media range is preferred over it; anything else gets JSON.
+func AcceptsProtobuf(r *http.Request) bool {
+	protobufQ, jsonQ := -1.0, -1.0
+	for part := range strings.SplitSeq(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case ProtobufContentType:
+			protobufQ = max(protobufQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return protobufQ > 0 && protobufQ >= jsonQ
+}
+
+// isProtobufResponse reports whether an upstream answered in protobuf.
+func isProtobufResponse(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == ProtobufContentType
+}
+
+// decodeProtobufQueryResponse converts a protobuf QueryResponse into the
+// same loghttp representation the JSON decoder produces, so both encodings
+// share one merge path.
+func decodeProtobufQueryResponse(body []byte) (loghttp.QueryResponse, error) {
+	var (
+		result    loghttp.QueryResponse
+		found     bool
+		code      uint64
+		statusMsg string
+	)
+	err := forEachField(body, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		var err error
+		switch num {
+		case queryResponseStatus:
+			msg, err := bytesField(typ, value)
+			if err != nil {
+				return err
+			}
+			return forEachField(msg, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				var err error
+				switch num {
+				case rpcStatusCode:
+					code, err = varintField(typ, value)
+				case rpcStatusMessage:
+					statusMsg, err = stringField(typ, value)
+				}
+				return err
+			})
+		case queryResponseStreams:
+			found = true
+			result, err = decodeLokiResponse(typ, value)
+		case queryResponseProm:
+			found = true
+			result, err = decodeLokiPromResponse(typ, value)
+		default:
+			err = fmt.Errorf("unsupported protobuf response field %d", num)
+		}
+		return err
+	})
+	if err != nil {
+		return loghttp.QueryResponse{}, err
+	}
+	if code != 0 {
+		return loghttp.QueryResponse{}, fmt.Errorf("upstream error (code %d): %s", code, statusMsg)
+	}
+	if !found {
+		return loghttp.QueryResponse{}, errors.New("protobuf response carries no query result")
+	}
+	return result, nil
+}
+
+// decodeLokiResponse decodes a LokiResponse, the payload of log queries.
+func decodeLokiResponse(typ protowire.Type, value []byte) (loghttp.QueryResponse, error) {
+	msg, err := bytesField(typ, value)
+	if err != nil {
+		return loghttp.QueryResponse{}, err
+	}
+
+	var (
+		result              loghttp.QueryResponse
+		errorType, errorMsg string
+		streams             = loghttp.Streams{}
+	)
+	err = forEachField(msg, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		var err error
+		switch num {
+		case lokiResponseStatus:
+			result.Status, err = stringField(typ, value)
+		case lokiResponseErrorType:
+			errorType, err = stringField(typ, value)
+		case lokiResponseError:
+			errorMsg, err = stringField(typ, value)
+		case lokiResponseStatistics:
+			err = unmarshalField(typ, value, &result.Data.Statistics)
+		case lokiResponseWarnings:
+			var warning string
+			warning, err = stringField(typ, value)
+			result.Warnings = append(result.Warnings, warning)
+		case lokiResponseData:
+			data, err := bytesField(typ, value)
+			if err != nil {
+				return err
+			}
+			return forEachField(data, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if num != lokiDataResult {
+					return nil
+				}
+				var s logproto.Stream
+				if err := unmarshalField(typ, value, &s); err != nil {
+					return err
+				}
+				stream, err := marshal.NewStream(s)
+				if err != nil {
+					return err
+				}
+				streams = append(streams, stream)
+				return nil
+			})
+		}
+		return err
+	})
+	if err != nil {
+		return loghttp.QueryResponse{}, err
+	}
+	if errorMsg != "" {
+		return loghttp.QueryResponse{}, fmt.Errorf("%s: %s", errorType, errorMsg)
+	}
+
+	result.Data.ResultType = loghttp.ResultTypeStream
+	result.Data.Result = streams
+	return result, nil
+}
+
+// decodeLokiPromResponse decodes a LokiPromResponse, the payload of metric
+// queries.
+func decodeLokiPromResponse(typ protowire.Type, value []byte) (loghttp.QueryResponse, error) {
+	msg, err := bytesField(typ, value)
+	if err != nil {
+		return loghttp.QueryResponse{}, err
+	}
+
+	var (
+		prom       queryrangebase.PrometheusResponse
+		statistics stats.Result
+	)
+	err = forEachField(msg, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch num {
+		case lokiPromResponseResponse:
+			return unmarshalField(typ, value, &prom)
+		case lokiPromResponseStatistics:
+			return unmarshalField(typ, value, &statistics)
+		}
+		return nil
+	})
+	if err != nil {
+		return loghttp.QueryResponse{}, err
+	}
+	if prom.Error != "" {
+		return loghttp.QueryResponse{}, fmt.Errorf("%s: %s", prom.ErrorType, prom.Error)
+	}
+
+	var result loghttp.ResultValue
+	switch loghttp.ResultType(prom.Data.ResultType) {
+	case loghttp.ResultTypeMatrix:
+		matrix := make(loghttp.Matrix, 0, len(prom.Data.Result))
+		for _, s := range prom.Data.Result {
+			values := make([]model.SamplePair, 0, len(s.Samples))
+			for _, sample := range s.Samples {
+				values = append(values, model.SamplePair{
+					Timestamp: model.Time(sample.TimestampMs),
+					Value:     model.SampleValue(sample.Value),
+				})
+			}
+			matrix = append(matrix, model.SampleStream{Metric: labelAdaptersToMetric(s.Labels), Values: values})
+		}
+		result = matrix
+	case loghttp.ResultTypeVector:
+		vector := make(loghttp.Vector, 0, len(prom.Data.Result))
+		for _, s := range prom.Data.Result {
+			for _, sample := range s.Samples {
+				vector = append(vector, model.Sample{
+					Metric:    labelAdaptersToMetric(s.Labels),
+					Value:     model.SampleValue(sample.Value),
+					Timestamp: model.Time(sample.TimestampMs),
+				})
+			}
+		}
+		result = vector
+	case loghttp.ResultTypeScalar:
+		// Loki encodes a scalar as a single label-less sample.
+		if len(prom.Data.Result) == 0 || len(prom.Data.Result[0].Samples) == 0 {
+			return loghttp.QueryResponse{}, errors.New("scalar result without a sample")
+		}
+		sample := prom.Data.Result[0].Samples[0]
+		result = loghttp.Scalar{
+			Timestamp: model.Time(sample.TimestampMs),
+			Value:     model.SampleValue(sample.Value),
+		}
+	default:
+		return loghttp.QueryResponse{}, fmt.Errorf("unsupported result type %q", prom.Data.ResultType)
+	}
+
+	return loghttp.QueryResponse{
+		Status: prom.Status,
+		Data: loghttp.QueryResponseData{
+			ResultType: loghttp.ResultType(prom.Data.ResultType),
+			Result:     result,
+			Statistics: statistics,
+		},
+		Warnings: prom.Warnings,
+	}, nil
+}
+
+// writeProtobufQueryResponse encodes a merged query result as a protobuf
+// QueryResponse, the format Loki itself returns when protobuf is negotiated.
+func writeProtobufQueryResponse(w http.ResponseWriter, merged mergedQuery, logger log.Logger) {
+	body, err := encodeProtobufQueryResponse(merged)
+	if err != nil {
+		level.Error(logger).Log("msg", "Failed to encode protobuf query response", "err", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", ProtobufContentType)
+	if _, err := w.Write(body); err != nil {
+		level.Error(logger).Log("msg", "Failed to write protobuf query response", "err", err)
+	}
+}
+
+func encodeProtobufQueryResponse(merged mergedQuery) ([]byte, error) {
+	statistics, err := merged.stats.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty google.rpc.Status is the OK status.
+	body := protowire.AppendTag(nil, queryResponseStatus, protowire.BytesType)
+	body = protowire.AppendBytes(body, nil)
+
+	switch merged.resultType {
+	case loghttp.ResultTypeMatrix, loghttp.ResultTypeVector, loghttp.ResultTypeScalar:
+		prom := queryrangebase.PrometheusResponse{
+			Status: statusSuccess,
+			Data: queryrangebase.PrometheusData{
+				ResultType: string(merged.resultType),
+			},
+			Warnings: merged.warnings,
+		}
+		for _, stream := range merged.matrix {
+			samples := make([]logproto.LegacySample, 0, len(stream.Values))
+			for _, v := range stream.Values {
+				samples = append(samples, logproto.LegacySample{Value: float64(v.Value), TimestampMs: int64(v.Timestamp)})
+			}
+			prom.Data.Result = append(prom.Data.Result, queryrangebase.SampleStream{Labels: metricToLabelAdapters(stream.Metric), Samples: samples})
+		}
+		for _, sample := range merged.vector {
+			prom.Data.Result = append(prom.Data.Result, queryrangebase.SampleStream{
+				Labels:  metricToLabelAdapters(sample.Metric),
+				Samples: []logproto.LegacySample{{Value: float64(sample.Value), TimestampMs: int64(sample.Timestamp)}},
+			})
+		}
+		if merged.scalar != nil {
+			prom.Data.Result = append(prom.Data.Result, queryrangebase.SampleStream{
+				Samples: []logproto.LegacySample{{Value: float64(merged.scalar.Value), TimestampMs: int64(merged.scalar.Timestamp)}},
+			})
+		}
+		promBytes, err := prom.Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		var msg []byte
+		msg = protowire.AppendTag(msg, lokiPromResponseResponse, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, promBytes)
+		msg = protowire.AppendTag(msg, lokiPromResponseStatistics, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, statistics)
+
+		body = protowire.AppendTag(body, queryResponseProm, protowire.BytesType)
+		return protowire.AppendBytes(body, msg), nil
+
+	default:
+		// Streams, and the empty result when no backend returned data.
+		var data []byte
+		data = protowire.AppendTag(data, lokiDataResultType, protowire.BytesType)
+		data = protowire.AppendString(data, string(loghttp.ResultTypeStream))
+		for _, stream := range loghttp.Streams(merged.streams).ToProto() {
+			streamBytes, err := stream.Marshal()
+			if err != nil {
+				return nil, err
+			}
+			data = protowire.AppendTag(data, lokiDataResult, protowire.BytesType)
+			data = protowire.AppendBytes(data, streamBytes)
+		}
+
+		var msg []byte
+		msg = protowire.AppendTag(msg, lokiResponseStatus, protowire.BytesType)
+		msg = protowire.AppendString(msg, statusSuccess)
+		msg = protowire.AppendTag(msg, lokiResponseData, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, data)
+		msg = protowire.AppendTag(msg, lokiResponseStatistics, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, statistics)
+		for _, warning := range merged.warnings {
+			msg = protowire.AppendTag(msg, lokiResponseWarnings, protowire.BytesType)
+			msg = protowire.AppendString(msg, warning)
+		}
+
+		body = protowire.AppendTag(body, queryResponseStreams, protowire.BytesType)
+		return protowire.AppendBytes(body, msg), nil
+	}
+}
+
+// forEachField calls fn with the number, wire type and raw value of every
+// field in a protobuf message.
+func forEachField(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return protowire.ParseError(m)
+		}
+		if err := fn(num, typ, b[:m]); err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+	return nil
+}
+
+func bytesField(typ protowire.Type, value []byte) ([]byte, error) {
+	if typ != protowire.BytesType {
+		return nil, fmt.Errorf("unexpected wire type %d for a length-delimited field", typ)
+	}
+	v, n := protowire.ConsumeBytes(value)
+	if n < 0 {
+		return nil, protowire.ParseError(n)
+	}
+	return v, nil
+}
+
+func stringField(typ protowire.Type, value []byte) (string, error) {
+	v, err := bytesField(typ, value)
+	return string(v), err
+}
+
+func varintField(typ protowire.Type, value []byte) (uint64, error) {
+	if typ != protowire.VarintType {
+		return 0, fmt.Errorf("unexpected wire type %d for a varint field", typ)
+	}
+	v, n := protowire.ConsumeVarint(value)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	return v, nil
+}
+
+func unmarshalField(typ protowire.Type, value []byte, m interface{ Unmarshal([]byte) error }) error {
+	v, err := bytesField(typ, value)
+	if err != nil {
+		return err
+	}
+	return m.Unmarshal(v)
+}
+
+func labelAdaptersToMetric(adapters []logproto.LabelAdapter) model.Metric {
+	metric := make(model.Metric, len(adapters))
+	for _, l := range adapters {
+		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+	return metric
+}
+
+// metricToLabelAdapters returns the metric's labels sorted by name, as
+// Prometheus label sets are expected to be.
+func metricToLabelAdapters(metric model.Metric) []logproto.LabelAdapter {
+	adapters := make([]logproto.LabelAdapter, 0, len(metric))
+	for name, value := range metric {
+		adapters = append(adapters, logproto.LabelAdapter{Name: string(name), Value: string(value)})
+	}
+	sort.Slice(adapters, func(i, j int) bool { return adapters[i].Name < adapters[j].Name })
+	return adapters
+}
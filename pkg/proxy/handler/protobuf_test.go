@@ -0,0 +1,247 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/loki/v3/pkg/loghttp"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/paulojmdias/lokxy/pkg/proxy/proxyresponse"
+)
+
+// promQueryResponseBody builds a QueryResponse carrying a LokiPromResponse
+// field by field, independently of the encoder under test.
+func promQueryResponseBody(t *testing.T, prom queryrangebase.PrometheusResponse) []byte {
+	t.Helper()
+	promBytes, err := prom.Marshal()
+	require.NoError(t, err)
+
+	msg := protowire.AppendTag(nil, 1, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, promBytes)
+
+	body := protowire.AppendTag(nil, 1, protowire.BytesType)
+	body = protowire.AppendBytes(body, nil)
+	body = protowire.AppendTag(body, 5, protowire.BytesType)
+	return protowire.AppendBytes(body, msg)
+}
+
+func protobufResponse(body []byte) *proxyresponse.BackendResponse {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", ProtobufContentType)
+	rec.Write(body)
+	return wrapResponse(rec.Result())
+}
+
+func TestAcceptsProtobuf(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"application/vnd.google.protobuf", true},
+		{"application/vnd.google.protobuf, application/json", true},
+		{"application/json, application/vnd.google.protobuf;q=0.5", false},
+		{"application/vnd.google.protobuf;q=0.9, */*;q=0.1", true},
+		{"application/vnd.google.protobuf;q=0", false},
+		{"*/*", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/loki/api/v1/query", nil)
+			r.Header.Set("Accept", tt.accept)
+			require.Equal(t, tt.want, AcceptsProtobuf(r))
+		})
+	}
+}
+
+func TestHandleLokiQueries_MixedProtobufAndJSONUpstreams(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 2)
+	results <- protobufResponse(promQueryResponseBody(t, queryrangebase.PrometheusResponse{
+		Status: "success",
+		Data: queryrangebase.PrometheusData{
+			ResultType: "matrix",
+			Result: []queryrangebase.SampleStream{{
+				Labels:  []logproto.LabelAdapter{{Name: "app", Value: "a"}},
+				Samples: []logproto.LegacySample{{Value: 1, TimestampMs: 1700000000000}, {Value: 2, TimestampMs: 1700000060000}},
+			}},
+		},
+		Warnings: []string{"upstream warning"},
+	}))
+	rec := httptest.NewRecorder()
+	rec.WriteString(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"app":"a"},"values":[[1700000000,"3"]]}],"stats":{}}}`)
+	results <- wrapResponse(rec.Result())
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiQueries(t.Context(), w, results, nil, logger)
+
+	var got struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+				Values [][]any           `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	require.Equal(t, "matrix", got.Data.ResultType)
+	require.Len(t, got.Data.Result, 1)
+	require.Equal(t, map[string]string{"app": "a"}, got.Data.Result[0].Metric)
+	require.Equal(t, [][]any{{1700000000.0, "4"}, {1700000060.0, "2"}}, got.Data.Result[0].Values)
+	require.Equal(t, []string{"upstream warning"}, got.Warnings)
+}
+
+func TestHandleLokiQueriesProtobuf_Streams(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	upstream, err := encodeProtobufQueryResponse(mergedQuery{
+		resultType: loghttp.ResultTypeStream,
+		streams: []loghttp.Stream{{
+			Labels: loghttp.LabelSet{"app": "a"},
+			Entries: []loghttp.Entry{{
+				Timestamp: time.Unix(1700000000, 0),
+				Line:      "from protobuf",
+			}},
+		}},
+	})
+	require.NoError(t, err)
+
+	results := make(chan *proxyresponse.BackendResponse, 2)
+	results <- protobufResponse(upstream)
+	rec := httptest.NewRecorder()
+	rec.WriteString(`{"status":"success","data":{"resultType":"streams","result":[{"stream":{"app":"b"},"values":[["1700000001000000000","from json"]]}]}}`)
+	results <- wrapResponse(rec.Result())
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiQueriesProtobuf(t.Context(), w, results, []string{"server group \"sg3\" error downgraded to warning"}, logger)
+
+	require.Equal(t, ProtobufContentType, w.Header().Get("Content-Type"))
+	got, err := decodeProtobufQueryResponse(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Equal(t, "success", got.Status)
+	require.EqualValues(t, loghttp.ResultTypeStream, got.Data.ResultType)
+	require.Equal(t, []string{"server group \"sg3\" error downgraded to warning"}, got.Warnings)
+
+	streams, ok := got.Data.Result.(loghttp.Streams)
+	require.True(t, ok)
+	require.Len(t, streams, 2)
+	lines := map[string]string{}
+	for _, s := range streams {
+		require.Len(t, s.Entries, 1)
+		lines[s.Labels["app"]] = s.Entries[0].Line
+	}
+	require.Equal(t, map[string]string{"a": "from protobuf", "b": "from json"}, lines)
+}
+
+func TestHandleLokiQueriesProtobuf_Vector(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	rec := httptest.NewRecorder()
+	rec.WriteString(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"app":"a","env":"prod"},"value":[1700000000,"5"]}],"stats":{}}}`)
+	results := make(chan *proxyresponse.BackendResponse, 1)
+	results <- wrapResponse(rec.Result())
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiQueriesProtobuf(t.Context(), w, results, nil, logger)
+
+	// The merged result decodes the same as Loki's encoding of it would.
+	want := promQueryResponseBody(t, queryrangebase.PrometheusResponse{
+		Status: "success",
+		Data: queryrangebase.PrometheusData{
+			ResultType: "vector",
+			Result: []queryrangebase.SampleStream{{
+				Labels:  []logproto.LabelAdapter{{Name: "app", Value: "a"}, {Name: "env", Value: "prod"}},
+				Samples: []logproto.LegacySample{{Value: 5, TimestampMs: 1700000000000}},
+			}},
+		},
+	})
+	got, err := decodeProtobufQueryResponse(w.Body.Bytes())
+	require.NoError(t, err)
+	expected, err := decodeProtobufQueryResponse(want)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+	require.Equal(t, loghttp.Vector{{
+		Metric:    model.Metric{"app": "a", "env": "prod"},
+		Value:     5,
+		Timestamp: 1700000000000,
+	}}, got.Data.Result)
+}
+
+func TestHandleLokiQueriesProtobuf_Scalar(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	// Loki encodes a scalar as one label-less sample.
+	results := make(chan *proxyresponse.BackendResponse, 1)
+	results <- protobufResponse(promQueryResponseBody(t, queryrangebase.PrometheusResponse{
+		Status: "success",
+		Data: queryrangebase.PrometheusData{
+			ResultType: "scalar",
+			Result: []queryrangebase.SampleStream{{
+				Samples: []logproto.LegacySample{{Value: 2, TimestampMs: 1700000000000}},
+			}},
+		},
+	}))
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiQueriesProtobuf(t.Context(), w, results, nil, logger)
+
+	got, err := decodeProtobufQueryResponse(w.Body.Bytes())
+	require.NoError(t, err)
+	require.EqualValues(t, loghttp.ResultTypeScalar, got.Data.ResultType)
+	require.Equal(t, loghttp.Scalar{Value: 2, Timestamp: 1700000000000}, got.Data.Result)
+}
+
+func TestDecodeProtobufQueryResponse_Errors(t *testing.T) {
+	_, err := decodeProtobufQueryResponse(promQueryResponseBody(t, queryrangebase.PrometheusResponse{
+		Status:    "error",
+		ErrorType: "bad_data",
+		Error:     "parse error",
+	}))
+	require.ErrorContains(t, err, "parse error")
+
+	// A non-OK google.rpc.Status without a payload.
+	status := protowire.AppendTag(nil, 1, protowire.VarintType)
+	status = protowire.AppendVarint(status, 3)
+	status = protowire.AppendTag(status, 2, protowire.BytesType)
+	status = protowire.AppendString(status, "invalid argument")
+	body := protowire.AppendTag(nil, 1, protowire.BytesType)
+	body = protowire.AppendBytes(body, status)
+	_, err = decodeProtobufQueryResponse(body)
+	require.ErrorContains(t, err, "invalid argument")
+
+	_, err = decodeProtobufQueryResponse([]byte("not protobuf"))
+	require.Error(t, err)
+}
+
+func TestHandleLokiQueries_InvalidProtobufSkipped(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 1)
+	results <- protobufResponse([]byte("not protobuf"))
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiQueries(t.Context(), w, results, nil, logger)
+
+	var response map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Equal(t, "success", response["status"])
+	require.Empty(t, response["data"].(map[string]any)["result"])
+}
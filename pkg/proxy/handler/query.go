@@ -28,11 +28,45 @@ type encodingFlagsEnvelope struct {
 	} `json:"data"`
 }
 
+// mergedQuery is the result of merging query or query_range responses from
+// every backend, before it is encoded for the client.
+type mergedQuery struct {
+	resultType     loghttp.ResultType
+	streams        []loghttp.Stream
+	matrix         loghttp.Matrix
+	vector         loghttp.Vector
+	scalar         *loghttp.Scalar
+	scalarConflict bool // backends returned different scalars
+	stats          stats.Result
+	encodingFlags  []string
+	warnings       []string
+}
+
 // Handle Loki query and query_range responses
 func HandleLokiQueries(_ context.Context, w http.ResponseWriter, results <-chan *proxyresponse.BackendResponse, warnings []string, logger log.Logger) {
+	merged := mergeQueryResponses(results, warnings, logger)
+	writeLokiQueryResponse(w, merged, logger)
+}
+
+// HandleLokiQueriesProtobuf merges query and query_range responses like
+// HandleLokiQueries, but encodes the result in Loki's protobuf format for
+// clients that negotiated it.
+func HandleLokiQueriesProtobuf(_ context.Context, w http.ResponseWriter, results <-chan *proxyresponse.BackendResponse, warnings []string, logger log.Logger) {
+	merged := mergeQueryResponses(results, warnings, logger)
+	writeProtobufQueryResponse(w, merged, logger)
+}
+
+// mergeQueryResponses merges query and query_range responses: streams are
+// concatenated, matrix samples at the same timestamp are summed and vector
+// samples are de-duplicated by series. The first scalar is passed through,
+// with a warning when backends disagree on it. Each body is decoded as JSON or, when
+// the upstream answered in protobuf, as a protobuf QueryResponse.
+func mergeQueryResponses(results <-chan *proxyresponse.BackendResponse, warnings []string, logger log.Logger) mergedQuery {
 	var mergedStreams []loghttp.Stream
 	var mergedMatrix loghttp.Matrix
 	var mergedVector loghttp.Vector
+	var mergedScalar *loghttp.Scalar
+	var scalarConflict bool
 	var resultType loghttp.ResultType
 	var mergedStats stats.Result
 	encodingFlagsMap := make(map[string]struct{})
@@ -53,25 +87,33 @@ func HandleLokiQueries(_ context.Context, w http.ResponseWriter, results <-chan
 			continue
 		}
 
-		// Log the full body for debugging (guard to avoid string copy when debug is off)
-		if ce := level.Debug(logger); ce != nil {
-			_ = ce.Log("msg", "Complete body received", "body", string(bodyBytes))
-		}
-
-		// Single parse into loghttp.QueryResponse
 		var queryResult loghttp.QueryResponse
-		if err := json.Unmarshal(bodyBytes, &queryResult); err != nil {
-			level.Error(logger).Log("msg", "Failed to unmarshal into loghttp.QueryResponse", "err", err)
-			continue
-		}
+		if isProtobufResponse(resp) {
+			queryResult, err = decodeProtobufQueryResponse(bodyBytes)
+			if err != nil {
+				level.Error(logger).Log("msg", "Failed to decode protobuf query response", "backend", backendResp.BackendName, "err", err)
+				continue
+			}
+		} else {
+			// Log the full body for debugging (guard to avoid string copy when debug is off)
+			if ce := level.Debug(logger); ce != nil {
+				_ = ce.Log("msg", "Complete body received", "body", string(bodyBytes))
+			}
+
+			// Single parse into loghttp.QueryResponse
+			if err := json.Unmarshal(bodyBytes, &queryResult); err != nil {
+				level.Error(logger).Log("msg", "Failed to unmarshal into loghttp.QueryResponse", "err", err)
+				continue
+			}
 
-		// Extract encodingFlags only when the field is present in the raw
-		// payload, avoiding a full second JSON parse in the common case.
-		if bytes.Contains(bodyBytes, encodingFlagsMarker) {
-			var envelope encodingFlagsEnvelope
-			if err := json.Unmarshal(bodyBytes, &envelope); err == nil {
-				for _, flag := range envelope.Data.EncodingFlags {
-					encodingFlagsMap[flag] = struct{}{}
+			// Extract encodingFlags only when the field is present in the raw
+			// payload, avoiding a full second JSON parse in the common case.
+			if bytes.Contains(bodyBytes, encodingFlagsMarker) {
+				var envelope encodingFlagsEnvelope
+				if err := json.Unmarshal(bodyBytes, &envelope); err == nil {
+					for _, flag := range envelope.Data.EncodingFlags {
+						encodingFlagsMap[flag] = struct{}{}
+					}
 				}
 			}
 		}
@@ -132,6 +174,18 @@ func HandleLokiQueries(_ context.Context, w http.ResponseWriter, results <-chan
 					vectorMap[fp] = &sampleCopy
 				}
 			}
+
+		case loghttp.ResultTypeScalar:
+			scalar, ok := queryResult.Data.Result.(loghttp.Scalar)
+			if !ok {
+				level.Error(logger).Log("msg", "Failed to assert type to loghttp.Scalar")
+				continue
+			}
+			if mergedScalar == nil {
+				mergedScalar = &scalar
+			} else if mergedScalar.Timestamp != scalar.Timestamp || !mergedScalar.Value.Equal(scalar.Value) {
+				scalarConflict = true
+			}
 		}
 
 		// Merge statistics
@@ -176,13 +230,42 @@ func HandleLokiQueries(_ context.Context, w http.ResponseWriter, results <-chan
 		mergedMatrix = append(mergedMatrix, mk.stream)
 	}
 
+	// Convert map back to a slice of strings
+	var encodingFlags []string
+	for flag := range encodingFlagsMap {
+		encodingFlags = append(encodingFlags, flag)
+	}
+
+	if scalarConflict {
+		warnings = append(warnings, "server groups returned different scalar results, the first one is returned")
+	}
+	if len(warnings) > 0 {
+		slices.Sort(warnings)
+		warnings = slices.Compact(warnings)
+	}
+
+	return mergedQuery{
+		resultType:     resultType,
+		streams:        mergedStreams,
+		matrix:         mergedMatrix,
+		vector:         mergedVector,
+		scalar:         mergedScalar,
+		scalarConflict: scalarConflict,
+		stats:          mergedStats,
+		encodingFlags:  encodingFlags,
+		warnings:       warnings,
+	}
+}
+
+// writeLokiQueryResponse encodes a merged query result in Loki's JSON format.
+func writeLokiQueryResponse(w http.ResponseWriter, merged mergedQuery, logger log.Logger) {
 	// Prepare final response
 	var finalResult any = []any{}
 
-	switch resultType {
+	switch merged.resultType {
 	case loghttp.ResultTypeStream:
 		var formattedResults []map[string]any
-		for _, stream := range mergedStreams {
+		for _, stream := range merged.streams {
 			values := make([][]any, len(stream.Entries))
 			for i, entry := range stream.Entries {
 				values[i] = []any{
@@ -219,7 +302,7 @@ func HandleLokiQueries(_ context.Context, w http.ResponseWriter, results <-chan
 
 	case loghttp.ResultTypeMatrix:
 		var formattedMatrix []map[string]any
-		for _, matrixEntry := range mergedMatrix {
+		for _, matrixEntry := range merged.matrix {
 			values := make([][]any, len(matrixEntry.Values))
 			for i, value := range matrixEntry.Values {
 				values[i] = []any{
@@ -236,7 +319,7 @@ func HandleLokiQueries(_ context.Context, w http.ResponseWriter, results <-chan
 
 	case loghttp.ResultTypeVector:
 		var formattedVector []map[string]any
-		for _, vectorEntry := range mergedVector {
+		for _, vectorEntry := range merged.vector {
 			formattedVector = append(formattedVector, map[string]any{
 				"metric": vectorEntry.Metric,
 				"value": []any{
@@ -246,34 +329,32 @@ func HandleLokiQueries(_ context.Context, w http.ResponseWriter, results <-chan
 			})
 		}
 		finalResult = formattedVector
+
+	case loghttp.ResultTypeScalar:
+		if merged.scalar != nil {
+			finalResult = merged.scalar
+		}
 	}
 
 	finalResponse := map[string]any{
 		"status": "success",
 		"data": map[string]any{
-			"resultType": resultType,
+			"resultType": merged.resultType,
 			"result":     finalResult,
-			"stats":      mergedStats,
+			"stats":      merged.stats,
 		},
 	}
 
 	// Surface warnings (downgraded server-group errors and any upstream
 	// warnings) on the native Loki warnings[] field so clients such as Grafana
 	// can display them.
-	if len(warnings) > 0 {
-		slices.Sort(warnings)
-		finalResponse["warnings"] = slices.Compact(warnings)
-	}
-
-	// Convert map back to a slice of strings
-	var encodingFlags []string
-	for flag := range encodingFlagsMap {
-		encodingFlags = append(encodingFlags, flag)
+	if len(merged.warnings) > 0 {
+		finalResponse["warnings"] = merged.warnings
 	}
 
 	// Only add encodingFlags if it's defined in any of the responses
-	if len(encodingFlags) > 0 {
-		finalResponse["data"].(map[string]any)["encodingFlags"] = encodingFlags
+	if len(merged.encodingFlags) > 0 {
+		finalResponse["data"].(map[string]any)["encodingFlags"] = merged.encodingFlags
 	}
 
 	if err := json.NewEncoder(w).Encode(finalResponse); err != nil {
@@ -780,3 +780,31 @@ func TestSumMergeSamplePairs_EmptyInputs(t *testing.T) {
 	require.Equal(t, pairs, sumMergeSamplePairs(nil, pairs))
 	require.Equal(t, pairs, sumMergeSamplePairs(pairs, nil))
 }
+
+func TestHandleLokiQueries_ScalarResult(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 2)
+	for _, value := range []string{"2", "3"} {
+		rec := httptest.NewRecorder()
+		rec.WriteString(`{"status":"success","data":{"resultType":"scalar","result":[1700000000,"` + value + `"]}}`)
+		results <- wrapResponse(rec.Result())
+	}
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiQueries(t.Context(), w, results, nil, logger)
+
+	var response struct {
+		Data struct {
+			ResultType string `json:"resultType"`
+			Result     []any  `json:"result"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	require.Equal(t, "scalar", response.Data.ResultType)
+	require.Equal(t, []any{1700000000.0, "2"}, response.Data.Result)
+	require.Len(t, response.Warnings, 1)
+	require.Contains(t, response.Warnings[0], "different scalar results")
+}
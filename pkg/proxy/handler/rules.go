@@ -0,0 +1,374 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/codes"
+	"gopkg.in/yaml.v2"
+
+	traces "github.com/paulojmdias/lokxy/pkg/o11y/tracing"
+	"github.com/paulojmdias/lokxy/pkg/proxy/proxyresponse"
+)
+
+// ServerGroupLabel is the label added to every merged alert to record the
+// server group it was read from.
+const ServerGroupLabel = "lokxy_server_group"
+
+// taggedNamespace prefixes a rule namespace with the originating server group
+// so namespaces from different clusters never collide in the merged view.
+func taggedNamespace(serverGroup, namespace string) string {
+	return serverGroup + "/" + namespace
+}
+
+// isJSONResponse reports whether the upstream response carries a JSON body.
+func isJSONResponse(resp *http.Response) bool {
+	return strings.Contains(resp.Header.Get("Content-Type"), "json")
+}
+
+// readRulesBody reads and closes a rules/alerts response body, tolerating nil
+// responses so a single broken backend does not abort the merge.
+func readRulesBody(ctx context.Context, backendResp *proxyresponse.BackendResponse, logger log.Logger) ([]byte, bool) {
+	resp := backendResp.Response
+	if resp == nil || resp.Body == nil {
+		level.Warn(logger).Log("msg", "nil response or body received for rules", "backend", backendResp.BackendName)
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	// A server group without rules answers 404; it adds nothing.
+	if resp.StatusCode == http.StatusNotFound {
+		level.Debug(logger).Log("msg", "no rules found", "backend", backendResp.BackendName)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		_, errSpan := traces.CreateSpan(ctx, "rules.read_body")
+		errSpan.RecordError(err)
+		errSpan.SetStatus(codes.Error, "failed to read response body")
+		errSpan.End()
+		level.Error(logger).Log("msg", "failed to read rules response body", "backend", backendResp.BackendName, "err", err)
+		return nil, false
+	}
+	return body, true
+}
+
+// HandleLokiRules merges /loki/api/v1/rules responses. Loki answers with a
+// YAML map of namespace to rule groups; JSON is accepted as well. Every
+// namespace is tagged with the originating server group. The merged response
+// is YAML unless all upstreams answered with JSON.
+func HandleLokiRules(ctx context.Context, w http.ResponseWriter, results <-chan *proxyresponse.BackendResponse, _ []string, logger log.Logger) {
+	ctx, span := traces.CreateSpan(ctx, "handle_rules")
+	defer span.End()
+
+	// Rule groups are kept as ordered maps so fields lokxy does not know
+	// about (limit, remote_write, ...) round-trip unchanged.
+	merged := make(map[string][]yaml.MapSlice)
+	allJSON := true
+	seen := 0
+
+	for backendResp := range results {
+		body, ok := readRulesBody(ctx, backendResp, logger)
+		if !ok {
+			continue
+		}
+
+		var namespaces map[string][]yaml.MapSlice
+		var err error
+		if isJSONResponse(backendResp.Response) {
+			namespaces, err = decodeJSONRuleNamespaces(body)
+		} else {
+			allJSON = false
+			err = yaml.Unmarshal(body, &namespaces)
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "failed to decode rules response", "backend", backendResp.BackendName, "err", err)
+			continue
+		}
+		seen++
+
+		for namespace, groups := range namespaces {
+			key := taggedNamespace(backendResp.BackendName, namespace)
+			merged[key] = append(merged[key], groups...)
+		}
+	}
+
+	// Group order inside a namespace is stable by name; duplicate names can
+	// only come from the same server group and keep their upstream order.
+	for _, groups := range merged {
+		sort.SliceStable(groups, func(i, j int) bool {
+			return mapSliceString(groups[i], "name") < mapSliceString(groups[j], "name")
+		})
+	}
+
+	if allJSON && seen > 0 {
+		out := make(map[string][]map[string]any, len(merged))
+		for namespace, groups := range merged {
+			for _, group := range groups {
+				out[namespace] = append(out[namespace], mapSliceToJSON(group))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			level.Error(logger).Log("msg", "failed to encode merged rules response", "err", err)
+		}
+		return
+	}
+
+	// yaml.v2 sorts map keys, so the namespace order is deterministic.
+	out, err := yaml.Marshal(merged)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "failed to encode merged rules response")
+		level.Error(logger).Log("msg", "failed to encode merged rules response", "err", err)
+		http.Error(w, "failed to encode merged rules response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	if _, err := w.Write(out); err != nil {
+		level.Error(logger).Log("msg", "failed to write merged rules response", "err", err)
+	}
+}
+
+// decodeJSONRuleNamespaces decodes a JSON namespace map into the same ordered
+// representation used for YAML so both formats share the merge path.
+func decodeJSONRuleNamespaces(body []byte) (map[string][]yaml.MapSlice, error) {
+	var namespaces map[string][]json.RawMessage
+	if err := json.Unmarshal(body, &namespaces); err != nil {
+		return nil, err
+	}
+	out := make(map[string][]yaml.MapSlice, len(namespaces))
+	for namespace, groups := range namespaces {
+		for _, raw := range groups {
+			// JSON is a subset of YAML, so the YAML decoder keeps key order.
+			var group yaml.MapSlice
+			if err := yaml.Unmarshal(raw, &group); err != nil {
+				return nil, err
+			}
+			out[namespace] = append(out[namespace], group)
+		}
+	}
+	return out, nil
+}
+
+// mapSliceString returns the string value stored under key, or "".
+func mapSliceString(ms yaml.MapSlice, key string) string {
+	for _, item := range ms {
+		if k, ok := item.Key.(string); ok && k == key {
+			if v, ok := item.Value.(string); ok {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+// mapSliceToJSON converts a decoded YAML value into types encoding/json can
+// marshal (yaml.v2 yields map[interface{}]interface{} for nested maps).
+func mapSliceToJSON(ms yaml.MapSlice) map[string]any {
+	out := make(map[string]any, len(ms))
+	for _, item := range ms {
+		out[toString(item.Key)] = yamlValueToJSON(item.Value)
+	}
+	return out
+}
+
+func yamlValueToJSON(v any) any {
+	switch val := v.(type) {
+	case yaml.MapSlice:
+		return mapSliceToJSON(val)
+	case map[any]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[toString(k)] = yamlValueToJSON(item)
+		}
+		return out
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = yamlValueToJSON(item)
+		}
+		return out
+	default:
+		return val
+	}
+}
+
+func toString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// prometheusRulesResponse mirrors the Prometheus-compatible rules API
+// response. Groups and alerts are kept as generic maps so unknown fields
+// survive the merge.
+type prometheusRulesResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Groups []map[string]any `json:"groups"`
+	} `json:"data"`
+}
+
+type prometheusAlertsResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Alerts []map[string]any `json:"alerts"`
+	} `json:"data"`
+}
+
+// decodeJSONNumbers unmarshals body keeping numbers as json.Number so values
+// such as evaluation timestamps are re-encoded exactly.
+func decodeJSONNumbers(body []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// tagAlert adds the server group label to a generic alert object.
+func tagAlert(alert map[string]any, serverGroup string) {
+	labels, ok := alert["labels"].(map[string]any)
+	if !ok {
+		labels = make(map[string]any)
+		alert["labels"] = labels
+	}
+	labels[ServerGroupLabel] = serverGroup
+}
+
+// HandlePrometheusRules merges /prometheus/api/v1/rules responses. Each
+// group's file (the Loki namespace) is tagged with the originating server
+// group, active alerts carry the server group label, and groups are sorted
+// by file and name.
+func HandlePrometheusRules(ctx context.Context, w http.ResponseWriter, results <-chan *proxyresponse.BackendResponse, _ []string, logger log.Logger) {
+	ctx, span := traces.CreateSpan(ctx, "handle_prometheus_rules")
+	defer span.End()
+
+	groups := make([]map[string]any, 0)
+
+	for backendResp := range results {
+		body, ok := readRulesBody(ctx, backendResp, logger)
+		if !ok {
+			continue
+		}
+
+		var rulesResp prometheusRulesResponse
+		if err := decodeJSONNumbers(body, &rulesResp); err != nil {
+			level.Error(logger).Log("msg", "failed to unmarshal prometheus rules response", "backend", backendResp.BackendName, "err", err)
+			continue
+		}
+
+		for _, group := range rulesResp.Data.Groups {
+			file, _ := group["file"].(string)
+			group["file"] = taggedNamespace(backendResp.BackendName, file)
+			if rules, ok := group["rules"].([]any); ok {
+				for _, rule := range rules {
+					ruleMap, ok := rule.(map[string]any)
+					if !ok {
+						continue
+					}
+					alerts, _ := ruleMap["alerts"].([]any)
+					for _, alert := range alerts {
+						if alertMap, ok := alert.(map[string]any); ok {
+							tagAlert(alertMap, backendResp.BackendName)
+						}
+					}
+				}
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		fi, _ := groups[i]["file"].(string)
+		fj, _ := groups[j]["file"].(string)
+		if fi != fj {
+			return fi < fj
+		}
+		ni, _ := groups[i]["name"].(string)
+		nj, _ := groups[j]["name"].(string)
+		return ni < nj
+	})
+
+	final := map[string]any{
+		"status": statusSuccess,
+		"data": map[string]any{
+			"groups": groups,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(final); err != nil {
+		span.RecordError(err)
+		level.Error(logger).Log("msg", "failed to encode merged prometheus rules response", "err", err)
+	}
+}
+
+// HandlePrometheusAlerts merges /prometheus/api/v1/alerts responses, tagging
+// every alert with the server group it came from. Alerts are sorted by
+// server group and then by their label set.
+func HandlePrometheusAlerts(ctx context.Context, w http.ResponseWriter, results <-chan *proxyresponse.BackendResponse, _ []string, logger log.Logger) {
+	ctx, span := traces.CreateSpan(ctx, "handle_prometheus_alerts")
+	defer span.End()
+
+	type keyedAlert struct {
+		alert map[string]any
+		group string
+		key   string
+	}
+	var keyed []keyedAlert
+
+	for backendResp := range results {
+		body, ok := readRulesBody(ctx, backendResp, logger)
+		if !ok {
+			continue
+		}
+
+		var alertsResp prometheusAlertsResponse
+		if err := decodeJSONNumbers(body, &alertsResp); err != nil {
+			level.Error(logger).Log("msg", "failed to unmarshal prometheus alerts response", "backend", backendResp.BackendName, "err", err)
+			continue
+		}
+
+		for _, alert := range alertsResp.Data.Alerts {
+			tagAlert(alert, backendResp.BackendName)
+			// encoding/json sorts map keys, giving a canonical label key.
+			labelKey, _ := json.Marshal(alert["labels"])
+			keyed = append(keyed, keyedAlert{alert: alert, group: backendResp.BackendName, key: string(labelKey)})
+		}
+	}
+
+	sort.SliceStable(keyed, func(i, j int) bool {
+		if keyed[i].group != keyed[j].group {
+			return keyed[i].group < keyed[j].group
+		}
+		return keyed[i].key < keyed[j].key
+	})
+
+	alerts := make([]map[string]any, 0, len(keyed))
+	for _, k := range keyed {
+		alerts = append(alerts, k.alert)
+	}
+
+	final := map[string]any{
+		"status": statusSuccess,
+		"data": map[string]any{
+			"alerts": alerts,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(final); err != nil {
+		span.RecordError(err)
+		level.Error(logger).Log("msg", "failed to encode merged prometheus alerts response", "err", err)
+	}
+}
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/paulojmdias/lokxy/pkg/proxy/proxyresponse"
+)
+
+// rulesResult builds a BackendResponse for the given server group, body and
+// content type.
+func rulesResult(backend, contentType, body string) *proxyresponse.BackendResponse {
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", contentType)
+	rec.WriteString(body)
+	return &proxyresponse.BackendResponse{
+		Response:    rec.Result(),
+		BackendName: backend,
+		BackendURL:  "http://" + backend + ":3100",
+	}
+}
+
+func TestHandleLokiRules_MergesYAMLAndTagsNamespaces(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 2)
+	results <- rulesResult("eu", "application/yaml", `
+app:
+  - name: zeta
+    interval: 1m
+    rules:
+      - alert: HighErrors
+        expr: sum(rate({app="foo"} |= "error" [5m])) > 10
+        for: 5m
+  - name: alpha
+    rules:
+      - record: app:lines:rate1m
+        expr: sum(rate({app="foo"}[1m]))
+`)
+	results <- rulesResult("us", "application/yaml", `
+app:
+  - name: alpha
+    limit: 10
+    rules:
+      - record: app:lines:rate1m
+        expr: sum(rate({app="foo"}[1m]))
+`)
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiRules(t.Context(), w, results, nil, logger)
+
+	require.Equal(t, "application/yaml", w.Header().Get("Content-Type"))
+
+	var out map[string][]yaml.MapSlice
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &out))
+	require.Len(t, out, 2)
+
+	eu := out["eu/app"]
+	require.Len(t, eu, 2)
+	require.Equal(t, "alpha", mapSliceString(eu[0], "name"))
+	require.Equal(t, "zeta", mapSliceString(eu[1], "name"))
+	require.Equal(t, "1m", mapSliceString(eu[1], "interval"))
+
+	us := out["us/app"]
+	require.Len(t, us, 1)
+	// Fields lokxy does not model are preserved.
+	require.Contains(t, w.Body.String(), "limit: 10")
+}
+
+func TestHandleLokiRules_AllJSONKeepsJSON(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 2)
+	results <- rulesResult("eu", "application/json", `{"app":[{"name":"g1","rules":[{"record":"r","expr":"sum(rate({a=\"b\"}[1m]))","labels":{"team":"x"}}]}]}`)
+	results <- rulesResult("us", "application/json", `{"app":[{"name":"g1","rules":[]}]}`)
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiRules(t.Context(), w, results, nil, logger)
+
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var out map[string][]map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	require.Contains(t, out, "eu/app")
+	require.Contains(t, out, "us/app")
+	rules := out["eu/app"][0]["rules"].([]any)
+	require.Equal(t, map[string]any{"team": "x"}, rules[0].(map[string]any)["labels"])
+}
+
+func TestHandleLokiRules_InvalidBodySkipped(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 3)
+	results <- rulesResult("eu", "application/yaml", "app:\n  - name: g1\n")
+	results <- rulesResult("us", "application/yaml", "::: not yaml")
+	results <- wrapResponse(&http.Response{StatusCode: http.StatusOK})
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiRules(t.Context(), w, results, nil, logger)
+
+	var out map[string][]yaml.MapSlice
+	require.NoError(t, yaml.Unmarshal(w.Body.Bytes(), &out))
+	require.Len(t, out, 1)
+	require.Contains(t, out, "eu/app")
+}
+
+func TestHandleLokiRules_NotFoundIsEmpty(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	empty := rulesResult("us", "text/plain", "")
+	empty.Response.StatusCode = http.StatusNotFound
+
+	results := make(chan *proxyresponse.BackendResponse, 2)
+	results <- rulesResult("eu", "application/json", `{"app":[{"name":"g1","rules":[]}]}`)
+	results <- empty
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandleLokiRules(t.Context(), w, results, nil, logger)
+
+	// The group without rules does not turn the response into YAML.
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.JSONEq(t, `{"eu/app":[{"name":"g1","rules":[]}]}`, w.Body.String())
+}
+
+func TestHandlePrometheusRules_MergeSortAndTag(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 2)
+	results <- rulesResult("us", "application/json", `{"status":"success","data":{"groups":[
+		{"name":"g2","file":"app","interval":60,"rules":[{"name":"HighErrors","type":"alerting","state":"firing","alerts":[{"labels":{"alertname":"HighErrors"},"state":"firing","value":"1.2e+01"}]}]}
+	]}}`)
+	results <- rulesResult("eu", "application/json", `{"status":"success","data":{"groups":[
+		{"name":"g1","file":"app","interval":60,"evaluationTime":0.001234567891234,"rules":[]}
+	]}}`)
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusRules(t.Context(), w, results, nil, logger)
+
+	var out struct {
+		Status string `json:"status"`
+		Data   struct {
+			Groups []struct {
+				Name  string `json:"name"`
+				File  string `json:"file"`
+				Rules []struct {
+					Alerts []struct {
+						Labels map[string]string `json:"labels"`
+					} `json:"alerts"`
+				} `json:"rules"`
+			} `json:"groups"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	require.Equal(t, "success", out.Status)
+	require.Len(t, out.Data.Groups, 2)
+	require.Equal(t, "eu/app", out.Data.Groups[0].File)
+	require.Equal(t, "us/app", out.Data.Groups[1].File)
+	require.Equal(t, "us", out.Data.Groups[1].Rules[0].Alerts[0].Labels[ServerGroupLabel])
+
+	// Numbers are re-encoded without losing precision.
+	require.Contains(t, w.Body.String(), "0.001234567891234")
+}
+
+func TestHandlePrometheusRules_Empty(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse)
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusRules(t.Context(), w, results, nil, logger)
+
+	require.JSONEq(t, `{"status":"success","data":{"groups":[]}}`, w.Body.String())
+}
+
+func TestHandlePrometheusAlerts_MergeSortAndTag(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	results := make(chan *proxyresponse.BackendResponse, 3)
+	results <- rulesResult("us", "application/json", `{"status":"success","data":{"alerts":[
+		{"labels":{"alertname":"B"},"state":"firing"},
+		{"labels":{"alertname":"A"},"state":"pending"}
+	]}}`)
+	results <- rulesResult("eu", "application/json", `{"status":"success","data":{"alerts":[
+		{"state":"firing"}
+	]}}`)
+	results <- rulesResult("broken", "application/json", `not json`)
+	close(results)
+
+	w := httptest.NewRecorder()
+	HandlePrometheusAlerts(t.Context(), w, results, nil, logger)
+
+	var out struct {
+		Data struct {
+			Alerts []struct {
+				Labels map[string]string `json:"labels"`
+				State  string            `json:"state"`
+			} `json:"alerts"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+	require.Len(t, out.Data.Alerts, 3)
+
+	require.Equal(t, "eu", out.Data.Alerts[0].Labels[ServerGroupLabel])
+	require.Equal(t, "A", out.Data.Alerts[1].Labels["alertname"])
+	require.Equal(t, "us", out.Data.Alerts[1].Labels[ServerGroupLabel])
+	require.Equal(t, "B", out.Data.Alerts[2].Labels["alertname"])
+}
@@ -2,21 +2,25 @@ package handler
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"fmt"
 	"io"
+	"maps"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/gorilla/websocket"
+	"github.com/grafana/loki/v3/pkg/loghttp"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 
 	cfg "github.com/paulojmdias/lokxy/pkg/config"
 	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
@@ -27,50 +31,430 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// Origins are checked against tail.allowed_origins by admitTail, before
+	// the upgrade.
 	CheckOrigin: func(_ *http.Request) bool {
-		return true // Allow all origins
+		return true
 	},
 }
 
-// createWebSocketDialer creates a WebSocket dialer with the appropriate TLS configuration
-func createWebSocketDialer(instance cfg.ServerGroup, logger log.Logger) (*websocket.Dialer, error) {
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: instance.HTTPClientConfig.TLSConfig.InsecureSkipVerify,
+// TailDialer connects a tail to the server groups, using each group's
+// transport settings and adding its headers to header. It is called for
+// every reconnect and poll, so it can pick up a reloaded configuration.
+type TailDialer interface {
+	// DialWebSocket opens a tail WebSocket to path, including the query
+	// string, on the named server group.
+	DialWebSocket(ctx context.Context, group, path string, header http.Header) (*websocket.Conn, *http.Response, error)
+
+	// Get sends a GET request for path to the named server group, for
+	// server groups tailed by polling.
+	Get(ctx context.Context, group, path string, header http.Header) (*http.Response, error)
+}
+
+// Defaults for cfg.TailConfig.
+const (
+	defaultTailReconnectAttempts = 5
+	defaultTailMinBackoff        = 250 * time.Millisecond
+	defaultTailMaxBackoff        = 10 * time.Second
+	defaultTailBufferSize        = 1000
+	defaultTailWriteTimeout      = 10 * time.Second
+	defaultTailPingInterval      = 30 * time.Second
+)
+
+// maxCloseReasonLength is the longest reason a WebSocket close frame can
+// carry: 125 bytes of control frame payload minus the 2 byte status code.
+const maxCloseReasonLength = 123
+
+// tailFrame is a tail message as sent by Loki, plus the warnings lokxy adds
+// to tell the client about downgraded server groups. Entry values are kept
+// raw so they are forwarded exactly as received.
+type tailFrame struct {
+	Streams        []tailStream       `json:"streams,omitempty"`
+	DroppedEntries []tailDroppedEntry `json:"dropped_entries,omitempty"`
+	Warnings       []string           `json:"warnings,omitempty"`
+}
+
+type tailStream struct {
+	Stream map[string]string   `json:"stream"`
+	Values [][]json.RawMessage `json:"values"`
+}
+
+// tailBackend is one server group's part of a tail. It reconnects with
+// backoff when its WebSocket closes or fails, resuming from the timestamp of
+// the last entry it received, and applies the group's error policy when it
+// cannot.
+type tailBackend struct {
+	instance  cfg.ServerGroup
+	dial      TailDialer
+	path      string
+	params    url.Values
+	reconnect cfg.TailReconnectConfig
+	logger    log.Logger
+
+	// lastTs is the timestamp of the newest entry received and lastSeen the
+	// entries received at exactly that timestamp, keyed by stream and line.
+	// A reconnect resumes from lastTs, so the entries in resumeSeen are
+	// dropped when the upstream sends them again.
+	lastTs     int64
+	lastSeen   map[string]struct{}
+	resumeTs   int64
+	resumeSeen map[string]struct{}
+
+	messages int
+}
+
+func newTailBackend(instance cfg.ServerGroup, dial TailDialer, r *http.Request, reconnect cfg.TailReconnectConfig, logger log.Logger) *tailBackend {
+	if reconnect.MaxAttempts == 0 {
+		reconnect.MaxAttempts = defaultTailReconnectAttempts
+	}
+	if reconnect.MinBackoff == 0 {
+		reconnect.MinBackoff = defaultTailMinBackoff
+	}
+	if reconnect.MaxBackoff == 0 {
+		reconnect.MaxBackoff = max(defaultTailMaxBackoff, reconnect.MinBackoff)
+	}
+
+	return &tailBackend{
+		instance:  instance,
+		dial:      dial,
+		path:      r.URL.Path,
+		params:    RequestParams(r).Values,
+		reconnect: reconnect,
+		logger:    logger,
+		lastSeen:  map[string]struct{}{},
+	}
+}
+
+func (t *tailBackend) required() bool {
+	return !t.instance.IgnoreError && !t.instance.DowngradeError
+}
+
+func (t *tailBackend) metricAttrs() metric.MeasurementOption {
+	return metric.WithAttributes(
+		attribute.String("path", "/loki/api/v1/tail"),
+		attribute.String("method", "GET"),
+		attribute.String("server_group", t.instance.Name),
+	)
+}
+
+// target returns the upstream tail path and query, starting at the last
+// entry received once there is one.
+func (t *tailBackend) target() string {
+	params := maps.Clone(t.params)
+	if t.lastTs > 0 {
+		if params == nil {
+			params = url.Values{}
+		}
+		params.Set("start", strconv.FormatInt(t.lastTs, 10))
+	}
+	if len(params) == 0 {
+		return t.path
+	}
+	return t.path + "?" + params.Encode()
+}
+
+// run streams the server group's entries to sink until ctx is done or the group
+// is given up on. Errors of required groups are sent to fatal.
+func (t *tailBackend) run(ctx context.Context, sink tailSink, fatal chan<- error) {
+	ctx, span := traces.CreateSpan(ctx, "websocket_backend_connection")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("upstream.name", t.instance.Name),
+		attribute.String("upstream.base_url", strings.Join(t.instance.Endpoints(), ",")),
+	)
+
+	active := metric.WithAttributes(attribute.String("server_group", t.instance.Name))
+	metrics.TailActive.Add(ctx, 1, active)
+	defer metrics.TailActive.Add(context.WithoutCancel(ctx), -1, active)
+
+	connected := false
+	attempt := 0
+	for {
+		conn, err := t.connect(ctx, span)
+		if err == nil {
+			if connected {
+				metrics.TailReconnects.Add(ctx, 1, metric.WithAttributes(attribute.String("server_group", t.instance.Name)))
+				span.AddEvent("reconnected", trace.WithAttributes(attribute.Int64("tail.resume_ts", t.lastTs)))
+				level.Info(t.logger).Log("msg", "Reconnected to Loki tail", "instance", t.instance.Name, "resume_ts", t.lastTs)
+			}
+			connected = true
+
+			start := time.Now()
+			var delivered bool
+			delivered, err = t.consume(ctx, conn, sink, span)
+			t.resumeTs, t.resumeSeen = t.lastTs, t.lastSeen
+			// A connection that was useful resets the attempt count, so
+			// separate outages each get the full number of attempts.
+			if delivered || time.Since(start) >= t.reconnect.MaxBackoff {
+				attempt = 0
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Fail fast: a required group that cannot be reached at all fails
+		// the tail instead of silently leaving out its entries.
+		if !connected && t.required() {
+			t.giveUp(err, sink, fatal)
+			return
+		}
+
+		attempt++
+		if t.reconnect.MaxAttempts < 0 || attempt > t.reconnect.MaxAttempts {
+			t.giveUp(err, sink, fatal)
+			return
+		}
+		if attempt == 1 && t.instance.DowngradeError {
+			t.warn(sink, fmt.Sprintf("server group %q tail interrupted, reconnecting: %s", t.instance.Name, err))
+		}
+
+		backoff := min(t.reconnect.MinBackoff<<(attempt-1), t.reconnect.MaxBackoff)
+		span.AddEvent("reconnect_backoff", trace.WithAttributes(
+			attribute.Int("tail.reconnect_attempt", attempt),
+			attribute.String("tail.reconnect_backoff", backoff.String()),
+		))
+		level.Warn(t.logger).Log("msg", "Tail connection lost, reconnecting", "instance", t.instance.Name, "attempt", attempt, "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
 	}
+}
 
-	// Load CA certificate if provided
-	if instance.HTTPClientConfig.TLSConfig.CAFile != "" {
-		caCert, err := os.ReadFile(instance.HTTPClientConfig.TLSConfig.CAFile)
+// tailConn is an established tail of a server group.
+type tailConn interface {
+	// next returns the server group's next frame.
+	next(ctx context.Context) (tailFrame, error)
+	close()
+}
+
+// wsTailConn reads the frames of a server group's tail WebSocket.
+type wsTailConn struct {
+	conn *websocket.Conn
+	stop func() bool
+}
+
+func (c *wsTailConn) next(context.Context) (tailFrame, error) {
+	_, message, err := c.conn.ReadMessage()
+	if err != nil {
+		return tailFrame{}, err
+	}
+	var frame tailFrame
+	if err := json.Unmarshal(message, &frame); err != nil {
+		return tailFrame{}, fmt.Errorf("failed to decode tail message: %w", err)
+	}
+	return frame, nil
+}
+
+func (c *wsTailConn) close() {
+	c.stop()
+	c.conn.Close()
+}
+
+// connect starts tailing the server group, over WebSocket or by polling
+// depending on its tail mode.
+func (t *tailBackend) connect(ctx context.Context, span trace.Span) (tailConn, error) {
+	if t.instance.TailMode == cfg.TailModePoll {
+		conn, err := t.connectPoll(ctx, span)
 		if err != nil {
-			level.Error(logger).Log("msg", "Failed to load CA certificate", "file", instance.HTTPClientConfig.TLSConfig.CAFile, "err", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Failed to poll server group")
+			metrics.RequestFailures.Add(ctx, 1, t.metricAttrs())
+			level.Error(t.logger).Log("msg", "Failed to poll server group for tail", "instance", t.instance.Name, "err", err)
 			return nil, err
 		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		tlsConfig.RootCAs = caCertPool
+		return conn, nil
 	}
 
-	// Load client certificate for mutual TLS if provided
-	if instance.HTTPClientConfig.TLSConfig.CertFile != "" && instance.HTTPClientConfig.TLSConfig.KeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(instance.HTTPClientConfig.TLSConfig.CertFile, instance.HTTPClientConfig.TLSConfig.KeyFile)
+	target := t.target()
+	level.Info(t.logger).Log("msg", "Connecting to Loki WebSocket instance", "instance", t.instance.Name, "target", target)
+
+	// Record the request
+	metrics.RequestCount.Add(ctx, 1, t.metricAttrs())
+
+	// The dialer adds the server group's headers.
+	headers := http.Header{}
+	traces.InjectTraceToHTTPRequest(ctx, &http.Request{Header: headers})
+
+	backendConn, resp, err := t.dial.DialWebSocket(ctx, t.instance.Name, target, headers)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Failed to connect to Loki WebSocket")
+		// Record error count
+		metrics.RequestFailures.Add(ctx, 1, t.metricAttrs())
+		level.Error(t.logger).Log("msg", "Failed to connect to Loki WebSocket", "instance", t.instance.Name, "err", err)
+		if resp != nil {
+			span.SetAttributes(attribute.Int("upstream.handshake_status", resp.StatusCode))
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			level.Error(t.logger).Log("msg", "Handshake response", "status", resp.StatusCode, "body", string(body))
+			return nil, fmt.Errorf("handshake failed with status %d: %w", resp.StatusCode, err)
+		}
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Bool("upstream.connected", true),
+		attribute.Int("upstream.handshake_status", 101),
+	)
+	// The dialer picks one of the server group's endpoints.
+	if resp != nil && resp.Request != nil {
+		span.SetAttributes(attribute.String("upstream.target_url", resp.Request.URL.String()))
+	}
+	return &wsTailConn{
+		conn: backendConn,
+		stop: context.AfterFunc(ctx, func() { backendConn.Close() }),
+	}, nil
+}
+
+// consume queues the connection's frames until it fails. It reports
+// whether any frame was received.
+func (t *tailBackend) consume(ctx context.Context, conn tailConn, sink tailSink, span trace.Span) (bool, error) {
+	defer conn.close()
+
+	delivered := false
+	for {
+		frame, err := conn.next(ctx)
 		if err != nil {
-			level.Error(logger).Log("msg", "Failed to load client certificate and key", "certFile", instance.HTTPClientConfig.TLSConfig.CertFile, "keyFile", instance.HTTPClientConfig.TLSConfig.KeyFile, "err", err)
-			return nil, err
+			if ctx.Err() != nil {
+				return delivered, ctx.Err()
+			}
+			span.RecordError(err)
+			// Record error count
+			metrics.RequestFailures.Add(ctx, 1, t.metricAttrs())
+			level.Error(t.logger).Log("msg", "Error reading tail from server group", "instance", t.instance.Name, "err", err)
+			span.SetAttributes(attribute.Int("upstream.messages_received", t.messages))
+			return delivered, err
+		}
+
+		t.messages++
+		delivered = true
+
+		t.track(&frame)
+		if len(frame.Streams) == 0 && len(frame.DroppedEntries) == 0 {
+			continue
+		}
+		if dropped := sink.push(frame); dropped > 0 {
+			metrics.TailDroppedEntries.Add(ctx, int64(dropped))
+			level.Debug(t.logger).Log("msg", "Tail client too slow, dropped buffered entries", "dropped", dropped)
+		}
+
+		if t.messages%100 == 0 {
+			span.SetAttributes(attribute.Int("upstream.messages_received", t.messages))
+		}
+	}
+}
+
+// track records the newest entry timestamp for resuming, and drops entries
+// the upstream sends again after a reconnect.
+func (t *tailBackend) track(frame *tailFrame) {
+	streams := frame.Streams[:0]
+	for _, s := range frame.Streams {
+		labels := loghttp.LabelSet(s.Stream).String()
+		values := s.Values[:0]
+		for _, v := range s.Values {
+			ts, ok := tailEntryTimestamp(v)
+			if !ok {
+				values = append(values, v)
+				continue
+			}
+			key := labels + string(v[1])
+			if ts == t.resumeTs {
+				if _, seen := t.resumeSeen[key]; seen {
+					continue
+				}
+			}
+			switch {
+			case ts > t.lastTs:
+				t.lastTs = ts
+				t.lastSeen = map[string]struct{}{key: {}}
+			case ts == t.lastTs:
+				t.lastSeen[key] = struct{}{}
+			}
+			values = append(values, v)
+		}
+		if len(values) > 0 {
+			s.Values = values
+			streams = append(streams, s)
 		}
-		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
+	frame.Streams = streams
+}
 
-	dialer := &websocket.Dialer{
-		Proxy:            http.ProxyFromEnvironment,
-		HandshakeTimeout: instance.HTTPClientConfig.DialTimeout,
-		TLSClientConfig:  tlsConfig,
+// tailEntryTimestamp parses the nanosecond timestamp of a [ts, line, ...]
+// entry value.
+func tailEntryTimestamp(v []json.RawMessage) (int64, bool) {
+	if len(v) < 2 {
+		return 0, false
+	}
+	var ts string
+	if err := json.Unmarshal(v[0], &ts); err != nil {
+		return 0, false
 	}
+	n, err := strconv.ParseInt(ts, 10, 64)
+	return n, err == nil
+}
 
-	return dialer, nil
+// giveUp applies the server group's error policy once it can no longer be
+// tailed: required groups fail the tail, downgraded ones send a warning and
+// ignored ones are only logged.
+func (t *tailBackend) giveUp(err error, sink tailSink, fatal chan<- error) {
+	switch {
+	case t.required():
+		fatal <- fmt.Errorf("server group %q: %w", t.instance.Name, err)
+	case t.instance.DowngradeError:
+		level.Warn(t.logger).Log("msg", "Server group tail error downgraded to warning", "instance", t.instance.Name, "err", err)
+		t.warn(sink, fmt.Sprintf("server group %q tail stopped: %s", t.instance.Name, err))
+	default:
+		level.Debug(t.logger).Log("msg", "Server group tail error ignored", "instance", t.instance.Name, "err", err)
+	}
+}
+
+func (t *tailBackend) warn(sink tailSink, msg string) {
+	sink.push(tailFrame{Warnings: []string{msg}})
+}
+
+// tailClient is the client end of a tail. Its methods are only called from
+// the goroutine forwarding the tail's frames.
+type tailClient interface {
+	// send writes a frame to the client.
+	send(frame tailFrame) error
+	// ping keeps an idle connection alive.
+	ping() error
+	// end ends the tail with reason. code is the WebSocket close status
+	// for it.
+	end(code int, reason string)
+}
+
+// wsTailClient sends the tail over a WebSocket, as Loki does.
+type wsTailClient struct {
+	conn         *websocket.Conn
+	writeTimeout time.Duration
+}
+
+func (c *wsTailClient) send(frame tailFrame) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	return c.conn.WriteJSON(frame)
+}
+
+func (c *wsTailClient) ping() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.writeTimeout))
+}
+
+func (c *wsTailClient) end(code int, reason string) {
+	if len(reason) > maxCloseReasonLength {
+		reason = reason[:maxCloseReasonLength]
+	}
+	_ = c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(c.writeTimeout))
 }
 
 // Handle WebSocket connections for the Loki Tail API
-func HandleTailWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, config *cfg.Config, logger log.Logger) {
+func HandleTailWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, config *cfg.Config, dial TailDialer, sessions *TailSessions, logger log.Logger) {
 	ctx, span := traces.CreateSpan(ctx, "websocket_tail_handler")
 	defer span.End()
 
@@ -78,6 +462,17 @@ func HandleTailWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Req
 		attribute.Int("lokxy.server_groups", len(config.ServerGroups)),
 	)
 
+	if !requireParams(w, r) {
+		span.SetStatus(codes.Error, "Invalid request parameters")
+		return
+	}
+	release, ok := admitTail(w, r, config.Tail, sessions, logger)
+	if !ok {
+		span.SetStatus(codes.Error, "Tail refused")
+		return
+	}
+	defer release()
+
 	// Upgrade the HTTP connection to a WebSocket connection
 	clientConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -90,168 +485,95 @@ func HandleTailWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Req
 
 	span.SetAttributes(attribute.Bool("websocket.upgraded", true))
 
-	// Create a WaitGroup to handle multiple WebSocket connections
-	var wg sync.WaitGroup
-	mergedResponses := make(chan map[string]any)
-
-	var connectedBackend int
-	var backendMutex sync.Mutex
-
-	// Loop through each Loki instance and create WebSocket connections
-	for _, instance := range config.ServerGroups {
-		wg.Add(1)
-
-		go func(instance cfg.ServerGroup) {
-			defer wg.Done()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			upstreamCtx, backendSpan := traces.CreateSpan(ctx, "websocket_backend_connection")
-			defer backendSpan.End()
+	tail := tailSettings(config.Tail)
 
-			backendSpan.SetAttributes(
-				attribute.String("upstream.name", instance.Name),
-				attribute.String("upstream.base_url", instance.URL),
-			)
-
-			// Build the WebSocket target URL
-			targetURL := instance.URL
-			if after, ok := strings.CutPrefix(targetURL, "http://"); ok {
-				targetURL = "ws://" + after
-			} else if after, ok := strings.CutPrefix(targetURL, "https://"); ok {
-				targetURL = "wss://" + after
-			}
-
-			targetURL += r.URL.Path
-			if r.URL.RawQuery != "" {
-				targetURL += "?" + r.URL.RawQuery
-			}
-
-			backendSpan.SetAttributes(attribute.String("upstream.target_url", targetURL))
-			level.Info(logger).Log("msg", "Connecting to Loki WebSocket instance", "url", targetURL)
-
-			// Create WebSocket dialer with TLS config
-			dialer, err := createWebSocketDialer(instance, logger)
-			if err != nil {
-				backendSpan.RecordError(err)
-				backendSpan.SetStatus(codes.Error, "Failed to create WebSocket dialer")
-				metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
-					attribute.String("path", "/loki/api/v1/tail"),
-					attribute.String("method", "GET"),
-					attribute.String("server_group", instance.Name),
-				))
-				level.Error(logger).Log("msg", "Failed to create WebSocket dialer", "instance", instance.Name, "err", err)
+	// The client does not send data, but reading is needed to process its
+	// close frame and pongs. The tail, and with it every server group
+	// connection, ends when the client goes away or stops answering pings.
+	pongWait := 2 * tail.PingInterval
+	_ = clientConn.SetReadDeadline(time.Now().Add(pongWait))
+	clientConn.SetPongHandler(func(string) error {
+		return clientConn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := clientConn.NextReader(); err != nil {
+				level.Debug(logger).Log("msg", "Tail client went away", "err", err)
 				return
 			}
+		}
+	}()
 
-			// Record the request
-			metrics.RequestCount.Add(upstreamCtx, 1, metric.WithAttributes(
-				attribute.String("path", "/loki/api/v1/tail"),
-				attribute.String("method", "GET"),
-				attribute.String("server_group", instance.Name),
-			))
-
-			// Create WebSocket connection to Loki instance
-			headers := http.Header{}
-			for key, value := range instance.Headers {
-				headers.Set(key, value)
-			}
-
-			traces.InjectTraceToHTTPRequest(upstreamCtx, &http.Request{Header: headers})
-
-			backendConn, resp, err := dialer.Dial(targetURL, headers)
-			if err != nil {
-				backendSpan.RecordError(err)
-				backendSpan.SetStatus(codes.Error, "Failed to connect to Loki WebSocket")
-				// Record error count
-				metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
-					attribute.String("path", "/loki/api/v1/tail"),
-					attribute.String("method", "GET"),
-					attribute.String("server_group", instance.Name),
-				))
-				level.Error(logger).Log("msg", "Failed to connect to Loki WebSocket", "instance", instance.Name, "err", err)
-				if resp != nil {
-					backendSpan.SetAttributes(attribute.Int("upstream.handshake_status", resp.StatusCode))
-					// Record error count
-					metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
-						attribute.String("path", "/loki/api/v1/tail"),
-						attribute.String("method", "GET"),
-						attribute.String("server_group", instance.Name),
-					))
-					body, _ := io.ReadAll(resp.Body)
-					resp.Body.Close()
-					level.Error(logger).Log("msg", "Handshake response", "status", resp.StatusCode, "body", string(body))
-				}
-				return
-			}
-			defer backendConn.Close()
-
-			backendMutex.Lock()
-			connectedBackend++
-			backendMutex.Unlock()
-
-			backendSpan.SetAttributes(
-				attribute.Bool("upstream.connected", true),
-				attribute.Int("upstream.handshake_status", 101),
-			)
-
-			messageCount := 0
-
-			// Listen for messages from Loki instance WebSocket
-			for {
-				_, message, err := backendConn.ReadMessage()
-				if err != nil {
-					backendSpan.RecordError(err)
-					backendSpan.SetStatus(codes.Error, "Error reading WebSocket message")
-					metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
-						attribute.String("path", "/loki/api/v1/tail"),
-						attribute.String("method", "GET"),
-						attribute.String("server_group", instance.Name),
-					))
-					level.Error(logger).Log("msg", "Error reading WebSocket message", "instance", instance.Name, "err", err)
-
-					backendSpan.SetAttributes(attribute.Int("upstream.messages_received", messageCount))
-					return
-				}
+	client := &wsTailClient{conn: clientConn, writeTimeout: tail.WriteTimeout}
+	runTail(ctx, span, r, config, dial, tail, client, logger)
 
-				messageCount++
-
-				// Parse and forward the message to the merged response channel
-				var result map[string]any
-				if err := json.Unmarshal(message, &result); err != nil {
-					backendSpan.RecordError(err)
-					// Record error count
-					metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
-						attribute.String("path", "/loki/api/v1/tail"),
-						attribute.String("method", "GET"),
-						attribute.String("server_group", instance.Name),
-					))
-					level.Error(logger).Log("msg", "Failed to decode WebSocket message", "instance", instance.Name, "err", err)
-					backendSpan.SetAttributes(attribute.Int("upstream.messages_received", messageCount))
-					return
-				}
+	span.SetAttributes(attribute.Bool("websocket.completed", true))
+}
 
-				mergedResponses <- result
+// runTail tails every server group and forwards their entries to client
+// until the client goes away, ctx is done or a required group fails.
+func runTail(ctx context.Context, span trace.Span, r *http.Request, config *cfg.Config, dial TailDialer, tail cfg.TailConfig, client tailClient, logger log.Logger) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	q := newTailQueue(tail.BufferSize, tail.SlowConsumerPolicy == cfg.TailDropOldest)
+	fatal := make(chan error, len(config.ServerGroups))
+
+	var sink tailSink = q
+	var reorder *tailReorder
+	if tail.ReorderWindow > 0 {
+		reorder = newTailReorder(tail.ReorderWindow, tail.BufferSize, q)
+		sink = reorder
+		go reorder.run(ctx)
+	}
+	// releaseHeld sends the entries still held for reordering, before the
+	// tail ends.
+	releaseHeld := func() {
+		if reorder != nil {
+			reorder.release(ctx, time.Now(), true)
+		}
+	}
 
-				if messageCount%100 == 0 {
-					backendSpan.SetAttributes(attribute.Int("upstream.messages_received", messageCount))
-				}
-			}
-		}(instance)
+	var wg sync.WaitGroup
+	for _, instance := range config.ServerGroups {
+		backend := newTailBackend(instance, dial, r, tail.Reconnect, logger)
+		wg.Go(func() {
+			backend.run(ctx, sink, fatal)
+		})
 	}
+	backendsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(backendsDone)
+	}()
 
-	_, forwardSpan := traces.CreateSpan(ctx, "websocket_client_forward")
+	_, forwardSpan := traces.CreateSpan(ctx, "tail_client_forward")
+	defer forwardSpan.End()
 	forwardedMessages := 0
 
-	// Goroutine to forward merged responses to the client WebSocket
-	go func() {
-		defer forwardSpan.End()
-
-		for response := range mergedResponses {
-			if err := clientConn.WriteJSON(response); err != nil {
+	// flush writes the queued frames to the client. It returns false when
+	// the tail must end.
+	flush := func() bool {
+		if q.overflow() {
+			forwardSpan.SetStatus(codes.Error, "Slow tail client disconnected")
+			level.Warn(logger).Log("msg", "Disconnecting slow tail client, buffer full", "buffer_size", tail.BufferSize)
+			client.end(websocket.CloseTryAgainLater, "client too slow, tail buffer full")
+			return false
+		}
+		for {
+			frame, ok := q.pop()
+			if !ok {
+				return true
+			}
+			if err := client.send(frame); err != nil {
 				forwardSpan.RecordError(err)
-				forwardSpan.SetStatus(codes.Error, "Error writing to client WebSocket")
-				level.Error(logger).Log("msg", "Error writing to client WebSocket", "err", err)
-				forwardSpan.SetAttributes(attribute.Int("client.messages_forwarded", forwardedMessages))
-				return
+				forwardSpan.SetStatus(codes.Error, "Error writing to tail client")
+				level.Error(logger).Log("msg", "Error writing to tail client", "err", err)
+				return false
 			}
 			forwardedMessages++
 
@@ -260,21 +582,89 @@ func HandleTailWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Req
 				forwardSpan.SetAttributes(attribute.Int("client.messages_forwarded", forwardedMessages))
 			}
 		}
+	}
 
-		forwardSpan.SetAttributes(
-			attribute.Int("client.messages_forwarded", forwardedMessages),
-			attribute.Bool("client.forwarding_complete", true),
-		)
-	}()
+	// failTail ends the tail because a required server group failed, with
+	// the reason, as a query would fail with it.
+	failTail := func(err error) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Required server group failed")
+		level.Error(logger).Log("msg", "Ending tail, required server group failed", "err", err)
+		releaseHeld()
+		flush()
+		client.end(websocket.CloseInternalServerErr, err.Error())
+	}
 
-	// Wait for all goroutines to finish
-	wg.Wait()
-	close(mergedResponses)
+	ping := time.NewTicker(tail.PingInterval)
+	defer ping.Stop()
 
-	backendMutex.Lock()
-	span.SetAttributes(
-		attribute.Int("websocket.connected_upstreams", connectedBackend),
-		attribute.Bool("websocket.completed", true),
+	var expired <-chan time.Time
+	if tail.MaxDuration > 0 {
+		timer := time.NewTimer(tail.MaxDuration)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+forward:
+	for {
+		select {
+		case <-q.ready:
+			if !flush() {
+				break forward
+			}
+		case <-ping.C:
+			if err := client.ping(); err != nil {
+				level.Debug(logger).Log("msg", "Failed to ping tail client", "err", err)
+				break forward
+			}
+		case err := <-fatal:
+			failTail(err)
+			break forward
+		case <-backendsDone:
+			// The last server group may have ended by failing the tail.
+			select {
+			case err := <-fatal:
+				failTail(err)
+			default:
+				releaseHeld()
+				flush()
+			}
+			break forward
+		case <-expired:
+			level.Info(logger).Log("msg", "Ending tail, maximum duration reached", "max_duration", tail.MaxDuration)
+			releaseHeld()
+			flush()
+			client.end(websocket.CloseNormalClosure, "maximum tail duration reached")
+			break forward
+		case <-ctx.Done():
+			break forward
+		}
+	}
+
+	// Stop the remaining server groups and wait for them to finish.
+	cancel()
+	<-backendsDone
+
+	forwardSpan.SetAttributes(
+		attribute.Int("client.messages_forwarded", forwardedMessages),
+		attribute.Bool("client.forwarding_complete", true),
 	)
-	backendMutex.Unlock()
+}
+
+// tailSettings fills in the defaults of the tail buffering and keepalive
+// settings.
+func tailSettings(tail cfg.TailConfig) cfg.TailConfig {
+	if tail.BufferSize == 0 {
+		tail.BufferSize = defaultTailBufferSize
+	}
+	if tail.SlowConsumerPolicy == "" {
+		tail.SlowConsumerPolicy = cfg.TailDropOldest
+	}
+	if tail.WriteTimeout == 0 {
+		tail.WriteTimeout = defaultTailWriteTimeout
+	}
+	if tail.PingInterval == 0 {
+		tail.PingInterval = defaultTailPingInterval
+	}
+	return tail
 }
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// TailSessions counts the open tails per client, to enforce
+// tail.max_concurrent_per_client; the overall limit is load_shedding's
+// max_inflight_tails. It is shared by all tail routes and outlives
+// configuration reloads; the limits are read from the configuration each
+// tail starts with.
+type TailSessions struct {
+	mu        sync.Mutex
+	perClient map[string]int
+}
+
+// NewTailSessions returns a TailSessions with no open tails.
+func NewTailSessions() *TailSessions {
+	return &TailSessions{perClient: map[string]int{}}
+}
+
+// acquire registers a tail of client. It returns false when the client's
+// limit is reached; otherwise release must be called once the tail ends.
+func (s *TailSessions) acquire(client string, tail cfg.TailConfig) (release func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tail.MaxConcurrentPerClient > 0 && s.perClient[client] >= tail.MaxConcurrentPerClient {
+		return nil, false
+	}
+	s.perClient[client]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.perClient[client]--; s.perClient[client] == 0 {
+				delete(s.perClient, client)
+			}
+		})
+	}, true
+}
+
+// admitTail applies the tail access controls before the WebSocket upgrade
+// or the stream starts: the origin, the client's credentials and the
+// concurrency limits, in that order. When the tail is refused the response
+// has been written. Otherwise release must be called once the tail ends.
+func admitTail(w http.ResponseWriter, r *http.Request, tail cfg.TailConfig, sessions *TailSessions, logger log.Logger) (release func(), ok bool) {
+	reject := func(reason string, status int, msg string) (func(), bool) {
+		metrics.TailRejected.Add(r.Context(), 1, metric.WithAttributes(attribute.String("reason", reason)))
+		level.Warn(logger).Log("msg", "Tail refused", "reason", reason, "remote_addr", r.RemoteAddr, "origin", r.Header.Get("Origin"))
+		http.Error(w, msg, status)
+		return nil, false
+	}
+
+	if !checkTailOrigin(r, tail.AllowedOrigins) {
+		return reject("origin", http.StatusForbidden, "origin not allowed")
+	}
+
+	client, ok := authenticateTail(r, tail.Auth)
+	if !ok {
+		if len(tail.Auth.BasicAuth) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="lokxy"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lokxy"`)
+		}
+		return reject("auth", http.StatusUnauthorized, "unauthorized")
+	}
+
+	release, ok = sessions.acquire(client, tail)
+	if !ok {
+		return reject("limit", http.StatusTooManyRequests, "too many concurrent tails")
+	}
+	return release, true
+}
+
+// checkTailOrigin reports whether a tail may be opened from the request's
+// origin. Without an allowlist every origin is allowed. Otherwise requests
+// without an Origin header, which do not come from browsers, are allowed,
+// and others must be listed in allowed, where "*" allows any origin.
+func checkTailOrigin(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateTail checks the request's credentials and returns the name
+// of the client. Without configured credentials every client is accepted
+// and identified by its IP address.
+func authenticateTail(r *http.Request, auth cfg.TailAuthConfig) (string, bool) {
+	if !auth.Enabled() {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr, true
+		}
+		return host, true
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		want, known := auth.BasicAuth[user]
+		if known && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1 {
+			return user, true
+		}
+		return "", false
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for name, want := range auth.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1 {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
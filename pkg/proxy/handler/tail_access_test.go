@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+func TestCheckTailOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"no origin", "", nil, true},
+		{"same origin", "http://lokxy.example.com", nil, true},
+		{"cross origin allowed by default", "https://grafana.example.com", nil, true},
+		{"listed origin", "https://grafana.example.com", []string{"https://grafana.example.com/"}, true},
+		{"unlisted origin", "https://evil.example.com", []string{"https://grafana.example.com"}, false},
+		{"any origin", "https://evil.example.com", []string{"*"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://lokxy.example.com/loki/api/v1/tail", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			require.Equal(t, tt.want, checkTailOrigin(req, tt.allowed))
+		})
+	}
+}
+
+func TestAuthenticateTail(t *testing.T) {
+	auth := cfg.TailAuthConfig{
+		BearerTokens: map[string]string{"grafana": "token"},
+		BasicAuth:    map[string]string{"alice": "secret"},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/tail", nil)
+	client, ok := authenticateTail(req, cfg.TailAuthConfig{})
+	require.True(t, ok)
+	require.Equal(t, "192.0.2.1", client)
+
+	_, ok = authenticateTail(req, auth)
+	require.False(t, ok)
+
+	req.Header.Set("Authorization", "Bearer token")
+	client, ok = authenticateTail(req, auth)
+	require.True(t, ok)
+	require.Equal(t, "grafana", client)
+
+	req.Header.Set("Authorization", "Bearer wrong")
+	_, ok = authenticateTail(req, auth)
+	require.False(t, ok)
+
+	req.SetBasicAuth("alice", "secret")
+	client, ok = authenticateTail(req, auth)
+	require.True(t, ok)
+	require.Equal(t, "alice", client)
+
+	req.SetBasicAuth("alice", "wrong")
+	_, ok = authenticateTail(req, auth)
+	require.False(t, ok)
+}
+
+func TestTailSessions_Limits(t *testing.T) {
+	s := NewTailSessions()
+	tail := cfg.TailConfig{MaxConcurrentPerClient: 1}
+
+	releaseA, ok := s.acquire("a", tail)
+	require.True(t, ok)
+	_, ok = s.acquire("a", tail)
+	require.False(t, ok, "per client limit")
+
+	releaseB, ok := s.acquire("b", tail)
+	require.True(t, ok)
+
+	releaseA()
+	releaseA()
+	_, ok = s.acquire("a", tail)
+	require.True(t, ok)
+	releaseB()
+	require.Equal(t, map[string]int{"a": 1}, s.perClient)
+}
+
+func TestHandleTailWebSocket_AccessControls(t *testing.T) {
+	backend := mkTailBackend(t, func(_ *websocket.Conn, _ *http.Request, _ int) {
+		time.Sleep(2 * time.Second)
+	})
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL}},
+		Tail: cfg.TailConfig{
+			AllowedOrigins:         []string{"https://grafana.example.com"},
+			Auth:                   cfg.TailAuthConfig{BearerTokens: map[string]string{"grafana": "token"}},
+			MaxConcurrentPerClient: 1,
+		},
+	}
+	sessions := NewTailSessions()
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleTailWebSocket(r.Context(), w, r, config, directTailDialer{config}, sessions, log.NewNopLogger())
+	}))
+	t.Cleanup(proxyServer.Close)
+	tailURL := "ws" + strings.TrimPrefix(proxyServer.URL, "http") + "/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D"
+
+	dial := func(origin, token string) (*websocket.Conn, int) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(tailURL, header)
+		if err != nil {
+			require.NotNil(t, resp, err)
+			return nil, resp.StatusCode
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn, resp.StatusCode
+	}
+
+	_, status := dial("https://evil.example.com", "token")
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = dial("", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+	_, status = dial("", "wrong")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	conn, status := dial("https://grafana.example.com", "token")
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+	_, status = dial("", "token")
+	require.Equal(t, http.StatusTooManyRequests, status)
+
+	// The slot is freed once the tail ends.
+	conn.Close()
+	require.Eventually(t, func() bool {
+		sessions.mu.Lock()
+		defer sessions.mu.Unlock()
+		return len(sessions.perClient) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	_, status = dial("", "token")
+	require.Equal(t, http.StatusSwitchingProtocols, status)
+}
+
+func TestHandleTailWebSocket_MaxDuration(t *testing.T) {
+	backend := mkTailBackend(t, func(_ *websocket.Conn, _ *http.Request, _ int) {
+		time.Sleep(2 * time.Second)
+	})
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL}},
+		Tail:         cfg.TailConfig{MaxDuration: 100 * time.Millisecond},
+	}
+	client := dialTail(t, config)
+
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseNormalClosure, closeErr.Code)
+	require.Equal(t, "maximum tail duration reached", closeErr.Text)
+}
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/loki/v3/pkg/loghttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+	traces "github.com/paulojmdias/lokxy/pkg/o11y/tracing"
+)
+
+const (
+	defaultTailPollInterval = time.Second
+
+	// maxTailPageLimit is the most a polled tail raises its query limit to
+	// when a full page of entries all share one timestamp. It is Loki's
+	// default max_entries_limit_per_query.
+	maxTailPageLimit = 5000
+)
+
+// pollTailConn emulates a tail of a server group that cannot be reached over
+// WebSocket, by querying query_range every interval from the newest entry
+// received on. Like Loki's own tail, it starts with the latest limit entries
+// since start rather than replaying all of them. The entries at that timestamp are returned again by the next
+// query and dropped by the backend, as after a reconnect.
+type pollTailConn struct {
+	t        *tailBackend
+	interval time.Duration
+	limit    int
+	delayFor time.Duration
+	start    int64
+
+	// pending is the result of the first query, made when connecting.
+	pending *tailFrame
+	// full is true when the last query hit the limit, so more entries may
+	// be waiting and the next query is made right away.
+	full bool
+	// pageLimit is the limit of the next query. It is raised while full
+	// pages do not get past their start timestamp, since the same query
+	// would return the same page again.
+	pageLimit int
+	// skipTs is a start timestamp that even maxTailPageLimit entries did
+	// not get past; the next query starts just after it.
+	skipTs int64
+}
+
+// connectPoll makes the first query of a polled tail, so that a server
+// group that cannot be queried fails like one that cannot be dialed. The
+// tail parameters are parsed as Loki parses them for its own tail endpoint.
+func (t *tailBackend) connectPoll(ctx context.Context, span trace.Span) (tailConn, error) {
+	req, err := loghttp.ParseTailQuery(&http.Request{Form: t.params})
+	if err != nil {
+		return nil, fmt.Errorf("invalid tail request: %w", err)
+	}
+	c := &pollTailConn{
+		t:         t,
+		interval:  t.instance.TailPollInterval,
+		limit:     int(req.Limit),
+		delayFor:  time.Duration(req.DelayFor) * time.Second,
+		start:     req.Start.UnixNano(),
+		pageLimit: int(req.Limit),
+	}
+	if c.interval == 0 {
+		c.interval = defaultTailPollInterval
+	}
+	span.SetAttributes(
+		attribute.String("upstream.tail_mode", "poll"),
+		attribute.String("upstream.tail_poll_interval", c.interval.String()),
+	)
+	level.Info(t.logger).Log("msg", "Tailing Loki instance by polling query_range", "instance", t.instance.Name, "interval", c.interval)
+
+	// A reconnect resumes from the newest entry received.
+	var frame tailFrame
+	if t.lastTs > 0 {
+		frame, err = c.query(ctx)
+	} else {
+		frame, err = c.queryLatest(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.pending = &frame
+	return c, nil
+}
+
+func (c *pollTailConn) next(ctx context.Context) (tailFrame, error) {
+	if c.pending != nil {
+		frame := *c.pending
+		c.pending = nil
+		return frame, nil
+	}
+	if !c.full {
+		select {
+		case <-time.After(c.interval):
+		case <-ctx.Done():
+			return tailFrame{}, ctx.Err()
+		}
+	}
+	return c.query(ctx)
+}
+
+func (c *pollTailConn) close() {}
+
+// queryLatest fetches the latest limit entries since start, oldest first.
+// Polling then goes on from the newest of them, or from the end of the
+// query when there were none.
+func (c *pollTailConn) queryLatest(ctx context.Context) (tailFrame, error) {
+	end := time.Now().Add(-c.delayFor).UnixNano()
+	if end <= c.start {
+		return tailFrame{}, nil
+	}
+
+	streams, err := c.fetch(ctx, c.start, end, c.limit, "backward")
+	if err != nil {
+		return tailFrame{}, err
+	}
+	entries := 0
+	for _, s := range streams {
+		slices.Reverse(s.Values)
+		entries += len(s.Values)
+	}
+	if entries == 0 {
+		c.start = end
+	}
+	return tailFrame{Streams: streams}, nil
+}
+
+// query fetches the entries since the newest one received.
+func (c *pollTailConn) query(ctx context.Context) (tailFrame, error) {
+	t := c.t
+	start := c.start
+	if t.lastTs > 0 {
+		start = t.lastTs
+	}
+	if start == c.skipTs {
+		start++
+	}
+	// The query includes start, so entries already received at it are
+	// dropped again.
+	t.resumeTs, t.resumeSeen = t.lastTs, t.lastSeen
+
+	end := time.Now().Add(-c.delayFor).UnixNano()
+	if end <= start {
+		c.full = false
+		return tailFrame{}, nil
+	}
+
+	streams, err := c.fetch(ctx, start, end, c.pageLimit, "forward")
+	if err != nil {
+		return tailFrame{}, err
+	}
+
+	// A query that hit the limit is repeated right away. If all its
+	// entries share the start timestamp the same query would return them
+	// again, so the limit is raised, and once at maxTailPageLimit the
+	// remaining entries at that timestamp are skipped.
+	entries := 0
+	newest := start
+	for _, s := range streams {
+		entries += len(s.Values)
+		for _, v := range s.Values {
+			if ts, ok := tailEntryTimestamp(v); ok {
+				newest = max(newest, ts)
+			}
+		}
+	}
+	c.full = entries >= c.pageLimit
+	switch {
+	case !c.full || newest > start:
+		c.pageLimit = c.limit
+	case c.pageLimit < maxTailPageLimit:
+		c.pageLimit = min(c.pageLimit*2, maxTailPageLimit)
+	default:
+		level.Warn(t.logger).Log("msg", "Skipping tail entries sharing one timestamp over the query limit", "instance", t.instance.Name, "ts", start, "limit", c.pageLimit)
+		c.skipTs = start
+		c.pageLimit = c.limit
+	}
+
+	return tailFrame{Streams: streams}, nil
+}
+
+// fetch runs a query_range of the tail's query on the server group.
+func (c *pollTailConn) fetch(ctx context.Context, start, end int64, limit int, direction string) ([]tailStream, error) {
+	t := c.t
+	params := url.Values{}
+	params.Set("query", t.params.Get("query"))
+	params.Set("start", strconv.FormatInt(start, 10))
+	params.Set("end", strconv.FormatInt(end, 10))
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("direction", direction)
+	path := "/loki/api/v1/query_range?" + params.Encode()
+
+	metrics.RequestCount.Add(ctx, 1, t.metricAttrs())
+
+	// The dialer adds the server group's headers.
+	headers := http.Header{}
+	headers.Set("Accept", "application/json")
+	traces.InjectTraceToHTTPRequest(ctx, &http.Request{Header: headers})
+
+	resp, err := t.dial.Get(ctx, t.instance.Name, path, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("query_range failed with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Data struct {
+			ResultType string       `json:"resultType"`
+			Result     []tailStream `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode query_range response: %w", err)
+	}
+	if result.Data.ResultType != "streams" {
+		return nil, fmt.Errorf("query_range returned %q instead of streams", result.Data.ResultType)
+	}
+	return result.Data.Result, nil
+}
@@ -0,0 +1,256 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// mkQueryRangeBackend starts a query_range stand-in. respond is called for
+// every request with its 1-based sequence number and returns the entries of
+// the app="a" stream, oldest first; like Loki, the stand-in sends them newest
+// first to backward queries.
+func mkQueryRangeBackend(t *testing.T, respond func(q url.Values, n int) [][2]string) (*httptest.Server, func() []url.Values) {
+	t.Helper()
+	var mu sync.Mutex
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/query_range" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		n := len(queries)
+		mu.Unlock()
+
+		entries := respond(r.URL.Query(), n)
+		if r.URL.Query().Get("direction") == "backward" {
+			slices.Reverse(entries)
+		}
+		values := make([][]string, len(entries))
+		for i, e := range entries {
+			values[i] = []string{e[0], e[1]}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status": "success",
+			"data": map[string]any{
+				"resultType": "streams",
+				"result":     []map[string]any{{"stream": map[string]string{"app": "a"}, "values": values}},
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []url.Values {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]url.Values(nil), queries...)
+	}
+}
+
+func TestHandleTailWebSocket_PollMode(t *testing.T) {
+	backend, queries := mkQueryRangeBackend(t, func(_ url.Values, n int) [][2]string {
+		switch n {
+		case 1:
+			return [][2]string{{"100", "a"}, {"200", "b"}}
+		case 2:
+			// The window boundary is queried again.
+			return [][2]string{{"200", "b"}, {"300", "c"}}
+		}
+		return nil
+	})
+
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{
+			Name:             "loki1",
+			URL:              backend.URL,
+			TailMode:         cfg.TailModePoll,
+			TailPollInterval: 10 * time.Millisecond,
+		}},
+	}
+	client := dialTail(t, config)
+
+	var lines []string
+	for len(lines) < 3 {
+		var frame tailFrame
+		require.NoError(t, client.ReadJSON(&frame))
+		lines = append(lines, frameLines(t, frame)["a"]...)
+	}
+	require.Equal(t, []string{"a", "b", "c"}, lines)
+
+	got := queries()
+	require.GreaterOrEqual(t, len(got), 2)
+	require.Equal(t, `{app="a"}`, got[0].Get("query"))
+	require.Equal(t, "backward", got[0].Get("direction"))
+	require.Equal(t, "100", got[0].Get("limit"))
+	require.Equal(t, "forward", got[1].Get("direction"))
+	require.Equal(t, "200", got[1].Get("start"))
+}
+
+func TestHandleTailWebSocket_PollModeStartsWithLatestEntries(t *testing.T) {
+	start := time.Now().Add(-10 * time.Minute).UTC().Truncate(time.Second)
+	backend, queries := mkQueryRangeBackend(t, func(q url.Values, _ int) [][2]string {
+		if q.Get("direction") == "backward" {
+			// The latest two of the entries since start.
+			return [][2]string{{"200", "b"}, {"300", "c"}}
+		}
+		return [][2]string{{"300", "c"}, {"400", "d"}}
+	})
+
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{
+			Name:             "loki1",
+			URL:              backend.URL,
+			TailMode:         cfg.TailModePoll,
+			TailPollInterval: 10 * time.Millisecond,
+		}},
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleTailWebSocket(r.Context(), w, r, config, directTailDialer{config}, NewTailSessions(), log.NewNopLogger())
+	}))
+	t.Cleanup(proxyServer.Close)
+	query := url.Values{"query": {`{app="a"}`}, "limit": {"2"}, "start": {start.Format(time.RFC3339)}}
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxyServer.URL, "http")+"/loki/api/v1/tail?"+query.Encode(), nil)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var lines []string
+	for len(lines) < 3 {
+		var frame tailFrame
+		require.NoError(t, client.ReadJSON(&frame))
+		lines = append(lines, frameLines(t, frame)["a"]...)
+	}
+	require.Equal(t, []string{"b", "c", "d"}, lines)
+
+	got := queries()
+	require.Equal(t, "backward", got[0].Get("direction"))
+	require.Equal(t, "2", got[0].Get("limit"))
+	require.Equal(t, strconv.FormatInt(start.UnixNano(), 10), got[0].Get("start"))
+	require.Equal(t, "forward", got[1].Get("direction"))
+	require.Equal(t, "300", got[1].Get("start"))
+}
+
+func TestHandleTailWebSocket_PollModeRepeatsFullQuery(t *testing.T) {
+	backend, queries := mkQueryRangeBackend(t, func(q url.Values, _ int) [][2]string {
+		switch {
+		case q.Get("direction") == "backward":
+			return [][2]string{{"100", "a"}, {"200", "b"}}
+		case q.Get("start") == "200":
+			return [][2]string{{"200", "b"}, {"300", "c"}}
+		case q.Get("start") == "300":
+			return [][2]string{{"300", "c"}, {"400", "d"}}
+		}
+		return nil
+	})
+
+	const interval = 500 * time.Millisecond
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{
+			Name:             "loki1",
+			URL:              backend.URL,
+			TailMode:         cfg.TailModePoll,
+			TailPollInterval: interval,
+		}},
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleTailWebSocket(r.Context(), w, r, config, directTailDialer{config}, NewTailSessions(), log.NewNopLogger())
+	}))
+	t.Cleanup(proxyServer.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxyServer.URL, "http")+"/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D&start=1&limit=2", nil)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	// The first poll hit the limit, so the next one is made without
+	// waiting for the poll interval again.
+	began := time.Now()
+	var lines []string
+	for len(lines) < 4 {
+		var frame tailFrame
+		require.NoError(t, client.ReadJSON(&frame))
+		lines = append(lines, frameLines(t, frame)["a"]...)
+	}
+	require.Equal(t, []string{"a", "b", "c", "d"}, lines)
+	require.Less(t, time.Since(began), 2*interval)
+	require.Equal(t, "2", queries()[1].Get("limit"))
+}
+
+func TestHandleTailWebSocket_PollModeFullPageAtOneTimestamp(t *testing.T) {
+	// More entries share timestamp 200 than fit in a page of the
+	// requested limit.
+	backend, queries := mkQueryRangeBackend(t, func(q url.Values, _ int) [][2]string {
+		if q.Get("direction") == "backward" {
+			return [][2]string{{"100", "a"}, {"200", "b"}}
+		}
+		if q.Get("start") != "200" {
+			return nil
+		}
+		if q.Get("limit") == "2" {
+			return [][2]string{{"200", "b"}, {"200", "c"}}
+		}
+		return [][2]string{{"200", "b"}, {"200", "c"}, {"200", "d"}, {"300", "e"}}
+	})
+
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{
+			Name:             "loki1",
+			URL:              backend.URL,
+			TailMode:         cfg.TailModePoll,
+			TailPollInterval: 10 * time.Millisecond,
+		}},
+	}
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleTailWebSocket(r.Context(), w, r, config, directTailDialer{config}, NewTailSessions(), log.NewNopLogger())
+	}))
+	t.Cleanup(proxyServer.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxyServer.URL, "http")+"/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D&start=1&limit=2", nil)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	// The page that does not get past 200 is queried again with a higher
+	// limit instead of waiting for the poll interval.
+	var lines []string
+	for len(lines) < 5 {
+		var frame tailFrame
+		require.NoError(t, client.ReadJSON(&frame))
+		lines = append(lines, frameLines(t, frame)["a"]...)
+	}
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, lines)
+	got := queries()
+	require.Equal(t, "4", got[2].Get("limit"))
+	require.Equal(t, "200", got[2].Get("start"))
+}
+
+func TestHandleTailWebSocket_PollModeRequiredGroupFails(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "upgrade required elsewhere", http.StatusBadGateway)
+	}))
+	t.Cleanup(backend.Close)
+
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL, TailMode: cfg.TailModePoll}},
+	}
+	client := dialTail(t, config)
+
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseInternalServerErr, closeErr.Code)
+	require.Contains(t, closeErr.Text, "status 502")
+}
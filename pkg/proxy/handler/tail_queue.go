@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"strconv"
+	"sync"
+)
+
+// tailDroppedEntry is an entry of Loki's dropped_entries tail field.
+type tailDroppedEntry struct {
+	Timestamp string            `json:"timestamp"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// tailQueue buffers a tail's frames between the server group readers and
+// the client writer, so a slow client never blocks the readers. It holds at
+// most limit entries. When full it either drops the oldest frames, reporting
+// their entries in the dropped_entries of the next frame sent, or marks the
+// tail as overflowed so the writer disconnects the client.
+type tailQueue struct {
+	mu         sync.Mutex
+	frames     []tailFrame
+	entries    int
+	limit      int
+	dropOldest bool
+	overflowed bool
+
+	// dropped and warnings are carried over to the next frame sent.
+	dropped  []tailDroppedEntry
+	warnings []string
+
+	// ready is signalled when frames are pushed.
+	ready chan struct{}
+}
+
+func newTailQueue(limit int, dropOldest bool) *tailQueue {
+	return &tailQueue{
+		limit:      limit,
+		dropOldest: dropOldest,
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+// push adds a frame without blocking. It returns the number of entries
+// dropped to make room for it.
+func (q *tailQueue) push(frame tailFrame) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.overflowed {
+		return 0
+	}
+
+	n := frame.entryCount()
+	dropped := 0
+	if q.entries+n > q.limit && len(q.frames) > 0 {
+		if !q.dropOldest {
+			q.overflowed = true
+			q.frames, q.entries = nil, 0
+			q.signal()
+			return 0
+		}
+		for len(q.frames) > 0 && q.entries+n > q.limit {
+			oldest := q.frames[0]
+			q.frames[0] = tailFrame{}
+			q.frames = q.frames[1:]
+			q.entries -= oldest.entryCount()
+			dropped += oldest.entryCount()
+			q.dropped = append(q.dropped, oldest.droppedEntries()...)
+			q.dropped = append(q.dropped, oldest.DroppedEntries...)
+			q.warnings = append(q.warnings, oldest.Warnings...)
+		}
+		// The report itself is bounded too; only the latest drops are kept.
+		if len(q.dropped) > q.limit {
+			q.dropped = q.dropped[len(q.dropped)-q.limit:]
+		}
+	}
+
+	q.frames = append(q.frames, frame)
+	q.entries += n
+	q.signal()
+	return dropped
+}
+
+func (q *tailQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest frame, with any dropped entries and warnings
+// carried over from frames dropped before it. It returns false when the
+// queue is empty.
+func (q *tailQueue) pop() (tailFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) == 0 {
+		return tailFrame{}, false
+	}
+	frame := q.frames[0]
+	q.frames[0] = tailFrame{}
+	q.frames = q.frames[1:]
+	q.entries -= frame.entryCount()
+
+	if len(q.dropped) > 0 {
+		frame.DroppedEntries = append(q.dropped, frame.DroppedEntries...)
+		q.dropped = nil
+	}
+	if len(q.warnings) > 0 {
+		frame.Warnings = append(q.warnings, frame.Warnings...)
+		q.warnings = nil
+	}
+	return frame, true
+}
+
+// overflow reports whether the buffer filled up under the disconnect
+// policy.
+func (q *tailQueue) overflow() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.overflowed
+}
+
+func (f tailFrame) entryCount() int {
+	n := 0
+	for _, s := range f.Streams {
+		n += len(s.Values)
+	}
+	return n
+}
+
+// droppedEntries describes the frame's entries for dropped_entries.
+func (f tailFrame) droppedEntries() []tailDroppedEntry {
+	var dropped []tailDroppedEntry
+	for _, s := range f.Streams {
+		for _, v := range s.Values {
+			ts, _ := tailEntryTimestamp(v)
+			dropped = append(dropped, tailDroppedEntry{Timestamp: strconv.FormatInt(ts, 10), Labels: s.Stream})
+		}
+	}
+	return dropped
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mkTailFrame(app string, timestamps ...int64) tailFrame {
+	values := make([][]json.RawMessage, len(timestamps))
+	for i, ts := range timestamps {
+		values[i] = []json.RawMessage{
+			json.RawMessage(strconv.Quote(strconv.FormatInt(ts, 10))),
+			json.RawMessage(`"line"`),
+		}
+	}
+	return tailFrame{Streams: []tailStream{{Stream: map[string]string{"app": app}, Values: values}}}
+}
+
+func TestTailQueue_DropOldest(t *testing.T) {
+	q := newTailQueue(3, true)
+
+	require.Zero(t, q.push(mkTailFrame("a", 1, 2)))
+	require.Zero(t, q.push(tailFrame{Warnings: []string{"server group down"}}))
+	// Making room for two more entries drops the oldest frame.
+	require.Equal(t, 2, q.push(mkTailFrame("b", 3, 4)))
+	require.False(t, q.overflow())
+
+	frame, ok := q.pop()
+	require.True(t, ok)
+	require.Equal(t, []tailDroppedEntry{
+		{Timestamp: "1", Labels: map[string]string{"app": "a"}},
+		{Timestamp: "2", Labels: map[string]string{"app": "a"}},
+	}, frame.DroppedEntries)
+	require.Equal(t, []string{"server group down"}, frame.Warnings)
+	require.Empty(t, frame.Streams)
+
+	frame, ok = q.pop()
+	require.True(t, ok)
+	require.Equal(t, 2, frame.entryCount())
+	require.Empty(t, frame.DroppedEntries)
+
+	_, ok = q.pop()
+	require.False(t, ok)
+}
+
+func TestTailQueue_DroppedFrameWarningsKept(t *testing.T) {
+	q := newTailQueue(1, true)
+
+	q.push(tailFrame{Streams: mkTailFrame("a", 1).Streams, Warnings: []string{"reconnecting"}})
+	q.push(mkTailFrame("a", 2))
+
+	frame, ok := q.pop()
+	require.True(t, ok)
+	require.Equal(t, []string{"reconnecting"}, frame.Warnings)
+	require.Len(t, frame.DroppedEntries, 1)
+	require.Equal(t, 1, frame.entryCount())
+}
+
+func TestTailQueue_Disconnect(t *testing.T) {
+	q := newTailQueue(2, false)
+
+	q.push(mkTailFrame("a", 1, 2))
+	require.False(t, q.overflow())
+	q.push(mkTailFrame("a", 3))
+	require.True(t, q.overflow())
+
+	_, ok := q.pop()
+	require.False(t, ok)
+}
+
+func TestTailQueue_OversizedFrame(t *testing.T) {
+	// A frame larger than the buffer is still delivered once the buffer is
+	// otherwise empty.
+	q := newTailQueue(2, false)
+	q.push(mkTailFrame("a", 1, 2, 3))
+	require.False(t, q.overflow())
+
+	frame, ok := q.pop()
+	require.True(t, ok)
+	require.Equal(t, 3, frame.entryCount())
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/loghttp"
+
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// tailSink receives the frames of a tail's server groups. It returns the
+// number of entries dropped to make room for the frame.
+type tailSink interface {
+	push(frame tailFrame) int
+}
+
+// reorderedEntry is an entry held in a tailReorder.
+type reorderedEntry struct {
+	labels  string
+	stream  map[string]string
+	value   []json.RawMessage
+	ts      int64
+	arrived time.Time
+}
+
+// tailReorder holds entries of all server groups back for a short window
+// and releases them to the queue in timestamp order, so a tail merged from
+// several clusters does not jump back and forth in time. Released entries
+// that share a label set are merged into one stream. Entries arriving too
+// late to be put in order are sent anyway and counted as late. At most
+// maxHeld entries are held; the oldest are released early to make room.
+type tailReorder struct {
+	mu      sync.Mutex
+	window  time.Duration
+	maxHeld int
+	q       *tailQueue
+
+	// held is in arrival order.
+	held []reorderedEntry
+	// lastTs is the newest timestamp released.
+	lastTs int64
+}
+
+func newTailReorder(window time.Duration, maxHeld int, q *tailQueue) *tailReorder {
+	return &tailReorder{window: window, maxHeld: maxHeld, q: q}
+}
+
+// push holds the frame's entries. Dropped entries and warnings are not
+// ordered and go to the queue straight away.
+func (b *tailReorder) push(frame tailFrame) int {
+	dropped := 0
+	if len(frame.DroppedEntries) > 0 || len(frame.Warnings) > 0 {
+		dropped = b.q.push(tailFrame{DroppedEntries: frame.DroppedEntries, Warnings: frame.Warnings})
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range frame.Streams {
+		labels := loghttp.LabelSet(s.Stream).String()
+		for _, v := range s.Values {
+			ts, ok := tailEntryTimestamp(v)
+			if !ok {
+				// Without a timestamp the entry cannot be ordered; it goes
+				// out with the next release.
+				ts = b.lastTs
+			}
+			b.held = append(b.held, reorderedEntry{labels: labels, stream: s.Stream, value: v, ts: ts, arrived: now})
+		}
+	}
+	if over := len(b.held) - b.maxHeld; over > 0 {
+		metrics.TailReorderForcedFlushes.Add(context.Background(), 1)
+		b.flush(context.Background(), over)
+	}
+	return dropped
+}
+
+// run releases the entries that have been held for the window until ctx is
+// done.
+func (b *tailReorder) run(ctx context.Context) {
+	ticker := time.NewTicker(max(b.window/4, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.release(ctx, time.Now(), false)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// release sends the entries that arrived a window before now, or all of
+// them when all is true, to the queue as one frame. Entries held for less
+// than the window are released with them when they are no newer, as they
+// could only be late otherwise.
+func (b *tailReorder) release(ctx context.Context, now time.Time, all bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	due := len(b.held)
+	if !all {
+		cutoff := now.Add(-b.window)
+		due = 0
+		for due < len(b.held) && !b.held[due].arrived.After(cutoff) {
+			due++
+		}
+	}
+	b.flush(ctx, due)
+}
+
+// flush sends the due oldest held entries to the queue as one frame, with
+// the held entries no newer than them. b.mu must be held.
+func (b *tailReorder) flush(ctx context.Context, due int) {
+	if due == 0 {
+		return
+	}
+
+	var newest int64
+	for _, e := range b.held[:due] {
+		newest = max(newest, e.ts)
+	}
+	var released, kept []reorderedEntry
+	released = append(released, b.held[:due]...)
+	for _, e := range b.held[due:] {
+		if e.ts <= newest {
+			released = append(released, e)
+		} else {
+			kept = append(kept, e)
+		}
+	}
+	b.held = kept
+
+	slices.SortStableFunc(released, func(x, y reorderedEntry) int {
+		return cmp.Compare(x.ts, y.ts)
+	})
+
+	late := 0
+	var frame tailFrame
+	streams := map[string]int{}
+	for _, e := range released {
+		if e.ts < b.lastTs {
+			late++
+		}
+		i, ok := streams[e.labels]
+		if !ok {
+			i = len(frame.Streams)
+			streams[e.labels] = i
+			frame.Streams = append(frame.Streams, tailStream{Stream: e.stream})
+		}
+		frame.Streams[i].Values = append(frame.Streams[i].Values, e.value)
+	}
+	b.lastTs = max(b.lastTs, newest)
+
+	if late > 0 {
+		metrics.TailLateEntries.Add(ctx, int64(late))
+	}
+	if dropped := b.q.push(frame); dropped > 0 {
+		metrics.TailDroppedEntries.Add(ctx, int64(dropped))
+	}
+}
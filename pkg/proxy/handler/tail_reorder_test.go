@@ -0,0 +1,185 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// streamFrame builds a frame with one stream of app=app entries.
+func streamFrame(app string, entries ...[2]string) tailFrame {
+	s := tailStream{Stream: map[string]string{"app": app}}
+	for _, e := range entries {
+		ts, _ := json.Marshal(e[0])
+		line, _ := json.Marshal(e[1])
+		s.Values = append(s.Values, []json.RawMessage{ts, line})
+	}
+	return tailFrame{Streams: []tailStream{s}}
+}
+
+// frameLines returns the lines of each stream in f, keyed by app label.
+func frameLines(t *testing.T, f tailFrame) map[string][]string {
+	t.Helper()
+	lines := map[string][]string{}
+	for _, s := range f.Streams {
+		for _, v := range s.Values {
+			var line string
+			require.NoError(t, json.Unmarshal(v[1], &line))
+			lines[s.Stream["app"]] = append(lines[s.Stream["app"]], line)
+		}
+	}
+	return lines
+}
+
+func TestTailReorder_ReleasesInTimestampOrder(t *testing.T) {
+	q := newTailQueue(100, true)
+	b := newTailReorder(time.Second, 100, q)
+
+	// Two server groups sending the same stream and another one, out of
+	// order.
+	b.push(streamFrame("a", [2]string{"300", "a3"}))
+	b.push(tailFrame{Streams: append(
+		streamFrame("a", [2]string{"100", "a1"}).Streams,
+		streamFrame("b", [2]string{"200", "b2"}).Streams...,
+	)})
+
+	// Nothing is released before the window has passed.
+	b.release(t.Context(), time.Now(), false)
+	_, ok := q.pop()
+	require.False(t, ok)
+
+	b.release(t.Context(), time.Now().Add(time.Second), false)
+	frame, ok := q.pop()
+	require.True(t, ok)
+	require.Len(t, frame.Streams, 2)
+	require.Equal(t, map[string][]string{"a": {"a1", "a3"}, "b": {"b2"}}, frameLines(t, frame))
+	require.Equal(t, "a", frame.Streams[0].Stream["app"])
+}
+
+func TestTailReorder_ReleasesNoNewerEntriesEarly(t *testing.T) {
+	q := newTailQueue(100, true)
+	b := newTailReorder(time.Second, 100, q)
+
+	b.push(streamFrame("a", [2]string{"200", "due"}))
+	b.held[0].arrived = time.Now().Add(-time.Second)
+	b.push(streamFrame("a", [2]string{"100", "older"}, [2]string{"300", "newer"}))
+
+	b.release(t.Context(), time.Now(), false)
+	frame, ok := q.pop()
+	require.True(t, ok)
+	require.Equal(t, map[string][]string{"a": {"older", "due"}}, frameLines(t, frame))
+	require.Len(t, b.held, 1)
+
+	// Warnings are not held.
+	b.push(tailFrame{Warnings: []string{"w"}})
+	frame, ok = q.pop()
+	require.True(t, ok)
+	require.Equal(t, []string{"w"}, frame.Warnings)
+}
+
+func TestTailReorder_CountsLateEntries(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	otel.SetMeterProvider(mp)
+	require.NoError(t, metrics.Reinitialize())
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+
+	q := newTailQueue(100, true)
+	b := newTailReorder(time.Millisecond, 100, q)
+
+	b.push(streamFrame("a", [2]string{"200", "first"}))
+	b.release(t.Context(), time.Now().Add(time.Second), true)
+	b.push(streamFrame("a", [2]string{"100", "late"}, [2]string{"300", "on time"}))
+	b.release(t.Context(), time.Now().Add(time.Second), true)
+
+	// Late entries are still sent.
+	q.pop()
+	frame, ok := q.pop()
+	require.True(t, ok)
+	require.Equal(t, map[string][]string{"a": {"late", "on time"}}, frameLines(t, frame))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	var late int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "lokxy_tail_late_entries_total" {
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					late += dp.Value
+				}
+			}
+		}
+	}
+	require.Equal(t, int64(1), late)
+}
+
+func TestTailReorder_FlushesOldestWhenFull(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	otel.SetMeterProvider(mp)
+	require.NoError(t, metrics.Reinitialize())
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+
+	q := newTailQueue(100, true)
+	b := newTailReorder(time.Hour, 2, q)
+
+	b.push(streamFrame("a", [2]string{"100", "a1"}, [2]string{"300", "a3"}))
+	_, ok := q.pop()
+	require.False(t, ok)
+
+	// The third entry makes room by releasing the oldest, without waiting
+	// for the window.
+	b.push(streamFrame("a", [2]string{"200", "a2"}))
+	frame, ok := q.pop()
+	require.True(t, ok)
+	require.Equal(t, map[string][]string{"a": {"a1"}}, frameLines(t, frame))
+	require.Len(t, b.held, 2)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	var flushes int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == "lokxy_tail_reorder_forced_flushes_total" {
+				for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+					flushes += dp.Value
+				}
+			}
+		}
+	}
+	require.Equal(t, int64(1), flushes)
+}
+
+func TestHandleTailWebSocket_ReorderWindowMergesServerGroups(t *testing.T) {
+	ahead := mkTailBackend(t, func(conn *websocket.Conn, _ *http.Request, _ int) {
+		_ = conn.WriteJSON(tailEntries([2]string{"200", "b"}, [2]string{"400", "d"}))
+		time.Sleep(time.Second)
+	})
+	behind := mkTailBackend(t, func(conn *websocket.Conn, _ *http.Request, _ int) {
+		time.Sleep(50 * time.Millisecond)
+		_ = conn.WriteJSON(tailEntries([2]string{"100", "a"}, [2]string{"300", "c"}))
+		time.Sleep(time.Second)
+	})
+
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "ahead", URL: ahead.URL}, {Name: "behind", URL: behind.URL}},
+		Tail:         cfg.TailConfig{ReorderWindow: 300 * time.Millisecond},
+	}
+	client := dialTail(t, config)
+
+	var frame tailFrame
+	require.NoError(t, client.ReadJSON(&frame))
+	require.Len(t, frame.Streams, 1)
+	require.Equal(t, map[string][]string{"a": {"a", "b", "c", "d"}}, frameLines(t, frame))
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	traces "github.com/paulojmdias/lokxy/pkg/o11y/tracing"
+)
+
+// Content types of the HTTP tail stream.
+const (
+	eventStreamContentType = "text/event-stream"
+	ndjsonContentType      = "application/x-ndjson"
+)
+
+// streamTailClient sends the tail over a long-lived HTTP response, for
+// clients and proxies that cannot use WebSockets. Every frame is a message
+// in Loki's WebSocket tail format, sent either as a server-sent event or as
+// a line of newline-delimited JSON.
+type streamTailClient struct {
+	w            http.ResponseWriter
+	rc           *http.ResponseController
+	sse          bool
+	writeTimeout time.Duration
+}
+
+func (c *streamTailClient) send(frame tailFrame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	if c.sse {
+		return c.write("data: " + string(data) + "\n\n")
+	}
+	return c.write(string(data) + "\n")
+}
+
+// ping writes an SSE comment, which EventSource ignores, or an empty frame.
+func (c *streamTailClient) ping() error {
+	if c.sse {
+		return c.write(": ping\n\n")
+	}
+	return c.write("{}\n")
+}
+
+// end sends the reason as an "error" event, or as a line with an error
+// field, before the response ends.
+func (c *streamTailClient) end(_ int, reason string) {
+	data, _ := json.Marshal(struct {
+		Error string `json:"error"`
+	}{reason})
+	if c.sse {
+		_ = c.write("event: error\ndata: " + string(data) + "\n\n")
+		return
+	}
+	_ = c.write(string(data) + "\n")
+}
+
+func (c *streamTailClient) write(s string) error {
+	if err := c.rc.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if _, err := c.w.Write([]byte(s)); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+// HandleTailStream serves a live tail over plain HTTP. It tails the server
+// groups exactly like [HandleTailWebSocket], but streams the frames in the
+// response body: as server-sent events when the client accepts
+// text/event-stream, as browsers' EventSource does, and as newline-delimited
+// JSON otherwise. r's path must be the upstream tail path.
+func HandleTailStream(ctx context.Context, w http.ResponseWriter, r *http.Request, config *cfg.Config, dial TailDialer, sessions *TailSessions, logger log.Logger) {
+	ctx, span := traces.CreateSpan(ctx, "stream_tail_handler")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireParams(w, r) {
+		span.SetStatus(codes.Error, "Invalid request parameters")
+		return
+	}
+
+	release, ok := admitTail(w, r, config.Tail, sessions, logger)
+	if !ok {
+		span.SetStatus(codes.Error, "Tail refused")
+		return
+	}
+	defer release()
+
+	sse := acceptsEventStream(r.Header.Get("Accept"))
+	contentType := ndjsonContentType
+	if sse {
+		contentType = eventStreamContentType
+	}
+	span.SetAttributes(
+		attribute.Int("lokxy.server_groups", len(config.ServerGroups)),
+		attribute.String("tail.content_type", contentType),
+	)
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Cache-Control", "no-cache")
+	// Keep nginx and compatible proxies from buffering the stream.
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Response cannot be streamed")
+		level.Error(logger).Log("msg", "Failed to start tail stream", "err", err)
+		return
+	}
+
+	tail := tailSettings(config.Tail)
+	client := &streamTailClient{w: w, rc: rc, sse: sse, writeTimeout: tail.WriteTimeout}
+	runTail(ctx, span, r, config, dial, tail, client, logger)
+
+	span.SetAttributes(attribute.Bool("tail.completed", true))
+}
+
+// acceptsEventStream reports whether the Accept header asks for
+// text/event-stream.
+func acceptsEventStream(accept string) bool {
+	for part := range strings.SplitSeq(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == eventStreamContentType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// getTailStream starts a tail stream against config and returns its response.
+func getTailStream(t *testing.T, config *cfg.Config, accept string) *http.Response {
+	t.Helper()
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleTailStream(r.Context(), w, r, config, directTailDialer{config}, NewTailSessions(), log.NewNopLogger())
+	}))
+	t.Cleanup(proxyServer.Close)
+
+	req, err := http.NewRequest(http.MethodGet, proxyServer.URL+"/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D", nil)
+	require.NoError(t, err)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return resp
+}
+
+func TestHandleTailStream_EventStream(t *testing.T) {
+	backend := mkTailBackend(t, func(conn *websocket.Conn, r *http.Request, _ int) {
+		if r.URL.Query().Get("query") != `{app="a"}` {
+			return
+		}
+		_ = conn.WriteJSON(tailEntries([2]string{"100", "a"}))
+		time.Sleep(time.Second)
+	})
+	config := &cfg.Config{ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL}}}
+
+	resp := getTailStream(t, config, "text/event-stream")
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	scanner := bufio.NewScanner(resp.Body)
+	require.True(t, scanner.Scan())
+	data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+	require.True(t, ok, scanner.Text())
+	require.JSONEq(t, `{"streams":[{"stream":{"app":"a"},"values":[["100","a"]]}]}`, data)
+	require.True(t, scanner.Scan())
+	require.Empty(t, scanner.Text())
+}
+
+func TestHandleTailStream_NDJSONReportsFailure(t *testing.T) {
+	backend := mkTailBackend(t, func(conn *websocket.Conn, _ *http.Request, _ int) {
+		_ = conn.WriteJSON(tailEntries([2]string{"100", "a"}))
+	})
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL}},
+		Tail:         cfg.TailConfig{Reconnect: cfg.TailReconnectConfig{MaxAttempts: -1}},
+	}
+
+	resp := getTailStream(t, config, "")
+	require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	var frames []map[string]any
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var frame map[string]any
+		if err := dec.Decode(&frame); err != nil {
+			break
+		}
+		frames = append(frames, frame)
+	}
+	require.Len(t, frames, 2)
+	require.Contains(t, frames[0], "streams")
+	require.Contains(t, frames[1]["error"], `server group "loki1"`)
+}
+
+func TestHandleTailStream_MethodNotAllowed(t *testing.T) {
+	config := &cfg.Config{}
+	w := httptest.NewRecorder()
+	HandleTailStream(t.Context(), w, httptest.NewRequest(http.MethodPost, "/loki/api/v1/tail", nil), config, directTailDialer{config}, NewTailSessions(), log.NewNopLogger())
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestAcceptsEventStream(t *testing.T) {
+	require.True(t, acceptsEventStream("text/event-stream"))
+	require.True(t, acceptsEventStream("application/json, text/event-stream;q=0.9"))
+	require.False(t, acceptsEventStream(""))
+	require.False(t, acceptsEventStream("*/*"))
+	require.False(t, acceptsEventStream("application/x-ndjson"))
+}
@@ -2,9 +2,14 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,65 +20,48 @@ import (
 	cfg "github.com/paulojmdias/lokxy/pkg/config"
 )
 
-func TestCreateWebSocketDialer_WithoutTLS(t *testing.T) {
-	logger := log.NewNopLogger()
-
-	instance := cfg.ServerGroup{
-		Name: "test-instance",
-		URL:  "http://localhost:3100",
-	}
-	instance.HTTPClientConfig.TLSConfig.InsecureSkipVerify = false
-
-	dialer, err := createWebSocketDialer(instance, logger)
-	require.NoError(t, err)
-	require.NotNil(t, dialer)
-
-	require.False(t, dialer.TLSClientConfig.InsecureSkipVerify)
+// directTailDialer dials server groups by their configured URL, standing in
+// for the proxy's upstream transports.
+type directTailDialer struct {
+	config *cfg.Config
 }
 
-func TestCreateWebSocketDialer_InsecureSkipVerify(t *testing.T) {
-	logger := log.NewNopLogger()
-
-	instance := cfg.ServerGroup{
-		Name: "test-instance",
-		URL:  "https://localhost:3100",
+func (d directTailDialer) group(name string, header http.Header) (cfg.ServerGroup, error) {
+	for _, sg := range d.config.ServerGroups {
+		if sg.Name != name {
+			continue
+		}
+		for key, value := range sg.Headers {
+			header.Set(key, value)
+		}
+		return sg, nil
 	}
-	instance.HTTPClientConfig.TLSConfig.InsecureSkipVerify = true
-
-	dialer, err := createWebSocketDialer(instance, logger)
-	require.NoError(t, err)
-	require.NotNil(t, dialer)
-
-	require.True(t, dialer.TLSClientConfig.InsecureSkipVerify)
+	return cfg.ServerGroup{}, fmt.Errorf("unknown server group %q", name)
 }
 
-func TestCreateWebSocketDialer_InvalidCAFile(t *testing.T) {
-	logger := log.NewNopLogger()
-
-	instance := cfg.ServerGroup{
-		Name: "test-instance",
-		URL:  "https://localhost:3100",
+func (d directTailDialer) DialWebSocket(ctx context.Context, group, path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	sg, err := d.group(group, header)
+	if err != nil {
+		return nil, nil, err
 	}
-	instance.HTTPClientConfig.TLSConfig.CAFile = "/nonexistent/ca.pem"
-
-	dialer, err := createWebSocketDialer(instance, logger)
-	require.Error(t, err)
-	require.Nil(t, dialer)
+	target := sg.URL
+	if after, ok := strings.CutPrefix(target, "http"); ok {
+		target = "ws" + after
+	}
+	return websocket.DefaultDialer.DialContext(ctx, target+path, header)
 }
 
-func TestCreateWebSocketDialer_InvalidCertFile(t *testing.T) {
-	logger := log.NewNopLogger()
-
-	instance := cfg.ServerGroup{
-		Name: "test-instance",
-		URL:  "https://localhost:3100",
+func (d directTailDialer) Get(ctx context.Context, group, path string, header http.Header) (*http.Response, error) {
+	sg, err := d.group(group, header)
+	if err != nil {
+		return nil, err
 	}
-	instance.HTTPClientConfig.TLSConfig.CertFile = "/nonexistent/cert.pem"
-	instance.HTTPClientConfig.TLSConfig.KeyFile = "/nonexistent/key.pem"
-
-	dialer, err := createWebSocketDialer(instance, logger)
-	require.Error(t, err)
-	require.Nil(t, dialer)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sg.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	return http.DefaultClient.Do(req)
 }
 
 func TestHandleTailWebSocket_UpgradeFailure(t *testing.T) {
@@ -86,7 +74,7 @@ func TestHandleTailWebSocket_UpgradeFailure(t *testing.T) {
 	req := httptest.NewRequest("GET", "/loki/api/v1/tail", nil)
 	w := httptest.NewRecorder()
 
-	HandleTailWebSocket(context.Background(), w, req, config, logger)
+	HandleTailWebSocket(context.Background(), w, req, config, directTailDialer{config}, NewTailSessions(), logger)
 
 	// Should fail to upgrade
 	require.NotEqual(t, http.StatusSwitchingProtocols, w.Code)
@@ -145,7 +133,7 @@ func TestHandleTailWebSocket_Integration(t *testing.T) {
 
 	// Create test server for the proxy
 	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		HandleTailWebSocket(context.Background(), w, r, config, logger)
+		HandleTailWebSocket(context.Background(), w, r, config, directTailDialer{config}, NewTailSessions(), logger)
 	}))
 	defer proxyServer.Close()
 
@@ -173,7 +161,7 @@ func TestHandleTailWebSocket_NoBackends(t *testing.T) {
 
 	// Create a mock WebSocket server
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		HandleTailWebSocket(context.Background(), w, r, config, logger)
+		HandleTailWebSocket(context.Background(), w, r, config, directTailDialer{config}, NewTailSessions(), logger)
 	}))
 	defer testServer.Close()
 
@@ -192,17 +180,6 @@ func TestHandleTailWebSocket_NoBackends(t *testing.T) {
 	require.Error(t, err)
 }
 
-func TestUpgrader_CheckOrigin(t *testing.T) {
-	// Verify that the upgrader allows all origins
-	req := httptest.NewRequest("GET", "/", nil)
-	req.Header.Set("Origin", "https://evil.example.com")
-
-	result := upgrader.CheckOrigin(req)
-
-	// Current implementation allows all origins (security issue)
-	require.True(t, result, "upgrader should currently allow all origins (this is a known security issue)")
-}
-
 func TestHandleTailWebSocket_URLSchemeRewrite_HTTP(t *testing.T) {
 	// The handler rewrites http:// → ws:// when dialing backends.
 	// We verify this by pointing a backend config at an http:// URL; the
@@ -224,7 +201,7 @@ func TestHandleTailWebSocket_URLSchemeRewrite_HTTP(t *testing.T) {
 
 	// Proxy server that uses the handler
 	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		HandleTailWebSocket(context.Background(), w, r, config, logger)
+		HandleTailWebSocket(context.Background(), w, r, config, directTailDialer{config}, NewTailSessions(), logger)
 	}))
 	defer proxyServer.Close()
 
@@ -256,7 +233,7 @@ func TestHandleTailWebSocket_URLSchemeRewrite_HTTPS(t *testing.T) {
 	}
 
 	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		HandleTailWebSocket(context.Background(), w, r, config, logger)
+		HandleTailWebSocket(context.Background(), w, r, config, directTailDialer{config}, NewTailSessions(), logger)
 	}))
 	defer proxyServer.Close()
 
@@ -299,7 +276,7 @@ func TestHandleTailWebSocket_InvalidJSONFromBackend(t *testing.T) {
 	config := &cfg.Config{ServerGroups: []cfg.ServerGroup{serverGroup}}
 
 	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		HandleTailWebSocket(context.Background(), w, r, config, logger)
+		HandleTailWebSocket(context.Background(), w, r, config, directTailDialer{config}, NewTailSessions(), logger)
 	}))
 	defer proxyServer.Close()
 
@@ -359,5 +336,224 @@ func TestHandleTailWebSocket_ContextCancellation(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	// This should handle context cancellation gracefully
-	HandleTailWebSocket(ctx, w, req, config, logger)
+	HandleTailWebSocket(ctx, w, req, config, directTailDialer{config}, NewTailSessions(), logger)
+}
+
+// mkTailBackend starts a Loki tail stand-in. handle is called for every
+// connection with its 1-based sequence number.
+func mkTailBackend(t *testing.T, handle func(conn *websocket.Conn, r *http.Request, n int)) *httptest.Server {
+	t.Helper()
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		up := websocket.Upgrader{CheckOrigin: func(_ *http.Request) bool { return true }}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn, r, int(n.Add(1)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func tailEntries(entries ...[2]string) map[string]any {
+	values := make([][]string, len(entries))
+	for i, e := range entries {
+		values[i] = []string{e[0], e[1]}
+	}
+	return map[string]any{"streams": []map[string]any{{"stream": map[string]string{"app": "a"}, "values": values}}}
+}
+
+func dialTail(t *testing.T, config *cfg.Config) *websocket.Conn {
+	t.Helper()
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		HandleTailWebSocket(r.Context(), w, r, config, directTailDialer{config}, NewTailSessions(), log.NewNopLogger())
+	}))
+	t.Cleanup(proxyServer.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(proxyServer.URL, "http")+"/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D", nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+	return client
+}
+
+func TestHandleTailWebSocket_ReconnectResumesFromLastEntry(t *testing.T) {
+	var resumeQuery atomic.Value
+	backend := mkTailBackend(t, func(conn *websocket.Conn, r *http.Request, n int) {
+		switch n {
+		case 1:
+			_ = conn.WriteJSON(tailEntries([2]string{"100", "a"}, [2]string{"200", "b"}))
+			// Simulate a restart by dropping the connection.
+		case 2:
+			resumeQuery.Store(r.URL.Query())
+			// The resumed tail repeats the entry at the start timestamp.
+			_ = conn.WriteJSON(tailEntries([2]string{"200", "b"}, [2]string{"300", "c"}))
+			time.Sleep(time.Second)
+		}
+	})
+
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL}},
+		Tail:         cfg.TailConfig{Reconnect: cfg.TailReconnectConfig{MinBackoff: 10 * time.Millisecond}},
+	}
+	client := dialTail(t, config)
+
+	var lines []string
+	for len(lines) < 3 {
+		var frame tailFrame
+		require.NoError(t, client.ReadJSON(&frame))
+		for _, s := range frame.Streams {
+			for _, v := range s.Values {
+				var line string
+				require.NoError(t, json.Unmarshal(v[1], &line))
+				lines = append(lines, line)
+			}
+		}
+	}
+	require.Equal(t, []string{"a", "b", "c"}, lines)
+	query := resumeQuery.Load().(url.Values)
+	require.Equal(t, "200", query.Get("start"))
+	require.Equal(t, `{app="a"}`, query.Get("query"))
+}
+
+func TestHandleTailWebSocket_DowngradedGroupSendsWarning(t *testing.T) {
+	healthy := mkTailBackend(t, func(conn *websocket.Conn, _ *http.Request, _ int) {
+		time.Sleep(200 * time.Millisecond)
+		_ = conn.WriteJSON(tailEntries([2]string{"100", "ok"}))
+		time.Sleep(time.Second)
+	})
+
+	down := cfg.ServerGroup{Name: "down", URL: "http://127.0.0.1:1", DowngradeError: true}
+	down.HTTPClientConfig.DialTimeout = 50 * time.Millisecond
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "healthy", URL: healthy.URL}, down},
+		Tail:         cfg.TailConfig{Reconnect: cfg.TailReconnectConfig{MaxAttempts: -1}},
+	}
+	client := dialTail(t, config)
+
+	var frame tailFrame
+	require.NoError(t, client.ReadJSON(&frame))
+	require.Len(t, frame.Warnings, 1)
+	require.Contains(t, frame.Warnings[0], `server group "down"`)
+
+	// The healthy group keeps streaming.
+	frame = tailFrame{}
+	require.NoError(t, client.ReadJSON(&frame))
+	require.Len(t, frame.Streams, 1)
+}
+
+func TestHandleTailWebSocket_RequiredGroupFailsFast(t *testing.T) {
+	healthy := mkTailBackend(t, func(_ *websocket.Conn, _ *http.Request, _ int) {
+		time.Sleep(time.Second)
+	})
+
+	down := cfg.ServerGroup{Name: "down", URL: "http://127.0.0.1:1"}
+	down.HTTPClientConfig.DialTimeout = 50 * time.Millisecond
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "healthy", URL: healthy.URL}, down},
+	}
+	client := dialTail(t, config)
+
+	start := time.Now()
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseInternalServerErr, closeErr.Code)
+	require.Contains(t, closeErr.Text, `server group "down"`)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestHandleTailWebSocket_RequiredGroupGivenUpAfterReconnects(t *testing.T) {
+	backend := mkTailBackend(t, func(conn *websocket.Conn, _ *http.Request, n int) {
+		if n == 1 {
+			_ = conn.WriteJSON(tailEntries([2]string{"100", "a"}))
+		}
+		// Every connection is dropped straight away.
+	})
+
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "flaky", URL: backend.URL}},
+		Tail: cfg.TailConfig{Reconnect: cfg.TailReconnectConfig{
+			MaxAttempts: 2,
+			MinBackoff:  10 * time.Millisecond,
+			MaxBackoff:  20 * time.Millisecond,
+		}},
+	}
+	client := dialTail(t, config)
+
+	var frame tailFrame
+	require.NoError(t, client.ReadJSON(&frame))
+	require.Len(t, frame.Streams, 1)
+
+	_, _, err := client.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.CloseInternalServerErr, closeErr.Code)
+	require.Contains(t, closeErr.Text, `server group "flaky"`)
+}
+
+// mkBlockingTailBackend returns a tail backend that sends nothing and
+// reports on closed when lokxy tears its connection down.
+func mkBlockingTailBackend(t *testing.T) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	closed := make(chan struct{})
+	var once sync.Once
+	srv := mkTailBackend(t, func(conn *websocket.Conn, _ *http.Request, _ int) {
+		_, _, _ = conn.ReadMessage()
+		once.Do(func() { close(closed) })
+	})
+	return srv, closed
+}
+
+func TestHandleTailWebSocket_ClientCloseTearsDownBackends(t *testing.T) {
+	backend, closed := mkBlockingTailBackend(t)
+	config := &cfg.Config{ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL}}}
+	client := dialTail(t, config)
+
+	// Give the proxy time to connect upstream, then leave.
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, client.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend connection was not closed after the client left")
+	}
+}
+
+func TestHandleTailWebSocket_UnresponsiveClientDisconnected(t *testing.T) {
+	backend, closed := mkBlockingTailBackend(t)
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL}},
+		Tail:         cfg.TailConfig{PingInterval: 50 * time.Millisecond},
+	}
+	// The client never reads, so it never answers pings.
+	dialTail(t, config)
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("unresponsive client was not disconnected")
+	}
+}
+
+func TestHandleTailWebSocket_RespondingClientKeptAlive(t *testing.T) {
+	backend := mkTailBackend(t, func(conn *websocket.Conn, _ *http.Request, _ int) {
+		time.Sleep(300 * time.Millisecond)
+		_ = conn.WriteJSON(tailEntries([2]string{"100", "late"}))
+		time.Sleep(time.Second)
+	})
+	config := &cfg.Config{
+		ServerGroups: []cfg.ServerGroup{{Name: "loki1", URL: backend.URL}},
+		Tail:         cfg.TailConfig{PingInterval: 50 * time.Millisecond},
+	}
+	client := dialTail(t, config)
+
+	// Reading answers pings, so the tail outlives several ping intervals.
+	var frame tailFrame
+	require.NoError(t, client.ReadJSON(&frame))
+	require.Len(t, frame.Streams, 1)
 }
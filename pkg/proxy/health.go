@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+const (
+	// defaultHealthCheckPath is probed when neither path nor query is set.
+	defaultHealthCheckPath = "/ready"
+
+	// maxDefaultHealthCheckTimeout caps the probe timeout derived from the
+	// interval.
+	maxDefaultHealthCheckTimeout = 5 * time.Second
+
+	// healthCheckIdleInterval is how often the configuration is looked at
+	// for newly enabled health checks when none are due.
+	healthCheckIdleInterval = time.Second
+)
+
+// groupHealth is the probe state of one server group.
+type groupHealth struct {
+	mu        sync.Mutex
+	down      bool
+	failures  int
+	nextProbe time.Time
+	probing   bool
+}
+
+// healthChecker keeps the probe state of the server groups. It is keyed by
+// group name and outlives configuration reloads, so a reload neither
+// forgets that a group is down nor probes it again straight away.
+type healthChecker struct {
+	mu     sync.Mutex
+	groups map[string]*groupHealth
+}
+
+func newHealthChecker() *healthChecker {
+	return &healthChecker{groups: map[string]*groupHealth{}}
+}
+
+func (c *healthChecker) group(name string) *groupHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.groups[name]
+	if !ok {
+		h = &groupHealth{}
+		c.groups[name] = h
+	}
+	return h
+}
+
+// isDown reports whether the server group's last probes failed. Groups
+// that are not probed are never down.
+func (c *healthChecker) isDown(name string) bool {
+	c.mu.Lock()
+	h, ok := c.groups[name]
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.down
+}
+
+// prune forgets the server groups that are no longer probed.
+func (c *healthChecker) prune(config *cfg.Config) {
+	probed := map[string]bool{}
+	for _, sg := range config.ServerGroups {
+		if sg.HealthCheck.Enabled() {
+			probed[sg.Name] = true
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.groups {
+		if !probed[name] {
+			delete(c.groups, name)
+		}
+	}
+}
+
+// RunHealthChecks probes the server groups that have a health check
+// configured, each on its own interval, until ctx is done. The current
+// configuration is read before every round, so reloads take effect
+// without a restart.
+func (p *Proxy) RunHealthChecks(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		st := p.state.Load()
+		p.health.prune(st.config)
+		now := time.Now()
+		wait := healthCheckIdleInterval
+		for _, instance := range st.config.ServerGroups {
+			hc := instance.HealthCheck
+			u, ok := st.upstreams[instance.Name]
+			if !hc.Enabled() || !ok {
+				continue
+			}
+
+			h := p.health.group(instance.Name)
+			h.mu.Lock()
+			due := !h.probing && !now.Before(h.nextProbe)
+			if due {
+				h.probing = true
+				h.nextProbe = now.Add(hc.Interval)
+			}
+			wait = min(wait, max(h.nextProbe.Sub(now), time.Millisecond))
+			h.mu.Unlock()
+
+			if due {
+				wg.Go(func() {
+					p.probe(ctx, u, h)
+				})
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// probe checks the server group once and records the result.
+func (p *Proxy) probe(ctx context.Context, u *upstream, h *groupHealth) {
+	hc := u.group.HealthCheck
+	timeout := hc.Timeout
+	if timeout == 0 {
+		timeout = min(hc.Interval, maxDefaultHealthCheckTimeout)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := u.checkHealth(ctx)
+	elapsed := time.Since(start)
+	if errors.Is(ctx.Err(), context.Canceled) {
+		// Shutting down.
+		h.mu.Lock()
+		h.probing = false
+		h.mu.Unlock()
+		return
+	}
+
+	threshold := max(hc.FailureThreshold, 1)
+	h.mu.Lock()
+	h.probing = false
+	wasDown := h.down
+	if err != nil {
+		h.failures++
+		h.down = h.down || h.failures >= threshold
+	} else {
+		h.failures = 0
+		h.down = false
+	}
+	down := h.down
+	h.mu.Unlock()
+
+	recordHealth(context.WithoutCancel(ctx), u.group.Name, !down, elapsed)
+	logHealth(p.logger, u.group.Name, wasDown, down, err)
+}
+
+// checkHealth requests the server group's readiness endpoint, or runs its
+// canary query. Any 2xx response counts as healthy.
+func (u *upstream) checkHealth(ctx context.Context) error {
+	hc := u.group.HealthCheck
+	req := upstreamRequest{method: http.MethodGet, path: hc.Path, header: http.Header{}}
+	if hc.Query != "" {
+		req.path = "/loki/api/v1/query"
+		req.rawQuery = url.Values{"query": {hc.Query}, "limit": {"1"}}.Encode()
+	} else if req.path == "" {
+		req.path = defaultHealthCheckPath
+	}
+
+	resp, err := u.send(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func recordHealth(ctx context.Context, group string, up bool, elapsed time.Duration) {
+	attrs := metric.WithAttributes(attribute.String("server_group", group))
+	var value int64
+	if up {
+		value = 1
+	}
+	metrics.ServerGroupUp.Record(ctx, value, attrs)
+	metrics.ServerGroupProbeDuration.Record(ctx, elapsed.Seconds(), attrs)
+}
+
+func logHealth(logger log.Logger, group string, wasDown, down bool, err error) {
+	switch {
+	case down && !wasDown:
+		level.Warn(logger).Log("msg", "Server group is down", "instance", group, "err", err)
+	case !down && wasDown:
+		level.Info(logger).Log("msg", "Server group is up again", "instance", group)
+	case err != nil:
+		level.Debug(logger).Log("msg", "Server group health check failed", "instance", group, "err", err)
+	}
+}
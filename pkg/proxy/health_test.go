@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// serverGroupUp returns the lokxy_server_group_up value of each group.
+func serverGroupUp(t *testing.T, reader *sdkmetric.ManualReader) map[string]int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	up := map[string]int64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "lokxy_server_group_up" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Gauge[int64]).DataPoints {
+				group, _ := dp.Attributes.Value("server_group")
+				up[group.AsString()] = dp.Value
+			}
+		}
+	}
+	return up
+}
+
+func TestProxy_RunHealthChecks(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	otel.SetMeterProvider(mp)
+	require.NoError(t, metrics.Reinitialize())
+	t.Cleanup(func() { _ = mp.Shutdown(context.Background()) })
+
+	var ready atomic.Bool
+	ready.Store(true)
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/ready": func(w http.ResponseWriter, _ *http.Request) {
+			if !ready.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		},
+	})
+	defer s1.Close()
+
+	config := mkConfig(s1.URL, "http://127.0.0.1:1")
+	for i := range config.ServerGroups {
+		config.ServerGroups[i].HealthCheck = cfg.HealthCheckConfig{Interval: 20 * time.Millisecond, FailureThreshold: 2}
+	}
+	p, err := New(log.NewNopLogger(), config)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error)
+	go func() { done <- p.RunHealthChecks(ctx) }()
+
+	require.Eventually(t, func() bool {
+		up := serverGroupUp(t, reader)
+		return up["sg1"] == 1 && p.health.isDown("sg2")
+	}, 2*time.Second, 10*time.Millisecond)
+	require.False(t, p.health.isDown("sg1"))
+
+	ready.Store(false)
+	require.Eventually(t, func() bool { return p.health.isDown("sg1") }, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(0), serverGroupUp(t, reader)["sg1"])
+
+	ready.Store(true)
+	require.Eventually(t, func() bool { return !p.health.isDown("sg1") }, 2*time.Second, 10*time.Millisecond)
+
+	// A reload that drops the health check forgets the group's state.
+	reloaded := mkConfig(s1.URL, "http://127.0.0.1:1")
+	require.NoError(t, p.ApplyConfig(reloaded))
+	require.Eventually(t, func() bool { return !p.health.isDown("sg2") }, 2*time.Second, 10*time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestUpstream_CheckHealth_CanaryQuery(t *testing.T) {
+	var query string
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query": func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.Query().Get("query")
+			io.WriteString(w, `{"status":"success"}`)
+		},
+	})
+	defer s1.Close()
+
+	sg := mkConfig(s1.URL).ServerGroups[0]
+	sg.HealthCheck = cfg.HealthCheckConfig{Interval: time.Second, Query: `count_over_time({job="canary"}[1m])`}
+	u, err := newUpstream(sg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	require.NoError(t, u.checkHealth(t.Context()))
+	require.Equal(t, `count_over_time({job="canary"}[1m])`, query)
+
+	sg.HealthCheck = cfg.HealthCheckConfig{Interval: time.Second, Path: "/missing"}
+	u, err = newUpstream(sg, log.NewNopLogger())
+	require.NoError(t, err)
+	require.ErrorContains(t, u.checkHealth(t.Context()), "status 404")
+}
+
+func TestProxy_ExcludesOptionalGroupsThatAreDown(t *testing.T) {
+	var downCalls atomic.Int32
+	healthy := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["a"]}`)
+		},
+	})
+	defer healthy.Close()
+	down := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			downCalls.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["b"]}`)
+		},
+	})
+	defer down.Close()
+
+	config := mkConfig(healthy.URL, down.URL)
+	config.ServerGroups[1].IgnoreError = true
+	config.ServerGroups[1].HealthCheck = cfg.HealthCheckConfig{Interval: time.Minute, ExcludeWhenDown: true}
+	p, err := New(log.NewNopLogger(), config)
+	require.NoError(t, err)
+	p.health.group("sg2").down = true
+
+	rr := httptest.NewRecorder()
+	NewServeMux(log.NewNopLogger(), p, nil, false).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"status":"success","data":["a"]}`, rr.Body.String())
+	require.Zero(t, downCalls.Load())
+}
@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+const (
+	// defaultHedgeMaxPerSecond is the hedge rate when max_per_second is
+	// not set.
+	defaultHedgeMaxPerSecond = 10
+
+	// hedgeLatencySamples is how many recent response times the hedge
+	// percentile is computed over.
+	hedgeLatencySamples = 1000
+
+	// hedgeMinSamples is how many response times must have been observed
+	// before the percentile is used instead of the fixed delay.
+	hedgeMinSamples = 20
+
+	// hedgeRecomputeEvery is how many observations the percentile is
+	// cached for.
+	hedgeRecomputeEvery = 16
+)
+
+// latencyTracker keeps a server group's recent response times and the
+// configured percentile of them.
+type latencyTracker struct {
+	mu         sync.Mutex
+	percentile float64
+	samples    []time.Duration
+	next       int
+	// sinceRecompute counts the observations since value was computed.
+	sinceRecompute int
+	value          time.Duration
+}
+
+func newLatencyTracker(percentile float64) *latencyTracker {
+	return &latencyTracker{percentile: percentile, samples: make([]time.Duration, 0, hedgeLatencySamples)}
+}
+
+// observe records the response time of one request.
+func (l *latencyTracker) observe(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < hedgeLatencySamples {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.next] = d
+		l.next = (l.next + 1) % hedgeLatencySamples
+	}
+	l.sinceRecompute++
+	if len(l.samples) >= hedgeMinSamples && (l.value == 0 || l.sinceRecompute >= hedgeRecomputeEvery) {
+		sorted := slices.Clone(l.samples)
+		slices.Sort(sorted)
+		i := int(math.Ceil(l.percentile/100*float64(len(sorted)))) - 1
+		l.value = sorted[min(max(i, 0), len(sorted)-1)]
+		l.sinceRecompute = 0
+	}
+}
+
+// quantile returns the percentile of the recent response times, once enough
+// have been observed.
+func (l *latencyTracker) quantile() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.value, l.value > 0
+}
+
+// hedgePolicy is a server group's hedging configuration and state.
+type hedgePolicy struct {
+	delay     time.Duration
+	latencies *latencyTracker
+	limiter   *rate.Limiter
+}
+
+// newHedgePolicy returns the hedge policy of a server group, or nil when
+// hedging is disabled.
+func newHedgePolicy(c cfg.HedgeConfig) *hedgePolicy {
+	if !c.Enabled() {
+		return nil
+	}
+	perSecond := c.MaxPerSecond
+	if perSecond == 0 {
+		perSecond = defaultHedgeMaxPerSecond
+	}
+	h := &hedgePolicy{
+		delay:   c.Delay,
+		limiter: rate.NewLimiter(rate.Limit(perSecond), max(int(math.Ceil(perSecond)), 1)),
+	}
+	if c.Percentile > 0 {
+		h.latencies = newLatencyTracker(c.Percentile)
+	}
+	return h
+}
+
+// hedgeDelay returns how long to wait for a response before hedging. It
+// returns false while a percentile-only policy has too few observations.
+func (h *hedgePolicy) hedgeDelay() (time.Duration, bool) {
+	if h.latencies != nil {
+		if q, ok := h.latencies.quantile(); ok {
+			return max(q, h.delay), true
+		}
+	}
+	return h.delay, h.delay > 0
+}
+
+// observe records the response time of a request to the server group.
+func (h *hedgePolicy) observe(d time.Duration) {
+	if h.latencies != nil {
+		h.latencies.observe(d)
+	}
+}
+
+// hedgeResult is the outcome of one of the requests of a hedged attempt.
+type hedgeResult struct {
+	resp  *http.Response
+	err   error
+	hedge bool
+	// finish releases what the request took from the server group's
+	// limiter and circuit breaker once it is done.
+	finish func()
+}
+
+// admitHedge takes a free slot of the server group's limiter, without
+// queueing, and a pass from its circuit breaker for a hedge. The returned
+// func gives them back with the hedge's result; it reports false when the
+// hedge must be skipped.
+func (u *upstream) admitHedge(ctx context.Context) (func(breakerResult), bool) {
+	release := func() {}
+	if u.limiter != nil {
+		var ok bool
+		if release, ok = u.limiter.tryAcquire(); !ok {
+			return nil, false
+		}
+	}
+	if u.breaker == nil {
+		return func(breakerResult) { release() }, true
+	}
+	state, ok := u.breaker.allow(ctx)
+	if !ok {
+		release()
+		return nil, false
+	}
+	return func(result breakerResult) {
+		u.breaker.done(ctx, state, result)
+		release()
+	}, true
+}
+
+// hedgeOutcome is how a request of a hedged attempt counts for the circuit
+// breaker. Only server errors count against it, and a request cancelled
+// because the other one won tells nothing.
+func hedgeOutcome(ctx context.Context, resp *http.Response, err error) breakerResult {
+	switch {
+	case err != nil && ctx.Err() != nil:
+		return breakerIgnored
+	case err != nil || resp.StatusCode >= 500:
+		return breakerFailure
+	}
+	return breakerSuccess
+}
+
+// sendHedged makes one attempt of req. When the server group hedges
+// requests and no response has come back within the hedge delay, a
+// duplicate request is sent and the first response of the two is used; the
+// other request is cancelled. A request that fails is only returned when
+// the other one fails too. The hedge counts against the group's limits and
+// circuit breaker like any request, and is skipped when they do not let it
+// through.
+func (u *upstream) sendHedged(ctx context.Context, span trace.Span, req upstreamRequest) (*http.Response, error) {
+	if u.hedge == nil || !isIdempotentRequest(req.method, req.path) {
+		return u.send(ctx, req)
+	}
+	// The response times of the server group set the percentile delay.
+	timedSend := func(ctx context.Context) (*http.Response, error) {
+		start := time.Now()
+		resp, err := u.send(ctx, req)
+		if err == nil {
+			u.hedge.observe(time.Since(start))
+		}
+		return resp, err
+	}
+	delay, ok := u.hedge.hedgeDelay()
+	if !ok {
+		return timedSend(ctx)
+	}
+
+	results := make(chan hedgeResult, 2)
+	var cancels []context.CancelFunc
+	// launch sends a request; done is called with its result once it is
+	// finished with.
+	launch := func(hedge bool, done func(breakerResult)) {
+		reqCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := timedSend(reqCtx)
+			result := hedgeOutcome(reqCtx, resp, err)
+			results <- hedgeResult{resp: resp, err: err, hedge: hedge, finish: func() { done(result) }}
+		}()
+	}
+	// cancelAll cancels the requests, except the one whose response is
+	// returned; its context is cancelled when the body is closed.
+	cancelAll := func(keep int) {
+		for i, cancel := range cancels {
+			if i != keep {
+				cancel()
+			}
+		}
+	}
+
+	// The limiter slot and breaker pass of the first request are held by
+	// the caller.
+	launch(false, func(breakerResult) {})
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	attrs := metric.WithAttributes(
+		attribute.String("path", req.pattern),
+		attribute.String("method", req.method),
+		attribute.String("server_group", u.group.Name),
+	)
+	pending := 1
+	for {
+		select {
+		case <-timer.C:
+			if !u.hedge.limiter.Allow() {
+				span.AddEvent("upstream_hedge_skipped", trace.WithAttributes(attribute.String("upstream.hedge_delay", delay.String())))
+				continue
+			}
+			done, ok := u.admitHedge(ctx)
+			if !ok {
+				span.AddEvent("upstream_hedge_skipped", trace.WithAttributes(attribute.String("upstream.hedge_delay", delay.String())))
+				continue
+			}
+			metrics.UpstreamHedges.Add(ctx, 1, attrs)
+			span.AddEvent("upstream_hedge", trace.WithAttributes(attribute.String("upstream.hedge_delay", delay.String())))
+			launch(true, done)
+			pending++
+
+		case res := <-results:
+			pending--
+			if res.err != nil && pending > 0 {
+				res.finish()
+				continue
+			}
+			if pending > 0 {
+				// Close the response of the other request should it still
+				// arrive after being cancelled.
+				go func() {
+					other := <-results
+					if other.resp != nil {
+						other.resp.Body.Close()
+					}
+					other.finish()
+				}()
+			}
+
+			winner := 0
+			if res.hedge {
+				winner = 1
+			}
+			if res.err != nil {
+				cancelAll(-1)
+				res.finish()
+				return nil, res.err
+			}
+			cancelAll(winner)
+			if res.hedge {
+				metrics.UpstreamHedgeWins.Add(ctx, 1, attrs)
+				span.AddEvent("upstream_hedge_won")
+			}
+			res.resp.Body = &closeHook{ReadCloser: res.resp.Body, onClose: func() {
+				cancels[winner]()
+				res.finish()
+			}}
+			return res.resp, nil
+		}
+	}
+}
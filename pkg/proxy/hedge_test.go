@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// mkHedgeConfig is mkConfig with hedging enabled on every server group.
+func mkHedgeConfig(hedge cfg.HedgeConfig, urls ...string) *cfg.Config {
+	config := mkConfig(urls...)
+	for i := range config.ServerGroups {
+		config.ServerGroups[i].Hedge = hedge
+	}
+	return config
+}
+
+// mkSlowFirstServer returns an upstream whose first request hangs until it
+// is cancelled, and a channel closed once it was.
+func mkSlowFirstServer(t *testing.T, calls *atomic.Int32) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+	cancelled := make(chan struct{})
+	s := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/": func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				select {
+				case <-r.Context().Done():
+					close(cancelled)
+				case <-time.After(5 * time.Second):
+				}
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["a"]}`)
+		},
+	})
+	t.Cleanup(s.Close)
+	return s, cancelled
+}
+
+func TestProxy_Hedge_FirstResponseWins(t *testing.T) {
+	var calls atomic.Int32
+	s1, cancelled := mkSlowFirstServer(t, &calls)
+
+	config := mkHedgeConfig(cfg.HedgeConfig{Delay: 50 * time.Millisecond}, s1.URL)
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int32(2), calls.Load())
+
+	// The slow request is cancelled.
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("slow request was not cancelled")
+	}
+}
+
+func TestProxy_Hedge_RateLimited(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			time.Sleep(100 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["a"]}`)
+		},
+	})
+	defer s1.Close()
+
+	// One hedge, then none for a long while.
+	config := mkHedgeConfig(cfg.HedgeConfig{Delay: 10 * time.Millisecond, MaxPerSecond: 0.001}, s1.URL)
+	mux := mustMux(t, log.NewNopLogger(), config)
+
+	for range 3 {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+	require.Eventually(t, func() bool { return calls.Load() == 4 }, time.Second, 10*time.Millisecond)
+}
+
+func TestProxy_Hedge_Limits(t *testing.T) {
+	t.Run("skipped without a free slot", func(t *testing.T) {
+		var calls atomic.Int32
+		s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+			"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+				calls.Add(1)
+				time.Sleep(100 * time.Millisecond)
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"status": "success", "data":["a"]}`)
+			},
+		})
+		defer s1.Close()
+
+		config := mkHedgeConfig(cfg.HedgeConfig{Delay: 10 * time.Millisecond}, s1.URL)
+		config.ServerGroups[0].Limits = cfg.LimitsConfig{MaxConcurrentRequests: 1}
+		rr := httptest.NewRecorder()
+		mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("outcome counts for the circuit breaker", func(t *testing.T) {
+		var calls atomic.Int32
+		s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+			"/": func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					<-r.Context().Done()
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+		})
+		defer s1.Close()
+
+		config := mkHedgeConfig(cfg.HedgeConfig{Delay: 10 * time.Millisecond}, s1.URL)
+		config.ServerGroups[0].CircuitBreaker = cfg.CircuitBreakerConfig{ConsecutiveFailures: 2, OpenDuration: time.Minute}
+		p, err := New(log.NewNopLogger(), config)
+		require.NoError(t, err)
+		rr := httptest.NewRecorder()
+		p.Handler()(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+		// The failed hedge and the request it answered both count.
+		require.Equal(t, int32(2), calls.Load())
+		require.Eventually(t, func() bool {
+			return p.state.Load().upstreams["sg1"].breaker.currentState() == breakerOpen
+		}, time.Second, time.Millisecond)
+	})
+}
+
+func TestProxy_Hedge_OnlyIdempotentRequests(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/": func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			time.Sleep(100 * time.Millisecond)
+			w.WriteHeader(http.StatusNoContent)
+		},
+	})
+	defer s1.Close()
+
+	config := mkHedgeConfig(cfg.HedgeConfig{Delay: 10 * time.Millisecond}, s1.URL)
+	rr := httptest.NewRecorder()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader("{}")))
+
+	require.Equal(t, http.StatusNoContent, rr.Code)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestHedgePolicy_Delay(t *testing.T) {
+	require.Nil(t, newHedgePolicy(cfg.HedgeConfig{}))
+
+	fixed := newHedgePolicy(cfg.HedgeConfig{Delay: time.Second})
+	d, ok := fixed.hedgeDelay()
+	require.True(t, ok)
+	require.Equal(t, time.Second, d)
+
+	// A percentile-only policy does not hedge until enough response times
+	// have been observed.
+	p := newHedgePolicy(cfg.HedgeConfig{Percentile: 90})
+	_, ok = p.hedgeDelay()
+	require.False(t, ok)
+	for i := 1; i <= 100; i++ {
+		p.observe(time.Duration(i) * time.Millisecond)
+	}
+	d, ok = p.hedgeDelay()
+	require.True(t, ok)
+	require.InDelta(t, 90*time.Millisecond, d, float64(5*time.Millisecond))
+
+	// The fixed delay is the lower bound of the percentile.
+	bounded := newHedgePolicy(cfg.HedgeConfig{Percentile: 90, Delay: time.Second})
+	for i := 1; i <= 100; i++ {
+		bounded.observe(time.Duration(i) * time.Millisecond)
+	}
+	d, ok = bounded.hedgeDelay()
+	require.True(t, ok)
+	require.Equal(t, time.Second, d)
+}
+
+func TestLatencyTracker_KeepsRecentSamples(t *testing.T) {
+	l := newLatencyTracker(50)
+	for range hedgeLatencySamples {
+		l.observe(time.Second)
+	}
+	for range hedgeLatencySamples {
+		l.observe(time.Millisecond)
+	}
+	require.Len(t, l.samples, hedgeLatencySamples)
+	q, ok := l.quantile()
+	require.True(t, ok)
+	require.Equal(t, time.Millisecond, q)
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/time/rate"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// defaultQueueTimeout is how long a request waits for a free slot when
+// queue_timeout is not set.
+const defaultQueueTimeout = time.Second
+
+var (
+	// errRateLimited rejects requests over a server group's request rate.
+	errRateLimited = errors.New("server group rate limit exceeded")
+
+	// errConcurrencyLimited rejects requests that found every slot of a
+	// server group taken and could not wait for one.
+	errConcurrencyLimited = errors.New("server group concurrency limit exceeded")
+)
+
+// limitReason returns the reason attribute of a request rejected by a
+// groupLimiter, or "" when err is not such a rejection.
+func limitReason(err error) string {
+	switch {
+	case errors.Is(err, errRateLimited):
+		return "rate"
+	case errors.Is(err, errConcurrencyLimited):
+		return "concurrency"
+	}
+	return ""
+}
+
+// groupLimiter bounds the requests sent to a server group: a token bucket
+// caps their rate, and at most a fixed number are in flight at a time while
+// a few more wait in a queue for a free slot. Its limits can be changed in
+// place, so a reload never loses count of the requests already in flight.
+type groupLimiter struct {
+	group string
+
+	mu            sync.Mutex
+	maxConcurrent int // 0 without a concurrency limit
+	inFlight      int
+	waiting       []chan struct{} // queued requests, oldest first
+	maxQueued     int
+	queueTimeout  time.Duration
+	rate          *rate.Limiter // nil without a rate limit
+}
+
+// newGroupLimiter returns the limiter of a server group, or nil when it has
+// no limits.
+func newGroupLimiter(instance cfg.ServerGroup) *groupLimiter {
+	if !hasLimits(instance.Limits) {
+		return nil
+	}
+	l := &groupLimiter{group: instance.Name}
+	l.update(instance.Limits)
+	return l
+}
+
+func hasLimits(c cfg.LimitsConfig) bool {
+	return c.MaxConcurrentRequests > 0 || c.RequestsPerSecond > 0
+}
+
+// update applies the limits of c. Requests already in flight keep their
+// slots; queued requests are admitted if the concurrency limit grew.
+func (l *groupLimiter) update(c cfg.LimitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maxConcurrent = c.MaxConcurrentRequests
+	l.maxQueued = c.MaxQueuedRequests
+	if l.maxQueued == 0 {
+		l.maxQueued = c.MaxConcurrentRequests
+	}
+	l.queueTimeout = c.QueueTimeout
+	if l.queueTimeout == 0 {
+		l.queueTimeout = defaultQueueTimeout
+	}
+
+	if c.RequestsPerSecond <= 0 {
+		l.rate = nil
+	} else {
+		burst := c.Burst
+		if burst == 0 {
+			burst = max(int(math.Ceil(c.RequestsPerSecond)), 1)
+		}
+		if l.rate == nil {
+			l.rate = rate.NewLimiter(rate.Limit(c.RequestsPerSecond), burst)
+		} else {
+			l.rate.SetLimit(rate.Limit(c.RequestsPerSecond))
+			l.rate.SetBurst(burst)
+		}
+	}
+	l.admit()
+}
+
+// acquire admits a request to the server group, waiting in the queue for a
+// free slot when needed. The returned func releases the slot and must be
+// called once the request is done.
+func (l *groupLimiter) acquire(ctx context.Context) (func(), error) {
+	l.mu.Lock()
+	if l.rate != nil && !l.rate.Allow() {
+		l.mu.Unlock()
+		return nil, errRateLimited
+	}
+	if l.maxConcurrent == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.release, nil
+	}
+	if l.inFlight < l.maxConcurrent && len(l.waiting) == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		l.recordWait(ctx, 0)
+		return l.release, nil
+	}
+	if len(l.waiting) >= l.maxQueued {
+		l.mu.Unlock()
+		return nil, fmt.Errorf("%w: wait queue is full", errConcurrencyLimited)
+	}
+	ready := make(chan struct{})
+	l.waiting = append(l.waiting, ready)
+	queueTimeout := l.queueTimeout
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		l.recordWait(ctx, time.Since(start))
+		return l.release, nil
+	case <-timer.C:
+		l.recordWait(ctx, time.Since(start))
+		err = fmt.Errorf("%w: no free slot within %s", errConcurrencyLimited, queueTimeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if !l.dequeue(ready) {
+		// The slot was handed over while giving up; pass it on.
+		l.release()
+	}
+	return nil, err
+}
+
+// tryAcquire admits a request only when the server group has a free slot
+// right away; it never queues. It reports false when the request is not
+// admitted.
+func (l *groupLimiter) tryAcquire() (func(), bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConcurrent > 0 && (l.inFlight >= l.maxConcurrent || len(l.waiting) > 0) {
+		return nil, false
+	}
+	if l.rate != nil && !l.rate.Allow() {
+		return nil, false
+	}
+	l.inFlight++
+	return l.release, true
+}
+
+func (l *groupLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.admit()
+}
+
+// admit hands free slots to the queued requests, oldest first. l.mu must be
+// held.
+func (l *groupLimiter) admit() {
+	for len(l.waiting) > 0 && (l.maxConcurrent == 0 || l.inFlight < l.maxConcurrent) {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		l.inFlight++
+	}
+}
+
+// dequeue removes a request that gave up waiting from the queue. It reports
+// false when the request was admitted in the meantime.
+func (l *groupLimiter) dequeue(ready chan struct{}) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := slices.Index(l.waiting, ready)
+	if i < 0 {
+		return false
+	}
+	l.waiting = slices.Delete(l.waiting, i, i+1)
+	return true
+}
+
+func (l *groupLimiter) queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.waiting)
+}
+
+func (l *groupLimiter) recordWait(ctx context.Context, wait time.Duration) {
+	metrics.ServerGroupQueueWait.Record(ctx, wait.Seconds(),
+		metric.WithAttributes(attribute.String("server_group", l.group)))
+}
+
+// groupLimiters keeps the limiters of the server groups. Like healthChecker
+// it is keyed by group name and outlives configuration reloads: a reload
+// resizes a group's limiter in place instead of replacing it, so requests
+// in flight under the old configuration still count against the new limits.
+type groupLimiters struct {
+	mu     sync.Mutex
+	groups map[string]*groupLimiter
+}
+
+func newGroupLimiters() *groupLimiters {
+	return &groupLimiters{groups: map[string]*groupLimiter{}}
+}
+
+// limiter returns the limiter of the server group updated to its current
+// limits, or nil when it has none.
+func (s *groupLimiters) limiter(instance cfg.ServerGroup) *groupLimiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !hasLimits(instance.Limits) {
+		delete(s.groups, instance.Name)
+		return nil
+	}
+	l, ok := s.groups[instance.Name]
+	if !ok {
+		l = newGroupLimiter(instance)
+		s.groups[instance.Name] = l
+		return l
+	}
+	l.update(instance.Limits)
+	return l
+}
+
+// prune forgets the limiters of server groups that are no longer
+// configured.
+func (s *groupLimiters) prune(config *cfg.Config) {
+	configured := map[string]bool{}
+	for _, sg := range config.ServerGroups {
+		configured[sg.Name] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.groups {
+		if !configured[name] {
+			delete(s.groups, name)
+		}
+	}
+}
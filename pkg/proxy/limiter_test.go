@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+func TestGroupLimiter_Concurrency(t *testing.T) {
+	l := newGroupLimiter(cfg.ServerGroup{
+		Name:   "loki1",
+		Limits: cfg.LimitsConfig{MaxConcurrentRequests: 1, MaxQueuedRequests: 1, QueueTimeout: 50 * time.Millisecond},
+	})
+	ctx := t.Context()
+
+	release, err := l.acquire(ctx)
+	require.NoError(t, err)
+
+	// The second request waits in the queue, the third finds it full.
+	queued := make(chan error)
+	go func() {
+		release, err := l.acquire(ctx)
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	require.Eventually(t, func() bool { return l.queued() == 1 }, time.Second, time.Millisecond)
+	_, err = l.acquire(ctx)
+	require.ErrorIs(t, err, errConcurrencyLimited)
+	require.Equal(t, "concurrency", limitReason(err))
+
+	release()
+	require.NoError(t, <-queued)
+
+	// A queued request gives up after the queue timeout.
+	release, err = l.acquire(ctx)
+	require.NoError(t, err)
+	defer release()
+	_, err = l.acquire(ctx)
+	require.ErrorIs(t, err, errConcurrencyLimited)
+	require.ErrorContains(t, err, "no free slot")
+}
+
+func TestGroupLimiter_Rate(t *testing.T) {
+	l := newGroupLimiter(cfg.ServerGroup{Name: "loki1", Limits: cfg.LimitsConfig{RequestsPerSecond: 1, Burst: 2}})
+
+	for range 2 {
+		release, err := l.acquire(t.Context())
+		require.NoError(t, err)
+		release()
+	}
+	_, err := l.acquire(t.Context())
+	require.ErrorIs(t, err, errRateLimited)
+	require.Equal(t, "rate", limitReason(err))
+}
+
+func TestGroupLimiter_Disabled(t *testing.T) {
+	require.Nil(t, newGroupLimiter(cfg.ServerGroup{Name: "loki1", Limits: cfg.LimitsConfig{QueueTimeout: time.Second}}))
+}
+
+func TestGroupLimiter_Update(t *testing.T) {
+	l := newGroupLimiter(cfg.ServerGroup{
+		Name:   "loki1",
+		Limits: cfg.LimitsConfig{MaxConcurrentRequests: 1, QueueTimeout: time.Second},
+	})
+	ctx := t.Context()
+
+	release, err := l.acquire(ctx)
+	require.NoError(t, err)
+	defer release()
+
+	queued := make(chan error)
+	go func() {
+		release, err := l.acquire(ctx)
+		if err == nil {
+			defer release()
+		}
+		queued <- err
+	}()
+	require.Eventually(t, func() bool { return l.queued() == 1 }, time.Second, time.Millisecond)
+
+	// Raising the limit admits the queued request straight away.
+	l.update(cfg.LimitsConfig{MaxConcurrentRequests: 2, QueueTimeout: time.Second})
+	require.NoError(t, <-queued)
+}
+
+func TestProxy_LimitsSurviveReload(t *testing.T) {
+	s := mkCountingServer(t, http.StatusOK, new(atomic.Int32))
+	mkLimited := func() *cfg.Config {
+		config := mkConfig(s.URL)
+		config.ServerGroups[0].Limits = cfg.LimitsConfig{MaxConcurrentRequests: 1, QueueTimeout: 10 * time.Millisecond}
+		return config
+	}
+	p, err := New(log.NewNopLogger(), mkLimited())
+	require.NoError(t, err)
+
+	l := p.state.Load().upstreams["sg1"].limiter
+	release, err := l.acquire(t.Context())
+	require.NoError(t, err)
+	defer release()
+
+	// The slot taken before the reload still counts afterwards.
+	require.NoError(t, p.ApplyConfig(mkLimited()))
+	reloaded := p.state.Load().upstreams["sg1"].limiter
+	require.Same(t, l, reloaded)
+	_, err = reloaded.acquire(t.Context())
+	require.ErrorIs(t, err, errConcurrencyLimited)
+
+	// Dropping the limits drops the limiter.
+	require.NoError(t, p.ApplyConfig(mkConfig(s.URL)))
+	require.Nil(t, p.state.Load().upstreams["sg1"].limiter)
+}
+
+func TestProxy_Limits(t *testing.T) {
+	var calls1, calls2 atomic.Int32
+	s1 := mkCountingServer(t, http.StatusOK, &calls1)
+	s2 := mkCountingServer(t, http.StatusOK, &calls2)
+
+	get := func(mux http.Handler) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+		return rr
+	}
+
+	t.Run("required group fails with 429", func(t *testing.T) {
+		config := mkConfig(s1.URL, s2.URL)
+		config.ServerGroups[1].Limits = cfg.LimitsConfig{RequestsPerSecond: 0.1, Burst: 1}
+		mux := mustMux(t, log.NewNopLogger(), config)
+
+		require.Equal(t, http.StatusOK, get(mux).Code)
+		rr := get(mux)
+		require.Equal(t, http.StatusTooManyRequests, rr.Code)
+		require.Equal(t, "sg2", rr.Header().Get("Failed-Backend"))
+		require.Contains(t, rr.Body.String(), "rate limit exceeded")
+	})
+
+	t.Run("optional group is left out", func(t *testing.T) {
+		calls2.Store(0)
+		config := mkConfig(s1.URL, s2.URL)
+		config.ServerGroups[1].IgnoreError = true
+		config.ServerGroups[1].Limits = cfg.LimitsConfig{RequestsPerSecond: 0.1, Burst: 1}
+		mux := mustMux(t, log.NewNopLogger(), config)
+
+		for range 3 {
+			require.Equal(t, http.StatusOK, get(mux).Code)
+		}
+		require.Equal(t, int32(1), calls2.Load())
+	})
+}
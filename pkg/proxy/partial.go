@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+const (
+	// partialResponseHeader lets a client override the error handling of
+	// the server groups for its request.
+	partialResponseHeader = "X-Lokxy-Partial-Response"
+
+	// missingGroupsHeader lists the server groups that did not contribute
+	// to a response.
+	missingGroupsHeader = "X-Lokxy-Missing-Server-Groups"
+
+	// partialStrict makes every server group required, so that a query
+	// either returns the data of all of them or fails.
+	partialStrict = "strict"
+
+	// partialAllow makes every server group optional: the errors of
+	// required groups are downgraded to warnings.
+	partialAllow = "allow"
+)
+
+// partialResponse returns the X-Lokxy-Partial-Response mode of the request,
+// or "" when it follows the groups' configuration.
+func partialResponse(r *http.Request) (string, error) {
+	switch mode := r.Header.Get(partialResponseHeader); mode {
+	case "", partialStrict, partialAllow:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid %s header %q: must be %s or %s", partialResponseHeader, mode, partialStrict, partialAllow)
+	}
+}
+
+// withPartialResponse returns the server groups with their error handling
+// overridden by mode. The configuration is left untouched.
+func withPartialResponse(groups []cfg.ServerGroup, mode string) []cfg.ServerGroup {
+	if mode == "" {
+		return groups
+	}
+	overridden := make([]cfg.ServerGroup, len(groups))
+	for i, sg := range groups {
+		switch mode {
+		case partialStrict:
+			sg.IgnoreError, sg.DowngradeError = false, false
+		case partialAllow:
+			if !sg.IgnoreError {
+				sg.DowngradeError = true
+			}
+		}
+		overridden[i] = sg
+	}
+	return overridden
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+func TestWithPartialResponse(t *testing.T) {
+	groups := []cfg.ServerGroup{
+		{Name: "required"},
+		{Name: "ignored", IgnoreError: true},
+		{Name: "downgraded", DowngradeError: true},
+	}
+
+	require.Equal(t, groups, withPartialResponse(groups, ""))
+
+	strict := withPartialResponse(groups, partialStrict)
+	for _, sg := range strict {
+		require.False(t, sg.IgnoreError || sg.DowngradeError, sg.Name)
+	}
+
+	allow := withPartialResponse(groups, partialAllow)
+	require.True(t, allow[0].DowngradeError)
+	require.True(t, allow[1].IgnoreError)
+	require.False(t, allow[1].DowngradeError)
+	require.True(t, allow[2].DowngradeError)
+
+	// The configured groups are left untouched.
+	require.False(t, groups[0].DowngradeError)
+	require.True(t, groups[1].IgnoreError)
+}
+
+func TestProxy_PartialResponse(t *testing.T) {
+	const target = "/loki/api/v1/query_range?query={app=\"a\"}"
+
+	serve := func(t *testing.T, config *cfg.Config, mode string) *httptest.ResponseRecorder {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if mode != "" {
+			req.Header.Set(partialResponseHeader, mode)
+		}
+		mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("ignored group is named", func(t *testing.T) {
+		var okCalls, failCalls atomic.Int32
+		ok := mkQueryRangeServer(t, http.StatusOK, &okCalls)
+		failing := mkQueryRangeServer(t, http.StatusInternalServerError, &failCalls)
+		config := mkConfig(ok.URL, failing.URL)
+		config.ServerGroups[1].IgnoreError = true
+
+		rr := serve(t, config, "")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.NotContains(t, rr.Body.String(), "warnings")
+		require.Equal(t, "sg2", rr.Header().Get(missingGroupsHeader))
+	})
+
+	t.Run("failed over groups are named", func(t *testing.T) {
+		var primaryCalls, drCalls, otherCalls atomic.Int32
+		primary := mkQueryRangeServer(t, http.StatusServiceUnavailable, &primaryCalls)
+		dr := mkQueryRangeServer(t, http.StatusOK, &drCalls)
+		other := mkQueryRangeServer(t, http.StatusOK, &otherCalls)
+		config := mkFailoverConfig(primary.URL, dr.URL)
+		config.ServerGroups = append(config.ServerGroups, cfg.ServerGroup{Name: "sg3", URL: other.URL})
+
+		rr := serve(t, config, "")
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "served by priority 1 (sg2)")
+		require.Equal(t, "sg1", rr.Header().Get(missingGroupsHeader))
+	})
+
+	t.Run("strict fails on an optional group", func(t *testing.T) {
+		var okCalls, failCalls atomic.Int32
+		ok := mkQueryRangeServer(t, http.StatusOK, &okCalls)
+		failing := mkQueryRangeServer(t, http.StatusInternalServerError, &failCalls)
+		config := mkConfig(ok.URL, failing.URL)
+		config.ServerGroups[1].IgnoreError = true
+
+		rr := serve(t, config, partialStrict)
+		require.Equal(t, http.StatusInternalServerError, rr.Code)
+		require.Equal(t, "sg2", rr.Header().Get("Failed-Backend"))
+	})
+
+	t.Run("allow downgrades a required group", func(t *testing.T) {
+		var okCalls, failCalls atomic.Int32
+		ok := mkQueryRangeServer(t, http.StatusOK, &okCalls)
+		failing := mkQueryRangeServer(t, http.StatusInternalServerError, &failCalls)
+		config := mkConfig(failing.URL, ok.URL)
+
+		rr := serve(t, config, partialAllow)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Contains(t, rr.Body.String(), "hello")
+		require.Contains(t, rr.Body.String(), `server group \"sg1\" error downgraded to warning`)
+		require.Equal(t, "sg1", rr.Header().Get(missingGroupsHeader))
+	})
+
+	t.Run("complete response", func(t *testing.T) {
+		var calls atomic.Int32
+		ok := mkQueryRangeServer(t, http.StatusOK, &calls)
+
+		rr := serve(t, mkConfig(ok.URL), partialAllow)
+		require.Equal(t, http.StatusOK, rr.Code)
+		require.Empty(t, rr.Header().Get(missingGroupsHeader))
+	})
+
+	t.Run("invalid mode", func(t *testing.T) {
+		var calls atomic.Int32
+		ok := mkQueryRangeServer(t, http.StatusOK, &calls)
+
+		rr := serve(t, mkConfig(ok.URL), "sometimes")
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		require.Zero(t, calls.Load())
+	})
+}
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -12,8 +11,11 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -24,7 +26,6 @@ import (
 	"go.opentelemetry.io/otel/metric"
 	semconv "go.opentelemetry.io/otel/semconv/v1.40.0"
 	"go.opentelemetry.io/otel/trace"
-	"golang.org/x/sync/errgroup"
 
 	cfg "github.com/paulojmdias/lokxy/pkg/config"
 	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
@@ -67,16 +68,22 @@ func redactHeaders(h http.Header) http.Header {
 	return redacted
 }
 
-// RoundTrip method allows us to inspect and modify requests/responses
-func (c *CustomRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	if ce := level.Debug(c.logger); ce != nil {
-		headersJSON, err := json.Marshal(redactHeaders(req.Header))
+// logUpstreamRequest logs an upstream request's URL and redacted headers at
+// debug level. The headers are only marshaled when debug logging is enabled.
+func logUpstreamRequest(logger log.Logger, url string, header http.Header) {
+	if ce := level.Debug(logger); ce != nil {
+		headersJSON, err := json.Marshal(redactHeaders(header))
 		if err != nil {
-			_ = level.Error(c.logger).Log("msg", "Failed to marshal headers for logging", "err", err)
+			_ = level.Error(logger).Log("msg", "Failed to marshal headers for logging", "err", err)
 		} else {
-			_ = ce.Log("msg", "Custom RoundTrip", "url", req.URL.String(), "headers", string(headersJSON))
+			_ = ce.Log("msg", "Custom RoundTrip", "url", url, "headers", string(headersJSON))
 		}
 	}
+}
+
+// RoundTrip method allows us to inspect and modify requests/responses
+func (c *CustomRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	logUpstreamRequest(c.logger, req.URL.String(), req.Header)
 
 	// Perform the actual request
 	resp, err := c.rt.RoundTrip(req)
@@ -84,22 +91,21 @@ func (c *CustomRoundTripper) RoundTrip(req *http.Request) (*http.Response, error
 		return nil, err
 	}
 
-	// Log and handle the response as needed
-	if resp.Header.Get("Content-Encoding") == "gzip" {
-		gzReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			resp.Body.Close()
-			return nil, err
-		}
-		resp.Body = io.NopCloser(gzReader) // Prevent early closure
+	// Decode gzip, zstd and snappy bodies so the merge handlers always see
+	// the plain payload.
+	if err := decodeResponseBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
 	}
 
 	// Add any custom behavior for the response here, if needed
 	return resp, nil
 }
 
-// Function to create an HTTP client dynamically
-func createHTTPClient(instance cfg.ServerGroup, logger log.Logger) (*http.Client, error) {
+// createTransport builds the transport for a server group from its TLS,
+// dial, proxy and transport settings. It is shared by the HTTP client and the
+// tail WebSocket dialer.
+func createTransport(instance cfg.ServerGroup) (*http.Transport, error) {
 	// Set default timeout
 	dialTimeout := instance.HTTPClientConfig.DialTimeout
 	if dialTimeout == 0 {
@@ -131,6 +137,16 @@ func createHTTPClient(instance cfg.ServerGroup, logger log.Logger) (*http.Client
 		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
+	// Without a proxy_url, connections are made directly.
+	var proxy func(*http.Request) (*url.URL, error)
+	if instance.HTTPClientConfig.ProxyURL != "" {
+		proxyURL, err := url.Parse(instance.HTTPClientConfig.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
 	// Create HTTP transport with the custom TLS configuration and dial timeout
 	dialer := &net.Dialer{
 		Timeout: dialTimeout,
@@ -167,6 +183,7 @@ func createHTTPClient(instance cfg.ServerGroup, logger log.Logger) (*http.Client
 	}
 
 	transport := &http.Transport{
+		Proxy:                 proxy,
 		TLSClientConfig:       tlsConfig,
 		DialContext:           dialer.DialContext,
 		DisableKeepAlives:     tc.DisableKeepAlives,
@@ -178,30 +195,49 @@ func createHTTPClient(instance cfg.ServerGroup, logger log.Logger) (*http.Client
 		ForceAttemptHTTP2:     forceHTTP2,
 	}
 
-	client := &http.Client{
-		Timeout:   time.Duration(instance.Timeout) * time.Second,
-		Transport: &CustomRoundTripper{rt: transport, logger: logger},
-	}
+	return transport, nil
+}
 
-	return client, nil
+// maxUpstreamQueryLength is the longest query string sent upstream on a GET
+// request. Longer queries to formUpstreamPaths are sent as a POST body.
+const maxUpstreamQueryLength = 4096
+
+// formUpstreamPaths are the Loki endpoints that accept their parameters as a
+// form-encoded POST body.
+var formUpstreamPaths = map[string]bool{
+	"/loki/api/v1/query":       true,
+	"/loki/api/v1/query_range": true,
+	"/loki/api/v1/series":      true,
+	"/loki/api/v1/labels":      true,
 }
 
+// errRequiredGroupFailed cancels the server groups still pending once a
+// required one failed, as the query fails whatever they answer.
+var errRequiredGroupFailed = errors.New("a required server group failed")
+
 type (
 	// Proxy fans requests out to the configured server groups. The loaded
-	// configuration and the HTTP clients built from it are held in an
+	// configuration and the upstreams built from it are held in an
 	// atomically swappable snapshot so the configuration can be reloaded at
 	// runtime without a restart.
 	Proxy struct {
-		logger log.Logger
-		state  atomic.Pointer[proxyState]
+		logger    log.Logger
+		state     atomic.Pointer[proxyState]
+		tails     *handler.TailSessions
+		health    *healthChecker
+		limiters  *groupLimiters
+		breakers  *circuitBreakers
+		endpoints *endpointStates
+		shed      *loadShedder
+		scheduler *queryScheduler
 	}
 
 	// proxyState is an immutable snapshot of a loaded configuration and the
-	// HTTP clients built from it. Each request loads one snapshot and uses it
+	// upstreams built from it. Each request loads one snapshot and uses it
 	// for its whole lifetime, so a request never mixes old and new config.
 	proxyState struct {
-		config  *cfg.Config
-		clients map[string]*http.Client
+		config    *cfg.Config
+		upstreams map[string]*upstream
 	}
 
 	transformFn func(context.Context, http.ResponseWriter, <-chan *proxyresponse.BackendResponse, []string, log.Logger)
@@ -217,14 +253,23 @@ type (
 // New builds a Proxy from the given configuration. It fails if any server
 // group's HTTP client cannot be created (e.g. an unreadable TLS file).
 func New(logger log.Logger, config *cfg.Config) (*Proxy, error) {
-	p := &Proxy{logger: logger}
+	p := &Proxy{
+		logger:    logger,
+		tails:     handler.NewTailSessions(),
+		health:    newHealthChecker(),
+		limiters:  newGroupLimiters(),
+		breakers:  newCircuitBreakers(),
+		endpoints: newEndpointStates(),
+		shed:      &loadShedder{},
+		scheduler: newQueryScheduler(),
+	}
 	if err := p.ApplyConfig(config); err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
-// ApplyConfig atomically replaces the proxy's configuration and HTTP clients.
+// ApplyConfig atomically replaces the proxy's configuration and upstreams.
 // If any client cannot be built, the previous configuration stays active and
 // the error is returned. In-flight requests keep using the snapshot they
 // started with; idle connections of the replaced clients are closed.
@@ -233,25 +278,38 @@ func (p *Proxy) ApplyConfig(config *cfg.Config) error {
 	if err != nil {
 		return err
 	}
+	// Limiters, breakers and endpoint state are kept across reloads:
+	// requests still in flight on the replaced upstreams count against the
+	// new limits, and open breakers and ejected endpoints stay so.
+	for _, u := range state.upstreams {
+		u.limiter = p.limiters.limiter(u.group)
+		u.breaker = p.breakers.breaker(u.group, p.logger)
+		p.endpoints.restore(u.endpoints)
+	}
+	p.limiters.prune(config)
+	p.breakers.prune(config)
+	p.endpoints.prune(config)
 	old := p.state.Swap(state)
 	if old != nil {
-		for _, client := range old.clients {
-			client.CloseIdleConnections()
+		for _, u := range old.upstreams {
+			for _, e := range u.endpoints.endpoints {
+				e.client.CloseIdleConnections()
+			}
 		}
 	}
 	return nil
 }
 
 func buildState(config *cfg.Config, logger log.Logger) (*proxyState, error) {
-	clients := make(map[string]*http.Client, len(config.ServerGroups))
+	upstreams := make(map[string]*upstream, len(config.ServerGroups))
 	for _, instance := range config.ServerGroups {
-		client, err := createHTTPClient(instance, logger)
+		u, err := newUpstream(instance, logger)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create HTTP client for server group %q: %w", instance.Name, err)
 		}
-		clients[instance.Name] = client
+		upstreams[instance.Name] = u
 	}
-	return &proxyState{config: config, clients: clients}, nil
+	return &proxyState{config: config, upstreams: upstreams}, nil
 }
 
 // Handler returns the proxy's request handler. The routes are fixed; the
@@ -263,7 +321,15 @@ func (p *Proxy) Handler() func(http.ResponseWriter, *http.Request) {
 	mux.HandleFunc("/loki/api/v1/tail", func(w http.ResponseWriter, r *http.Request) {
 		span := trace.SpanFromContext(r.Context())
 		span.SetAttributes(attribute.String("proxy.route_type", "websocket"))
-		handler.HandleTailWebSocket(r.Context(), w, r, p.state.Load().config, logger)
+		handler.HandleTailWebSocket(r.Context(), w, r, p.state.Load().config, tailDialer{p}, p.tails, logger)
+	})
+
+	// Live tail over a plain HTTP response, as server-sent events or
+	// newline-delimited JSON, for clients that cannot use WebSockets.
+	mux.HandleFunc("/lokxy/api/v1/tail", func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("proxy.route_type", "tail_stream"))
+		handler.HandleTailStream(r.Context(), w, withUpstreamPath(r, "/loki/api/v1/tail"), p.state.Load().config, tailDialer{p}, p.tails, logger)
 	})
 
 	mux.HandleFunc("/loki/api/v1/label/{name}/values", func(w http.ResponseWriter, r *http.Request) {
@@ -297,12 +363,16 @@ func (p *Proxy) Handler() func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		p.fanoutRequest(w, r, handler.HandleLokiQueries)
+		p.fanoutRequest(w, withProtobufAccept(r), queryTransform(r))
+	})
+	mux.HandleFunc("/loki/api/v1/query_range", func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("proxy.route_type", "api_route"))
+		p.fanoutRequest(w, withProtobufAccept(r), queryTransform(r))
 	})
 
 	// Variable to hold the API routes and their corresponding handlers
 	apiRoutes := map[string]transformFn{
-		"/loki/api/v1/query_range":        handler.HandleLokiQueries,
 		"/loki/api/v1/series":             handler.HandleLokiSeries,
 		"/loki/api/v1/index/stats":        handler.HandleLokiStats,
 		"/loki/api/v1/labels":             handler.HandleLokiLabels,
@@ -311,6 +381,9 @@ func (p *Proxy) Handler() func(http.ResponseWriter, *http.Request) {
 		"/loki/api/v1/detected_labels":    handler.HandleLokiDetectedLabels,
 		"/loki/api/v1/patterns":           handler.HandleLokiPatterns,
 		"/loki/api/v1/detected_fields":    handler.HandleLokiDetectedFields,
+		"/loki/api/v1/rules":              handler.HandleLokiRules,
+		"/prometheus/api/v1/rules":        handler.HandlePrometheusRules,
+		"/prometheus/api/v1/alerts":       handler.HandlePrometheusAlerts,
 	}
 	for path, handlerFunc := range apiRoutes {
 		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
@@ -320,6 +393,49 @@ func (p *Proxy) Handler() func(http.ResponseWriter, *http.Request) {
 		})
 	}
 
+	// A namespace of the merged rules view is read from, or written to, the
+	// server group it is tagged with. The last route catches tagged
+	// namespaces sent without percent-encoding.
+	for _, path := range []string{"/loki/api/v1/rules/{namespace}", "/loki/api/v1/rules/{namespace}/{group}", "/loki/api/v1/rules/{namespace}/{group}/{rest...}"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.String("proxy.route_type", "api_route"))
+			p.handleRuleNamespace(w, r)
+		})
+	}
+
+	// Prometheus-compatible API backed by LogQL metric queries. Requests are
+	// forwarded to the equivalent Loki endpoint and, for queries, the merged
+	// result is encoded in the Prometheus response format. Series and label
+	// responses already share the Prometheus format.
+	prometheusRoutes := map[string]struct {
+		lokiPath string
+		fn       transformFn
+		protobuf bool
+	}{
+		"/prometheus/api/v1/query":       {"/loki/api/v1/query", handler.HandlePrometheusQueries, true},
+		"/prometheus/api/v1/query_range": {"/loki/api/v1/query_range", handler.HandlePrometheusQueries, true},
+		"/prometheus/api/v1/series":      {"/loki/api/v1/series", handler.HandleLokiSeries, false},
+		"/prometheus/api/v1/labels":      {"/loki/api/v1/labels", handler.HandleLokiLabels, false},
+	}
+	for path, route := range prometheusRoutes {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			span := trace.SpanFromContext(r.Context())
+			span.SetAttributes(attribute.String("proxy.route_type", "prometheus_api"))
+			upstream := withUpstreamPath(r, route.lokiPath)
+			if route.protobuf {
+				upstream = withProtobufAccept(upstream)
+			}
+			p.fanoutRequest(w, upstream, route.fn)
+		})
+	}
+	mux.HandleFunc("/prometheus/api/v1/label/{name}/values", func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		span.SetAttributes(attribute.String("proxy.route_type", "prometheus_api"))
+		lokiPath := "/loki/api/v1/label/" + r.PathValue("name") + "/values"
+		p.fanoutRequest(w, withUpstreamPath(r, lokiPath), handler.HandleLokiLabels)
+	})
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		span := trace.SpanFromContext(r.Context())
 		span.SetAttributes(attribute.String("proxy.route_type", "first_response"))
@@ -342,8 +458,98 @@ func (p *Proxy) Handler() func(http.ResponseWriter, *http.Request) {
 
 		level.Info(logger).Log("msg", "Handling request", "method", method, "path", path, "query", r.URL.RawQuery)
 
-		mux.ServeHTTP(w, r.WithContext(ctx))
+		r = r.WithContext(ctx)
+
+		// Shed load before doing any work, the request body included.
+		// Grafana's datasource health check, a GET, is answered without
+		// contacting the server groups and is exempt.
+		if !(path == "/loki/api/v1/query" && handler.IsGrafanaHealthCheck(r)) {
+			shedding := p.state.Load().config.LoadShedding
+			kind := shedKindRequest
+			if path == "/loki/api/v1/tail" || path == "/lokxy/api/v1/tail" {
+				kind = shedKindTail
+			}
+			release, reason, ok := p.shed.admit(ctx, kind, shedding)
+			if !ok {
+				span.SetAttributes(attribute.String("proxy.shed_reason", reason))
+				level.Warn(logger).Log("msg", "Shedding request", "kind", kind, "reason", reason, "path", path)
+				shed(w, r, kind, reason, shedding, logger)
+				return
+			}
+			defer release()
+		}
+
+		// Parse the parameters once, from the query string and any
+		// form-encoded body, so routing and handlers see the same values
+		// whether the client used GET or POST. Malformed parameters only
+		// fail the routes that read them; other requests are forwarded as
+		// they are.
+		params, err := handler.ParseParams(r)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "Failed to read request body")
+			level.Error(logger).Log("msg", "Failed to read request body", "err", err)
+			writeError(w, r, http.StatusBadRequest, "Failed to read request body", logger)
+			return
+		}
+		if params.Err != nil {
+			level.Debug(logger).Log("msg", "Malformed request parameters", "path", path, "err", params.Err)
+		}
+		r = handler.WithParams(r, params)
+
+		compression := p.state.Load().config.ResponseCompression
+		// WebSocket upgrades hijack the connection and are never compressed.
+		if !compression.Enabled || r.Header.Get("Upgrade") != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		cw := newCompressResponseWriter(w, r, encoding, compression)
+		mux.ServeHTTP(cw, r)
+		if err := cw.Close(); err != nil {
+			level.Error(logger).Log("msg", "Failed to compress response", "encoding", encoding, "err", err)
+		}
+	}
+}
+
+// withUpstreamPath returns a shallow copy of r whose URL path is replaced, so
+// the request is forwarded to a different upstream endpoint. The matched
+// route pattern is kept for metrics.
+func withUpstreamPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	r2.URL = &u
+	return r2
+}
+
+// withProtobufAccept returns a shallow copy of r that asks upstreams for a
+// protobuf encoded response. Upstreams that do not support it answer in JSON;
+// the merge handlers decode either based on the response Content-Type.
+func withProtobufAccept(r *http.Request) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	if r2.Header == nil {
+		r2.Header = make(http.Header)
 	}
+	r2.Header.Set("Accept", handler.ProtobufContentType)
+	return r2
+}
+
+// queryTransform picks the merge handler for a query or query_range request
+// from the client's Accept header, falling back to JSON.
+func queryTransform(r *http.Request) transformFn {
+	if handler.AcceptsProtobuf(r) {
+		return handler.HandleLokiQueriesProtobuf
+	}
+	return handler.HandleLokiQueries
 }
 
 // Forward the first valid response for non-query endpoints
@@ -385,7 +591,61 @@ func forwardFirstResponse(_ context.Context, w http.ResponseWriter, results <-ch
 	}
 }
 
+// isPrometheusAPI reports whether r was sent to the Prometheus-compatible
+// API, whose clients expect errors in the Prometheus format. The matched
+// route is checked too, since a routed request is already rewritten to its
+// upstream Loki path.
+func isPrometheusAPI(r *http.Request) bool {
+	const prefix = "/prometheus/api/v1/"
+	return strings.HasPrefix(r.Pattern, prefix) || strings.HasPrefix(r.URL.Path, prefix)
+}
+
+// writeError answers a request that failed in lokxy itself: in the
+// Prometheus error format on the Prometheus-compatible API, and as plain
+// text elsewhere.
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string, logger log.Logger) {
+	if isPrometheusAPI(r) {
+		handler.WritePrometheusError(w, status, handler.PrometheusErrorType(status), msg, logger)
+		return
+	}
+	http.Error(w, msg, status)
+}
+
+// forwardBackendErrors sends the failures of the server groups to the
+// client, in the Prometheus error format on the Prometheus-compatible API.
+func (p *Proxy) forwardBackendErrors(w http.ResponseWriter, r *http.Request, errs []*proxyresponse.BackendError) {
+	if !isPrometheusAPI(r) {
+		proxyresponse.ForwardBackendErrors(w, errs, p.logger)
+		return
+	}
+	status, names, message := proxyresponse.SummarizeBackendErrors(proxyresponse.SortBackendErrors(errs))
+	level.Error(p.logger).Log(
+		"msg", "Forwarding backend errors to client",
+		"backends", strings.Join(names, ","),
+		"status", status,
+	)
+	w.Header().Set("Failed-Backend", strings.Join(names, ","))
+	handler.WritePrometheusError(w, status, handler.PrometheusErrorType(status), message, p.logger)
+}
+
 func (p *Proxy) fanoutRequest(w http.ResponseWriter, r *http.Request, fn transformFn) {
+	// Wait for the request's turn behind the requests of other tenants.
+	if scheduler := p.state.Load().config.QueryScheduler; scheduler.Enabled() {
+		tenant := requestTenant(r)
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("proxy.tenant", tenant))
+		release, err := p.scheduler.schedule(r.Context(), tenant, scheduler)
+		if err != nil {
+			if !errors.Is(err, errTenantQueueFull) && !errors.Is(err, errTenantQueueTimeout) {
+				level.Debug(p.logger).Log("msg", "Request cancelled while queued", "tenant", tenant, "err", err)
+				return
+			}
+			level.Warn(p.logger).Log("msg", "Rejecting queued request", "tenant", tenant, "err", err)
+			writeError(w, r, http.StatusTooManyRequests, fmt.Sprintf("%s %q", err, tenant), p.logger)
+			return
+		}
+		defer release()
+	}
+
 	startTime := time.Now()
 
 	// Load one snapshot for the whole request so the server groups and the
@@ -394,6 +654,33 @@ func (p *Proxy) fanoutRequest(w http.ResponseWriter, r *http.Request, fn transfo
 
 	// Read the original request body once
 	span := trace.SpanFromContext(r.Context())
+
+	// Optional server groups still pending at the soft deadline are
+	// cancelled, so the results that arrived are returned without them.
+	softTimeout, err := softDeadline(r, st.config.SoftDeadline)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "Invalid soft deadline", "err", err)
+		writeError(w, r, http.StatusBadRequest, err.Error(), p.logger)
+		return
+	}
+	var softDeadlineAt time.Time
+	if softTimeout > 0 {
+		softDeadlineAt = startTime.Add(softTimeout)
+	}
+
+	// Clients may make every server group required or optional for their
+	// request, whatever the groups are configured with.
+	partialMode, err := partialResponse(r)
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "Invalid partial response mode", "err", err)
+		writeError(w, r, http.StatusBadRequest, err.Error(), p.logger)
+		return
+	}
+	if partialMode != "" {
+		span.SetAttributes(attribute.String("proxy.partial_response", partialMode))
+	}
+	groups := withPartialResponse(requestServerGroups(r, st.config.ServerGroups), partialMode)
+
 	var bodyBytes []byte
 	if r.Body != nil {
 		var err error
@@ -402,210 +689,361 @@ func (p *Proxy) fanoutRequest(w http.ResponseWriter, r *http.Request, fn transfo
 			span.RecordError(err)
 			span.SetStatus(codes.Error, "Failed to read request body")
 			level.Error(p.logger).Log("msg", "Failed to read request body", "err", err)
-			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			writeError(w, r, http.StatusBadRequest, "Failed to read request body", p.logger)
 			return
 		}
 		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 	}
 
-	// Function to create a fresh reader for each request
-	bodyReader := func() io.ReadCloser {
-		return io.NopCloser(bytes.NewReader(bodyBytes))
+	// Long GET queries are sent upstream as a form-encoded POST, which Loki
+	// accepts on its query endpoints, so they do not hit URL length limits.
+	method, rawQuery := r.Method, r.URL.RawQuery
+	asForm := method == http.MethodGet && len(rawQuery) > maxUpstreamQueryLength && formUpstreamPaths[r.URL.Path]
+	if asForm {
+		level.Debug(p.logger).Log("msg", "Sending long GET query upstream as POST", "path", r.URL.Path, "length", len(rawQuery))
+		method = http.MethodPost
+		bodyBytes = []byte(rawQuery)
+		rawQuery = ""
 	}
+
+	// The retries of all server groups draw from one budget per request.
+	budget := newRetryBudget(st.config.RetryBudget)
 	results := make(chan *proxyresponse.BackendResponse, len(st.config.ServerGroups))
 	// softErrs collects failures from server groups configured with
 	// ignore_error/downgrade_error so they do not fail the overall query.
 	softErrs := make(chan softFailure, len(st.config.ServerGroups))
 	ctx := r.Context()
 
-	// Forward requests using the custom RoundTripper
-	wg, ctx := errgroup.WithContext(ctx)
-	for _, instance := range st.config.ServerGroups {
-		wg.Go(func() error {
-			// Classify this server group's error-handling policy. A required
-			// group (the default) fails the whole query on error; an optional
-			// group's failure is recorded as a soft failure instead. The two
-			// flags are mutually exclusive (enforced by config.Validate).
-			optional := instance.IgnoreError || instance.DowngradeError
-			downgrade := instance.DowngradeError
-			recordFailure := func(berr *proxyresponse.BackendError) error {
-				if !optional {
-					return berr
-				}
-				softErrs <- softFailure{berr: berr, downgrade: downgrade}
-				return nil
+	// queryGroup sends the request to one server group and returns its
+	// response, or the error it failed with.
+	queryGroup := func(ctx context.Context, instance cfg.ServerGroup) (_ *proxyresponse.BackendResponse, groupErr *proxyresponse.BackendError) {
+		// Optional groups are those whose failure does not fail the query.
+		optional := instance.IgnoreError || instance.DowngradeError
+
+		defer func() {
+			if groupErr != nil && groupErr.StatusCode == 0 && errors.Is(context.Cause(ctx), errRequiredGroupFailed) {
+				groupErr.Err = fmt.Errorf("%w: %w", errRequiredGroupFailed, groupErr.Err)
 			}
+		}()
+		if optional && !softDeadlineAt.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadlineCause(ctx, softDeadlineAt, errSoftDeadline)
+			defer cancel()
+			defer func() {
+				if groupErr != nil && groupErr.StatusCode == 0 && errors.Is(context.Cause(ctx), errSoftDeadline) {
+					groupErr.Err = fmt.Errorf("%w after %s: %w", errSoftDeadline, softTimeout, groupErr.Err)
+				}
+			}()
+		}
 
-			upstreamCtx, requestSpan := traces.CreateSpan(ctx, "proxy_upstream_request", trace.WithSpanKind(trace.SpanKindClient))
-			defer requestSpan.End()
+		upstreamCtx, requestSpan := traces.CreateSpan(ctx, "proxy_upstream_request", trace.WithSpanKind(trace.SpanKindClient))
+		defer requestSpan.End()
 
+		groupURL := strings.Join(instance.Endpoints(), ",")
+		requestSpan.SetAttributes(
+			attribute.String("upstream.name", instance.Name),
+			attribute.String("upstream.url", groupURL),
+		)
+		if instance.FailoverGroup != "" {
 			requestSpan.SetAttributes(
-				attribute.String("upstream.name", instance.Name),
-				attribute.String("upstream.url", instance.URL),
+				attribute.String("upstream.failover_group", instance.FailoverGroup),
+				attribute.Int("upstream.priority", instance.Priority),
 			)
+		}
 
-			client, ok := st.clients[instance.Name]
-			if !ok {
-				requestSpan.SetStatus(codes.Error, "Missing HTTP client")
-				level.Error(p.logger).Log("msg", "Missing HTTP client", "instance", instance.Name)
-				return recordFailure(&proxyresponse.BackendError{
-					Err:         fmt.Errorf("missing HTTP client for instance %s", instance.Name),
-					BackendName: instance.Name,
-					BackendURL:  instance.URL,
-				})
+		// An optional or failover group its health check found down is
+		// skipped rather than waited for.
+		if (optional || instance.FailoverGroup != "") && instance.HealthCheck.ExcludeWhenDown && p.health.isDown(instance.Name) {
+			requestSpan.SetAttributes(attribute.Bool("upstream.excluded", true))
+			level.Debug(p.logger).Log("msg", "Skipping server group that is down", "instance", instance.Name)
+			return nil, &proxyresponse.BackendError{
+				Err:         fmt.Errorf("server group %s is down according to its health check", instance.Name),
+				BackendName: instance.Name,
+				BackendURL:  groupURL,
 			}
+		}
 
-			targetURL := instance.URL + r.URL.Path
-			if r.URL.RawQuery != "" {
-				targetURL += "?" + r.URL.RawQuery
+		u, ok := st.upstreams[instance.Name]
+		if !ok {
+			requestSpan.SetStatus(codes.Error, "Missing HTTP client")
+			level.Error(p.logger).Log("msg", "Missing HTTP client", "instance", instance.Name)
+			return nil, &proxyresponse.BackendError{
+				Err:         fmt.Errorf("missing HTTP client for instance %s", instance.Name),
+				BackendName: instance.Name,
+				BackendURL:  groupURL,
 			}
+		}
 
-			requestSpan.SetAttributes(attribute.String("upstream.target_url", targetURL))
-
-			// Record the request
-			metrics.RequestCount.Add(upstreamCtx, 1, metric.WithAttributes(
-				attribute.String("path", r.Pattern),
-				attribute.String("method", r.Method),
-				attribute.String("server_group", instance.Name),
-			))
-
-			req, err := http.NewRequestWithContext(upstreamCtx, r.Method, targetURL, bodyReader())
+		// Requests over the group's concurrency or rate limit are
+		// rejected with 429.
+		if u.limiter != nil {
+			release, err := u.limiter.acquire(upstreamCtx)
 			if err != nil {
 				requestSpan.RecordError(err)
-				requestSpan.SetStatus(codes.Error, "Failed to create request")
-				// Record error count
-				metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
-					attribute.String("path", r.Pattern),
-					attribute.String("method", r.Method),
-					attribute.String("server_group", instance.Name),
-				))
-				level.Error(p.logger).Log("msg", "Failed to create request", "instance", instance.Name, "err", err)
-				return recordFailure(&proxyresponse.BackendError{
+				berr := &proxyresponse.BackendError{
 					Err:         err,
 					BackendName: instance.Name,
-					BackendURL:  instance.URL,
-				})
-			}
-
-			req.Header = r.Header.Clone()
-			for key, value := range instance.Headers {
-				req.Header.Set(key, value)
-			}
-
-			traces.InjectTraceToHTTPRequest(upstreamCtx, req)
-
-			if ce := level.Debug(p.logger); ce != nil {
-				for name, headers := range redactHeaders(req.Header) {
-					for _, h := range headers {
-						_ = ce.Log("msg", "Request Header", "Name", name, "Value", h)
-					}
+					BackendURL:  groupURL,
 				}
+				if reason := limitReason(err); reason != "" {
+					requestSpan.SetStatus(codes.Error, "Server group limit exceeded")
+					metrics.ServerGroupLimited.Add(upstreamCtx, 1, metric.WithAttributes(
+						attribute.String("path", r.Pattern),
+						attribute.String("method", r.Method),
+						attribute.String("server_group", instance.Name),
+						attribute.String("reason", reason),
+					))
+					level.Warn(p.logger).Log("msg", "Server group limit exceeded, rejecting request", "instance", instance.Name, "err", err)
+					berr.StatusCode = http.StatusTooManyRequests
+					berr.Data = []byte(err.Error())
+				}
+				return nil, berr
 			}
+			defer release()
+		}
 
-			resp, err := client.Do(req)
-			if err != nil {
-				requestSpan.RecordError(err)
-				requestSpan.SetStatus(codes.Error, "Error querying Loki instance")
-				// Record error count
-				metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
+		// While the group's circuit breaker is open, requests fail at
+		// once instead of waiting for it.
+		result := breakerIgnored
+		if u.breaker != nil {
+			state, allowed := u.breaker.allow(upstreamCtx)
+			requestSpan.SetAttributes(attribute.String("upstream.circuit_breaker_state", state.String()))
+			if !allowed {
+				metrics.CircuitBreakerRejected.Add(upstreamCtx, 1, metric.WithAttributes(
 					attribute.String("path", r.Pattern),
 					attribute.String("method", r.Method),
 					attribute.String("server_group", instance.Name),
 				))
-				level.Error(p.logger).Log("msg", "Error querying Loki instance", "instance", instance.Name, "err", err)
-				return recordFailure(&proxyresponse.BackendError{
-					Err:         err,
+				level.Debug(p.logger).Log("msg", "Circuit breaker is open, failing request", "instance", instance.Name)
+				return nil, &proxyresponse.BackendError{
+					Err:         errCircuitOpen,
 					BackendName: instance.Name,
-					BackendURL:  instance.URL,
-				})
+					BackendURL:  groupURL,
+				}
 			}
+			defer func() { u.breaker.done(upstreamCtx, state, result) }()
+		}
 
-			requestSpan.SetAttributes(
-				attribute.Int("upstream.status_code", resp.StatusCode),
-				attribute.String("upstream.content_type", resp.Header.Get("Content-Type")),
-				attribute.Int64("upstream.content_length", resp.ContentLength),
-			)
+		// Record the request
+		metrics.RequestCount.Add(upstreamCtx, 1, metric.WithAttributes(
+			attribute.String("path", r.Pattern),
+			attribute.String("method", r.Method),
+			attribute.String("server_group", instance.Name),
+		))
 
-			// Measure response time
-			metrics.RequestDuration.Record(upstreamCtx, time.Since(startTime).Seconds(),
-				metric.WithAttributes(
-					attribute.String("path", r.Pattern),
-					attribute.String("method", r.Method),
-					attribute.String("server_group", instance.Name),
-				),
+		resp, err := u.do(upstreamCtx, requestSpan, upstreamRequest{
+			method:   method,
+			path:     r.URL.EscapedPath(),
+			rawQuery: rawQuery,
+			body:     bodyBytes,
+			header:   r.Header,
+			asForm:   asForm,
+			pattern:  r.Pattern,
+			budget:   budget,
+		})
+		if err != nil {
+			requestSpan.RecordError(err)
+			requestSpan.SetStatus(codes.Error, "Error querying Loki instance")
+			// Record error count
+			metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
+				attribute.String("path", r.Pattern),
+				attribute.String("method", r.Method),
+				attribute.String("server_group", instance.Name),
+			))
+			if upstreamCtx.Err() == nil {
+				result = breakerFailure
+			}
+			level.Error(p.logger).Log("msg", "Error querying Loki instance", "instance", instance.Name, "err", err)
+			return nil, &proxyresponse.BackendError{
+				Err:         err,
+				BackendName: instance.Name,
+				BackendURL:  groupURL,
+			}
+		}
+
+		requestSpan.SetAttributes(
+			attribute.String("upstream.target_url", resp.Request.URL.String()),
+			attribute.Int("upstream.status_code", resp.StatusCode),
+			attribute.String("upstream.content_type", resp.Header.Get("Content-Type")),
+			attribute.Int64("upstream.content_length", resp.ContentLength),
+		)
+
+		// Measure response time
+		metrics.RequestDuration.Record(upstreamCtx, time.Since(startTime).Seconds(),
+			metric.WithAttributes(
+				attribute.String("path", r.Pattern),
+				attribute.String("method", r.Method),
+				attribute.String("server_group", instance.Name),
+			),
+		)
+
+		// Only server errors count against the circuit breaker; a
+		// client error is the request's fault.
+		result = breakerSuccess
+		if resp.StatusCode >= 500 {
+			result = breakerFailure
+		}
+
+		// Server groups without rules answer 404 on the rules endpoints;
+		// to a read, that is an empty rule set, not a failure.
+		if resp.StatusCode == http.StatusNotFound && r.Method == http.MethodGet && emptyOnNotFoundPatterns[r.Pattern] {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			resp.Body = http.NoBody
+			return &proxyresponse.BackendResponse{
+				Response:    resp,
+				BackendName: instance.Name,
+				BackendURL:  groupURL,
+			}, nil
+		}
+
+		// Check for error response (non-2xx status code)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			level.Error(p.logger).Log(
+				"msg", "Backend returned error response",
+				"instance", instance.Name,
+				"status", resp.StatusCode,
 			)
 
-			// Check for error response (non-2xx status code)
-			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			// drain the body
+			bodyBytes, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
 				level.Error(p.logger).Log(
-					"msg", "Backend returned error response",
-					"instance", instance.Name,
-					"status", resp.StatusCode,
+					"msg", "Failed to read error response body",
+					"backend", instance.Name,
+					"err", err,
 				)
-
-				// drain the body
-				bodyBytes, err := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				if err != nil {
-					level.Error(p.logger).Log(
-						"msg", "Failed to read error response body",
-						"backend", instance.Name,
-						"err", err,
-					)
-					bodyBytes = []byte("Failed to read error response")
-				}
-				return recordFailure(&proxyresponse.BackendError{
-					Err:         fmt.Errorf("non-2xx response from the upstream: %s", instance.Name),
-					BackendName: instance.Name,
-					BackendURL:  instance.URL,
-					StatusCode:  resp.StatusCode,
-					Data:        bodyBytes,
-				})
+				bodyBytes = []byte("Failed to read error response")
 			}
-			respBodyBytes, err := io.ReadAll(resp.Body)
-			_ = resp.Body.Close()
-			if err != nil {
-				requestSpan.RecordError(err)
-				requestSpan.SetStatus(codes.Error, "Failed to read upstream response body")
-				metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
-					attribute.String("path", r.Pattern),
-					attribute.String("method", r.Method),
-					attribute.String("server_group", instance.Name),
-				))
-				level.Error(p.logger).Log("msg", "Failed to read upstream response body", "instance", instance.Name, "err", err)
-				return recordFailure(&proxyresponse.BackendError{
-					Err:         err,
-					BackendName: instance.Name,
-					BackendURL:  instance.URL,
-				})
+			return nil, &proxyresponse.BackendError{
+				Err:         fmt.Errorf("non-2xx response from the upstream: %s", instance.Name),
+				BackendName: instance.Name,
+				BackendURL:  groupURL,
+				StatusCode:  resp.StatusCode,
+				Data:        bodyBytes,
 			}
-			resp.Body = io.NopCloser(bytes.NewReader(respBodyBytes))
-			resp.ContentLength = int64(len(respBodyBytes))
-			results <- &proxyresponse.BackendResponse{
-				Response:    resp,
+		}
+		respBodyBytes, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			requestSpan.RecordError(err)
+			requestSpan.SetStatus(codes.Error, "Failed to read upstream response body")
+			metrics.RequestFailures.Add(upstreamCtx, 1, metric.WithAttributes(
+				attribute.String("path", r.Pattern),
+				attribute.String("method", r.Method),
+				attribute.String("server_group", instance.Name),
+			))
+			if upstreamCtx.Err() == nil {
+				result = breakerFailure
+			} else {
+				result = breakerIgnored
+			}
+			level.Error(p.logger).Log("msg", "Failed to read upstream response body", "instance", instance.Name, "err", err)
+			return nil, &proxyresponse.BackendError{
+				Err:         err,
 				BackendName: instance.Name,
-				BackendURL:  instance.URL,
+				BackendURL:  groupURL,
+			}
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(respBodyBytes))
+		resp.ContentLength = int64(len(respBodyBytes))
+		return &proxyresponse.BackendResponse{
+			Response:    resp,
+			BackendName: instance.Name,
+			BackendURL:  groupURL,
+		}, nil
+	}
+
+	// failures collects the failures of required server groups. The first
+	// one cancels the groups still pending; the failures that arrived by
+	// then are reported together, and the most telling one decides the
+	// status.
+	failures := make(chan *proxyresponse.BackendError, len(st.config.ServerGroups))
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// recordFailure applies the server group's error-handling policy. A
+	// required group (the default) fails the whole query on error; an
+	// optional group's failure is recorded as a soft failure instead. The
+	// two flags are mutually exclusive (enforced by config.Validate).
+	recordFailure := func(instance cfg.ServerGroup, berr *proxyresponse.BackendError) {
+		if instance.IgnoreError || instance.DowngradeError {
+			softErrs <- softFailure{berr: berr, downgrade: instance.DowngradeError}
+			return
+		}
+		failures <- berr
+		cancel(errRequiredGroupFailed)
+	}
+
+	// Forward requests using the custom RoundTripper. The server groups of
+	// a failover group are queried tier by tier, the next tier only when
+	// every group of the previous one failed; other groups are queried
+	// alongside.
+	failovers := make(chan string, len(st.config.ServerGroups))
+	// failedOverGroups collects the groups of the tiers failed over from,
+	// which did not contribute to the response.
+	failedOverGroups := make(chan string, len(st.config.ServerGroups))
+	var wg sync.WaitGroup
+	for _, tiers := range fanoutPlan(groups) {
+		wg.Go(func() {
+			// failedOver holds the outcomes of the tiers failed over from.
+			var failedOver []groupOutcome
+			for i, tier := range tiers {
+				outcomes := queryTier(ctx, tier, queryGroup)
+				if i < len(tiers)-1 && shouldFailOver(outcomes) && ctx.Err() == nil {
+					level.Warn(p.logger).Log("msg", "Server group tier failed, failing over", "failover_group", tier[0].FailoverGroup, "priority", tier[0].Priority)
+					failedOver = append(failedOver, outcomes...)
+					continue
+				}
+				// When no tier answered, the failures of every tier are
+				// reported, so that an earlier tier's client error or rate
+				// limiting is not hidden by the last tier's.
+				if !answered(outcomes) {
+					outcomes = append(failedOver, outcomes...)
+				} else if i > 0 {
+					for _, o := range failedOver {
+						failedOverGroups <- o.instance.Name
+					}
+					span.AddEvent("failover", trace.WithAttributes(
+						attribute.String("upstream.failover_group", tier[0].FailoverGroup),
+						attribute.Int("upstream.priority", tier[0].Priority),
+					))
+					failovers <- fmt.Sprintf("failover group %q served by priority %d (%s) after higher priorities failed", tier[0].FailoverGroup, tier[0].Priority, tierNames(tier))
+				}
+				for _, o := range outcomes {
+					if o.resp != nil {
+						results <- o.resp
+					} else {
+						recordFailure(o.instance, o.berr)
+					}
+				}
+				return
 			}
-			return nil
 		})
 	}
 	// Await for all responses
-	err := wg.Wait()
+	wg.Wait()
+	if shedding := st.config.LoadShedding; shedding.Adaptive.Enabled() && r.Context().Err() == nil {
+		p.shed.adaptive.observe(r.Context(), time.Since(startTime), shedding)
+	}
 	close(results)
 	close(softErrs)
-	if err != nil {
-		berr := &proxyresponse.BackendError{}
-		if errors.As(err, &berr) {
-			level.Error(p.logger).Log("msg", "Failed to fetch responses", "err", err, "instance", berr.BackendName)
-			if berr.StatusCode != 0 {
-				proxyresponse.ForwardBackendError(w, berr.BackendName, berr.StatusCode, berr.Data, p.logger)
-			} else {
-				proxyresponse.ForwardConnectionError(w, berr, p.logger)
-			}
-		} else {
-			level.Error(p.logger).Log("msg", "Failed to fetch responses from upstreams", "err", err)
-			http.Error(w, "No healthy upstreams available", http.StatusBadGateway)
+	close(failovers)
+	close(failedOverGroups)
+	close(failures)
+	var failed []*proxyresponse.BackendError
+	for berr := range failures {
+		// Requests cancelled because another required group failed add
+		// nothing to the error.
+		if errors.Is(berr, errRequiredGroupFailed) {
+			continue
 		}
+		failed = append(failed, berr)
+	}
+	if len(failed) > 0 {
+		level.Error(p.logger).Log("msg", "Failed to fetch responses", "failed", len(failed), "err", failed[0])
+		p.forwardBackendErrors(w, r, failed)
 
 		for remaining := range results {
 			if remaining.Response != nil && remaining.Response.Body != nil {
@@ -623,23 +1061,29 @@ func (p *Proxy) fanoutRequest(w http.ResponseWriter, r *http.Request, fn transfo
 
 	// No required server group failed. Process soft failures (optional groups
 	// configured with ignore_error/downgrade_error): downgraded ones become
-	// warnings on the merged response, ignored ones are silent.
-	var warnings []string
-	var lastSoft *proxyresponse.BackendError
-	softCount := 0
+	// warnings on the merged response, ignored ones are silent. Groups
+	// cancelled at the soft deadline are named in one warning either way.
+	var warnings, timedOut, missing []string
+	var softFailed []*proxyresponse.BackendError
 	for sf := range softErrs {
-		softCount++
-		lastSoft = sf.berr
+		softFailed = append(softFailed, sf.berr)
+		missing = append(missing, sf.berr.BackendName)
 		outcome := "ignored"
 		if sf.downgrade {
 			outcome = "downgraded"
+		}
+		switch {
+		case errors.Is(sf.berr, errSoftDeadline):
+			timedOut = append(timedOut, sf.berr.BackendName)
+			level.Warn(p.logger).Log("msg", "Server group did not answer within the soft deadline", "instance", sf.berr.BackendName, "soft_deadline", softTimeout)
+		case sf.downgrade:
 			msg := sf.berr.Error()
 			if sf.berr.StatusCode != 0 {
 				msg = fmt.Sprintf("status %d: %s", sf.berr.StatusCode, strings.TrimSpace(string(sf.berr.Data)))
 			}
 			warnings = append(warnings, fmt.Sprintf("server group %q error downgraded to warning: %s", sf.berr.BackendName, msg))
 			level.Warn(p.logger).Log("msg", "Server group error downgraded to warning", "instance", sf.berr.BackendName, "err", sf.berr.Error())
-		} else {
+		default:
 			level.Debug(p.logger).Log("msg", "Server group error ignored", "instance", sf.berr.BackendName, "err", sf.berr.Error())
 		}
 		metrics.RequestDegraded.Add(r.Context(), 1, metric.WithAttributes(
@@ -650,16 +1094,32 @@ func (p *Proxy) fanoutRequest(w http.ResponseWriter, r *http.Request, fn transfo
 		))
 	}
 
+	if len(timedOut) > 0 {
+		slices.Sort(timedOut)
+		span.SetAttributes(attribute.StringSlice("proxy.soft_deadline_exceeded", timedOut))
+		warnings = append(warnings, fmt.Sprintf("server groups %s did not answer within the soft deadline of %s and were left out of the results", strings.Join(timedOut, ", "), softTimeout))
+	}
+
+	for msg := range failovers {
+		warnings = append(warnings, msg)
+	}
+
+	// Name the groups whose data is missing, ignored and failed over ones
+	// included, so clients can tell a partial response from a complete one.
+	for name := range failedOverGroups {
+		missing = append(missing, name)
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		w.Header().Set(missingGroupsHeader, strings.Join(missing, ","))
+	}
+
 	// If every contributing server group was optional and all of them failed,
-	// there is no data to merge. Forward the last failure rather than return a
+	// there is no data to merge. Forward their failures rather than return a
 	// misleading empty success.
-	if len(results) == 0 && softCount > 0 {
-		level.Error(p.logger).Log("msg", "All optional server groups failed", "instance", lastSoft.BackendName)
-		if lastSoft.StatusCode != 0 {
-			proxyresponse.ForwardBackendError(w, lastSoft.BackendName, lastSoft.StatusCode, lastSoft.Data, p.logger)
-		} else {
-			proxyresponse.ForwardConnectionError(w, lastSoft, p.logger)
-		}
+	if len(results) == 0 && len(softFailed) > 0 {
+		level.Error(p.logger).Log("msg", "All optional server groups failed", "failed", len(softFailed))
+		p.forwardBackendErrors(w, r, softFailed)
 		return
 	}
 
@@ -17,21 +17,25 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/grafana/loki/v3/pkg/querier/queryrange/queryrangebase"
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/protobuf/encoding/protowire"
 
 	cfg "github.com/paulojmdias/lokxy/pkg/config"
 	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+	"github.com/paulojmdias/lokxy/pkg/proxy/handler"
 	"github.com/paulojmdias/lokxy/pkg/proxy/proxyresponse"
 )
 
 // ---------- helpers ----------
 
 // nonexistentCAFile is a CA path that never exists, used to force
-// createHTTPClient to fail.
+// newUpstream to fail.
 const nonexistentCAFile = "/nonexistent/ca.pem"
 
 // mustMux builds a Proxy from config and returns a serve mux with the
@@ -236,6 +240,104 @@ func TestProxy_FanOut_POSTBodyReused(t *testing.T) {
 	require.Equal(t, `query={app="lokxy"}`, got2)
 }
 
+func TestProxy_FormPOST_GrafanaHealthCheckIntercepted(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	called := false
+	srv := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query": func(w http.ResponseWriter, _ *http.Request) {
+			called = true
+			w.WriteHeader(http.StatusOK)
+		},
+	})
+	defer srv.Close()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/query",
+		strings.NewReader("query=vector%281%29%2Bvector%281%29&time=4000000000"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	mustMux(t, logger, mkConfig(srv.URL)).ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.False(t, called, "health check must not reach the upstream")
+	require.Contains(t, rr.Body.String(), `"value":[4,"2"]`)
+}
+
+func TestProxy_MalformedParams(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	var gotRawQuery string
+	srv := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/config": func(w http.ResponseWriter, r *http.Request) {
+			gotRawQuery = r.URL.RawQuery
+			w.WriteHeader(http.StatusOK)
+		},
+	})
+	defer srv.Close()
+	mux := mustMux(t, logger, mkConfig(srv.URL))
+
+	// Routes that forward the request as it is do not parse it.
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/config?mode=%zz", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "mode=%zz", gotRawQuery)
+
+	// A tail needs its parameters.
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/lokxy/api/v1/tail?query=%zz", nil))
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestProxy_LongGETQuery_SentUpstreamAsPOST(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	longQuery := `{app="lokxy"} |= "` + strings.Repeat("x", maxUpstreamQueryLength) + `"`
+	rawQuery := url.Values{"query": {longQuery}, "limit": {"10"}}.Encode()
+
+	var gotMethod, gotContentType, gotRawQuery string
+	var gotForm url.Values
+	srv := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+			gotMethod = r.Method
+			gotContentType = r.Header.Get("Content-Type")
+			gotRawQuery = r.URL.RawQuery
+			require.NoError(t, r.ParseForm())
+			gotForm = r.PostForm
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"streams","result":[],"stats":{}}}`))
+		},
+		"/loki/api/v1/patterns": func(w http.ResponseWriter, r *http.Request) {
+			gotMethod = r.Method
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+		},
+	})
+	defer srv.Close()
+	mux := mustMux(t, logger, mkConfig(srv.URL))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?"+rawQuery, nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, http.MethodPost, gotMethod)
+	require.Equal(t, "application/x-www-form-urlencoded", gotContentType)
+	require.Empty(t, gotRawQuery)
+	require.Equal(t, longQuery, gotForm.Get("query"))
+	require.Equal(t, "10", gotForm.Get("limit"))
+
+	// Endpoints that do not take form bodies keep the GET.
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/patterns?"+rawQuery, nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, http.MethodGet, gotMethod)
+
+	// Short queries keep the GET too.
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query=%7Bapp%3D%22a%22%7D", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, http.MethodGet, gotMethod)
+	require.Equal(t, "query=%7Bapp%3D%22a%22%7D", gotRawQuery)
+}
+
 func TestProxy_QueryRange_SlowStreamingBody_NotCanceledBeforeMerge(t *testing.T) {
 	logger := log.NewNopLogger()
 
@@ -347,7 +449,7 @@ func TestProxy_DetectedFieldValues_UpstreamFailure(t *testing.T) {
 
 	// Should return error when backend fails (fail-fast behavior)
 	require.Equal(t, http.StatusInternalServerError, rr.Code)
-	require.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
 	require.Equal(t, "sg1", rr.Header().Get("Failed-Backend"))
 	require.Contains(t, rr.Body.String(), errorBody)
 }
@@ -376,6 +478,346 @@ func TestProxy_ApiRoutes_Dispatch(t *testing.T) {
 	require.Equal(t, "success", got["status"])
 }
 
+func TestProxy_PrometheusRules_MergedAcrossServerGroups(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	rulesBody := `{"status":"success","data":{"groups":[{"name":"g","file":"ns","rules":[]}]}}`
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/prometheus/api/v1/rules": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, rulesBody)
+		},
+	})
+	defer s1.Close()
+	s2 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/prometheus/api/v1/rules": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, rulesBody)
+		},
+	})
+	defer s2.Close()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/prometheus/api/v1/rules", nil)
+	mustMux(t, logger, mkConfig(s1.URL, s2.URL)).ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var got struct {
+		Data struct {
+			Groups []struct {
+				File string `json:"file"`
+			} `json:"groups"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.Len(t, got.Data.Groups, 2)
+	require.Equal(t, "sg1/ns", got.Data.Groups[0].File)
+	require.Equal(t, "sg2/ns", got.Data.Groups[1].File)
+}
+
+func TestProxy_Rules_ServerGroupWithoutRules(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/prometheus/api/v1/rules": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status":"success","data":{"groups":[{"name":"g","file":"ns","rules":[]}]}}`)
+		},
+	})
+	defer s1.Close()
+	// Loki answers 404 when it has no rules.
+	s2 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/prometheus/api/v1/rules": func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+		},
+		"/loki/api/v1/rules": func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+		},
+	})
+	defer s2.Close()
+
+	rr := httptest.NewRecorder()
+	mustMux(t, logger, mkConfig(s1.URL, s2.URL)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/prometheus/api/v1/rules", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Contains(t, rr.Body.String(), `"file":"sg1/ns"`)
+
+	rr = httptest.NewRecorder()
+	mustMux(t, logger, mkConfig(s2.URL)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/rules", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "{}\n", rr.Body.String())
+}
+
+func TestProxy_Rules_Namespace(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	var gotPath, gotMethod string
+	s1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotMethod = r.URL.EscapedPath(), r.Method
+		w.Header().Set("Content-Type", "application/yaml")
+		switch r.URL.EscapedPath() {
+		case "/loki/api/v1/rules/team%2Fapp":
+			io.WriteString(w, "team/app:\n  - name: g1\n    rules: []\n")
+		case "/loki/api/v1/rules/team%2Fapp/g1":
+			io.WriteString(w, "name: g1\nrules: []\n")
+		default:
+			http.Error(w, "no rule groups found", http.StatusNotFound)
+		}
+	}))
+	defer s1.Close()
+	var s2Calls atomic.Int32
+	s2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		s2Calls.Add(1)
+		http.Error(w, "unexpected", http.StatusInternalServerError)
+	}))
+	defer s2.Close()
+
+	config := mkConfig(s1.URL, s2.URL)
+	config.ServerGroups[0].Name = "eu"
+	config.ServerGroups[1].Name = "eu/west"
+	mux := mustMux(t, logger, config)
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+
+	// The namespace is read from the server group it is tagged with, and
+	// merged like the full list.
+	rr := serve(http.MethodGet, "/loki/api/v1/rules/"+url.PathEscape("eu/team/app"))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "/loki/api/v1/rules/team%2Fapp", gotPath)
+	require.Contains(t, rr.Body.String(), "eu/team/app:")
+
+	rr = serve(http.MethodGet, "/loki/api/v1/rules/"+url.PathEscape("eu/team/app")+"/g1")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "/loki/api/v1/rules/team%2Fapp/g1", gotPath)
+	require.Equal(t, "name: g1\nrules: []\n", rr.Body.String())
+
+	// Writes are forwarded as they are.
+	serve(http.MethodDelete, "/loki/api/v1/rules/"+url.PathEscape("eu/team/app")+"/g1")
+	require.Equal(t, http.MethodDelete, gotMethod)
+
+	// A namespace the server group has no rules in is empty.
+	rr = serve(http.MethodGet, "/loki/api/v1/rules/"+url.PathEscape("eu/missing"))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "{}\n", rr.Body.String())
+
+	// Deleting it is not reported as a success.
+	rr = serve(http.MethodDelete, "/loki/api/v1/rules/"+url.PathEscape("eu/missing"))
+	require.Equal(t, http.MethodDelete, gotMethod)
+	require.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = serve(http.MethodGet, "/loki/api/v1/rules/"+url.PathEscape("us/app"))
+	require.Equal(t, http.StatusNotFound, rr.Code)
+	require.Zero(t, s2Calls.Load())
+
+	// A tagged namespace sent without percent-encoding is recognized too.
+	rr = serve(http.MethodGet, "/loki/api/v1/rules/eu/missing")
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "/loki/api/v1/rules/missing", gotPath)
+	require.Equal(t, "{}\n", rr.Body.String())
+
+	serve(http.MethodGet, "/loki/api/v1/rules/eu/app/g1")
+	require.Equal(t, "/loki/api/v1/rules/app/g1", gotPath)
+	require.Zero(t, s2Calls.Load())
+
+	serve(http.MethodGet, "/loki/api/v1/rules/eu/west/app")
+	require.Equal(t, int32(1), s2Calls.Load())
+
+	rr = serve(http.MethodGet, "/loki/api/v1/rules/eu/app/g1/extra")
+	require.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestSplitRuleNamespace(t *testing.T) {
+	groups := []cfg.ServerGroup{{Name: "eu"}, {Name: "eu/west"}}
+
+	group, namespace, ok := splitRuleNamespace(groups, "eu/west/app")
+	require.True(t, ok)
+	require.Equal(t, "eu/west", group)
+	require.Equal(t, "app", namespace)
+
+	group, namespace, ok = splitRuleNamespace(groups, "eu/team/app")
+	require.True(t, ok)
+	require.Equal(t, "eu", group)
+	require.Equal(t, "team/app", namespace)
+
+	_, _, ok = splitRuleNamespace(groups, "eu/")
+	require.False(t, ok)
+	_, _, ok = splitRuleNamespace(groups, "us/app")
+	require.False(t, ok)
+}
+
+func TestProxy_PrometheusAPI_ForwardsToLokiEndpoints(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	var gotPath, gotQuery string
+	s := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+			gotPath = r.URL.Path
+			gotQuery = r.URL.Query().Get("query")
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"app":"a"},"values":[[1700000000,"1"]]}],"stats":{}}}`)
+		},
+		"/loki/api/v1/label/app/values": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status":"success","data":["a","b"]}`)
+		},
+	})
+	defer s.Close()
+
+	mux := mustMux(t, logger, mkConfig(s.URL))
+
+	rr := httptest.NewRecorder()
+	q := url.Values{"query": {`sum(rate({app="a"}[1m]))`}, "start": {"1700000000"}, "end": {"1700000060"}, "step": {"60"}}
+	req := httptest.NewRequest(http.MethodGet, "/prometheus/api/v1/query_range?"+q.Encode(), nil)
+	mux.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, "/loki/api/v1/query_range", gotPath)
+	require.Equal(t, `sum(rate({app="a"}[1m]))`, gotQuery)
+	require.JSONEq(t, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"app":"a"},"values":[[1700000000,"1"]]}]}}`, rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/prometheus/api/v1/label/app/values", nil)
+	mux.ServeHTTP(rr, req)
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.JSONEq(t, `{"status":"success","data":["a","b"]}`, rr.Body.String())
+}
+
+func TestProxy_PrometheusAPI_ErrorsInPrometheusFormat(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	s := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "parse error")
+		},
+	})
+	defer s.Close()
+
+	mux := mustMux(t, logger, mkConfig(s.URL))
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/prometheus/api/v1/query_range?query=up", nil))
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	require.Equal(t, "sg1", rr.Header().Get("Failed-Backend"))
+	require.JSONEq(t, `{"status":"error","errorType":"bad_data","error":"sg1: parse error"}`, rr.Body.String())
+
+	// The Loki API keeps its own error format.
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/query_range?query=up", nil))
+
+	require.Equal(t, http.StatusBadRequest, rr.Code)
+	var body proxyresponse.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+	require.Equal(t, http.StatusBadRequest, body.Code)
+	require.Len(t, body.Errors, 1)
+}
+
+func TestProxy_QueryRange_ProtobufNegotiation(t *testing.T) {
+	logger := log.NewNopLogger()
+
+	var gotAccept atomic.Value
+	// sg1 supports protobuf; sg2 behaves like an older Loki and ignores the
+	// Accept header.
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+			gotAccept.Store(r.Header.Get("Accept"))
+			prom := queryrangebase.PrometheusResponse{
+				Status: "success",
+				Data: queryrangebase.PrometheusData{
+					ResultType: "matrix",
+					Result: []queryrangebase.SampleStream{{
+						Labels:  []logproto.LabelAdapter{{Name: "app", Value: "a"}},
+						Samples: []logproto.LegacySample{{Value: 1, TimestampMs: 1700000000000}},
+					}},
+				},
+			}
+			body := wrapPromQueryResponse(t, &prom)
+			w.Header().Set("Content-Type", handler.ProtobufContentType)
+			w.Write(body)
+		},
+	})
+	defer s1.Close()
+	s2 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"app":"a"},"values":[[1700000000,"2"]]}],"stats":{}}}`)
+		},
+	})
+	defer s2.Close()
+
+	mux := mustMux(t, logger, mkConfig(s1.URL, s2.URL))
+	target := "/loki/api/v1/query_range?query=" + url.QueryEscape(`sum(rate({app="a"}[1m]))`)
+
+	// Without a protobuf Accept header the client gets JSON.
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, handler.ProtobufContentType, gotAccept.Load())
+	var got struct {
+		Data struct {
+			Result []struct {
+				Values [][]any `json:"values"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &got))
+	require.Len(t, got.Data.Result, 1)
+	require.Equal(t, [][]any{{1700000000.0, "3"}}, got.Data.Result[0].Values)
+
+	// A client negotiating protobuf gets the merged result in protobuf.
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", handler.ProtobufContentType)
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, handler.ProtobufContentType, rr.Header().Get("Content-Type"))
+	prom := unwrapPromQueryResponse(t, rr.Body.Bytes())
+	require.Equal(t, []logproto.LegacySample{{Value: 3, TimestampMs: 1700000000000}}, prom.Data.Result[0].Samples)
+}
+
+// wrapPromQueryResponse encodes a Prometheus response as Loki's protobuf
+// QueryResponse (status = 1, prom = 5; LokiPromResponse.response = 1).
+func wrapPromQueryResponse(t *testing.T, prom *queryrangebase.PrometheusResponse) []byte {
+	t.Helper()
+	promBytes, err := prom.Marshal()
+	require.NoError(t, err)
+	msg := protowire.AppendTag(nil, 1, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, promBytes)
+	body := protowire.AppendTag(nil, 1, protowire.BytesType)
+	body = protowire.AppendBytes(body, nil)
+	body = protowire.AppendTag(body, 5, protowire.BytesType)
+	return protowire.AppendBytes(body, msg)
+}
+
+// unwrapPromQueryResponse is the reverse of wrapPromQueryResponse.
+func unwrapPromQueryResponse(t *testing.T, body []byte) *queryrangebase.PrometheusResponse {
+	t.Helper()
+	field := func(b []byte, want protowire.Number) []byte {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			require.GreaterOrEqual(t, n, 0)
+			b = b[n:]
+			if num == want && typ == protowire.BytesType {
+				v, m := protowire.ConsumeBytes(b)
+				require.GreaterOrEqual(t, m, 0)
+				return v
+			}
+			m := protowire.ConsumeFieldValue(num, typ, b)
+			require.GreaterOrEqual(t, m, 0)
+			b = b[m:]
+		}
+		t.Fatalf("field %d not found", want)
+		return nil
+	}
+	var prom queryrangebase.PrometheusResponse
+	require.NoError(t, prom.Unmarshal(field(field(body, 5), 1)))
+	return &prom
+}
+
 func TestProxy_AllBackendsFailWithError(t *testing.T) {
 	logger := log.NewNopLogger()
 
@@ -403,20 +845,25 @@ func TestProxy_AllBackendsFailWithError(t *testing.T) {
 
 	mustMux(t, logger, cfg).ServeHTTP(rr, req)
 
-	// Should return error status from first backend
+	// Should return the backends' client error
 	require.Equal(t, http.StatusBadRequest, rr.Code)
-	// Should use simple text format: {backend}: {error}
-	responseBody := rr.Body.String()
-	// Either sg1 or sg2 could respond first (race condition)
-	require.True(t, strings.HasPrefix(responseBody, "sg1:") || strings.HasPrefix(responseBody, "sg2:"),
-		"Response should start with backend name (got: %s)", responseBody)
-	require.Contains(t, responseBody, errorBody)
-	// Should be plain text, not JSON
-	require.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
-	// Should have Failed-Backend header (either sg1 or sg2)
-	failedBackend := rr.Header().Get("Failed-Backend")
-	require.True(t, failedBackend == "sg1" || failedBackend == "sg2",
-		"Failed-Backend header should be sg1 or sg2 (got: %s)", failedBackend)
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	// Either backend may reject the query first; one that is still pending
+	// is cancelled and left out.
+	var body proxyresponse.ErrorResponse
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+	require.Equal(t, http.StatusBadRequest, body.Code)
+	require.Equal(t, "error", body.Status)
+	require.NotEmpty(t, body.Errors)
+	var names []string
+	for _, failure := range body.Errors {
+		require.Contains(t, []string{"sg1", "sg2"}, failure.ServerGroup)
+		require.Equal(t, http.StatusBadRequest, failure.Status)
+		require.Equal(t, errorBody, failure.Message)
+		names = append(names, failure.ServerGroup)
+	}
+	require.Equal(t, strings.Join(names, ","), rr.Header().Get("Failed-Backend"))
 }
 
 func TestProxy_AnyBackendFailure_ReturnsError(t *testing.T) {
@@ -441,7 +888,7 @@ func TestProxy_AnyBackendFailure_ReturnsError(t *testing.T) {
 
 	// Should return error when backend fails
 	require.Equal(t, http.StatusInternalServerError, rr.Code)
-	require.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
 	require.Equal(t, "sg1", rr.Header().Get("Failed-Backend"))
 	require.Contains(t, rr.Body.String(), errorBody)
 }
@@ -458,7 +905,7 @@ func TestProxy_UnreachableBackend_ReturnsConnectionError(t *testing.T) {
 
 	// Should return 502 Bad Gateway for connection errors
 	require.Equal(t, http.StatusBadGateway, rr.Code)
-	require.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Equal(t, "application/json", rr.Header().Get("Content-Type"))
 	require.Equal(t, "sg1", rr.Header().Get("Failed-Backend"))
 	// Response should include backend name and error message
 	responseBody := rr.Body.String()
@@ -466,6 +913,52 @@ func TestProxy_UnreachableBackend_ReturnsConnectionError(t *testing.T) {
 	require.Contains(t, responseBody, "connection refused")
 }
 
+func TestProxy_BackendFailures_Aggregated(t *testing.T) {
+	logger := log.NewNopLogger()
+	const target = "/loki/api/v1/query_range?query={app=\"a\"}"
+
+	t.Run("client error wins over connection error", func(t *testing.T) {
+		// The groups of a tier are waited for together, so both failures
+		// arrive; the rejected query is what the client needs to know.
+		s2 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+			"/loki/api/v1/query_range": func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, "parse error at line 1")
+			},
+		})
+		defer s2.Close()
+
+		config := mkConfig("http://127.0.0.1:1", s2.URL)
+		config.ServerGroups[0].FailoverGroup = "logs"
+		config.ServerGroups[1].FailoverGroup = "logs"
+
+		rr := httptest.NewRecorder()
+		mustMux(t, logger, config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		require.Equal(t, http.StatusBadRequest, rr.Code)
+		require.Equal(t, "sg2,sg1", rr.Header().Get("Failed-Backend"))
+		var body proxyresponse.ErrorResponse
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&body))
+		require.Len(t, body.Errors, 2)
+		require.Equal(t, proxyresponse.BackendFailure{ServerGroup: "sg2", Status: http.StatusBadRequest, Message: "parse error at line 1"}, body.Errors[0])
+		require.Equal(t, "sg1", body.Errors[1].ServerGroup)
+		require.Equal(t, http.StatusBadGateway, body.Errors[1].Status)
+	})
+
+	t.Run("first failure cancels pending groups", func(t *testing.T) {
+		var calls atomic.Int32
+		failing := mkQueryRangeServer(t, http.StatusServiceUnavailable, &calls)
+		slow := mkSlowQueryRangeServer(t, nil)
+
+		rr := httptest.NewRecorder()
+		mustMux(t, logger, mkConfig(failing.URL, slow.URL)).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+
+		require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		require.Equal(t, "sg1", rr.Header().Get("Failed-Backend"))
+		require.Contains(t, rr.Body.String(), `"message":"sg1: failed"`)
+	})
+}
+
 func TestProxy_NoHealthyUpstreams_Returns502(t *testing.T) {
 	logger := log.NewNopLogger()
 
@@ -613,25 +1106,25 @@ func TestRoundTrip_GzipDecompression(t *testing.T) {
 
 func TestCreateHTTPClient_NoTLS(t *testing.T) {
 	sg := cfg.ServerGroup{Name: "loki1", URL: "http://localhost:3100"}
-	client, err := createHTTPClient(sg, log.NewNopLogger())
+	u, err := newUpstream(sg, log.NewNopLogger())
 	require.NoError(t, err)
-	require.NotNil(t, client)
+	require.NotNil(t, u.endpoints.endpoints[0].client)
 }
 
 func TestCreateHTTPClient_InsecureSkipVerify(t *testing.T) {
 	sg := cfg.ServerGroup{Name: "loki1", URL: "https://localhost:3100"}
 	sg.HTTPClientConfig.TLSConfig.InsecureSkipVerify = true
 
-	client, err := createHTTPClient(sg, log.NewNopLogger())
+	u, err := newUpstream(sg, log.NewNopLogger())
 	require.NoError(t, err)
-	require.NotNil(t, client)
+	require.NotNil(t, u.endpoints.endpoints[0].client)
 }
 
 func TestCreateHTTPClient_InvalidCAFile(t *testing.T) {
 	sg := cfg.ServerGroup{Name: "loki1", URL: "https://localhost:3100"}
 	sg.HTTPClientConfig.TLSConfig.CAFile = nonexistentCAFile
 
-	_, err := createHTTPClient(sg, log.NewNopLogger())
+	_, err := newUpstream(sg, log.NewNopLogger())
 	require.Error(t, err)
 }
 
@@ -640,7 +1133,7 @@ func TestCreateHTTPClient_InvalidCertKeyPair(t *testing.T) {
 	sg.HTTPClientConfig.TLSConfig.CertFile = "/nonexistent/cert.pem"
 	sg.HTTPClientConfig.TLSConfig.KeyFile = "/nonexistent/key.pem"
 
-	_, err := createHTTPClient(sg, log.NewNopLogger())
+	_, err := newUpstream(sg, log.NewNopLogger())
 	require.Error(t, err)
 }
 
@@ -713,7 +1206,7 @@ type errorReader struct{}
 func (e *errorReader) Read([]byte) (int, error) { return 0, io.ErrUnexpectedEOF }
 
 func TestProxyHandler_HTTPClientCreationFailure(t *testing.T) {
-	// If a ServerGroup has an invalid CA file, createHTTPClient fails and the
+	// If a ServerGroup has an invalid CA file, newUpstream fails and the
 	// proxy refuses to build: New returns an error instead of serving with a
 	// silently skipped backend.
 	logger := log.NewNopLogger()
@@ -869,12 +1362,12 @@ func TestCreateHTTPClient_ConnectionPoolSettings(t *testing.T) {
 		Timeout: 5,
 	}
 
-	client, err := createHTTPClient(sg, log.NewNopLogger())
+	u, err := newUpstream(sg, log.NewNopLogger())
 	require.NoError(t, err)
-	require.NotNil(t, client)
+	require.NotNil(t, u.endpoints.endpoints[0].client)
 
 	// Unwrap CustomRoundTripper to get at the underlying Transport
-	crt, ok := client.Transport.(*CustomRoundTripper)
+	crt, ok := u.endpoints.endpoints[0].client.Transport.(*CustomRoundTripper)
 	require.True(t, ok, "expected CustomRoundTripper wrapper")
 
 	transport, ok := crt.rt.(*http.Transport)
@@ -896,10 +1389,10 @@ func TestCreateHTTPClient_ExplicitResponseHeaderTimeout(t *testing.T) {
 	}
 	sg.HTTPClientConfig.Transport.ResponseHeaderTimeout = 10 * time.Second
 
-	client, err := createHTTPClient(sg, log.NewNopLogger())
+	u, err := newUpstream(sg, log.NewNopLogger())
 	require.NoError(t, err)
 
-	crt, ok := client.Transport.(*CustomRoundTripper)
+	crt, ok := u.endpoints.endpoints[0].client.Transport.(*CustomRoundTripper)
 	require.True(t, ok)
 	transport, ok := crt.rt.(*http.Transport)
 	require.True(t, ok)
@@ -1,8 +1,12 @@
 package proxyresponse
 
 import (
+	"cmp"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -39,39 +43,119 @@ func (b *BackendError) Unwrap() error {
 	return b.Err
 }
 
-// ForwardBackendError sends a simple error response: {backend}: {error}
-func ForwardBackendError(w http.ResponseWriter, backendName string, statusCode int, bodyBytes []byte, logger log.Logger) {
-	level.Error(logger).Log(
-		"msg", "Forwarding backend error to client",
-		"backend", backendName,
-		"status", statusCode,
-	)
+// ErrorResponse is the body of an error response, in Loki's error format,
+// listing the failure of every server group.
+type ErrorResponse struct {
+	Code    int              `json:"code"`
+	Status  string           `json:"status"`
+	Message string           `json:"message"`
+	Errors  []BackendFailure `json:"errors"`
+}
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Set("Failed-Backend", backendName)
-	w.WriteHeader(statusCode)
+// BackendFailure is the failure of one server group in an ErrorResponse.
+type BackendFailure struct {
+	ServerGroup string `json:"server_group"`
+	Status      int    `json:"status"`
+	Message     string `json:"message"`
+}
 
-	errorMessage := fmt.Sprintf("%s: %s", backendName, string(bodyBytes))
-	if _, err := w.Write([]byte(errorMessage)); err != nil {
-		level.Error(logger).Log("msg", "Failed to write error response", "err", err)
+// Status returns the status the failure is answered with: the backend's,
+// or 502 Bad Gateway when the backend could not be reached.
+func (b *BackendError) Status() int {
+	if b.StatusCode == 0 {
+		return http.StatusBadGateway
+	}
+	return b.StatusCode
+}
+
+// IsClientError reports whether the backend rejected the request itself,
+// e.g. with 400 for an invalid query. Rate limiting is not a client error.
+func (b *BackendError) IsClientError() bool {
+	return b.StatusCode >= 400 && b.StatusCode < 500 && b.StatusCode != http.StatusTooManyRequests
+}
+
+// message returns what the backend answered, or why it could not be reached.
+func (b *BackendError) message() string {
+	if b.StatusCode == 0 {
+		return b.Error()
+	}
+	if msg := strings.TrimSpace(string(b.Data)); msg != "" {
+		return msg
 	}
+	return http.StatusText(b.StatusCode)
 }
 
-// ForwardConnectionError sends a connection error response: {backend}: {error}
-// Uses 502 Bad Gateway to indicate the backend was unreachable
-func ForwardConnectionError(w http.ResponseWriter, backendErr *BackendError, logger log.Logger) {
+// precedence ranks a failure for choosing the status of the response:
+// client errors first, as every backend would reject the request alike,
+// then rate limiting, server errors, and unreachable backends last.
+func (b *BackendError) precedence() int {
+	switch {
+	case b.IsClientError():
+		return 0
+	case b.StatusCode == http.StatusTooManyRequests:
+		return 1
+	case b.StatusCode != 0:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// SortBackendErrors returns errs ordered by precedence: the first decides
+// the status of the response.
+func SortBackendErrors(errs []*BackendError) []*BackendError {
+	errs = slices.Clone(errs)
+	slices.SortStableFunc(errs, func(a, b *BackendError) int {
+		return cmp.Or(cmp.Compare(a.precedence(), b.precedence()), cmp.Compare(a.BackendName, b.BackendName))
+	})
+	return errs
+}
+
+// SummarizeBackendErrors returns the status, the backend names and the
+// message of an error response for errs, which must be sorted with
+// SortBackendErrors.
+func SummarizeBackendErrors(errs []*BackendError) (status int, names []string, message string) {
+	names = make([]string, len(errs))
+	messages := make([]string, len(errs))
+	for i, berr := range errs {
+		names[i] = berr.BackendName
+		messages[i] = fmt.Sprintf("%s: %s", berr.BackendName, berr.message())
+	}
+	return errs[0].Status(), names, strings.Join(messages, "; ")
+}
+
+// ForwardBackendErrors sends the failures of the backends as one JSON error
+// response. The failures are listed by precedence, and the first decides the
+// status. The Failed-Backend header names the backends in the same order.
+func ForwardBackendErrors(w http.ResponseWriter, errs []*BackendError, logger log.Logger) {
+	errs = SortBackendErrors(errs)
+	status, names, message := SummarizeBackendErrors(errs)
+
+	failures := make([]BackendFailure, len(errs))
+	for i, berr := range errs {
+		failures[i] = BackendFailure{
+			ServerGroup: berr.BackendName,
+			Status:      berr.Status(),
+			Message:     berr.message(),
+		}
+	}
+
 	level.Error(logger).Log(
-		"msg", "Forwarding connection error to client",
-		"backend", backendErr.BackendName,
-		"err", backendErr.Err,
+		"msg", "Forwarding backend errors to client",
+		"backends", strings.Join(names, ","),
+		"status", status,
 	)
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Set("Failed-Backend", backendErr.BackendName)
-	w.WriteHeader(http.StatusBadGateway)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Failed-Backend", strings.Join(names, ","))
+	w.WriteHeader(status)
 
-	errorMessage := fmt.Sprintf("%s: %s", backendErr.BackendName, backendErr.Err.Error())
-	if _, err := w.Write([]byte(errorMessage)); err != nil {
+	if err := json.NewEncoder(w).Encode(ErrorResponse{
+		Code:    status,
+		Status:  "error",
+		Message: message,
+		Errors:  failures,
+	}); err != nil {
 		level.Error(logger).Log("msg", "Failed to write error response", "err", err)
 	}
 }
@@ -1,6 +1,7 @@
 package proxyresponse
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
 	"net/http/httptest"
@@ -11,41 +12,63 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func TestForwardBackendError(t *testing.T) {
+func TestForwardBackendErrors(t *testing.T) {
 	logger := log.NewNopLogger()
-	w := httptest.NewRecorder()
 
-	ForwardBackendError(w, "loki1", 503, []byte("upstream unavailable"), logger)
+	t.Run("single backend", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ForwardBackendErrors(w, []*BackendError{
+			{BackendName: "loki1", StatusCode: 503, Data: []byte("upstream unavailable\n")},
+		}, logger)
 
-	resp := w.Result()
-	require.Equal(t, 503, resp.StatusCode)
-	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
-	require.Equal(t, "loki1", resp.Header.Get("Failed-Backend"))
+		resp := w.Result()
+		require.Equal(t, 503, resp.StatusCode)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		require.Equal(t, "loki1", resp.Header.Get("Failed-Backend"))
 
-	body, err := io.ReadAll(resp.Body)
-	require.NoError(t, err)
-	assert.Equal(t, "loki1: upstream unavailable", string(body))
-}
+		var body ErrorResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, ErrorResponse{
+			Code:    503,
+			Status:  "error",
+			Message: "loki1: upstream unavailable",
+			Errors:  []BackendFailure{{ServerGroup: "loki1", Status: 503, Message: "upstream unavailable"}},
+		}, body)
+	})
 
-func TestForwardConnectionError(t *testing.T) {
-	logger := log.NewNopLogger()
-	w := httptest.NewRecorder()
+	t.Run("client error takes precedence", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ForwardBackendErrors(w, []*BackendError{
+			{BackendName: "loki1", Err: errors.New("connection refused")},
+			{BackendName: "loki2", StatusCode: 500, Data: []byte("internal error")},
+			{BackendName: "loki3", StatusCode: 429},
+			{BackendName: "loki4", StatusCode: 400, Data: []byte("parse error")},
+		}, logger)
 
-	backendErr := &BackendError{
-		BackendName: "loki2",
-		BackendURL:  "http://loki2:3100",
-		Err:         errors.New("connection refused"),
-	}
-	ForwardConnectionError(w, backendErr, logger)
+		resp := w.Result()
+		require.Equal(t, 400, resp.StatusCode)
+		require.Equal(t, "loki4,loki3,loki2,loki1", resp.Header.Get("Failed-Backend"))
 
-	resp := w.Result()
-	require.Equal(t, 502, resp.StatusCode)
-	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
-	require.Equal(t, "loki2", resp.Header.Get("Failed-Backend"))
+		var body ErrorResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, 400, body.Code)
+		assert.Equal(t, "loki4: parse error; loki3: Too Many Requests; loki2: internal error; loki1: connection refused", body.Message)
+		assert.Equal(t, []BackendFailure{
+			{ServerGroup: "loki4", Status: 400, Message: "parse error"},
+			{ServerGroup: "loki3", Status: 429, Message: "Too Many Requests"},
+			{ServerGroup: "loki2", Status: 500, Message: "internal error"},
+			{ServerGroup: "loki1", Status: 502, Message: "connection refused"},
+		}, body.Errors)
+	})
 
-	body, err := io.ReadAll(resp.Body)
-	require.NoError(t, err)
-	assert.Equal(t, "loki2: connection refused", string(body))
+	t.Run("connection errors answer 502", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		ForwardBackendErrors(w, []*BackendError{
+			{BackendName: "loki2", Err: errors.New("connection refused")},
+		}, logger)
+		require.Equal(t, 502, w.Code)
+		require.Contains(t, w.Body.String(), "loki2: connection refused")
+	})
 }
 
 func TestBackendError(t *testing.T) {
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+	traces "github.com/paulojmdias/lokxy/pkg/o11y/tracing"
+)
+
+// Defaults for cfg.RetryConfig.
+const (
+	defaultRetryMinBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 2 * time.Second
+)
+
+var defaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// retryPolicy is a server group's retry configuration with the defaults
+// filled in.
+type retryPolicy struct {
+	maxAttempts int
+	statusCodes map[int]bool
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+func newRetryPolicy(c cfg.RetryConfig) retryPolicy {
+	p := retryPolicy{
+		maxAttempts: max(c.MaxAttempts, 1),
+		statusCodes: map[int]bool{},
+		minBackoff:  c.MinBackoff,
+		maxBackoff:  c.MaxBackoff,
+	}
+	codes := c.StatusCodes
+	if len(codes) == 0 {
+		codes = defaultRetryStatusCodes
+	}
+	for _, code := range codes {
+		p.statusCodes[code] = true
+	}
+	if p.minBackoff == 0 {
+		p.minBackoff = defaultRetryMinBackoff
+	}
+	if p.maxBackoff == 0 {
+		p.maxBackoff = max(defaultRetryMaxBackoff, p.minBackoff)
+	}
+	return p
+}
+
+// backoff returns the delay before the given retry (1-based): the
+// exponential backoff with its upper half randomized, so the retries of
+// concurrent requests spread out.
+func (p retryPolicy) backoff(retry int) time.Duration {
+	d := p.maxBackoff
+	if shift := retry - 1; shift < 32 && p.minBackoff<<shift < p.maxBackoff {
+		d = p.minBackoff << shift
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryBudget bounds the retries of one client request across all server
+// groups, so a struggling backend cannot multiply the load of every query.
+type retryBudget struct {
+	unlimited bool
+	remaining atomic.Int64
+}
+
+func newRetryBudget(c cfg.RetryBudgetConfig) *retryBudget {
+	b := &retryBudget{unlimited: c.MaxRetries == 0}
+	b.remaining.Store(int64(c.MaxRetries))
+	return b
+}
+
+// take reserves one retry. It returns false once the budget is spent.
+func (b *retryBudget) take() bool {
+	return b.unlimited || b.remaining.Add(-1) >= 0
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP
+// date.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(t.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// isIdempotentRequest reports whether a request is idempotent and may be
+// sent more than once: a GET or HEAD, or a POST to one of Loki's read-only
+// query endpoints.
+func isIdempotentRequest(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		return formUpstreamPaths[path]
+	}
+	return false
+}
+
+// upstreamRequest is a client request as forwarded to every server group.
+type upstreamRequest struct {
+	method   string
+	path     string
+	rawQuery string
+	body     []byte
+	header   http.Header
+	asForm   bool
+
+	// pattern is the matched route, for metrics.
+	pattern string
+	// budget is shared by the server groups of one client request.
+	budget *retryBudget
+}
+
+// do sends req to the server group, retrying connection errors and
+// retryable statuses of idempotent requests as configured. Every attempt is
+// recorded as an event on span. It returns the last attempt's response or
+// error.
+func (u *upstream) do(ctx context.Context, span trace.Span, req upstreamRequest) (*http.Response, error) {
+	retryable := u.group.Retry.Enabled() && isIdempotentRequest(req.method, req.path)
+	for attempt := 1; ; attempt++ {
+		resp, err := u.sendHedged(ctx, span, req)
+
+		event := []attribute.KeyValue{attribute.Int("upstream.attempt", attempt)}
+		if err != nil {
+			event = append(event, attribute.String("upstream.error", err.Error()))
+		} else {
+			event = append(event, attribute.Int("upstream.status_code", resp.StatusCode))
+		}
+
+		delay, retry := u.retryDelay(resp, err, attempt)
+		retry = retry && retryable && ctx.Err() == nil
+		if retry && !req.budget.take() {
+			level.Debug(u.logger).Log("msg", "Retry budget exhausted", "instance", u.group.Name)
+			event = append(event, attribute.Bool("upstream.retry_budget_exhausted", true))
+			retry = false
+		}
+		if retry {
+			event = append(event, attribute.String("upstream.retry_backoff", delay.String()))
+		}
+		span.AddEvent("upstream_attempt", trace.WithAttributes(event...))
+		if !retry {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		metrics.UpstreamRetries.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("path", req.pattern),
+			attribute.String("method", req.method),
+			attribute.String("server_group", u.group.Name),
+		))
+		if err != nil {
+			level.Warn(u.logger).Log("msg", "Retrying upstream request", "instance", u.group.Name, "attempt", attempt, "backoff", delay, "err", err)
+		} else {
+			level.Warn(u.logger).Log("msg", "Retrying upstream request", "instance", u.group.Name, "attempt", attempt, "backoff", delay, "status", resp.StatusCode)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryDelay decides whether the outcome of the given attempt is retried,
+// and after how long. A Retry-After on a 429 or 503 response is honored; if
+// it asks for longer than the maximum backoff the response is returned
+// instead.
+func (u *upstream) retryDelay(resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= u.retry.maxAttempts {
+		return 0, false
+	}
+	delay := u.retry.backoff(attempt)
+	if err != nil {
+		return delay, true
+	}
+	if !u.retry.statusCodes[resp.StatusCode] {
+		return 0, false
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if after, ok := retryAfter(resp.Header, time.Now()); ok {
+			if after > u.retry.maxBackoff {
+				return 0, false
+			}
+			delay = max(delay, after)
+		}
+	}
+	return delay, true
+}
+
+// send makes one attempt of req. Idempotent requests fail over to the
+// server group's next endpoint when one cannot be reached or answers that
+// it is unavailable.
+func (u *upstream) send(ctx context.Context, req upstreamRequest) (*http.Response, error) {
+	idempotent := isIdempotentRequest(req.method, req.path)
+	order := u.endpoints.order()
+	for i, e := range order {
+		resp, err := u.sendTo(ctx, e, req)
+		if ctx.Err() != nil {
+			// Cancelled, e.g. a hedge that lost; not the endpoint's fault.
+			return resp, err
+		}
+		failed := err != nil || isEndpointFailure(resp.StatusCode)
+		u.endpoints.report(e, failed)
+		if !failed || !idempotent || i == len(order)-1 {
+			return resp, err
+		}
+
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		trace.SpanFromContext(ctx).AddEvent("upstream_failover", trace.WithAttributes(
+			attribute.String("upstream.endpoint", e.url),
+			attribute.String("upstream.error", err.Error()),
+		))
+		level.Warn(u.logger).Log("msg", "Failing over to next server group endpoint", "instance", u.group.Name, "endpoint", e.url, "err", err)
+	}
+	return nil, fmt.Errorf("server group %q has no endpoints", u.group.Name)
+}
+
+// sendTo sends req to one endpoint of the server group.
+func (u *upstream) sendTo(ctx context.Context, e *endpoint, req upstreamRequest) (*http.Response, error) {
+	targetURL := e.url + req.path
+	if req.rawQuery != "" {
+		targetURL += "?" + req.rawQuery
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, targetURL, bytes.NewReader(req.body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header = req.header.Clone()
+	if httpReq.Header == nil {
+		httpReq.Header = make(http.Header)
+	}
+	// lokxy decodes upstream bodies itself and compresses its own
+	// response, so the client's Accept-Encoding is not forwarded.
+	httpReq.Header.Set("Accept-Encoding", upstreamAcceptEncoding)
+	if req.asForm {
+		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	u.setHeaders(httpReq.Header)
+
+	traces.InjectTraceToHTTPRequest(ctx, httpReq)
+
+	if ce := level.Debug(u.logger); ce != nil {
+		for name, headers := range redactHeaders(httpReq.Header) {
+			for _, h := range headers {
+				_ = ce.Log("msg", "Request Header", "Name", name, "Value", h)
+			}
+		}
+	}
+
+	e.inflight.Add(1)
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		e.inflight.Add(-1)
+		return nil, err
+	}
+	resp.Body = &closeHook{ReadCloser: resp.Body, onClose: func() { e.inflight.Add(-1) }}
+	return resp, nil
+}
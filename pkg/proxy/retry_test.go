@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// mkRetryConfig is mkConfig with retries enabled on every server group.
+func mkRetryConfig(retry cfg.RetryConfig, urls ...string) *cfg.Config {
+	config := mkConfig(urls...)
+	for i := range config.ServerGroups {
+		config.ServerGroups[i].Retry = retry
+	}
+	return config
+}
+
+func TestProxy_Retry_SucceedsAfterRetryableStatus(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["a"]}`)
+		},
+	})
+	defer s1.Close()
+
+	config := mkRetryConfig(cfg.RetryConfig{MaxAttempts: 3, MinBackoff: time.Millisecond}, s1.URL)
+	rr := httptest.NewRecorder()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestProxy_Retry_GivesUpAfterMaxAttempts(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "unavailable")
+		},
+	})
+	defer s1.Close()
+
+	config := mkRetryConfig(cfg.RetryConfig{MaxAttempts: 3, MinBackoff: time.Millisecond}, s1.URL)
+	rr := httptest.NewRecorder()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Contains(t, rr.Body.String(), "unavailable")
+	require.Equal(t, int32(3), calls.Load())
+}
+
+func TestProxy_Retry_NonRetryableRequestsAndStatuses(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/": func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	})
+	defer s1.Close()
+
+	mux := mustMux(t, log.NewNopLogger(), mkRetryConfig(cfg.RetryConfig{MaxAttempts: 3, MinBackoff: time.Millisecond}, s1.URL))
+
+	// A POST to an endpoint that is not read-only is sent once.
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader("{}")))
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	require.Equal(t, int32(1), calls.Load())
+
+	// A status that is not configured as retryable is returned at once.
+	calls.Store(0)
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+	require.Equal(t, http.StatusInternalServerError, rr.Code)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestProxy_Retry_ReadOnlyPOST(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if string(body) != "start=1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusGatewayTimeout)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["a"]}`)
+		},
+	})
+	defer s1.Close()
+
+	config := mkRetryConfig(cfg.RetryConfig{MaxAttempts: 2, MinBackoff: time.Millisecond}, s1.URL)
+	req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/labels", strings.NewReader("start=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, req)
+
+	// The body is sent again in full on the retry.
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestProxy_Retry_HonorsRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	var first time.Time
+	var waited time.Duration
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			if calls.Add(1) == 1 {
+				first = time.Now()
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			waited = time.Since(first)
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["a"]}`)
+		},
+	})
+	defer s1.Close()
+
+	config := mkRetryConfig(cfg.RetryConfig{MaxAttempts: 2, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Second}, s1.URL)
+	rr := httptest.NewRecorder()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.GreaterOrEqual(t, waited, time.Second)
+}
+
+func TestProxy_Retry_RetryAfterBeyondMaxBackoff(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	})
+	defer s1.Close()
+
+	config := mkRetryConfig(cfg.RetryConfig{MaxAttempts: 3, MinBackoff: time.Millisecond}, s1.URL)
+	rr := httptest.NewRecorder()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+func TestProxy_Retry_BudgetSharedAcrossServerGroups(t *testing.T) {
+	var calls atomic.Int32
+	failing := func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{"/loki/api/v1/labels": failing})
+	defer s1.Close()
+	s2 := mkUpstreamServer(t, map[string]http.HandlerFunc{"/loki/api/v1/labels": failing})
+	defer s2.Close()
+
+	config := mkRetryConfig(cfg.RetryConfig{MaxAttempts: 5, MinBackoff: time.Millisecond}, s1.URL, s2.URL)
+	for i := range config.ServerGroups {
+		config.ServerGroups[i].IgnoreError = true
+	}
+	config.RetryBudget.MaxRetries = 3
+	rr := httptest.NewRecorder()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+	require.Equal(t, http.StatusBadGateway, rr.Code)
+	// Two first attempts and the three retries of the budget.
+	require.Equal(t, int32(5), calls.Load())
+}
+
+func TestProxy_Retry_ConnectionError(t *testing.T) {
+	var calls atomic.Int32
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			if calls.Add(1) == 1 {
+				// Drop the connection without a response.
+				conn, _, err := http.NewResponseController(w).Hijack()
+				require.NoError(t, err)
+				conn.Close()
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"status": "success", "data":["a"]}`)
+		},
+	})
+	defer s1.Close()
+
+	config := mkRetryConfig(cfg.RetryConfig{MaxAttempts: 2, MinBackoff: time.Millisecond}, s1.URL)
+	rr := httptest.NewRecorder()
+	mustMux(t, log.NewNopLogger(), config).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil))
+
+	require.Equal(t, http.StatusOK, rr.Code)
+	require.Equal(t, int32(2), calls.Load())
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := newRetryPolicy(cfg.RetryConfig{MaxAttempts: 10, MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second})
+	for range 100 {
+		d := p.backoff(1)
+		require.GreaterOrEqual(t, d, 50*time.Millisecond)
+		require.LessOrEqual(t, d, 100*time.Millisecond)
+
+		d = p.backoff(3)
+		require.GreaterOrEqual(t, d, 200*time.Millisecond)
+		require.LessOrEqual(t, d, 400*time.Millisecond)
+
+		// Capped at max_backoff, even for large retry numbers.
+		d = p.backoff(100)
+		require.GreaterOrEqual(t, d, 500*time.Millisecond)
+		require.LessOrEqual(t, d, time.Second)
+	}
+}
+
+func TestRetryPolicy_Defaults(t *testing.T) {
+	p := newRetryPolicy(cfg.RetryConfig{})
+	require.Equal(t, 1, p.maxAttempts)
+	require.Equal(t, defaultRetryMinBackoff, p.minBackoff)
+	require.Equal(t, defaultRetryMaxBackoff, p.maxBackoff)
+	require.Equal(t, map[int]bool{429: true, 502: true, 503: true, 504: true}, p.statusCodes)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	header := func(v string) http.Header {
+		return http.Header{"Retry-After": []string{v}}
+	}
+
+	d, ok := retryAfter(header("3"), now)
+	require.True(t, ok)
+	require.Equal(t, 3*time.Second, d)
+
+	d, ok = retryAfter(header(now.Add(5*time.Second).Format(http.TimeFormat)), now)
+	require.True(t, ok)
+	require.Equal(t, 5*time.Second, d)
+
+	d, ok = retryAfter(header(now.Add(-time.Minute).Format(http.TimeFormat)), now)
+	require.True(t, ok)
+	require.Zero(t, d)
+
+	_, ok = retryAfter(header("soon"), now)
+	require.False(t, ok)
+	_, ok = retryAfter(http.Header{}, now)
+	require.False(t, ok)
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := newRetryBudget(cfg.RetryBudgetConfig{MaxRetries: 2})
+	require.True(t, b.take())
+	require.True(t, b.take())
+	require.False(t, b.take())
+
+	unlimited := newRetryBudget(cfg.RetryBudgetConfig{})
+	for range 100 {
+		require.True(t, unlimited.take())
+	}
+}
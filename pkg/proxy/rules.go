@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/proxy/handler"
+)
+
+// emptyOnNotFoundPatterns are the routes whose upstreams answer 404 when
+// they have no rules. A 404 to a GET of them is merged as an empty rule set,
+// so that a server group without rules does not fail the merged view; other
+// methods keep the 404.
+var emptyOnNotFoundPatterns = map[string]bool{
+	"/loki/api/v1/rules":             true,
+	"/loki/api/v1/rules/{namespace}": true,
+	"/prometheus/api/v1/rules":       true,
+	"/prometheus/api/v1/alerts":      true,
+}
+
+type serverGroupKey struct{}
+
+// withServerGroup returns a shallow copy of r that is only sent to the named
+// server group.
+func withServerGroup(r *http.Request, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), serverGroupKey{}, name))
+}
+
+// requestServerGroups returns the server groups r is sent to: the one set
+// with withServerGroup, else all of them.
+func requestServerGroups(r *http.Request, groups []cfg.ServerGroup) []cfg.ServerGroup {
+	name, ok := r.Context().Value(serverGroupKey{}).(string)
+	if !ok {
+		return groups
+	}
+	for _, sg := range groups {
+		if sg.Name == name {
+			return []cfg.ServerGroup{sg}
+		}
+	}
+	return nil
+}
+
+// splitRuleNamespace maps a namespace of the merged rules view, prefixed
+// with its server group, back to the server group and the namespace it has
+// there. The longest matching server group name wins.
+func splitRuleNamespace(groups []cfg.ServerGroup, tagged string) (group, namespace string, ok bool) {
+	for _, sg := range groups {
+		rest, found := strings.CutPrefix(tagged, sg.Name+"/")
+		if found && rest != "" && len(sg.Name) > len(group) {
+			group, namespace, ok = sg.Name, rest, true
+		}
+	}
+	return group, namespace, ok
+}
+
+// splitUnescapedRuleNamespace maps the path of a tagged namespace that was
+// not percent-encoded, "<server group>/<namespace>[/<rule group>]", back to
+// its parts. The longest matching server group name wins; the namespace is
+// the segment after it, so a namespace that contains "/" must be encoded.
+func splitUnescapedRuleNamespace(groups []cfg.ServerGroup, path string) (group, namespace, ruleGroup string, ok bool) {
+	group, rest, ok := splitRuleNamespace(groups, path)
+	if !ok {
+		return "", "", "", false
+	}
+	namespace, ruleGroup, _ = strings.Cut(rest, "/")
+	if namespace == "" || strings.Contains(ruleGroup, "/") {
+		return "", "", "", false
+	}
+	return group, namespace, ruleGroup, true
+}
+
+// handleRuleNamespace serves /loki/api/v1/rules/{namespace} and
+// /loki/api/v1/rules/{namespace}/{group} from the server group the
+// namespace was tagged with in the merged view. The tagged namespace
+// contains "/" and is expected percent-encoded; unencoded, it is still
+// recognized as long as the namespace itself has no "/". Reading a
+// namespace merges it like the full list; other requests are forwarded as
+// they are.
+func (p *Proxy) handleRuleNamespace(w http.ResponseWriter, r *http.Request) {
+	groups := p.state.Load().config.ServerGroups
+	ruleGroup := r.PathValue("group")
+	group, namespace, ok := splitRuleNamespace(groups, r.PathValue("namespace"))
+	if !ok && ruleGroup != "" {
+		path := r.PathValue("namespace") + "/" + ruleGroup
+		if rest := r.PathValue("rest"); rest != "" {
+			path += "/" + rest
+		}
+		group, namespace, ruleGroup, ok = splitUnescapedRuleNamespace(groups, path)
+	} else if r.PathValue("rest") != "" {
+		ok = false
+	}
+	if !ok {
+		http.Error(w, "no rule groups found", http.StatusNotFound)
+		return
+	}
+
+	path := "/loki/api/v1/rules/" + namespace
+	rawPath := "/loki/api/v1/rules/" + url.PathEscape(namespace)
+	pattern := "/loki/api/v1/rules/{namespace}"
+	if ruleGroup != "" {
+		path += "/" + ruleGroup
+		rawPath += "/" + url.PathEscape(ruleGroup)
+		pattern += "/{group}"
+	}
+	fn := forwardFirstResponse
+	if r.Method == http.MethodGet && ruleGroup == "" {
+		fn = handler.HandleLokiRules
+	}
+
+	upstream := withUpstreamPath(r, path)
+	upstream.URL.RawPath = rawPath
+	// However the namespace was sent, the request is handled, and labelled
+	// in metrics, as the route it resolved to.
+	upstream.Pattern = pattern
+	p.fanoutRequest(w, withServerGroup(upstream, group), fn)
+}
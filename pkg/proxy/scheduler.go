@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+const (
+	// defaultMaxQueueLength bounds a tenant's queue when max_queue_length
+	// is not set.
+	defaultMaxQueueLength = 100
+
+	// defaultMaxTenants bounds the tenants scheduled under their own name
+	// when max_tenants is not set.
+	defaultMaxTenants = 1000
+
+	// anonymousTenant is the tenant of requests that name none.
+	anonymousTenant = "anonymous"
+
+	// overflowTenant is the tenant requests are scheduled as once
+	// max_tenants tenants have been seen.
+	overflowTenant = "other"
+)
+
+var (
+	// errTenantQueueFull rejects requests of a tenant whose queue is full.
+	errTenantQueueFull = errors.New("too many queued requests for tenant")
+
+	// errTenantQueueTimeout rejects requests that waited in their tenant's
+	// queue for longer than the queue timeout.
+	errTenantQueueTimeout = errors.New("timed out waiting in tenant queue")
+)
+
+// requestTenant returns the tenant a request is scheduled as: its
+// X-Scope-OrgID header, else the user it authenticates as with HTTP basic
+// auth, else anonymousTenant.
+func requestTenant(r *http.Request) string {
+	if tenant := r.Header.Get("X-Scope-OrgID"); tenant != "" {
+		return tenant
+	}
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return anonymousTenant
+}
+
+// queryScheduler queues fanout requests per tenant and dispatches them in
+// turn, so that the requests of one tenant cannot starve those of others.
+// It outlives configuration reloads; the limits are read from the
+// configuration each request starts with. A tenant's queue is dropped once
+// it has no requests left, making room for another tenant under max_tenants.
+type queryScheduler struct {
+	mu       sync.Mutex
+	tenants  map[string]*tenantQueue
+	inflight int
+	// seen is the tenants with requests scheduled under their own name.
+	// The tenant names come from clients, so they are capped to bound the
+	// queues. A tenant is dropped from it with its queue.
+	seen map[string]struct{}
+	// active lists the tenants with queued requests, in dispatch order;
+	// next is the one whose turn it is.
+	active []*tenantQueue
+	next   int
+}
+
+// tenantQueue holds the requests of one tenant.
+type tenantQueue struct {
+	name     string
+	queue    []*schedulerWaiter
+	inflight int
+	active   bool
+	// credit is the number of requests the tenant may still dispatch in
+	// its current turn.
+	credit int
+}
+
+// schedulerWaiter is a queued request. ready is closed once it is
+// dispatched.
+type schedulerWaiter struct {
+	ready      chan struct{}
+	dispatched bool
+}
+
+func newQueryScheduler() *queryScheduler {
+	return &queryScheduler{tenants: map[string]*tenantQueue{}, seen: map[string]struct{}{}}
+}
+
+// resolve returns the tenant a request of tenant is scheduled as: tenant
+// itself, or overflowTenant while max_tenants other tenants have requests.
+// s.mu must be held.
+func (s *queryScheduler) resolve(tenant string, config cfg.QuerySchedulerConfig) string {
+	if _, ok := config.TenantWeights[tenant]; ok {
+		return tenant
+	}
+	if _, ok := s.seen[tenant]; ok {
+		return tenant
+	}
+	maxTenants := config.MaxTenants
+	if maxTenants == 0 {
+		maxTenants = defaultMaxTenants
+	}
+	if len(s.seen) >= maxTenants {
+		return overflowTenant
+	}
+	s.seen[tenant] = struct{}{}
+	return tenant
+}
+
+// schedule waits for the request's turn to be fanned out. The returned
+// func must be called once the request is done.
+func (s *queryScheduler) schedule(ctx context.Context, tenant string, config cfg.QuerySchedulerConfig) (func(), error) {
+	s.mu.Lock()
+	tenant = s.resolve(tenant, config)
+	attrs := metric.WithAttributes(attribute.String("tenant", tenant))
+	tq, ok := s.tenants[tenant]
+	if !ok {
+		tq = &tenantQueue{name: tenant}
+		s.tenants[tenant] = tq
+	}
+	if len(tq.queue) == 0 && s.hasCapacity(tq, config) {
+		s.start(ctx, tq, attrs)
+		s.mu.Unlock()
+		metrics.SchedulerQueueWait.Record(ctx, 0, attrs)
+		return s.releaseFunc(ctx, tq, config, attrs), nil
+	}
+
+	maxQueue := config.MaxQueueLength
+	if maxQueue == 0 {
+		maxQueue = defaultMaxQueueLength
+	}
+	if len(tq.queue) >= maxQueue {
+		s.forget(tq)
+		s.mu.Unlock()
+		s.recordRejected(ctx, tenant, "queue_full")
+		return nil, errTenantQueueFull
+	}
+	w := &schedulerWaiter{ready: make(chan struct{})}
+	tq.queue = append(tq.queue, w)
+	if !tq.active {
+		tq.active = true
+		s.active = append(s.active, tq)
+	}
+	s.mu.Unlock()
+	metrics.SchedulerQueueLength.Add(ctx, 1, attrs)
+	defer metrics.SchedulerQueueLength.Add(context.WithoutCancel(ctx), -1, attrs)
+
+	start := time.Now()
+	var timeout <-chan time.Time
+	if config.QueueTimeout > 0 {
+		timer := time.NewTimer(config.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+	case <-timeout:
+		err = errTenantQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	metrics.SchedulerQueueWait.Record(context.WithoutCancel(ctx), time.Since(start).Seconds(), attrs)
+
+	release := s.releaseFunc(ctx, tq, config, attrs)
+	if err != nil {
+		s.mu.Lock()
+		dispatched := w.dispatched
+		if !dispatched {
+			tq.queue = slices.DeleteFunc(tq.queue, func(q *schedulerWaiter) bool { return q == w })
+			s.forget(tq)
+		}
+		s.mu.Unlock()
+		if dispatched {
+			// Dispatched just as it gave up: hand the slot on.
+			release()
+		}
+		if errors.Is(err, errTenantQueueTimeout) {
+			s.recordRejected(ctx, tenant, "timeout")
+		}
+		return nil, err
+	}
+	return release, nil
+}
+
+func (s *queryScheduler) recordRejected(ctx context.Context, tenant, reason string) {
+	metrics.SchedulerRejected.Add(context.WithoutCancel(ctx), 1, metric.WithAttributes(
+		attribute.String("tenant", tenant),
+		attribute.String("reason", reason),
+	))
+}
+
+// hasCapacity reports whether a request of tq may be fanned out now.
+// s.mu must be held.
+func (s *queryScheduler) hasCapacity(tq *tenantQueue, config cfg.QuerySchedulerConfig) bool {
+	return (config.MaxConcurrentQueries == 0 || s.inflight < config.MaxConcurrentQueries) &&
+		(config.MaxInflightPerTenant == 0 || tq.inflight < config.MaxInflightPerTenant)
+}
+
+// start counts a request of tq as fanned out. s.mu must be held.
+func (s *queryScheduler) start(ctx context.Context, tq *tenantQueue, attrs metric.MeasurementOption) {
+	s.inflight++
+	tq.inflight++
+	metrics.SchedulerInflight.Add(ctx, 1, attrs)
+}
+
+func (s *queryScheduler) releaseFunc(ctx context.Context, tq *tenantQueue, config cfg.QuerySchedulerConfig, attrs metric.MeasurementOption) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ctx := context.WithoutCancel(ctx)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.inflight--
+			tq.inflight--
+			metrics.SchedulerInflight.Add(ctx, -1, attrs)
+			s.dispatch(ctx, config)
+			s.forget(tq)
+		})
+	}
+}
+
+// dispatch starts queued requests while there is capacity, taking tenants
+// in turn. s.mu must be held.
+func (s *queryScheduler) dispatch(ctx context.Context, config cfg.QuerySchedulerConfig) {
+	for {
+		tq := s.pick(config)
+		if tq == nil {
+			return
+		}
+		w := tq.queue[0]
+		tq.queue = tq.queue[1:]
+		w.dispatched = true
+		s.start(ctx, tq, metric.WithAttributes(attribute.String("tenant", tq.name)))
+		close(w.ready)
+	}
+}
+
+// pick returns the tenant to dispatch the next request of, or nil when no
+// queued request may be dispatched. With the weighted strategy a tenant
+// dispatches up to its weight in requests per turn, otherwise one.
+// s.mu must be held.
+func (s *queryScheduler) pick(config cfg.QuerySchedulerConfig) *tenantQueue {
+	if config.MaxConcurrentQueries > 0 && s.inflight >= config.MaxConcurrentQueries {
+		return nil
+	}
+	for tried := 0; tried < len(s.active); {
+		if s.next >= len(s.active) {
+			s.next = 0
+		}
+		tq := s.active[s.next]
+		if len(tq.queue) == 0 {
+			tq.active = false
+			tq.credit = 0
+			s.active = slices.Delete(s.active, s.next, s.next+1)
+			continue
+		}
+		if !s.hasCapacity(tq, config) {
+			tq.credit = 0
+			s.next++
+			tried++
+			continue
+		}
+		if tq.credit == 0 {
+			tq.credit = 1
+			if config.Strategy == cfg.SchedulerWeighted {
+				tq.credit = max(config.TenantWeights[tq.name], 1)
+			}
+		}
+		if tq.credit--; tq.credit == 0 {
+			s.next++
+		}
+		return tq
+	}
+	return nil
+}
+
+// forget drops tq once it has no requests left. s.mu must be held.
+func (s *queryScheduler) forget(tq *tenantQueue) {
+	if tq.inflight > 0 || len(tq.queue) > 0 {
+		return
+	}
+	if tq.active {
+		i := slices.Index(s.active, tq)
+		s.active = slices.Delete(s.active, i, i+1)
+		if i < s.next {
+			s.next--
+		}
+		tq.active = false
+	}
+	delete(s.tenants, tq.name)
+	delete(s.seen, tq.name)
+}
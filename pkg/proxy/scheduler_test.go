@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// queued returns the number of requests waiting in the scheduler.
+func (s *queryScheduler) queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, tq := range s.tenants {
+		n += len(tq.queue)
+	}
+	return n
+}
+
+// dispatchOrder queues one request per entry of tenants, in order, behind a
+// request holding the only slot, and returns the tenants in the order their
+// requests were dispatched.
+func dispatchOrder(t *testing.T, config cfg.QuerySchedulerConfig, tenants ...string) []string {
+	t.Helper()
+	s := newQueryScheduler()
+	ctx := t.Context()
+	hold, err := s.schedule(ctx, "holder", config)
+	require.NoError(t, err)
+
+	dispatched := make(chan string)
+	for i, tenant := range tenants {
+		go func() {
+			release, err := s.schedule(ctx, tenant, config)
+			if err != nil {
+				dispatched <- err.Error()
+				return
+			}
+			dispatched <- tenant
+			release()
+		}()
+		require.Eventually(t, func() bool { return s.queued() == i+1 }, time.Second, time.Millisecond)
+	}
+
+	hold()
+	var order []string
+	for range tenants {
+		order = append(order, <-dispatched)
+	}
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.tenants) == 0
+	}, time.Second, time.Millisecond)
+	return order
+}
+
+func TestQueryScheduler_RoundRobin(t *testing.T) {
+	config := cfg.QuerySchedulerConfig{MaxConcurrentQueries: 1}
+	order := dispatchOrder(t, config, "a", "a", "a", "b", "c")
+	require.Equal(t, []string{"a", "b", "c", "a", "a"}, order)
+}
+
+func TestQueryScheduler_Weighted(t *testing.T) {
+	config := cfg.QuerySchedulerConfig{
+		MaxConcurrentQueries: 1,
+		Strategy:             cfg.SchedulerWeighted,
+		TenantWeights:        map[string]int{"a": 2},
+	}
+	order := dispatchOrder(t, config, "a", "a", "a", "a", "b", "b")
+	require.Equal(t, []string{"a", "a", "b", "a", "a", "b"}, order)
+}
+
+func TestQueryScheduler_PerTenantLimit(t *testing.T) {
+	s := newQueryScheduler()
+	config := cfg.QuerySchedulerConfig{MaxInflightPerTenant: 1, QueueTimeout: 50 * time.Millisecond}
+	ctx := t.Context()
+
+	release, err := s.schedule(ctx, "a", config)
+	require.NoError(t, err)
+
+	// Other tenants are not held up by a tenant at its limit.
+	releaseB, err := s.schedule(ctx, "b", config)
+	require.NoError(t, err)
+	releaseB()
+
+	_, err = s.schedule(ctx, "a", config)
+	require.ErrorIs(t, err, errTenantQueueTimeout)
+
+	release()
+	release, err = s.schedule(ctx, "a", config)
+	require.NoError(t, err)
+	release()
+	require.Empty(t, s.tenants)
+}
+
+func TestQueryScheduler_QueueFull(t *testing.T) {
+	s := newQueryScheduler()
+	config := cfg.QuerySchedulerConfig{MaxConcurrentQueries: 1, MaxQueueLength: 1}
+
+	release, err := s.schedule(t.Context(), "a", config)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	queued := make(chan error)
+	go func() {
+		_, err := s.schedule(ctx, "a", config)
+		queued <- err
+	}()
+	require.Eventually(t, func() bool { return s.queued() == 1 }, time.Second, time.Millisecond)
+
+	_, err = s.schedule(t.Context(), "a", config)
+	require.ErrorIs(t, err, errTenantQueueFull)
+
+	// A request that gives up leaves the queue.
+	cancel()
+	require.ErrorIs(t, <-queued, context.Canceled)
+	require.Zero(t, s.queued())
+	release()
+	require.Empty(t, s.tenants)
+}
+
+func TestQueryScheduler_MaxTenants(t *testing.T) {
+	s := newQueryScheduler()
+	config := cfg.QuerySchedulerConfig{MaxConcurrentQueries: 10, MaxTenants: 2, TenantWeights: map[string]int{"platform": 2}}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Equal(t, "a", s.resolve("a", config))
+	require.Equal(t, "b", s.resolve("b", config))
+	require.Equal(t, overflowTenant, s.resolve("c", config))
+	// Tenants already seen and weighted tenants keep their own name.
+	require.Equal(t, "a", s.resolve("a", config))
+	require.Equal(t, "platform", s.resolve("platform", config))
+	require.Len(t, s.seen, 2)
+}
+
+func TestQueryScheduler_MaxTenantsChurn(t *testing.T) {
+	s := newQueryScheduler()
+	config := cfg.QuerySchedulerConfig{MaxConcurrentQueries: 10, MaxTenants: 1}
+
+	release, err := s.schedule(t.Context(), "a", config)
+	require.NoError(t, err)
+	overflow, err := s.schedule(t.Context(), "b", config)
+	require.NoError(t, err)
+	s.mu.Lock()
+	require.Contains(t, s.tenants, overflowTenant)
+	require.NotContains(t, s.tenants, "b")
+	s.mu.Unlock()
+	overflow()
+
+	// Once tenant a is done, a new tenant gets its own queue.
+	release()
+	release, err = s.schedule(t.Context(), "c", config)
+	require.NoError(t, err)
+	defer release()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Contains(t, s.tenants, "c")
+	require.NotContains(t, s.tenants, overflowTenant)
+	require.Equal(t, map[string]struct{}{"c": {}}, s.seen)
+}
+
+func TestRequestTenant(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil)
+	require.Equal(t, anonymousTenant, requestTenant(r))
+
+	r.SetBasicAuth("grafana", "secret")
+	require.Equal(t, "grafana", requestTenant(r))
+
+	r.Header.Set("X-Scope-OrgID", "team-a")
+	require.Equal(t, "team-a", requestTenant(r))
+}
+
+func TestProxy_QueryScheduler(t *testing.T) {
+	started := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			started <- struct{}{}
+			<-unblock
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status": "success", "data":["a"]}`))
+		},
+	})
+	defer s1.Close()
+
+	config := mkConfig(s1.URL)
+	config.QueryScheduler = cfg.QuerySchedulerConfig{MaxConcurrentQueries: 1, MaxQueueLength: 1}
+	p, err := New(log.NewNopLogger(), config)
+	require.NoError(t, err)
+	mux := NewServeMux(log.NewNopLogger(), p, nil, false)
+	serve := func() int {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/loki/api/v1/labels", nil)
+		req.Header.Set("X-Scope-OrgID", "team-a")
+		mux.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	codes := make(chan int, 2)
+	go func() { codes <- serve() }()
+	<-started
+	go func() { codes <- serve() }()
+	require.Eventually(t, func() bool { return p.scheduler.queued() == 1 }, time.Second, time.Millisecond)
+
+	require.Equal(t, http.StatusTooManyRequests, serve())
+
+	close(unblock)
+	require.Equal(t, http.StatusOK, <-codes)
+	require.Equal(t, http.StatusOK, <-codes)
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// Defaults for cfg.LoadSheddingConfig.
+const (
+	defaultShedRetryAfter   = time.Second
+	defaultAdaptiveMinLimit = 10
+	defaultAdaptiveMaxLimit = 1000
+)
+
+// adaptiveBackoff is the factor the adaptive limit is multiplied by when
+// requests are slow.
+const adaptiveBackoff = 0.9
+
+// Kinds of shed requests, for the "kind" metric attribute.
+const (
+	shedKindRequest = "request"
+	shedKindTail    = "tail"
+)
+
+// loadShedder bounds the requests and tails served at once. It outlives
+// configuration reloads; the limits are read from the configuration each
+// request starts with.
+type loadShedder struct {
+	requests atomic.Int64
+	tails    atomic.Int64
+	adaptive adaptiveLimit
+}
+
+// admit counts a request of kind in. It returns false, with the reason,
+// when the request has to be shed; otherwise release must be called once
+// the request is done.
+func (s *loadShedder) admit(ctx context.Context, kind string, config cfg.LoadSheddingConfig) (release func(), reason string, ok bool) {
+	inflight, limit := &s.requests, config.MaxInflightRequests
+	if kind == shedKindTail {
+		inflight, limit = &s.tails, config.MaxInflightTails
+	}
+
+	n := inflight.Add(1)
+	switch {
+	case limit > 0 && n > int64(limit):
+		reason = "limit"
+	case kind == shedKindRequest && config.Adaptive.Enabled() && n > int64(s.adaptive.current(config)):
+		reason = "adaptive"
+	}
+	if reason != "" {
+		inflight.Add(-1)
+		return nil, reason, false
+	}
+
+	attrs := metric.WithAttributes(attribute.String("kind", kind))
+	metrics.InflightRequests.Add(ctx, 1, attrs)
+	return func() {
+		inflight.Add(-1)
+		metrics.InflightRequests.Add(context.WithoutCancel(ctx), -1, attrs)
+	}, "", true
+}
+
+// shed answers a request that could not be admitted.
+func shed(w http.ResponseWriter, r *http.Request, kind, reason string, config cfg.LoadSheddingConfig, logger log.Logger) {
+	metrics.RequestsShed.Add(r.Context(), 1, metric.WithAttributes(
+		attribute.String("kind", kind),
+		attribute.String("reason", reason),
+	))
+	retryAfter := config.RetryAfter
+	if retryAfter == 0 {
+		retryAfter = defaultShedRetryAfter
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, r, http.StatusServiceUnavailable, "lokxy is overloaded, retry later", logger)
+}
+
+// adaptiveLimit is a concurrency limit adjusted to the upstream latency:
+// it is multiplied by adaptiveBackoff when a request takes longer than the
+// target latency, at most once per target latency so a burst of slow
+// requests does not collapse it, and grows by about one every limit fast
+// requests.
+type adaptiveLimit struct {
+	mu          sync.Mutex
+	limit       float64
+	lastBackoff time.Time
+}
+
+// adaptiveBounds returns the range of the adaptive limit.
+func adaptiveBounds(config cfg.LoadSheddingConfig) (lo, hi float64) {
+	a := config.Adaptive
+	hi = float64(a.MaxLimit)
+	if hi == 0 {
+		hi = float64(config.MaxInflightRequests)
+	}
+	if hi == 0 {
+		hi = defaultAdaptiveMaxLimit
+	}
+	lo = float64(a.MinLimit)
+	if lo == 0 {
+		lo = defaultAdaptiveMinLimit
+	}
+	return min(lo, hi), hi
+}
+
+// current returns the limit, within the configured bounds.
+func (a *adaptiveLimit) current(config cfg.LoadSheddingConfig) float64 {
+	lo, hi := adaptiveBounds(config)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.limit == 0 {
+		a.limit = hi
+	}
+	a.limit = min(max(a.limit, lo), hi)
+	return a.limit
+}
+
+// observe adjusts the limit to the time the server groups took to answer a
+// request.
+func (a *adaptiveLimit) observe(ctx context.Context, latency time.Duration, config cfg.LoadSheddingConfig) {
+	target := config.Adaptive.TargetLatency
+	lo, hi := adaptiveBounds(config)
+	a.mu.Lock()
+	if a.limit == 0 {
+		a.limit = hi
+	}
+	now := time.Now()
+	switch {
+	case latency <= target:
+		a.limit += 1 / a.limit
+	case now.Sub(a.lastBackoff) >= target:
+		a.limit *= adaptiveBackoff
+		a.lastBackoff = now
+	}
+	a.limit = min(max(a.limit, lo), hi)
+	limit := a.limit
+	a.mu.Unlock()
+
+	metrics.AdaptiveConcurrencyLimit.Record(context.WithoutCancel(ctx), int64(limit))
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// readFunc is an io.Reader calling itself.
+type readFunc func([]byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestProxy_LoadShedding(t *testing.T) {
+	started := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	s1 := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/labels": func(w http.ResponseWriter, _ *http.Request) {
+			started <- struct{}{}
+			<-unblock
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status": "success", "data":["a"]}`))
+		},
+	})
+	defer s1.Close()
+
+	config := mkConfig(s1.URL)
+	config.LoadShedding = cfg.LoadSheddingConfig{MaxInflightRequests: 1, MaxInflightTails: 1, RetryAfter: 1500 * time.Millisecond}
+	p, err := New(log.NewNopLogger(), config)
+	require.NoError(t, err)
+	mux := NewServeMux(log.NewNopLogger(), p, nil, false)
+	serve := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		return rr
+	}
+
+	first := make(chan int)
+	go func() { first <- serve("/loki/api/v1/labels").Code }()
+	<-started
+
+	rr := serve("/loki/api/v1/labels")
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.Equal(t, "2", rr.Header().Get("Retry-After"))
+
+	// Prometheus clients get the Prometheus error format.
+	rr = serve("/prometheus/api/v1/labels")
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.JSONEq(t, `{"status":"error","errorType":"unavailable","error":"lokxy is overloaded, retry later"}`, rr.Body.String())
+
+	// A shed request's body is not read.
+	var read atomic.Bool
+	req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/labels", readFunc(func([]byte) (int, error) {
+		read.Store(true)
+		return 0, io.EOF
+	}))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	require.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	require.False(t, read.Load())
+
+	// Probes and the Grafana health check are never shed, and tails are
+	// counted apart from other requests.
+	require.Equal(t, http.StatusOK, serve("/healthy").Code)
+	require.Equal(t, http.StatusOK, serve("/loki/api/v1/query?query=vector(1)%2Bvector(1)").Code)
+	p.shed.tails.Store(1)
+	require.Equal(t, http.StatusServiceUnavailable, serve("/loki/api/v1/tail?query={app=\"a\"}").Code)
+	p.shed.tails.Store(0)
+
+	close(unblock)
+	require.Equal(t, http.StatusOK, <-first)
+	require.Equal(t, http.StatusOK, serve("/loki/api/v1/labels").Code)
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	config := cfg.LoadSheddingConfig{Adaptive: cfg.AdaptiveConcurrencyConfig{TargetLatency: 50 * time.Millisecond, MinLimit: 5, MaxLimit: 20}}
+	var a adaptiveLimit
+	ctx := t.Context()
+	require.InDelta(t, 20, a.current(config), 0.001)
+
+	// Slow requests back the limit off once per target latency.
+	a.observe(ctx, time.Second, config)
+	a.observe(ctx, time.Second, config)
+	require.InDelta(t, 18, a.current(config), 0.001)
+
+	for range 20 {
+		a.lastBackoff = time.Time{}
+		a.observe(ctx, time.Second, config)
+	}
+	require.InDelta(t, 5, a.current(config), 0.001)
+
+	// Fast requests grow it back by about one per limit requests.
+	for range 5 {
+		a.observe(ctx, time.Millisecond, config)
+	}
+	require.InDelta(t, 6, a.current(config), 0.1)
+}
+
+func TestLoadShedder_Adaptive(t *testing.T) {
+	config := cfg.LoadSheddingConfig{Adaptive: cfg.AdaptiveConcurrencyConfig{TargetLatency: time.Second, MinLimit: 1, MaxLimit: 2}}
+	var s loadShedder
+	ctx := t.Context()
+
+	r1, _, ok := s.admit(ctx, shedKindRequest, config)
+	require.True(t, ok)
+	r2, _, ok := s.admit(ctx, shedKindRequest, config)
+	require.True(t, ok)
+	_, reason, ok := s.admit(ctx, shedKindRequest, config)
+	require.False(t, ok)
+	require.Equal(t, "adaptive", reason)
+
+	// The adaptive limit does not apply to tails.
+	r3, _, ok := s.admit(ctx, shedKindTail, config)
+	require.True(t, ok)
+	r1()
+	r2()
+	r3()
+	require.Zero(t, s.requests.Load())
+	require.Zero(t, s.tails.Load())
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gorilla/websocket"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// defaultHandshakeTimeout bounds the tail WebSocket handshake when neither
+// response_header_timeout nor timeout is set, as gorilla's default dialer
+// does.
+const defaultHandshakeTimeout = 45 * time.Second
+
+// upstream is the connection setup for one server group, built once per
+// configuration load. The HTTP fanout and the tail WebSocket both connect
+// through it, so the group's TLS, dial, proxy, timeout and header settings
+// apply to both alike.
+type upstream struct {
+	group     cfg.ServerGroup
+	endpoints *endpointPool
+	retry     retryPolicy
+	hedge     *hedgePolicy
+	breaker   *circuitBreaker
+	limiter   *groupLimiter
+	logger    log.Logger
+}
+
+func newUpstream(instance cfg.ServerGroup, logger log.Logger) (*upstream, error) {
+	endpoints, err := newEndpointPool(instance, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upstream{
+		group:     instance,
+		endpoints: endpoints,
+		retry:     newRetryPolicy(instance.Retry),
+		hedge:     newHedgePolicy(instance.Hedge),
+		breaker:   newCircuitBreaker(instance, logger),
+		limiter:   newGroupLimiter(instance),
+		logger:    logger,
+	}, nil
+}
+
+// createWebSocketDialer derives the tail dialer from the server group's
+// transport, sharing its dialer, proxy and TLS settings.
+func createWebSocketDialer(instance cfg.ServerGroup, transport *http.Transport) *websocket.Dialer {
+	handshakeTimeout := transport.ResponseHeaderTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = defaultHandshakeTimeout
+	}
+	if instance.HTTPClientConfig.DialTimeout > 0 {
+		handshakeTimeout += instance.HTTPClientConfig.DialTimeout
+	}
+
+	return &websocket.Dialer{
+		NetDialContext: transport.DialContext,
+		Proxy:          transport.Proxy,
+		// The transport adds HTTP/2 to its own TLS config on first use; a
+		// WebSocket handshake must stay on HTTP/1.1.
+		TLSClientConfig:  transport.TLSClientConfig.Clone(),
+		HandshakeTimeout: handshakeTimeout,
+	}
+}
+
+// setHeaders applies the server group's configured headers, which take
+// precedence over any forwarded from the client.
+func (u *upstream) setHeaders(h http.Header) {
+	for key, value := range u.group.Headers {
+		h.Set(key, value)
+	}
+}
+
+// dialWebSocket opens a WebSocket to path on the server group, with the
+// group's headers added to header. Endpoints that cannot be reached are
+// failed over.
+func (u *upstream) dialWebSocket(ctx context.Context, path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	u.setHeaders(header)
+
+	var (
+		conn *websocket.Conn
+		resp *http.Response
+		err  error
+	)
+	for _, e := range u.endpoints.order() {
+		targetURL := e.url
+		if after, ok := strings.CutPrefix(targetURL, "http://"); ok {
+			targetURL = "ws://" + after
+		} else if after, ok := strings.CutPrefix(targetURL, "https://"); ok {
+			targetURL = "wss://" + after
+		}
+		targetURL += path
+
+		logUpstreamRequest(u.logger, targetURL, header)
+		conn, resp, err = e.dialer.DialContext(ctx, targetURL, header)
+		if ctx.Err() != nil {
+			break
+		}
+		failed := err != nil && (resp == nil || isEndpointFailure(resp.StatusCode))
+		u.endpoints.report(e, failed)
+		if !failed {
+			break
+		}
+		level.Warn(u.logger).Log("msg", "Failed to reach server group endpoint", "instance", u.group.Name, "endpoint", e.url, "err", err)
+	}
+	return conn, resp, err
+}
+
+// get sends a GET request for path to the server group, with the group's
+// headers added to header.
+func (u *upstream) get(ctx context.Context, path string, header http.Header) (*http.Response, error) {
+	path, rawQuery, _ := strings.Cut(path, "?")
+	return u.send(ctx, upstreamRequest{method: http.MethodGet, path: path, rawQuery: rawQuery, header: header})
+}
+
+// tailDialer connects tails to the server groups of the proxy. The upstream
+// is looked up in the current snapshot on every call, so reconnects and
+// polls of running tails pick up a reloaded configuration.
+type tailDialer struct {
+	p *Proxy
+}
+
+func (d tailDialer) upstream(group string) (*upstream, error) {
+	u, ok := d.p.state.Load().upstreams[group]
+	if !ok {
+		return nil, fmt.Errorf("server group %q is no longer configured", group)
+	}
+	return u, nil
+}
+
+func (d tailDialer) DialWebSocket(ctx context.Context, group, path string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	u, err := d.upstream(group)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u.dialWebSocket(ctx, path, header)
+}
+
+func (d tailDialer) Get(ctx context.Context, group, path string, header http.Header) (*http.Response, error) {
+	u, err := d.upstream(group)
+	if err != nil {
+		return nil, err
+	}
+	return u.get(ctx, path, header)
+}
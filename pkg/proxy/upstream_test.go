@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	traces "github.com/paulojmdias/lokxy/pkg/o11y/tracing"
+)
+
+func TestCreateWebSocketDialer_SharesTransportSettings(t *testing.T) {
+	sg := cfg.ServerGroup{Name: "loki1", URL: "https://localhost:3100", Timeout: 5}
+	sg.HTTPClientConfig.DialTimeout = time.Second
+	sg.HTTPClientConfig.TLSConfig.InsecureSkipVerify = true
+
+	u, err := newUpstream(sg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	transport := u.endpoints.endpoints[0].client.Transport.(*CustomRoundTripper).rt.(*http.Transport)
+	require.NotNil(t, u.endpoints.endpoints[0].dialer.NetDialContext)
+	// Without a proxy_url both connect directly.
+	require.Nil(t, transport.Proxy)
+	require.Nil(t, u.endpoints.endpoints[0].dialer.Proxy)
+	require.True(t, u.endpoints.endpoints[0].dialer.TLSClientConfig.InsecureSkipVerify)
+	// The dialer must not share the TLS config the transport adds h2 to.
+	require.NotSame(t, transport.TLSClientConfig, u.endpoints.endpoints[0].dialer.TLSClientConfig)
+	// Handshake bounded by the response header timeout plus the dial timeout.
+	require.Equal(t, 6*time.Second, u.endpoints.endpoints[0].dialer.HandshakeTimeout)
+}
+
+func TestCreateWebSocketDialer_DefaultHandshakeTimeout(t *testing.T) {
+	u, err := newUpstream(cfg.ServerGroup{Name: "loki1", URL: "http://localhost:3100"}, log.NewNopLogger())
+	require.NoError(t, err)
+	require.Equal(t, defaultHandshakeTimeout, u.endpoints.endpoints[0].dialer.HandshakeTimeout)
+}
+
+func TestUpstream_ProxyURL(t *testing.T) {
+	// The proxy refuses every request; it only records what went through it.
+	var mu sync.Mutex
+	var proxied []string
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.Method+" "+r.Host)
+		mu.Unlock()
+		http.Error(w, "refused", http.StatusForbidden)
+	}))
+	defer proxySrv.Close()
+
+	sg := cfg.ServerGroup{Name: "loki1", URL: "http://loki.example:3100"}
+	sg.HTTPClientConfig.ProxyURL = proxySrv.URL
+	u, err := newUpstream(sg, log.NewNopLogger())
+	require.NoError(t, err)
+
+	// Queries and tails of the group both go through the proxy.
+	resp, err := u.get(t.Context(), "/loki/api/v1/labels", http.Header{})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	_, _, err = u.dialWebSocket(t.Context(), "/loki/api/v1/tail", http.Header{})
+	require.Error(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, []string{"GET loki.example:3100", "CONNECT loki.example:3100"}, proxied)
+}
+
+// mkTailUpstream starts a TLS WebSocket tail backend that records the
+// headers of every connection and drops the first one.
+func mkTailUpstream(t *testing.T) (*httptest.Server, func() []http.Header) {
+	t.Helper()
+	var mu sync.Mutex
+	var headers []http.Header
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Clone())
+		n := len(headers)
+		mu.Unlock()
+
+		up := websocket.Upgrader{}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteJSON(map[string]any{"streams": []map[string]any{{
+			"stream": map[string]string{"app": "a"},
+			"values": [][]string{{"100", "line"}},
+		}}})
+		if n > 1 {
+			time.Sleep(time.Second)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []http.Header {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]http.Header(nil), headers...)
+	}
+}
+
+func TestProxy_Tail_UsesServerGroupTransportAndReload(t *testing.T) {
+	backend, headers := mkTailUpstream(t)
+
+	config := mkConfig(backend.URL)
+	config.ServerGroups[0].Headers = map[string]string{"X-Scope-OrgID": "before"}
+	config.Tail.Reconnect.MinBackoff = 200 * time.Millisecond
+
+	logger := log.NewNopLogger()
+	p, err := New(logger, config)
+	require.NoError(t, err)
+	srv := httptest.NewServer(NewServeMux(logger, p, nil, false))
+	defer srv.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/loki/api/v1/tail?query=%7Bapp%3D%22a%22%7D", nil)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	var frame map[string]any
+	require.NoError(t, client.ReadJSON(&frame))
+
+	// The upstream drops the first connection; the reconnect uses the
+	// reloaded configuration.
+	reloaded := mkConfig(backend.URL)
+	reloaded.ServerGroups[0].Headers = map[string]string{"X-Scope-OrgID": "after"}
+	require.NoError(t, p.ApplyConfig(reloaded))
+
+	require.Eventually(t, func() bool { return len(headers()) == 2 }, 3*time.Second, 10*time.Millisecond)
+	got := headers()
+	require.Equal(t, "before", got[0].Get("X-Scope-OrgID"))
+	require.Equal(t, "after", got[1].Get("X-Scope-OrgID"))
+}
+
+func TestProxy_TailStream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The tail is forwarded to Loki's tail endpoint.
+		if r.URL.Path != "/loki/api/v1/tail" {
+			http.NotFound(w, r)
+			return
+		}
+		up := websocket.Upgrader{}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteJSON(map[string]any{"streams": []map[string]any{{
+			"stream": map[string]string{"app": "a"},
+			"values": [][]string{{"100", "line"}},
+		}}})
+		time.Sleep(time.Second)
+	}))
+	defer backend.Close()
+
+	logger := log.NewNopLogger()
+	// Served like lokxy serves it, behind the tracing handler and with
+	// response compression negotiated.
+	config := mkConfig(backend.URL)
+	config.ResponseCompression.Enabled = true
+	srv := httptest.NewServer(traces.HTTPTracesHandler(logger)(mustMux(t, logger, config)))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/lokxy/api/v1/tail?query=%7Bapp%3D%22a%22%7D", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, `data: {"streams":[{"stream":{"app":"a"},"values":[["100","line"]]}]}`+"\n", line)
+}
+
+func TestTailDialer_Get(t *testing.T) {
+	srv := mkUpstreamServer(t, map[string]http.HandlerFunc{
+		"/loki/api/v1/query_range": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Got", r.Header.Get("X-Lokxy")+" "+r.URL.Query().Get("query"))
+		},
+	})
+	defer srv.Close()
+
+	p, err := New(log.NewNopLogger(), mkConfig(srv.URL))
+	require.NoError(t, err)
+	d := tailDialer{p}
+
+	resp, err := d.Get(t.Context(), "sg1", "/loki/api/v1/query_range?query=up", http.Header{})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "test up", resp.Header.Get("X-Got"))
+
+	_, err = d.Get(t.Context(), "gone", "/loki/api/v1/query_range", http.Header{})
+	require.ErrorContains(t, err, `server group "gone" is no longer configured`)
+}
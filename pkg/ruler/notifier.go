@@ -0,0 +1,92 @@
+package ruler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// Alert is a single alert in the Alertmanager v2 API format.
+type Alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Notifier delivers alerts to an Alertmanager-compatible receiver.
+type Notifier interface {
+	Send(ctx context.Context, alerts []Alert) error
+}
+
+// alertmanagerAlertsPath is appended to Alertmanager URLs given without a path.
+const alertmanagerAlertsPath = "/api/v2/alerts"
+
+// HTTPNotifier POSTs alerts as JSON to an Alertmanager or compatible webhook.
+type HTTPNotifier struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewHTTPNotifier builds a notifier from the ruler's Alertmanager settings.
+// A URL without a path is treated as an Alertmanager base URL.
+func NewHTTPNotifier(config cfg.AlertmanagerConfig) (*HTTPNotifier, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alertmanager url: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = alertmanagerAlertsPath
+	}
+
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &HTTPNotifier{
+		url:     u.String(),
+		headers: config.Headers,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Send implements Notifier.
+func (n *HTTPNotifier) Send(ctx context.Context, alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range n.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("alertmanager returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,72 @@
+package ruler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+func TestHTTPNotifier_Send(t *testing.T) {
+	var gotPath, gotAuth string
+	var got []Alert
+	am := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer am.Close()
+
+	n, err := NewHTTPNotifier(cfg.AlertmanagerConfig{
+		URL:     am.URL,
+		Headers: map[string]string{"Authorization": "Bearer x"},
+	})
+	require.NoError(t, err)
+
+	startsAt := time.Unix(1700000000, 0).UTC()
+	err = n.Send(t.Context(), []Alert{{
+		Labels:   map[string]string{"alertname": "A"},
+		StartsAt: startsAt,
+		EndsAt:   startsAt.Add(time.Minute),
+	}})
+	require.NoError(t, err)
+
+	require.Equal(t, "/api/v2/alerts", gotPath)
+	require.Equal(t, "Bearer x", gotAuth)
+	require.Len(t, got, 1)
+	require.Equal(t, "A", got[0].Labels["alertname"])
+	require.True(t, startsAt.Equal(got[0].StartsAt))
+}
+
+func TestHTTPNotifier_WebhookPathKept(t *testing.T) {
+	var gotPath string
+	hook := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer hook.Close()
+
+	n, err := NewHTTPNotifier(cfg.AlertmanagerConfig{URL: hook.URL + "/hooks/alerts"})
+	require.NoError(t, err)
+	require.NoError(t, n.Send(t.Context(), []Alert{{Labels: map[string]string{"alertname": "A"}}}))
+	require.Equal(t, "/hooks/alerts", gotPath)
+}
+
+func TestHTTPNotifier_ErrorStatus(t *testing.T) {
+	am := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "bad alerts", http.StatusBadRequest)
+	}))
+	defer am.Close()
+
+	n, err := NewHTTPNotifier(cfg.AlertmanagerConfig{URL: am.URL})
+	require.NoError(t, err)
+
+	err = n.Send(t.Context(), []Alert{{Labels: map[string]string{"alertname": "A"}}})
+	require.ErrorContains(t, err, "status 400")
+	require.ErrorContains(t, err, "bad alerts")
+}
@@ -0,0 +1,99 @@
+package ruler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/loghttp"
+	"github.com/prometheus/common/model"
+)
+
+// Querier runs an instant LogQL metric query and returns its samples.
+type Querier interface {
+	Query(ctx context.Context, expr string, ts time.Time) (loghttp.Vector, error)
+}
+
+// HandlerQuerier evaluates queries by calling an HTTP handler in-process,
+// typically lokxy's own proxy handler, so rule evaluation goes through the
+// same fanout and merge as user queries and sees every server group.
+type HandlerQuerier struct {
+	handler http.Handler
+}
+
+// NewHandlerQuerier returns a Querier backed by the given handler.
+func NewHandlerQuerier(handler http.Handler) *HandlerQuerier {
+	return &HandlerQuerier{handler: handler}
+}
+
+// Query implements Querier.
+func (q *HandlerQuerier) Query(ctx context.Context, expr string, ts time.Time) (loghttp.Vector, error) {
+	params := url.Values{
+		"query": []string{expr},
+		"time":  []string{strconv.FormatInt(ts.UnixNano(), 10)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/loki/api/v1/query?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := newResponseBuffer()
+	q.handler.ServeHTTP(rw, req)
+
+	if rw.status < 200 || rw.status >= 300 {
+		return nil, fmt.Errorf("query failed with status %d: %s", rw.status, strings.TrimSpace(rw.body.String()))
+	}
+
+	var resp loghttp.QueryResponse
+	if err := json.Unmarshal(rw.body.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode query response: %w", err)
+	}
+
+	switch result := resp.Data.Result.(type) {
+	case loghttp.Vector:
+		return result, nil
+	case loghttp.Scalar:
+		return loghttp.Vector{{
+			Metric:    model.Metric{},
+			Value:     result.Value,
+			Timestamp: result.Timestamp,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("rule expression must return a vector, got %q", resp.Data.ResultType)
+	}
+}
+
+// responseBuffer is a minimal in-memory http.ResponseWriter.
+type responseBuffer struct {
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.wroteHeader {
+		return
+	}
+	b.status = status
+	b.wroteHeader = true
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
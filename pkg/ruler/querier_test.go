@@ -0,0 +1,56 @@
+package ruler
+
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerQuerier_Vector(t *testing.T) {
+	var gotQuery, gotTime string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("query")
+		gotTime = r.URL.Query().Get("time")
+		io.WriteString(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"app":"api"},"value":[1700000000,"4"]}]}}`)
+	})
+
+	q := NewHandlerQuerier(h)
+	vec, err := q.Query(t.Context(), `sum(rate({a="b"}[1m]))`, time.Unix(1700000000, 0))
+	require.NoError(t, err)
+
+	require.Equal(t, `sum(rate({a="b"}[1m]))`, gotQuery)
+	require.Equal(t, "1700000000000000000", gotTime)
+	require.Len(t, vec, 1)
+	require.Equal(t, model.Metric{"app": "api"}, vec[0].Metric)
+	require.InDelta(t, 4.0, float64(vec[0].Value), 0)
+}
+
+func TestHandlerQuerier_Scalar(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"2"]}}`)
+	})
+
+	vec, err := NewHandlerQuerier(h).Query(t.Context(), "vector(2)", time.Now())
+	require.NoError(t, err)
+	require.Len(t, vec, 1)
+	require.InDelta(t, 2.0, float64(vec[0].Value), 0)
+}
+
+func TestHandlerQuerier_Errors(t *testing.T) {
+	failing := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "sg1: parse error", http.StatusBadRequest)
+	})
+	_, err := NewHandlerQuerier(failing).Query(t.Context(), "x", time.Now())
+	require.ErrorContains(t, err, "status 400")
+	require.ErrorContains(t, err, "parse error")
+
+	streams := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, `{"status":"success","data":{"resultType":"streams","result":[]}}`)
+	})
+	_, err = NewHandlerQuerier(streams).Query(t.Context(), "x", time.Now())
+	require.ErrorContains(t, err, "must return a vector")
+}
@@ -0,0 +1,168 @@
+package ruler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// Sample is a single recording rule result.
+type Sample struct {
+	Metric    model.Metric
+	Value     float64
+	Timestamp time.Time
+}
+
+// Appender stores the results of one recording rule evaluation. Each call
+// replaces the previous results of the same rule.
+type Appender interface {
+	Append(ctx context.Context, rule string, samples []Sample) error
+}
+
+// RemoteWriteAppender pushes samples to a Prometheus remote write endpoint.
+type RemoteWriteAppender struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewRemoteWriteAppender builds an appender from the ruler's remote write
+// settings.
+func NewRemoteWriteAppender(config cfg.RemoteWriteConfig) *RemoteWriteAppender {
+	timeout := config.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	return &RemoteWriteAppender{
+		url:     config.URL,
+		headers: config.Headers,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Append implements Appender.
+func (a *RemoteWriteAppender) Append(ctx context.Context, _ string, samples []Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+
+	series := make([]prompb.TimeSeries, 0, len(samples))
+	for _, s := range samples {
+		names := make([]string, 0, len(s.Metric))
+		for name := range s.Metric {
+			names = append(names, string(name))
+		}
+		// Remote write requires labels sorted by name.
+		sort.Strings(names)
+
+		lbls := make([]prompb.Label, 0, len(names))
+		for _, name := range names {
+			lbls = append(lbls, prompb.Label{Name: name, Value: string(s.Metric[model.LabelName(name)])})
+		}
+		series = append(series, prompb.TimeSeries{
+			Labels:  lbls,
+			Samples: []prompb.Sample{{Value: s.Value, Timestamp: s.Timestamp.UnixMilli()}},
+		})
+	}
+
+	data, err := (&prompb.WriteRequest{Timeseries: series}).Marshal()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for key, value := range a.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("remote write returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// CollectorAppender keeps the latest results of every recording rule and
+// exposes them as gauges through the Prometheus collector interface, so they
+// can be scraped from the metrics server.
+type CollectorAppender struct {
+	mu      sync.RWMutex
+	samples map[string][]Sample
+}
+
+var (
+	_ Appender             = (*CollectorAppender)(nil)
+	_ prometheus.Collector = (*CollectorAppender)(nil)
+)
+
+// NewCollectorAppender returns an empty CollectorAppender.
+func NewCollectorAppender() *CollectorAppender {
+	return &CollectorAppender{samples: make(map[string][]Sample)}
+}
+
+// Append implements Appender.
+func (c *CollectorAppender) Append(_ context.Context, rule string, samples []Sample) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples[rule] = samples
+	return nil
+}
+
+// Describe implements prometheus.Collector. It sends no descriptors, which
+// makes this an unchecked collector: the recorded series are only known once
+// rules have been evaluated.
+func (c *CollectorAppender) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c *CollectorAppender) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, samples := range c.samples {
+		for _, s := range samples {
+			name := string(s.Metric[model.MetricNameLabel])
+			labelNames := make([]string, 0, len(s.Metric))
+			labelValues := make([]string, 0, len(s.Metric))
+			for ln, lv := range s.Metric {
+				if ln == model.MetricNameLabel {
+					continue
+				}
+				labelNames = append(labelNames, string(ln))
+				labelValues = append(labelValues, string(lv))
+			}
+			desc := prometheus.NewDesc(name, "Recording rule evaluated by the lokxy federated ruler.", labelNames, nil)
+			m, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, s.Value, labelValues...)
+			if err != nil {
+				ch <- prometheus.NewInvalidMetric(desc, err)
+				continue
+			}
+			ch <- prometheus.NewMetricWithTimestamp(s.Timestamp, m)
+		}
+	}
+}
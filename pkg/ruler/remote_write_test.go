@@ -0,0 +1,90 @@
+package ruler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+func TestRemoteWriteAppender_Append(t *testing.T) {
+	var got prompb.WriteRequest
+	var encoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		compressed, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := got.Unmarshal(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	a := NewRemoteWriteAppender(cfg.RemoteWriteConfig{URL: srv.URL})
+	ts := time.Unix(1700000000, 0)
+	err := a.Append(t.Context(), "rule", []Sample{{
+		Metric:    model.Metric{"__name__": "app:lines", "app": "api"},
+		Value:     2.5,
+		Timestamp: ts,
+	}})
+	require.NoError(t, err)
+
+	require.Equal(t, "snappy", encoding)
+	require.Len(t, got.Timeseries, 1)
+	require.Equal(t, []prompb.Label{{Name: "__name__", Value: "app:lines"}, {Name: "app", Value: "api"}}, got.Timeseries[0].Labels)
+	require.Equal(t, []prompb.Sample{{Value: 2.5, Timestamp: ts.UnixMilli()}}, got.Timeseries[0].Samples)
+}
+
+func TestRemoteWriteAppender_ErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "out of order", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	a := NewRemoteWriteAppender(cfg.RemoteWriteConfig{URL: srv.URL})
+	err := a.Append(t.Context(), "rule", []Sample{{Metric: model.Metric{"__name__": "x"}, Value: 1, Timestamp: time.Now()}})
+	require.ErrorContains(t, err, "status 400")
+}
+
+func TestCollectorAppender_Collect(t *testing.T) {
+	c := NewCollectorAppender()
+	ts := time.Unix(1700000000, 0)
+	require.NoError(t, c.Append(t.Context(), "g;app:lines", []Sample{
+		{Metric: model.Metric{"__name__": "app_lines", "app": "api"}, Value: 2, Timestamp: ts},
+		{Metric: model.Metric{"__name__": "app_lines", "app": "web", "team": "x"}, Value: 3, Timestamp: ts},
+	}))
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(t, reg.Register(c))
+
+	expected := `
+# HELP app_lines Recording rule evaluated by the lokxy federated ruler.
+# TYPE app_lines gauge
+app_lines{app="api"} 2 1700000000000
+app_lines{app="web",team="x"} 3 1700000000000
+`
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(expected), "app_lines"))
+
+	// A later evaluation replaces the previous results of the rule.
+	require.NoError(t, c.Append(t.Context(), "g;app:lines", nil))
+	count, err := testutil.GatherAndCount(reg, "app_lines")
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
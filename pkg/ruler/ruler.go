@@ -0,0 +1,295 @@
+// Package ruler implements lokxy's federated ruler. It evaluates Loki-format
+// recording and alerting rules through lokxy's own query fanout, so a single
+// rule sees the data of every configured server group.
+package ruler
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+	"github.com/paulojmdias/lokxy/pkg/o11y/metrics"
+)
+
+// defaultEvaluationInterval is used when neither the group nor the ruler
+// configuration sets an interval.
+const defaultEvaluationInterval = time.Minute
+
+// Ruler periodically evaluates the configured rule groups.
+type Ruler struct {
+	logger         log.Logger
+	groups         []*group
+	querier        Querier
+	notifier       Notifier
+	appender       Appender
+	externalLabels model.LabelSet
+}
+
+// New loads the configured rule files and builds a Ruler that evaluates
+// them with querier. Alerts go to notifier and recording rule results to
+// appender; a nil notifier drops alerts.
+func New(logger log.Logger, config cfg.RulerConfig, querier Querier, notifier Notifier, appender Appender) (*Ruler, error) {
+	loaded, err := loadRuleFiles(config.RuleFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultInterval := config.EvaluationInterval
+	if defaultInterval == 0 {
+		defaultInterval = defaultEvaluationInterval
+	}
+
+	externalLabels := make(model.LabelSet, len(config.ExternalLabels))
+	for name, value := range config.ExternalLabels {
+		externalLabels[model.LabelName(name)] = model.LabelValue(value)
+	}
+
+	r := &Ruler{
+		logger:         logger,
+		querier:        querier,
+		notifier:       notifier,
+		appender:       appender,
+		externalLabels: externalLabels,
+	}
+	for _, lg := range loaded {
+		interval := time.Duration(lg.Interval)
+		if interval == 0 {
+			interval = defaultInterval
+		}
+		g := &group{loadedGroup: lg, interval: interval, alerts: make(map[int]map[model.Fingerprint]*activeAlert)}
+		r.groups = append(r.groups, g)
+	}
+	return r, nil
+}
+
+// Run evaluates every rule group on its interval until ctx is canceled.
+func (r *Ruler) Run(ctx context.Context) error {
+	level.Info(r.logger).Log("msg", "Starting federated ruler", "groups", len(r.groups))
+
+	var wg sync.WaitGroup
+	for _, g := range r.groups {
+		wg.Go(func() {
+			ticker := time.NewTicker(g.interval)
+			defer ticker.Stop()
+			for {
+				r.evalGroup(ctx, g, time.Now())
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	return nil
+}
+
+// group is a loaded rule group plus the evaluation state of its alerts.
+type group struct {
+	loadedGroup
+	interval time.Duration
+
+	// alerts holds the active alerts of each alerting rule, keyed by the
+	// rule's index in the group and the alert's label fingerprint.
+	alerts map[int]map[model.Fingerprint]*activeAlert
+}
+
+type alertState int
+
+const (
+	statePending alertState = iota
+	stateFiring
+)
+
+type activeAlert struct {
+	labels      model.LabelSet
+	annotations map[string]string
+	activeAt    time.Time
+	state       alertState
+}
+
+// evalGroup evaluates all rules of g at ts, in order.
+func (r *Ruler) evalGroup(ctx context.Context, g *group, ts time.Time) {
+	start := time.Now()
+	groupAttr := attribute.String("rule_group", g.key())
+	defer func() {
+		metrics.RulerEvaluations.Add(ctx, 1, metric.WithAttributes(groupAttr))
+		metrics.RulerEvaluationDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(groupAttr))
+	}()
+
+	var notify []Alert
+	for i, rule := range g.Rules {
+		vector, err := r.querier.Query(ctx, rule.Expr, ts)
+		if err == nil && g.Limit > 0 && len(vector) > g.Limit {
+			r.recordFailure(ctx, g, rule, "limit", fmt.Errorf("rule produced %d series, exceeding the group limit of %d", len(vector), g.Limit))
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.recordFailure(ctx, g, rule, "query", err)
+			continue
+		}
+
+		if rule.Record != "" {
+			samples := r.recordSamples(rule, vector, ts)
+			if err := r.appender.Append(ctx, g.key()+";"+rule.Record, samples); err != nil {
+				r.recordFailure(ctx, g, rule, "remote_write", err)
+			}
+			continue
+		}
+
+		notify = append(notify, r.evalAlert(g, i, rule, vector, ts)...)
+	}
+
+	if len(notify) > 0 && r.notifier != nil {
+		if err := r.notifier.Send(ctx, notify); err != nil {
+			r.recordFailure(ctx, g, Rule{}, "notify", err)
+		}
+	}
+}
+
+func (r *Ruler) recordFailure(ctx context.Context, g *group, rule Rule, reason string, err error) {
+	metrics.RulerEvaluationFailures.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("rule_group", g.key()),
+		attribute.String("reason", reason),
+	))
+	level.Error(r.logger).Log("msg", "Rule evaluation failed", "group", g.key(), "rule", rule.Name(), "reason", reason, "err", err)
+}
+
+// recordSamples turns a recording rule's query result into named series.
+func (r *Ruler) recordSamples(rule Rule, vector []model.Sample, ts time.Time) []Sample {
+	samples := make([]Sample, 0, len(vector))
+	for _, s := range vector {
+		m := make(model.Metric, len(s.Metric)+len(rule.Labels)+len(r.externalLabels)+1)
+		for name, value := range r.externalLabels {
+			m[name] = value
+		}
+		maps.Copy(m, s.Metric)
+		for name, value := range rule.Labels {
+			m[model.LabelName(name)] = model.LabelValue(value)
+		}
+		m[model.MetricNameLabel] = model.LabelValue(rule.Record)
+		samples = append(samples, Sample{Metric: m, Value: float64(s.Value), Timestamp: ts})
+	}
+	return samples
+}
+
+// evalAlert updates the state of an alerting rule from its query result and
+// returns the alerts to send: every firing alert, plus alerts that resolved
+// in this evaluation.
+func (r *Ruler) evalAlert(g *group, idx int, rule Rule, vector []model.Sample, ts time.Time) []Alert {
+	active := g.alerts[idx]
+	if active == nil {
+		active = make(map[model.Fingerprint]*activeAlert)
+		g.alerts[idx] = active
+	}
+
+	seen := make(map[model.Fingerprint]struct{}, len(vector))
+	for _, s := range vector {
+		lbls := make(model.LabelSet, len(s.Metric)+len(rule.Labels)+1)
+		for name, value := range s.Metric {
+			if name != model.MetricNameLabel {
+				lbls[name] = value
+			}
+		}
+		for name, value := range rule.Labels {
+			lbls[model.LabelName(name)] = model.LabelValue(value)
+		}
+		lbls[model.AlertNameLabel] = model.LabelValue(rule.Alert)
+
+		fp := lbls.Fingerprint()
+		seen[fp] = struct{}{}
+
+		annotations := r.expandAnnotations(g, rule, lbls, float64(s.Value))
+		if a, ok := active[fp]; ok {
+			a.annotations = annotations
+			continue
+		}
+		active[fp] = &activeAlert{labels: lbls, annotations: annotations, activeAt: ts, state: statePending}
+	}
+
+	// Alerts are considered valid for a few evaluation intervals, so a
+	// missed evaluation does not resolve them in the receiver.
+	validUntil := ts.Add(4 * g.interval)
+
+	var out []Alert
+	for fp, a := range active {
+		if _, ok := seen[fp]; !ok {
+			delete(active, fp)
+			if a.state == stateFiring {
+				out = append(out, r.toAlert(a, ts))
+			}
+			continue
+		}
+		if a.state == statePending && ts.Sub(a.activeAt) >= time.Duration(rule.For) {
+			a.state = stateFiring
+		}
+		if a.state == stateFiring {
+			out = append(out, r.toAlert(a, validUntil))
+		}
+	}
+	return out
+}
+
+func (r *Ruler) toAlert(a *activeAlert, endsAt time.Time) Alert {
+	lbls := make(map[string]string, len(a.labels)+len(r.externalLabels))
+	for name, value := range r.externalLabels {
+		lbls[string(name)] = string(value)
+	}
+	for name, value := range a.labels {
+		lbls[string(name)] = string(value)
+	}
+	return Alert{
+		Labels:      lbls,
+		Annotations: a.annotations,
+		StartsAt:    a.activeAt,
+		EndsAt:      endsAt,
+	}
+}
+
+// expandAnnotations renders annotation templates with the Prometheus-style
+// $labels and $value variables. A template that fails to render is kept
+// verbatim together with the error, as Prometheus does.
+func (r *Ruler) expandAnnotations(g *group, rule Rule, lbls model.LabelSet, value float64) map[string]string {
+	if len(rule.Annotations) == 0 {
+		return nil
+	}
+
+	labels := make(map[string]string, len(lbls))
+	for name, v := range lbls {
+		labels[string(name)] = string(v)
+	}
+	data := struct {
+		Labels map[string]string
+		Value  float64
+	}{Labels: labels, Value: value}
+
+	out := make(map[string]string, len(rule.Annotations))
+	for name, text := range rule.Annotations {
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse("{{$labels := .Labels}}{{$value := .Value}}" + text)
+		if err == nil {
+			var b strings.Builder
+			if err = tmpl.Execute(&b, data); err == nil {
+				out[name] = b.String()
+				continue
+			}
+		}
+		level.Warn(r.logger).Log("msg", "Failed to expand annotation template", "group", g.key(), "rule", rule.Alert, "annotation", name, "err", err)
+		out[name] = fmt.Sprintf("%s (error expanding template: %s)", text, err)
+	}
+	return out
+}
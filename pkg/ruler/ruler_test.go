@@ -0,0 +1,214 @@
+package ruler
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/loki/v3/pkg/loghttp"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	cfg "github.com/paulojmdias/lokxy/pkg/config"
+)
+
+// fakeQuerier returns canned results per expression.
+type fakeQuerier struct {
+	mu      sync.Mutex
+	results map[string]loghttp.Vector
+	err     error
+}
+
+func (f *fakeQuerier) Query(_ context.Context, expr string, _ time.Time) (loghttp.Vector, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.results[expr], nil
+}
+
+func (f *fakeQuerier) set(expr string, v loghttp.Vector) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[expr] = v
+}
+
+// stubNotifier stands in for Alertmanager and records every batch it gets.
+type stubNotifier struct {
+	mu      sync.Mutex
+	batches [][]Alert
+}
+
+func (s *stubNotifier) Send(_ context.Context, alerts []Alert) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, alerts)
+	return nil
+}
+
+func (s *stubNotifier) last() []Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.batches) == 0 {
+		return nil
+	}
+	return s.batches[len(s.batches)-1]
+}
+
+const (
+	recordExpr = `sum by (app) (rate({env="prod"} |= "error" [5m]))`
+	alertExpr  = `sum by (app) (rate({env="prod"} |= "error" [5m])) > 10`
+)
+
+func newTestRuler(t *testing.T, q Querier, n Notifier, a Appender) *Ruler {
+	t.Helper()
+	r, err := New(log.NewNopLogger(), cfg.RulerConfig{
+		RuleFiles:      []string{"testdata/rules.yaml"},
+		ExternalLabels: map[string]string{"source": "lokxy"},
+	}, q, n, a)
+	require.NoError(t, err)
+	require.Len(t, r.groups, 1)
+	return r
+}
+
+func TestRuler_RecordingRule(t *testing.T) {
+	q := &fakeQuerier{results: map[string]loghttp.Vector{
+		recordExpr: {{Metric: model.Metric{"app": "api"}, Value: 3}},
+	}}
+	appender := NewCollectorAppender()
+	r := newTestRuler(t, q, nil, appender)
+
+	ts := time.Unix(1700000000, 0)
+	r.evalGroup(t.Context(), r.groups[0], ts)
+
+	samples := appender.samples["testdata/rules.yaml;errors;app:error_lines:rate5m"]
+	require.Len(t, samples, 1)
+	require.Equal(t, model.Metric{
+		"__name__": "app:error_lines:rate5m",
+		"app":      "api",
+		"team":     "platform",
+		"source":   "lokxy",
+	}, samples[0].Metric)
+	require.InDelta(t, 3.0, samples[0].Value, 0)
+	require.Equal(t, ts, samples[0].Timestamp)
+}
+
+func TestRuler_AlertLifecycle(t *testing.T) {
+	q := &fakeQuerier{results: map[string]loghttp.Vector{
+		alertExpr: {{Metric: model.Metric{"app": "api"}, Value: 42}},
+	}}
+	n := &stubNotifier{}
+	r := newTestRuler(t, q, n, NewCollectorAppender())
+	g := r.groups[0]
+
+	start := time.Unix(1700000000, 0)
+
+	// Pending: the rule has "for: 5m", nothing is sent yet.
+	r.evalGroup(t.Context(), g, start)
+	require.Empty(t, n.batches)
+
+	// Firing once the condition held for 5 minutes.
+	r.evalGroup(t.Context(), g, start.Add(5*time.Minute))
+	firing := n.last()
+	require.Len(t, firing, 1)
+	require.Equal(t, "HighErrorRate", firing[0].Labels["alertname"])
+	require.Equal(t, "page", firing[0].Labels["severity"])
+	require.Equal(t, "api", firing[0].Labels["app"])
+	require.Equal(t, "lokxy", firing[0].Labels["source"])
+	require.Equal(t, "api logs 42 errors per second", firing[0].Annotations["summary"])
+	require.Equal(t, start, firing[0].StartsAt)
+	require.True(t, firing[0].EndsAt.After(start.Add(5*time.Minute)))
+
+	// Resolved when the condition no longer holds.
+	q.set(alertExpr, nil)
+	resolvedAt := start.Add(6 * time.Minute)
+	r.evalGroup(t.Context(), g, resolvedAt)
+	resolved := n.last()
+	require.Len(t, resolved, 1)
+	require.Equal(t, resolvedAt, resolved[0].EndsAt)
+
+	// Nothing left to send afterwards.
+	batches := len(n.batches)
+	r.evalGroup(t.Context(), g, start.Add(7*time.Minute))
+	require.Len(t, n.batches, batches)
+}
+
+func TestRuler_PendingAlertDroppedWithoutNotification(t *testing.T) {
+	q := &fakeQuerier{results: map[string]loghttp.Vector{
+		alertExpr: {{Metric: model.Metric{"app": "api"}, Value: 42}},
+	}}
+	n := &stubNotifier{}
+	r := newTestRuler(t, q, n, NewCollectorAppender())
+	g := r.groups[0]
+
+	r.evalGroup(t.Context(), g, time.Unix(1700000000, 0))
+	q.set(alertExpr, nil)
+	r.evalGroup(t.Context(), g, time.Unix(1700000060, 0))
+
+	require.Empty(t, n.batches)
+	require.Empty(t, g.alerts[1])
+}
+
+func TestRuler_QueryFailureDoesNotStopGroup(t *testing.T) {
+	q := &fakeQuerier{results: map[string]loghttp.Vector{}, err: errors.New("boom")}
+	appender := NewCollectorAppender()
+	r := newTestRuler(t, q, &stubNotifier{}, appender)
+
+	require.NotPanics(t, func() {
+		r.evalGroup(t.Context(), r.groups[0], time.Now())
+	})
+	require.Empty(t, appender.samples)
+}
+
+func TestRuler_GroupLimit(t *testing.T) {
+	q := &fakeQuerier{results: map[string]loghttp.Vector{
+		recordExpr: {
+			{Metric: model.Metric{"app": "a"}, Value: 1},
+			{Metric: model.Metric{"app": "b"}, Value: 1},
+		},
+	}}
+	appender := NewCollectorAppender()
+	r := newTestRuler(t, q, nil, appender)
+	r.groups[0].Limit = 1
+
+	r.evalGroup(t.Context(), r.groups[0], time.Now())
+	require.Empty(t, appender.samples)
+}
+
+func TestRuler_RunStopsOnCancel(t *testing.T) {
+	q := &fakeQuerier{results: map[string]loghttp.Vector{}}
+	r := newTestRuler(t, q, nil, NewCollectorAppender())
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ruler did not stop after context cancellation")
+	}
+}
+
+func TestNew_DefaultInterval(t *testing.T) {
+	r, err := New(log.NewNopLogger(), cfg.RulerConfig{
+		RuleFiles:          []string{"testdata/duplicate_group.yaml"},
+		EvaluationInterval: 2 * time.Minute,
+	}, &fakeQuerier{}, nil, NewCollectorAppender())
+	require.Error(t, err)
+	require.Nil(t, r)
+
+	r, err = New(log.NewNopLogger(), cfg.RulerConfig{
+		RuleFiles:          []string{"testdata/rules.yaml"},
+		EvaluationInterval: 2 * time.Minute,
+	}, &fakeQuerier{}, nil, NewCollectorAppender())
+	require.NoError(t, err)
+	// The group sets its own interval, which wins over the default.
+	require.Equal(t, 30*time.Second, r.groups[0].interval)
+}
@@ -0,0 +1,141 @@
+package ruler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/grafana/loki/v3/pkg/logql/syntax"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// RuleGroups is the top-level structure of a Loki rule file.
+type RuleGroups struct {
+	Groups []RuleGroup `yaml:"groups"`
+}
+
+// RuleGroup is a named set of rules evaluated together on an interval.
+type RuleGroup struct {
+	Name     string         `yaml:"name"`
+	Interval model.Duration `yaml:"interval"`
+	Limit    int            `yaml:"limit"`
+	Rules    []Rule         `yaml:"rules"`
+}
+
+// Rule is a single recording or alerting rule. Exactly one of Record and
+// Alert is set; Expr must be a LogQL metric query.
+type Rule struct {
+	Record      string            `yaml:"record"`
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         model.Duration    `yaml:"for"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// Name returns the recorded metric name or the alert name.
+func (r Rule) Name() string {
+	if r.Record != "" {
+		return r.Record
+	}
+	return r.Alert
+}
+
+// loadedGroup is a rule group together with the file it was read from.
+type loadedGroup struct {
+	RuleGroup
+	file string
+}
+
+// key identifies the group in logs and metrics.
+func (g loadedGroup) key() string {
+	return g.file + ";" + g.Name
+}
+
+// loadRuleFiles expands the given glob patterns and parses every matching
+// file. It fails on the first invalid file or rule.
+func loadRuleFiles(patterns []string) ([]loadedGroup, error) {
+	var groups []loadedGroup
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule file pattern %q: %w", pattern, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("rule file pattern %q matched no files", pattern)
+		}
+		for _, file := range files {
+			fileGroups, err := parseRuleFile(file)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, fileGroups...)
+		}
+	}
+	return groups, nil
+}
+
+func parseRuleFile(file string) ([]loadedGroup, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rgs RuleGroups
+	if err := yaml.UnmarshalStrict(data, &rgs); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	seen := make(map[string]struct{}, len(rgs.Groups))
+	groups := make([]loadedGroup, 0, len(rgs.Groups))
+	for i, g := range rgs.Groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("%s: groups[%d]: name is required", file, i)
+		}
+		if _, ok := seen[g.Name]; ok {
+			return nil, fmt.Errorf("%s: groups[%d]: duplicate group name %q", file, i, g.Name)
+		}
+		seen[g.Name] = struct{}{}
+
+		for j, r := range g.Rules {
+			if err := r.validate(); err != nil {
+				return nil, fmt.Errorf("%s: group %q: rules[%d]: %w", file, g.Name, j, err)
+			}
+		}
+		groups = append(groups, loadedGroup{RuleGroup: g, file: file})
+	}
+	return groups, nil
+}
+
+func (r Rule) validate() error {
+	switch {
+	case r.Record != "" && r.Alert != "":
+		return errors.New("only one of record and alert may be set")
+	case r.Record == "" && r.Alert == "":
+		return errors.New("one of record or alert must be set")
+	case r.Expr == "":
+		return errors.New("expr is required")
+	}
+	if r.Record != "" {
+		if !model.LegacyValidation.IsValidMetricName(r.Record) {
+			return fmt.Errorf("invalid recording rule name %q", r.Record)
+		}
+		if r.For != 0 {
+			return errors.New("for is only valid on alerting rules")
+		}
+		if len(r.Annotations) > 0 {
+			return errors.New("annotations are only valid on alerting rules")
+		}
+	}
+	for name := range r.Labels {
+		if !model.LegacyValidation.IsValidLabelName(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	if _, err := syntax.ParseSampleExpr(r.Expr); err != nil {
+		return fmt.Errorf("expr must be a LogQL metric query: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package ruler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRuleFiles(t *testing.T) {
+	groups, err := loadRuleFiles([]string{"testdata/rules.yaml"})
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+
+	g := groups[0]
+	require.Equal(t, "errors", g.Name)
+	require.Equal(t, "testdata/rules.yaml;errors", g.key())
+	require.Equal(t, model.Duration(30*time.Second), g.Interval)
+	require.Len(t, g.Rules, 2)
+
+	require.Equal(t, "app:error_lines:rate5m", g.Rules[0].Name())
+	require.Equal(t, "platform", g.Rules[0].Labels["team"])
+
+	require.Equal(t, "HighErrorRate", g.Rules[1].Name())
+	require.Equal(t, model.Duration(5*time.Minute), g.Rules[1].For)
+	require.Contains(t, g.Rules[1].Annotations["summary"], "$labels.app")
+}
+
+func TestLoadRuleFiles_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		wantErr string
+	}{
+		{name: "no match", pattern: "testdata/does_not_exist*.yaml", wantErr: "matched no files"},
+		{name: "log query", pattern: "testdata/invalid_expr.yaml", wantErr: "LogQL metric query"},
+		{name: "record and alert", pattern: "testdata/invalid_rule.yaml", wantErr: "only one of record and alert"},
+		{name: "duplicate group", pattern: "testdata/duplicate_group.yaml", wantErr: "duplicate group name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadRuleFiles([]string{tt.pattern})
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	valid := Rule{Record: "a:b", Expr: `sum(rate({a="b"}[1m]))`}
+	require.NoError(t, valid.validate())
+
+	missing := Rule{Expr: `sum(rate({a="b"}[1m]))`}
+	require.ErrorContains(t, missing.validate(), "one of record or alert")
+
+	badName := Rule{Record: "a-b", Expr: `sum(rate({a="b"}[1m]))`}
+	require.ErrorContains(t, badName.validate(), "invalid recording rule name")
+
+	recordFor := Rule{Record: "a:b", For: model.Duration(time.Minute), Expr: `sum(rate({a="b"}[1m]))`}
+	require.ErrorContains(t, recordFor.validate(), "only valid on alerting rules")
+
+	badLabel := Rule{Alert: "A", Labels: map[string]string{"bad-label": "x"}, Expr: `sum(rate({a="b"}[1m]))`}
+	require.ErrorContains(t, badLabel.validate(), "invalid label name")
+}